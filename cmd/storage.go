@@ -0,0 +1,218 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"nakama/server"
+
+	"github.com/go-yaml/yaml"
+	"go.uber.org/zap"
+)
+
+type storageService struct {
+	dbAddress  string
+	configPath string
+	bucket     string
+	collection string
+	userID     string
+	file       string
+	conflict   string
+	dryRun     bool
+	config     server.Config
+	logger     *zap.Logger
+	db         *sql.DB
+}
+
+func StorageParse(args []string, logger *zap.Logger) {
+	if len(args) == 0 {
+		logger.Fatal("Storage requires a subcommand. Available commands are: 'export', 'import', 'reindex'.")
+	}
+
+	ss := &storageService{
+		logger: logger,
+	}
+
+	var exec func()
+	switch args[0] {
+	case "export":
+		exec = ss.export
+	case "import":
+		exec = ss.importRecords
+	case "reindex":
+		exec = ss.reindex
+	default:
+		logger.Fatal("Unrecognized storage subcommand. Available commands are: 'export', 'import', 'reindex'.")
+	}
+
+	ss.parseSubcommand(args[0], args[1:])
+	if args[0] == "export" && ss.file == "-" {
+		// Keep log output apart from exported records.
+		logger = server.NewJSONLogger(os.Stderr, true)
+		ss.logger = logger
+	}
+
+	// Check the server configuration before connecting, the same way the server does when it starts.
+	ss.config = ss.loadConfig()
+
+	rawurl := fmt.Sprintf("postgresql://%s?sslmode=disable", ss.dbAddress)
+	url, err := url.Parse(rawurl)
+	if err != nil {
+		logger.Fatal("Bad connection URL", zap.Error(err))
+	}
+	if len(url.Path) < 2 {
+		url.Path = "/nakama"
+	}
+
+	logger.Info("Database connection", zap.String("db", ss.dbAddress))
+
+	db, err := sql.Open(dialect, url.String())
+	if err != nil {
+		logger.Fatal("Failed to open database", zap.Error(err))
+	}
+	if err = db.Ping(); err != nil {
+		logger.Fatal("Error pinging database", zap.Error(err))
+	}
+	ss.db = db
+
+	exec()
+	os.Exit(0)
+}
+
+func (ss *storageService) export() {
+	var w io.Writer = os.Stdout
+	if ss.file != "-" {
+		f, err := os.Create(ss.file)
+		if err != nil {
+			ss.logger.Fatal("Could not create export file", zap.Error(err))
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+
+	count, err := server.StorageExport(ss.logger, ss.db, ss.bucket, ss.collection, ss.userID, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		ss.logger.Fatal("Failed to export storage", zap.Int("count", count), zap.Error(err))
+	}
+
+	ss.logger.Info("Successfully exported storage", zap.Int("count", count))
+}
+
+func (ss *storageService) importRecords() {
+	var r io.Reader = os.Stdin
+	if ss.file != "-" {
+		f, err := os.Open(ss.file)
+		if err != nil {
+			ss.logger.Fatal("Could not open import file", zap.Error(err))
+		}
+		defer f.Close()
+		r = f
+	}
+
+	// Use the server's storage configuration, so imported records are indexed, versioned and checked the same way.
+	storage := ss.loadStorage()
+
+	result, err := server.StorageImport(ss.logger, ss.db, storage, bufio.NewReader(r), ss.conflict, ss.dryRun)
+	if err != nil {
+		ss.logger.Fatal("Failed to import storage", zap.Int("imported", result.Imported), zap.Int("skipped", result.Skipped), zap.Error(err))
+	}
+
+	if ss.dryRun {
+		ss.logger.Info("Dry run complete, no records were changed", zap.Int("imported", result.Imported), zap.Int("skipped", result.Skipped))
+	} else {
+		ss.logger.Info("Successfully imported storage", zap.Int("imported", result.Imported), zap.Int("skipped", result.Skipped))
+	}
+}
+
+func (ss *storageService) reindex() {
+	count, err := ss.loadStorage().Indexes().Reindex(ss.logger, ss.db, ss.bucket, ss.collection)
+	if err != nil {
+		ss.logger.Fatal("Failed to reindex storage", zap.Int("count", count), zap.Error(err))
+	}
+
+	ss.logger.Info("Successfully reindexed storage", zap.Int("count", count))
+}
+
+// loadConfig reads and validates the server configuration file, if one is given, or returns the default configuration.
+func (ss *storageService) loadConfig() server.Config {
+	config := server.NewConfig()
+	if ss.configPath != "" {
+		data, err := ioutil.ReadFile(ss.configPath)
+		if err != nil {
+			ss.logger.Fatal("Could not read config file", zap.Error(err))
+		}
+		if err = yaml.Unmarshal(data, config); err != nil {
+			ss.logger.Fatal("Could not parse config file", zap.Error(err))
+		}
+	}
+	server.ValidateConfig(ss.logger, config)
+	return config
+}
+
+// loadStorage creates a storage service with the storage configuration from the server configuration file, if one is given.
+func (ss *storageService) loadStorage() *server.StorageService {
+	storage, err := server.NewStorageService(ss.logger, ss.db, nil, nil, ss.config.GetStorage())
+	if err != nil {
+		ss.logger.Fatal("Invalid storage configuration", zap.Error(err))
+	}
+	return storage
+}
+
+func (ss *storageService) parseSubcommand(subcommand string, args []string) {
+	flags := flag.NewFlagSet("storage", flag.ExitOnError)
+	flags.StringVar(&ss.dbAddress, "database.address", "root@localhost:26257", "Address of CockroachDB server (username:password@address:port/dbname)")
+	switch subcommand {
+	case "export":
+		flags.StringVar(&ss.file, "file", "-", "JSON lines file to export to, '-' for standard output.")
+		flags.StringVar(&ss.bucket, "bucket", "", "Bucket to export records from.")
+		flags.StringVar(&ss.collection, "collection", "", "Collection to export records from, or all collections in the bucket if empty.")
+		flags.StringVar(&ss.userID, "user_id", "", "User to export records for, or all users if empty.")
+	case "reindex":
+		flags.StringVar(&ss.configPath, "config", "", "The absolute file path to the server configuration YAML file, for storage indexes.")
+		flags.StringVar(&ss.bucket, "bucket", "", "Bucket of the collection to reindex.")
+		flags.StringVar(&ss.collection, "collection", "", "Collection to reindex.")
+	default:
+		flags.StringVar(&ss.file, "file", "-", "JSON lines file to import from, '-' for standard input.")
+		flags.StringVar(&ss.configPath, "config", "", "The absolute file path to the server configuration YAML file, for storage indexes, history and schemas.")
+		flags.StringVar(&ss.conflict, "conflict", server.STORAGE_IMPORT_CONFLICT_SKIP, "What to do when a record already exists: 'skip', 'overwrite', or 'if-version-matches'.")
+		flags.BoolVar(&ss.dryRun, "dry_run", false, "Check and count the records to import without changing any.")
+	}
+
+	if err := flags.Parse(args); err != nil {
+		ss.logger.Fatal("Could not parse storage flags.")
+	}
+
+	if ss.dbAddress == "" {
+		ss.logger.Fatal("Database connection details are required.")
+	}
+	if subcommand == "export" && ss.bucket == "" {
+		ss.logger.Fatal("A bucket is required to export.")
+	}
+	if subcommand == "reindex" && (ss.bucket == "" || ss.collection == "") {
+		ss.logger.Fatal("A bucket and collection are required to reindex.")
+	}
+}
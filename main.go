@@ -65,6 +65,8 @@ func main() {
 			cmd.DoctorParse(os.Args[2:])
 		case "migrate":
 			cmd.MigrateParse(os.Args[2:], cmdLogger)
+		case "storage":
+			cmd.StorageParse(os.Args[2:], cmdLogger)
 		}
 	}
 
@@ -105,15 +107,26 @@ func main() {
 	presenceNotifier := server.NewPresenceNotifier(jsonLogger, config.GetName(), trackerService, messageRouter)
 	trackerService.AddDiffListener(presenceNotifier.HandleDiff)
 	notificationService := server.NewNotificationService(jsonLogger, db, trackerService, messageRouter, config.GetSocial().Notification)
+	messageRetentionService := server.NewMessageRetentionService(jsonLogger, db, config.GetSocial().Topic)
+	storageService, err := server.NewStorageService(jsonLogger, db, trackerService, messageRouter, config.GetStorage())
+	if err != nil {
+		multiLogger.Fatal("Failed initializing storage.", zap.Error(err))
+	}
+	storageService.Indexes().CheckEntries(multiLogger, db)
 
-	runtimePool, err := server.NewRuntimePool(jsonLogger, multiLogger, db, config.GetRuntime(), trackerService, notificationService)
+	runtimePool, err := server.NewRuntimePool(jsonLogger, multiLogger, db, config.GetRuntime(), trackerService, messageRouter, messageRetentionService, storageService, notificationService)
 	if err != nil {
 		multiLogger.Fatal("Failed initializing runtime modules.", zap.Error(err))
 	}
 
+	moderationService, err := server.NewModerationService(jsonLogger, config.GetSocial().Moderation, runtimePool)
+	if err != nil {
+		multiLogger.Fatal("Failed initializing moderation.", zap.Error(err))
+	}
+
 	socialClient := social.NewClient(5 * time.Second)
 	purchaseService := server.NewPurchaseService(jsonLogger, multiLogger, db, config.GetPurchase())
-	pipeline := server.NewPipeline(config, db, trackerService, matchmakerService, messageRouter, sessionRegistry, socialClient, runtimePool, purchaseService, notificationService)
+	pipeline := server.NewPipeline(config, db, trackerService, matchmakerService, messageRouter, messageRetentionService, storageService, sessionRegistry, socialClient, runtimePool, purchaseService, notificationService, moderationService)
 	authService := server.NewAuthenticationService(jsonLogger, config, db, jsonpbMarshaler, jsonpbUnmarshaler, statsService, sessionRegistry, socialClient, pipeline, runtimePool)
 	dashboardService := server.NewDashboardService(jsonLogger, multiLogger, semver, dbVersion, config, statsService)
 
@@ -135,6 +148,7 @@ func main() {
 		authService.Stop()
 		dashboardService.Stop()
 		trackerService.Stop()
+		messageRetentionService.Stop()
 
 		if gaenabled {
 			ga.SendSessionStop(http.DefaultClient, gacode, cookie)
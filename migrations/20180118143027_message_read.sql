@@ -0,0 +1,29 @@
+/*
+ * Copyright 2018 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS message_read (
+    PRIMARY KEY (user_id, topic, topic_type),
+    user_id    BYTEA        NOT NULL,
+    topic      BYTEA        CHECK (length(topic) <= 128) NOT NULL,
+    topic_type SMALLINT     NOT NULL, -- dm(0), room(1), group(2)
+    message_id BYTEA        NOT NULL, -- last message read, or empty if none read yet
+    read_at    BIGINT       CHECK (read_at >= 0) NOT NULL, -- created_at of the last message read
+    updated_at BIGINT       CHECK (updated_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS message_read;
@@ -0,0 +1,29 @@
+/*
+ * Copyright 2018 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS topic_moderation (
+    PRIMARY KEY (topic, topic_type, user_id),
+    topic       BYTEA    CHECK (length(topic) <= 128) NOT NULL,
+    topic_type  SMALLINT NOT NULL, -- room(1), group(2)
+    user_id     BYTEA    NOT NULL,
+    muted_until BIGINT   DEFAULT 0 CHECK (muted_until >= 0) NOT NULL, -- 0 if not muted
+    banned_at   BIGINT   DEFAULT 0 CHECK (banned_at >= 0) NOT NULL,   -- 0 if not banned
+    updated_at  BIGINT   CHECK (updated_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS topic_moderation;
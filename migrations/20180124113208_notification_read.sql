@@ -0,0 +1,26 @@
+/*
+ * Copyright 2018 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+ALTER TABLE IF EXISTS notification ADD COLUMN IF NOT EXISTS read_at BIGINT NOT NULL DEFAULT 0; -- 0 if unread
+
+-- count unread notifications for a user that are not deleted or expired.
+CREATE INDEX IF NOT EXISTS notification_user_id_deleted_at_read_at_expires_at_idx ON notification (user_id, deleted_at, read_at, expires_at);
+
+-- +migrate Down
+DROP INDEX IF EXISTS notification@notification_user_id_deleted_at_read_at_expires_at_idx;
+ALTER TABLE IF EXISTS notification DROP COLUMN IF EXISTS read_at;
@@ -0,0 +1,34 @@
+/*
+ * Copyright 2018 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS storage_index (
+    PRIMARY KEY (bucket, collection, name, user_id, record),
+    bucket       VARCHAR(128)     NOT NULL,
+    collection   VARCHAR(128)     NOT NULL,
+    name         VARCHAR(128)     NOT NULL,
+    user_id      BYTEA            NOT NULL,
+    record       VARCHAR(128)     NOT NULL,
+    value_string VARCHAR,                  -- set for string indexes
+    value_number DOUBLE PRECISION          -- set for number indexes
+);
+-- filter and sort records in a collection by an indexed value.
+CREATE INDEX IF NOT EXISTS bucket_collection_name_value_string_user_id_record_idx ON storage_index (bucket, collection, name, value_string, user_id, record);
+CREATE INDEX IF NOT EXISTS bucket_collection_name_value_number_user_id_record_idx ON storage_index (bucket, collection, name, value_number, user_id, record);
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_index;
@@ -0,0 +1,34 @@
+/*
+ * Copyright 2018 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS storage_history (
+    PRIMARY KEY (bucket, collection, user_id, record, created_at, id),
+    id         BYTEA        NOT NULL,
+    user_id    BYTEA        NOT NULL,
+    bucket     VARCHAR(128) NOT NULL,
+    collection VARCHAR(128) NOT NULL,
+    record     VARCHAR(128) NOT NULL,
+    value      BYTEA        NOT NULL,
+    version    BYTEA        NOT NULL,
+    read       SMALLINT     DEFAULT 1 CHECK (read >= 0) NOT NULL,
+    write      SMALLINT     DEFAULT 1 CHECK (write >= 0) NOT NULL,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_history;
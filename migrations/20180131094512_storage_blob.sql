@@ -0,0 +1,49 @@
+/*
+ * Copyright 2018 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- value size is limited by the server configuration, and large values are stored compressed.
+ALTER TABLE storage DROP CONSTRAINT IF EXISTS check_value;
+
+CREATE TABLE IF NOT EXISTS storage_blob (
+    PRIMARY KEY (bucket, collection, user_id, record),
+    id           BYTEA        NOT NULL,
+    user_id      BYTEA        NOT NULL,
+    bucket       VARCHAR(128) NOT NULL,
+    collection   VARCHAR(128) NOT NULL,
+    record       VARCHAR(128) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size         BIGINT       CHECK (size >= 0) NOT NULL,
+    chunks       INT          CHECK (chunks >= 0) NOT NULL,
+    version      BYTEA        NOT NULL,
+    read         SMALLINT     DEFAULT 1 CHECK (read >= 0) NOT NULL,
+    write        SMALLINT     DEFAULT 1 CHECK (write >= 0) NOT NULL,
+    created_at   BIGINT       CHECK (created_at > 0) NOT NULL,
+    updated_at   BIGINT       CHECK (updated_at > 0) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS storage_blob_chunk (
+    PRIMARY KEY (blob_id, seq),
+    blob_id BYTEA NOT NULL,
+    seq     INT   CHECK (seq >= 0) NOT NULL,
+    data    BYTEA NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_blob_chunk;
+DROP TABLE IF EXISTS storage_blob;
+ALTER TABLE storage ADD CONSTRAINT check_value CHECK (length(value) < 16000);
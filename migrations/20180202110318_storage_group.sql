@@ -0,0 +1,26 @@
+/*
+ * Copyright 2018 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+ALTER TABLE IF EXISTS storage ADD COLUMN IF NOT EXISTS group_id BYTEA NOT NULL DEFAULT ''; -- empty if not shared with a group
+ALTER TABLE IF EXISTS storage_history ADD COLUMN IF NOT EXISTS group_id BYTEA NOT NULL DEFAULT ''; -- empty if not shared with a group
+ALTER TABLE IF EXISTS storage_blob ADD COLUMN IF NOT EXISTS group_id BYTEA NOT NULL DEFAULT ''; -- empty if not shared with a group
+
+-- +migrate Down
+ALTER TABLE IF EXISTS storage_blob DROP COLUMN IF EXISTS group_id;
+ALTER TABLE IF EXISTS storage_history DROP COLUMN IF EXISTS group_id;
+ALTER TABLE IF EXISTS storage DROP COLUMN IF EXISTS group_id;
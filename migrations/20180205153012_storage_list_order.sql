@@ -0,0 +1,25 @@
+/*
+ * Copyright 2018 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- List a collection across users by most recently created or changed.
+CREATE INDEX IF NOT EXISTS bucket_collection_created_at_user_id_record_idx ON storage (bucket, collection, created_at, user_id, record);
+CREATE INDEX IF NOT EXISTS bucket_collection_updated_at_user_id_record_idx ON storage (bucket, collection, updated_at, user_id, record);
+
+-- +migrate Down
+-- NOTE: not postgres compatible, it expects table.index rather than table@index.
+DROP INDEX IF EXISTS storage@bucket_collection_updated_at_user_id_record_idx;
+DROP INDEX IF EXISTS storage@bucket_collection_created_at_user_id_record_idx;
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
 )
 
@@ -56,6 +57,23 @@ func (o operation) conditional() bool {
 	return false // Treat bad values as not conditional.
 }
 
+// bound returns the optional numeric field of an operation, such as "min" or "max", or nil if it is not set.
+func (o operation) bound(name string) (*float64, error) {
+	if obj, ok := o[name]; ok && obj != nil {
+		var bound float64
+
+		err := json.Unmarshal(*obj, &bound)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", name)
+		}
+
+		return &bound, nil
+	}
+
+	return nil, nil
+}
+
 func NewExtendedPatch(ops []map[string]*json.RawMessage) (ExtendedPatch, error) {
 	ep := make(ExtendedPatch, len(ops))
 	for i, op := range ops {
@@ -129,6 +147,16 @@ func (ep ExtendedPatch) ApplyIndent(doc []byte, indent string) ([]byte, error) {
 			err = ep.patch(&pd, op)
 		case "compare":
 			err = ep.compare(&pd, op)
+		case "clamp":
+			err = ep.clamp(&pd, op)
+		case "multiply":
+			err = ep.multiply(&pd, op)
+		case "bounded_incr":
+			err = ep.boundedIncr(&pd, op)
+		case "remove_value":
+			err = ep.removeValue(&pd, op)
+		case "add_to_set":
+			err = ep.addToSet(&pd, op)
 		default:
 			err = fmt.Errorf("Unexpected kind: %s", op.kind())
 		}
@@ -430,3 +458,242 @@ func (ep ExtendedPatch) compare(doc *container, op operation) error {
 
 	return errors.New("jsonpatch compare operation failed: given value is not comparable")
 }
+
+// findNumber returns the container and key of the number at the path, and its current value.
+func findNumber(doc *container, kind string, path string) (container, string, float64, error) {
+	con, key := findObject(doc, path)
+
+	if con == nil {
+		return nil, "", 0, fmt.Errorf("jsonpatch %s operation does not apply: doc is missing path: %s", kind, path)
+	}
+
+	val, ok := con.get(key)
+	if val == nil || ok != nil {
+		return nil, "", 0, fmt.Errorf("jsonpatch %s operation does not apply: doc is missing key: %s", kind, path)
+	}
+
+	var value float64
+	if err := json.Unmarshal(*val.raw, &value); err != nil {
+		return nil, "", 0, fmt.Errorf("jsonpatch %s operation does not apply: path does not point to a number: %s", kind, path)
+	}
+
+	return con, key, value, nil
+}
+
+func setNumber(con container, key string, value float64) error {
+	raw := json.RawMessage([]byte(strconv.FormatFloat(value, 'f', -1, 64)))
+	node := newLazyNode(&raw)
+
+	return con.set(key, node)
+}
+
+// findArray returns the container and key of the array at the path, and the array itself.
+func findArray(doc *container, kind string, path string) (container, string, *partialArray, error) {
+	con, key := findObject(doc, path)
+
+	if con == nil {
+		return nil, "", nil, fmt.Errorf("jsonpatch %s operation does not apply: doc is missing path: %s", kind, path)
+	}
+
+	val, ok := con.get(key)
+	if val == nil || ok != nil {
+		return nil, "", nil, fmt.Errorf("jsonpatch %s operation does not apply: doc is missing key: %s", kind, path)
+	}
+
+	array, err := val.intoAry()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("jsonpatch %s operation does not apply: path does not point to an array: %s", kind, path)
+	}
+
+	return con, key, array, nil
+}
+
+func setArray(con container, key string, kind string, array *partialArray) error {
+	raw, err := json.Marshal(array)
+	if err != nil {
+		return fmt.Errorf("jsonpatch %s operation does not apply: array cannot be encoded: %s", kind, err.Error())
+	}
+	rawMessage := json.RawMessage(raw)
+	node := newLazyNode(&rawMessage)
+
+	return con.set(key, node)
+}
+
+// decodeNode returns the decoded JSON value of a node, so values can be compared regardless of formatting.
+func decodeNode(n *lazyNode) (interface{}, error) {
+	raw, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if err = json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (ep ExtendedPatch) clamp(doc *container, op operation) error {
+	path := op.path()
+	min, err := op.bound("min")
+	if err != nil {
+		return fmt.Errorf("jsonpatch clamp operation does not apply: %s", err.Error())
+	}
+	max, err := op.bound("max")
+	if err != nil {
+		return fmt.Errorf("jsonpatch clamp operation does not apply: %s", err.Error())
+	}
+	if min == nil && max == nil {
+		return errors.New("jsonpatch clamp operation does not apply: min or max is required")
+	}
+	if min != nil && max != nil && *min > *max {
+		return errors.New("jsonpatch clamp operation does not apply: min must not be greater than max")
+	}
+
+	con, key, value, err := findNumber(doc, "clamp", path)
+	if err != nil {
+		return err
+	}
+
+	if min != nil && value < *min {
+		return setNumber(con, key, *min)
+	}
+	if max != nil && value > *max {
+		return setNumber(con, key, *max)
+	}
+
+	return nil
+}
+
+func (ep ExtendedPatch) multiply(doc *container, op operation) error {
+	path := op.path()
+	incomingValue := op.value()
+	if incomingValue == nil {
+		return errors.New("jsonpatch multiply operation does not apply: value is required")
+	}
+
+	var factor float64
+	if err := json.Unmarshal(*incomingValue.raw, &factor); err != nil {
+		return errors.New("jsonpatch multiply operation does not apply: value must be a number")
+	}
+
+	con, key, value, err := findNumber(doc, "multiply", path)
+	if err != nil {
+		return err
+	}
+
+	return setNumber(con, key, value*factor)
+}
+
+// boundedIncr adds to a number like incr, but fails the patch if the result would be outside the given min or max.
+func (ep ExtendedPatch) boundedIncr(doc *container, op operation) error {
+	path := op.path()
+	incomingValue := op.value()
+	if incomingValue == nil {
+		return errors.New("jsonpatch bounded_incr operation does not apply: value is required")
+	}
+	min, err := op.bound("min")
+	if err != nil {
+		return fmt.Errorf("jsonpatch bounded_incr operation does not apply: %s", err.Error())
+	}
+	max, err := op.bound("max")
+	if err != nil {
+		return fmt.Errorf("jsonpatch bounded_incr operation does not apply: %s", err.Error())
+	}
+	if min == nil && max == nil {
+		return errors.New("jsonpatch bounded_incr operation does not apply: min or max is required")
+	}
+
+	var incr float64
+	if err := json.Unmarshal(*incomingValue.raw, &incr); err != nil {
+		return errors.New("jsonpatch bounded_incr operation does not apply: value must be a number")
+	}
+
+	con, key, value, err := findNumber(doc, "bounded_incr", path)
+	if err != nil {
+		return err
+	}
+
+	result := value + incr
+	if min != nil && result < *min {
+		return fmt.Errorf("jsonpatch bounded_incr operation failed: result would be less than min on path: %s", path)
+	}
+	if max != nil && result > *max {
+		return fmt.Errorf("jsonpatch bounded_incr operation failed: result would be greater than max on path: %s", path)
+	}
+
+	return setNumber(con, key, result)
+}
+
+// removeValue removes every element equal to the value from an array. Unless conditional, at least one must be removed.
+func (ep ExtendedPatch) removeValue(doc *container, op operation) error {
+	path := op.path()
+	incomingValue := op.value()
+	if incomingValue == nil {
+		return errors.New("jsonpatch remove_value operation does not apply: value is required")
+	}
+	target, err := decodeNode(incomingValue)
+	if err != nil {
+		return errors.New("jsonpatch remove_value operation does not apply: value is not valid JSON")
+	}
+
+	con, key, array, err := findArray(doc, "remove_value", path)
+	if err != nil {
+		return err
+	}
+
+	kept := make(partialArray, 0, len(*array))
+	for _, element := range *array {
+		value, err := decodeNode(element)
+		if err != nil {
+			return fmt.Errorf("jsonpatch remove_value operation does not apply: array element is not valid JSON: %s", path)
+		}
+		if !reflect.DeepEqual(value, target) {
+			kept = append(kept, element)
+		}
+	}
+
+	if len(kept) == len(*array) {
+		if op.conditional() {
+			return nil
+		}
+		return fmt.Errorf("jsonpatch remove_value operation failed: value not found in array on path: %s", path)
+	}
+
+	return setArray(con, key, "remove_value", &kept)
+}
+
+// addToSet appends the value to an array only if no element is already equal to it.
+func (ep ExtendedPatch) addToSet(doc *container, op operation) error {
+	path := op.path()
+	incomingValue := op.value()
+	if incomingValue == nil {
+		return errors.New("jsonpatch add_to_set operation does not apply: value is required")
+	}
+	target, err := decodeNode(incomingValue)
+	if err != nil {
+		return errors.New("jsonpatch add_to_set operation does not apply: value is not valid JSON")
+	}
+
+	con, key, array, err := findArray(doc, "add_to_set", path)
+	if err != nil {
+		return err
+	}
+
+	for _, element := range *array {
+		value, err := decodeNode(element)
+		if err != nil {
+			return fmt.Errorf("jsonpatch add_to_set operation does not apply: array element is not valid JSON: %s", path)
+		}
+		if reflect.DeepEqual(value, target) {
+			return nil
+		}
+	}
+
+	if err = array.add("-", incomingValue); err != nil {
+		return errors.New("jsonpatch add_to_set operation does not apply: array cannot be appended to")
+	}
+
+	return setArray(con, key, "add_to_set", array)
+}
@@ -124,6 +124,71 @@ var ExtendedCases = []Case{
 		patch:  `[{"op":"compare","path":"/foo","value":2,"assert":-1},{"op":"incr","path":"/foo","value":7}]`,
 		result: `{"foo":8}`,
 	},
+	{
+		doc:    `{"foo":150,"bar":-5,"baz":5}`,
+		patch:  `[{"op":"clamp","path":"/foo","max":100},{"op":"clamp","path":"/bar","min":0,"max":100},{"op":"clamp","path":"/baz","min":0,"max":100}]`,
+		result: `{"foo":100,"bar":0,"baz":5}`,
+	},
+	{
+		doc:    `{"foo":{"bar":3}}`,
+		patch:  `[{"op":"multiply","path":"/foo/bar","value":1.5}]`,
+		result: `{"foo":{"bar":4.5}}`,
+	},
+	{
+		doc:    `{"foo":95}`,
+		patch:  `[{"op":"bounded_incr","path":"/foo","value":5,"max":100},{"op":"bounded_incr","path":"/foo","value":-100,"min":0}]`,
+		result: `{"foo":0}`,
+	},
+	{
+		doc:    `{"foo":["a",{"b":1},"c","a"]}`,
+		patch:  `[{"op":"remove_value","path":"/foo","value":"a"},{"op":"remove_value","path":"/foo","value":{"b":1.0}}]`,
+		result: `{"foo":["c"]}`,
+	},
+	{
+		doc:    `{"foo":["a"]}`,
+		patch:  `[{"op":"remove_value","path":"/foo","value":"b","conditional":true}]`,
+		result: `{"foo":["a"]}`,
+	},
+	{
+		doc:    `{"foo":["a",{"b":1}]}`,
+		patch:  `[{"op":"add_to_set","path":"/foo","value":"a"},{"op":"add_to_set","path":"/foo","value":{"b":1}},{"op":"add_to_set","path":"/foo","value":"c"}]`,
+		result: `{"foo":["a",{"b":1},"c"]}`,
+	},
+}
+
+var ExtendedBadCases = []BadCase{
+	{
+		`{"foo":1}`,
+		`[{"op":"clamp","path":"/foo"}]`,
+	},
+	{
+		`{"foo":1}`,
+		`[{"op":"clamp","path":"/foo","min":10,"max":0}]`,
+	},
+	{
+		`{"foo":"bar"}`,
+		`[{"op":"multiply","path":"/foo","value":2}]`,
+	},
+	{
+		`{"foo":95}`,
+		`[{"op":"bounded_incr","path":"/foo","value":10,"max":100}]`,
+	},
+	{
+		`{"foo":5}`,
+		`[{"op":"bounded_incr","path":"/foo","value":-10,"min":0}]`,
+	},
+	{
+		`{"foo":5}`,
+		`[{"op":"bounded_incr","path":"/foo","value":1}]`,
+	},
+	{
+		`{"foo":["a"]}`,
+		`[{"op":"remove_value","path":"/foo","value":"b"}]`,
+	},
+	{
+		`{"foo":{"a":1}}`,
+		`[{"op":"add_to_set","path":"/foo","value":"a"}]`,
+	},
 }
 
 func TestAllExtendedCases(t *testing.T) {
@@ -140,3 +205,13 @@ func TestAllExtendedCases(t *testing.T) {
 		}
 	}
 }
+
+func TestAllExtendedBadCases(t *testing.T) {
+	for _, c := range ExtendedBadCases {
+		_, err := applyExtendedPatch(c.doc, c.patch)
+
+		if err == nil {
+			t.Errorf("ExtendedPatch should have failed to apply but it did not: %s", c.patch)
+		}
+	}
+}
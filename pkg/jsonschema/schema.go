@@ -0,0 +1,485 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jsonschema validates JSON documents against a subset of the JSON Schema draft 4 validation keywords:
+//
+//	type, enum
+//	properties, required, additionalProperties, minProperties, maxProperties
+//	items (a schema or a tuple of schemas), additionalItems, minItems, maxItems, uniqueItems
+//	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf
+//	minLength, maxLength, pattern
+//
+// Schemas using other validation keywords, such as "$ref", "oneOf" or "format", do not compile.
+// Annotations, such as "title", are ignored.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var schemaTypes = map[string]bool{
+	"array":   true,
+	"boolean": true,
+	"integer": true,
+	"null":    true,
+	"number":  true,
+	"object":  true,
+	"string":  true,
+}
+
+// unsupportedKeywords are validation keywords that are not implemented. Schemas using them are rejected,
+// rather than compiled into schemas that silently accept documents the keywords would not allow.
+var unsupportedKeywords = []string{
+	"$ref",
+	"allOf",
+	"anyOf",
+	"const",
+	"contains",
+	"dependencies",
+	"else",
+	"format",
+	"if",
+	"not",
+	"oneOf",
+	"patternProperties",
+	"propertyNames",
+	"then",
+}
+
+// Schema is a compiled JSON Schema that can validate any number of documents.
+type Schema struct {
+	types []string
+	enum  []interface{}
+
+	properties             map[string]*Schema
+	required               []string
+	additionalProperties   *Schema
+	noAdditionalProperties bool
+	minProperties          *int
+	maxProperties          *int
+
+	items             *Schema
+	tupleItems        []*Schema
+	additionalItems   *Schema
+	noAdditionalItems bool
+	minItems          *int
+	maxItems          *int
+	uniqueItems       bool
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum bool
+	exclusiveMaximum bool
+	multipleOf       *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+}
+
+// ValidationError describes the first part of a document found not to match a schema.
+type ValidationError struct {
+	// JSON pointer to the value that does not match, empty for the whole document.
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%v %v", e.Path, e.Message)
+}
+
+// Compile parses a JSON Schema, or returns an error if it is not a valid schema.
+func Compile(data []byte) (*Schema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %v", err)
+	}
+	return compile(raw, "")
+}
+
+func compile(raw interface{}, path string) (*Schema, error) {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, schemaError(path, "must be an object")
+	}
+
+	for _, k := range unsupportedKeywords {
+		if _, ok := m[k]; ok {
+			return nil, schemaError(path, fmt.Sprintf("keyword %v is not supported", k))
+		}
+	}
+
+	s := &Schema{}
+	var err error
+
+	if t, ok := m["type"]; ok {
+		switch t := t.(type) {
+		case string:
+			s.types = []string{t}
+		case []interface{}:
+			for _, v := range t {
+				vs, ok := v.(string)
+				if !ok {
+					return nil, schemaError(path, "type must be a string or array of strings")
+				}
+				s.types = append(s.types, vs)
+			}
+		default:
+			return nil, schemaError(path, "type must be a string or array of strings")
+		}
+		for _, t := range s.types {
+			if !schemaTypes[t] {
+				return nil, schemaError(path, fmt.Sprintf("type %v is not known", t))
+			}
+		}
+	}
+
+	if e, ok := m["enum"]; ok {
+		if s.enum, ok = e.([]interface{}); !ok || len(s.enum) == 0 {
+			return nil, schemaError(path, "enum must be a non-empty array")
+		}
+	}
+
+	if p, ok := m["properties"]; ok {
+		pm, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, schemaError(path, "properties must be an object")
+		}
+		s.properties = make(map[string]*Schema, len(pm))
+		for name, ps := range pm {
+			if s.properties[name], err = compile(ps, path+"/properties/"+escapePointer(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if r, ok := m["required"]; ok {
+		ra, ok := r.([]interface{})
+		if !ok {
+			return nil, schemaError(path, "required must be an array of strings")
+		}
+		for _, v := range ra {
+			vs, ok := v.(string)
+			if !ok {
+				return nil, schemaError(path, "required must be an array of strings")
+			}
+			s.required = append(s.required, vs)
+		}
+	}
+
+	if a, ok := m["additionalProperties"]; ok {
+		if ab, ok := a.(bool); ok {
+			s.noAdditionalProperties = !ab
+		} else if s.additionalProperties, err = compile(a, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+
+	if i, ok := m["items"]; ok {
+		if tuple, ok := i.([]interface{}); ok {
+			s.tupleItems = make([]*Schema, len(tuple))
+			for n, t := range tuple {
+				if s.tupleItems[n], err = compile(t, fmt.Sprintf("%v/items/%v", path, n)); err != nil {
+					return nil, err
+				}
+			}
+		} else if s.items, err = compile(i, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	if a, ok := m["additionalItems"]; ok {
+		if ab, ok := a.(bool); ok {
+			s.noAdditionalItems = !ab
+		} else if s.additionalItems, err = compile(a, path+"/additionalItems"); err != nil {
+			return nil, err
+		}
+	}
+
+	if u, ok := m["uniqueItems"]; ok {
+		if s.uniqueItems, ok = u.(bool); !ok {
+			return nil, schemaError(path, "uniqueItems must be a boolean")
+		}
+	}
+
+	for name, dest := range map[string]**int{
+		"minProperties": &s.minProperties,
+		"maxProperties": &s.maxProperties,
+		"minItems":      &s.minItems,
+		"maxItems":      &s.maxItems,
+		"minLength":     &s.minLength,
+		"maxLength":     &s.maxLength,
+	} {
+		if *dest, err = compileCount(m, name, path); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, dest := range map[string]**float64{
+		"minimum":    &s.minimum,
+		"maximum":    &s.maximum,
+		"multipleOf": &s.multipleOf,
+	} {
+		if v, ok := m[name]; ok {
+			vf, ok := v.(float64)
+			if !ok {
+				return nil, schemaError(path, name+" must be a number")
+			}
+			*dest = &vf
+		}
+	}
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, schemaError(path, "multipleOf must be greater than 0")
+	}
+
+	for name, dest := range map[string]*bool{
+		"exclusiveMinimum": &s.exclusiveMinimum,
+		"exclusiveMaximum": &s.exclusiveMaximum,
+	} {
+		if v, ok := m[name]; ok {
+			if *dest, ok = v.(bool); !ok {
+				return nil, schemaError(path, name+" must be a boolean")
+			}
+		}
+	}
+
+	if p, ok := m["pattern"]; ok {
+		ps, ok := p.(string)
+		if !ok {
+			return nil, schemaError(path, "pattern must be a string")
+		}
+		if s.pattern, err = regexp.Compile(ps); err != nil {
+			return nil, schemaError(path, fmt.Sprintf("pattern is not a valid regular expression: %v", err))
+		}
+	}
+
+	return s, nil
+}
+
+func compileCount(m map[string]interface{}, name string, path string) (*int, error) {
+	v, ok := m[name]
+	if !ok {
+		return nil, nil
+	}
+	vf, ok := v.(float64)
+	if !ok || vf < 0 || vf != math.Trunc(vf) {
+		return nil, schemaError(path, name+" must be a non-negative integer")
+	}
+	vi := int(vf)
+	return &vi, nil
+}
+
+func schemaError(path string, message string) error {
+	if path == "" {
+		return fmt.Errorf("schema %v", message)
+	}
+	return fmt.Errorf("schema %v %v", path, message)
+}
+
+// Validate checks a JSON document against the schema, and returns a ValidationError if it does not match.
+func (s *Schema) Validate(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return &ValidationError{Message: "is not valid JSON"}
+	}
+	return s.validate(value, "")
+}
+
+func (s *Schema) validate(value interface{}, path string) error {
+	if len(s.types) != 0 {
+		matched := false
+		for _, t := range s.types {
+			if matchesType(value, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be of type %v", strings.Join(s.types, " or "))}
+		}
+	}
+
+	if len(s.enum) != 0 {
+		matched := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(value, e) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &ValidationError{Path: path, Message: "must be one of the allowed values"}
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return s.validateObject(v, path)
+	case []interface{}:
+		return s.validateArray(v, path)
+	case float64:
+		return s.validateNumber(v, path)
+	case string:
+		return s.validateString(v, path)
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(value map[string]interface{}, path string) error {
+	if s.minProperties != nil && len(value) < *s.minProperties {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must have at least %v properties", *s.minProperties)}
+	}
+	if s.maxProperties != nil && len(value) > *s.maxProperties {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must have at most %v properties", *s.maxProperties)}
+	}
+	for _, name := range s.required {
+		if _, ok := value[name]; !ok {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must have property %v", name)}
+		}
+	}
+	for name, v := range value {
+		propertyPath := path + "/" + escapePointer(name)
+		if ps, ok := s.properties[name]; ok {
+			if err := ps.validate(v, propertyPath); err != nil {
+				return err
+			}
+		} else if s.noAdditionalProperties {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must not have property %v", name)}
+		} else if s.additionalProperties != nil {
+			if err := s.additionalProperties.validate(v, propertyPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(value []interface{}, path string) error {
+	if s.minItems != nil && len(value) < *s.minItems {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must have at least %v items", *s.minItems)}
+	}
+	if s.maxItems != nil && len(value) > *s.maxItems {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must have at most %v items", *s.maxItems)}
+	}
+	if s.uniqueItems {
+		for i := 1; i < len(value); i++ {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					return &ValidationError{Path: path, Message: "must not have duplicate items"}
+				}
+			}
+		}
+	}
+	if s.items != nil {
+		for i, v := range value {
+			if err := s.items.validate(v, fmt.Sprintf("%v/%v", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	if s.tupleItems != nil {
+		// Items beyond the tuple are only checked against additionalItems, which has no effect without a tuple.
+		if s.noAdditionalItems && len(value) > len(s.tupleItems) {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must have at most %v items", len(s.tupleItems))}
+		}
+		for i, v := range value {
+			itemSchema := s.additionalItems
+			if i < len(s.tupleItems) {
+				itemSchema = s.tupleItems[i]
+			}
+			if itemSchema == nil {
+				continue
+			}
+			if err := itemSchema.validate(v, fmt.Sprintf("%v/%v", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(value float64, path string) error {
+	if s.minimum != nil && (value < *s.minimum || (s.exclusiveMinimum && value == *s.minimum)) {
+		if s.exclusiveMinimum {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be greater than %v", *s.minimum)}
+		}
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must be at least %v", *s.minimum)}
+	}
+	if s.maximum != nil && (value > *s.maximum || (s.exclusiveMaximum && value == *s.maximum)) {
+		if s.exclusiveMaximum {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be less than %v", *s.maximum)}
+		}
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must be at most %v", *s.maximum)}
+	}
+	if s.multipleOf != nil {
+		if q := value / *s.multipleOf; q != math.Trunc(q) {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be a multiple of %v", *s.multipleOf)}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateString(value string, path string) error {
+	length := utf8.RuneCountInString(value)
+	if s.minLength != nil && length < *s.minLength {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must be at least %v characters", *s.minLength)}
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must be at most %v characters", *s.maxLength)}
+	}
+	if s.pattern != nil && !s.pattern.MatchString(value) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("must match pattern %v", s.pattern.String())}
+	}
+	return nil
+}
+
+func matchesType(value interface{}, t string) bool {
+	switch t {
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "integer":
+		v, ok := value.(float64)
+		return ok && v == math.Trunc(v)
+	case "null":
+		return value == nil
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	}
+	return false
+}
+
+// escapePointer escapes a property name for use as a JSON pointer reference token.
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonschema
+
+import (
+	"testing"
+)
+
+const inventorySchema = `{
+  "type": "object",
+  "required": ["items"],
+  "additionalProperties": false,
+  "properties": {
+    "items": {
+      "type": "array",
+      "maxItems": 3,
+      "uniqueItems": true,
+      "items": {
+        "type": "object",
+        "required": ["name", "count"],
+        "properties": {
+          "name": {"type": "string", "minLength": 1, "pattern": "^[a-z_]+$"},
+          "count": {"type": "integer", "minimum": 0, "maximum": 99},
+          "rarity": {"enum": ["common", "rare"]}
+        }
+      }
+    },
+    "gold": {"type": "number", "minimum": 0, "exclusiveMinimum": true, "multipleOf": 0.5}
+  }
+}`
+
+var schemaTests = []struct {
+	doc   string
+	error string
+}{
+	{`{"items":[]}`, ""},
+	{`{"items":[{"name":"sword","count":1,"rarity":"rare"}],"gold":2.5}`, ""},
+	{`[]`, "must be of type object"},
+	{`{}`, "must have property items"},
+	{`{"items":[],"armour":1}`, "must not have property armour"},
+	{`{"items":{}}`, "/items must be of type array"},
+	{`{"items":[{},{},{},{}]}`, "/items must have at most 3 items"},
+	{`{"items":[{"name":"a","count":1},{"name":"a","count":1}]}`, "/items must not have duplicate items"},
+	{`{"items":[{"name":"sword"}]}`, "/items/0 must have property count"},
+	{`{"items":[{"name":"sword","count":1.5}]}`, "/items/0/count must be of type integer"},
+	{`{"items":[{"name":"sword","count":100}]}`, "/items/0/count must be at most 99"},
+	{`{"items":[{"name":"","count":1}]}`, "/items/0/name must be at least 1 characters"},
+	{`{"items":[{"name":"Sword","count":1}]}`, "/items/0/name must match pattern ^[a-z_]+$"},
+	{`{"items":[{"name":"sword","count":1,"rarity":"epic"}]}`, "/items/0/rarity must be one of the allowed values"},
+	{`{"items":[],"gold":0}`, "/gold must be greater than 0"},
+	{`{"items":[],"gold":1.25}`, "/gold must be a multiple of 0.5"},
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := Compile([]byte(inventorySchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range schemaTests {
+		err := schema.Validate([]byte(c.doc))
+		if c.error == "" {
+			if err != nil {
+				t.Errorf("Expected %v to be valid but was: %v", c.doc, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Expected %v to be invalid", c.doc)
+		} else if err.Error() != c.error {
+			t.Errorf("Expected %v error %q but was %q", c.doc, c.error, err.Error())
+		}
+	}
+}
+
+func TestSchemaValidateTupleItems(t *testing.T) {
+	schema, err := Compile([]byte(`{
+  "type": "array",
+  "items": [{"type": "string"}, {"type": "integer"}],
+  "additionalItems": {"type": "boolean"}
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := Compile([]byte(`{"items":[{"type":"string"}],"additionalItems":false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		schema *Schema
+		doc    string
+		error  string
+	}{
+		{schema, `[]`, ""},
+		{schema, `["a"]`, ""},
+		{schema, `["a",1,true,false]`, ""},
+		{schema, `[1]`, "/0 must be of type string"},
+		{schema, `["a","b"]`, "/1 must be of type integer"},
+		{schema, `["a",1,"c"]`, "/2 must be of type boolean"},
+		{closed, `["a"]`, ""},
+		{closed, `["a","b"]`, "must have at most 1 items"},
+	}
+
+	for _, c := range cases {
+		err := c.schema.Validate([]byte(c.doc))
+		if c.error == "" {
+			if err != nil {
+				t.Errorf("Expected %v to be valid but was: %v", c.doc, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Expected %v to be invalid", c.doc)
+		} else if err.Error() != c.error {
+			t.Errorf("Expected %v error %q but was %q", c.doc, c.error, err.Error())
+		}
+	}
+}
+
+func TestSchemaCompileInvalid(t *testing.T) {
+	schemas := []string{
+		`[]`,
+		`{"type":"list"}`,
+		`{"required":"name"}`,
+		`{"minItems":-1}`,
+		`{"multipleOf":0}`,
+		`{"pattern":"("}`,
+		`{"properties":{"name":{"type":1}}}`,
+		`{"items":[{"type":"string"},"integer"]}`,
+		`{"additionalItems":1}`,
+	}
+
+	for _, s := range schemas {
+		if _, err := Compile([]byte(s)); err == nil {
+			t.Errorf("Expected schema %v to be invalid", s)
+		}
+	}
+}
+
+func TestSchemaCompileUnsupported(t *testing.T) {
+	schemas := map[string]string{
+		`{"$ref":"#/definitions/item"}`:                          "schema keyword $ref is not supported",
+		`{"allOf":[{"type":"object"}]}`:                          "schema keyword allOf is not supported",
+		`{"anyOf":[{"type":"object"}]}`:                          "schema keyword anyOf is not supported",
+		`{"oneOf":[{"type":"object"}]}`:                          "schema keyword oneOf is not supported",
+		`{"not":{"type":"object"}}`:                              "schema keyword not is not supported",
+		`{"patternProperties":{"^a":{"type":"string"}}}`:         "schema keyword patternProperties is not supported",
+		`{"dependencies":{"a":["b"]}}`:                           "schema keyword dependencies is not supported",
+		`{"type":"string","format":"email"}`:                     "schema keyword format is not supported",
+		`{"properties":{"items":{"items":{"$ref":"#"}}}}`:        "schema /properties/items/items keyword $ref is not supported",
+		`{"additionalProperties":{"anyOf":[{"type":"string"}]}}`: "schema /additionalProperties keyword anyOf is not supported",
+	}
+
+	for s, message := range schemas {
+		_, err := Compile([]byte(s))
+		if err == nil {
+			t.Errorf("Expected schema %v to be rejected", s)
+		} else if err.Error() != message {
+			t.Errorf("Expected schema %v error %q but was %q", s, message, err.Error())
+		}
+	}
+}
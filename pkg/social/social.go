@@ -72,11 +72,54 @@ type GoogleProfile struct {
 	Locale string `json:"locale"`
 }
 
+type googleConnectionSource struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type googleConnectionMetadata struct {
+	Sources []googleConnectionSource `json:"sources"`
+}
+
+type googleConnectionName struct {
+	DisplayName string `json:"displayName"`
+}
+
+type googleConnectionEmail struct {
+	Value string `json:"value"`
+}
+
+type googleConnection struct {
+	ResourceName   string                   `json:"resourceName"`
+	Metadata       googleConnectionMetadata `json:"metadata"`
+	Names          []googleConnectionName   `json:"names"`
+	EmailAddresses []googleConnectionEmail  `json:"emailAddresses"`
+}
+
+type googleConnections struct {
+	Connections   []googleConnection `json:"connections"`
+	NextPageToken string             `json:"nextPageToken"`
+}
+
 // SteamProfile is an abbreviated version of a Steam profile.
 type SteamProfile struct {
 	SteamID uint64 `json:"steamid"`
 }
 
+type steamFriend struct {
+	SteamID      string `json:"steamid"`
+	Relationship string `json:"relationship"`
+	FriendSince  int64  `json:"friend_since"`
+}
+
+type steamFriendsList struct {
+	Friends []steamFriend `json:"friends"`
+}
+
+type steamFriends struct {
+	FriendsList steamFriendsList `json:"friendslist"`
+}
+
 // NewClient creates a new Social Client
 func NewClient(timeout time.Duration) *Client {
 	// From https://knowledge.symantec.com/support/code-signing-support/index?page=content&actp=CROSSLINK&id=AR2170
@@ -171,6 +214,50 @@ func (c *Client) GetGoogleProfile(accessToken string) (*GoogleProfile, error) {
 	return &profile, nil
 }
 
+// GetGoogleFriends retrieves the user's Google contacts that have a Google profile.
+// Token is expected to also have the "https://www.googleapis.com/auth/contacts.readonly" scope.
+func (c *Client) GetGoogleFriends(accessToken string) ([]GoogleProfile, error) {
+	friends := make([]GoogleProfile, 0)
+	pageToken := ""
+	for {
+		path := "https://people.googleapis.com/v1/people/me/connections?pageSize=1000" +
+			"&personFields=" + url.QueryEscape("metadata,names,emailAddresses")
+		if pageToken != "" {
+			path += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		var currentFriends googleConnections
+		err := c.request("google friends", path, map[string]string{"Authorization": "Bearer " + accessToken}, &currentFriends)
+		if err != nil {
+			return friends, err
+		}
+		for _, connection := range currentFriends.Connections {
+			// Only contacts backed by a Google profile can be matched to a Google ID.
+			profile := GoogleProfile{}
+			for _, source := range connection.Metadata.Sources {
+				if source.Type == "PROFILE" {
+					profile.ID = source.ID
+					break
+				}
+			}
+			if profile.ID == "" {
+				continue
+			}
+			if len(connection.Names) != 0 {
+				profile.Name = connection.Names[0].DisplayName
+			}
+			if len(connection.EmailAddresses) != 0 {
+				profile.Email = connection.EmailAddresses[0].Value
+			}
+			friends = append(friends, profile)
+		}
+		// When there are no more items, this will be "" and end the loop
+		if currentFriends.NextPageToken == "" {
+			return friends, nil
+		}
+		pageToken = currentFriends.NextPageToken
+	}
+}
+
 // CheckGameCenterID checks to see validity of the GameCenter playerID
 func (c *Client) CheckGameCenterID(playerID string, bundleID string, timestamp int64, salt string, signature string, publicKeyURL string) (bool, error) {
 	pub, err := url.Parse(publicKeyURL)
@@ -234,6 +321,28 @@ func (c *Client) GetSteamProfile(publisherKey string, appID int, ticket string)
 	return &profile, nil
 }
 
+// GetSteamFriends retrieves the friend list of the given Steam user.
+// Key should be configured at the application level, and the user's profile must be public.
+// See: https://developer.valvesoftware.com/wiki/Steam_Web_API#GetFriendList_.28v0001.29
+func (c *Client) GetSteamFriends(publisherKey string, steamID string) ([]SteamProfile, error) {
+	path := "https://api.steampowered.com/ISteamUser/GetFriendList/v0001/?format=json&relationship=friend" +
+		"&key=" + url.QueryEscape(publisherKey) + "&steamid=" + url.QueryEscape(steamID)
+	var currentFriends steamFriends
+	err := c.request("steam friends", path, map[string]string{}, &currentFriends)
+	if err != nil {
+		return nil, err
+	}
+	friends := make([]SteamProfile, 0, len(currentFriends.FriendsList.Friends))
+	for _, friend := range currentFriends.FriendsList.Friends {
+		id, err := strconv.ParseUint(friend.SteamID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		friends = append(friends, SteamProfile{SteamID: id})
+	}
+	return friends, nil
+}
+
 func (c *Client) request(provider, path string, headers map[string]string, to interface{}) error {
 	body, err := c.requestRaw(provider, path, headers)
 	if err != nil {
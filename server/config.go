@@ -42,6 +42,7 @@ type Config interface {
 	GetSocial() *SocialConfig
 	GetRuntime() *RuntimeConfig
 	GetPurchase() *PurchaseConfig
+	GetStorage() *StorageConfig
 }
 
 func ParseArgs(logger *zap.Logger, args []string) Config {
@@ -94,15 +95,7 @@ func ParseArgs(logger *zap.Logger, args []string) Config {
 	}
 
 	// Enforce rules for parameters with strict requirements.
-	if len(mainConfig.GetSession().UdpKey) != 32 {
-		logger.Fatal("session.udp_key must be exactly 32 characters")
-	}
-	if net.ParseIP(mainConfig.GetSocket().ListenAddress) == nil {
-		logger.Fatal("socket.listen_address must be a valid IP address")
-	}
-	if net.ParseIP(mainConfig.GetSocket().PublicAddress) == nil {
-		logger.Fatal("socket.public_address must be a valid IP address")
-	}
+	ValidateConfig(logger, mainConfig)
 
 	// Log warnings for insecure default parameter values.
 	if mainConfig.GetSocket().ServerKey == "defaultkey" {
@@ -121,6 +114,31 @@ func ParseArgs(logger *zap.Logger, args []string) Config {
 	return mainConfig
 }
 
+// ValidateConfig enforces the rules for parameters with strict requirements, and exits if any are broken.
+func ValidateConfig(logger *zap.Logger, config Config) {
+	if len(config.GetSession().UdpKey) != 32 {
+		logger.Fatal("session.udp_key must be exactly 32 characters")
+	}
+	if net.ParseIP(config.GetSocket().ListenAddress) == nil {
+		logger.Fatal("socket.listen_address must be a valid IP address")
+	}
+	if net.ParseIP(config.GetSocket().PublicAddress) == nil {
+		logger.Fatal("socket.public_address must be a valid IP address")
+	}
+	if config.GetSocket().RateLimitViolationWindowMs < 1 {
+		logger.Fatal("socket.rate_limit_violation_window_ms must be greater than 0")
+	}
+	if config.GetStorage().MaxValueSizeBytes < 1 {
+		logger.Fatal("storage.max_value_size_bytes must be greater than 0")
+	}
+	if config.GetStorage().BlobMaxSizeBytes < 1 || config.GetStorage().BlobChunkSizeBytes < 1 {
+		logger.Fatal("storage.blob_max_size_bytes and storage.blob_chunk_size_bytes must be greater than 0")
+	}
+	if config.GetStorage().MaxSubscriptions < 1 {
+		logger.Fatal("storage.max_subscriptions must be greater than 0")
+	}
+}
+
 type config struct {
 	Name      string           `yaml:"name" json:"name" usage:"Nakama server’s node name - must be unique"`
 	Config    string           `yaml:"config" json:"config" usage:"The absolute file path to configuration YAML file."`
@@ -133,6 +151,7 @@ type config struct {
 	Social    *SocialConfig    `yaml:"social" json:"social" usage:"Properties for social providers"`
 	Runtime   *RuntimeConfig   `yaml:"runtime" json:"runtime" usage:"Script Runtime properties"`
 	Purchase  *PurchaseConfig  `yaml:"purchase" json:"purchase" usage:"In-App Purchase provider configuration"`
+	Storage   *StorageConfig   `yaml:"storage" json:"storage" usage:"Storage engine configuration"`
 }
 
 // NewConfig constructs a Config struct which represents server settings.
@@ -151,6 +170,7 @@ func NewConfig() *config {
 		Social:    NewSocialConfig(),
 		Runtime:   NewRuntimeConfig(),
 		Purchase:  NewPurchaseConfig(),
+		Storage:   NewStorageConfig(),
 	}
 }
 
@@ -194,6 +214,10 @@ func (c *config) GetPurchase() *PurchaseConfig {
 	return c.Purchase
 }
 
+func (c *config) GetStorage() *StorageConfig {
+	return c.Storage
+}
+
 // DashboardConfig is configuration relevant to the dashboard
 type DashboardConfig struct {
 	Port int `yaml:"port" json:"port" usage:"The port for accepting connections to the dashboard, listening on all interfaces."`
@@ -253,6 +277,19 @@ type SocketConfig struct {
 	PingPeriodMs        int    `yaml:"ping_period_ms" json:"ping_period_ms" usage:"Time in milliseconds to wait between client ping messages. This value must be less than the pong_wait_ms."`
 	SSLCertificate      string `yaml:"ssl_certificate" json:"ssl_certificate" usage:"Path to certificate file if you want the server to use SSL directly. Must also supply ssl_private_key"`
 	SSLPrivateKey       string `yaml:"ssl_private_key" json:"ssl_private_key" usage:"Path to private key file if you want the server to use SSL directly. Must also supply ssl_certificate"`
+
+	RateLimitChat              *RateLimitConfig `yaml:"rate_limit_chat" json:"rate_limit_chat" usage:"Rate limit for each chat message type, per session."`
+	RateLimitRpc               *RateLimitConfig `yaml:"rate_limit_rpc" json:"rate_limit_rpc" usage:"Rate limit for RPC calls, per session."`
+	RateLimitStorage           *RateLimitConfig `yaml:"rate_limit_storage" json:"rate_limit_storage" usage:"Rate limit for each storage message type, per session."`
+	RateLimitDefault           *RateLimitConfig `yaml:"rate_limit_default" json:"rate_limit_default" usage:"Rate limit for each other message type, per session."`
+	RateLimitDisconnectAfter   int              `yaml:"rate_limit_disconnect_after" json:"rate_limit_disconnect_after" usage:"Disconnect sessions after this many rate limited messages within the violation window. 0 never disconnects."`
+	RateLimitViolationWindowMs int              `yaml:"rate_limit_violation_window_ms" json:"rate_limit_violation_window_ms" usage:"Time in milliseconds that a rate limited message counts towards disconnecting the session."`
+}
+
+// RateLimitConfig is configuration for a token bucket rate limit
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate" json:"rate" usage:"Number of messages allowed per second, on average. 0 disables the limit."`
+	Burst int     `yaml:"burst" json:"burst" usage:"Maximum number of messages allowed in a burst."`
 }
 
 // NewTransportConfig creates a new TransportConfig struct
@@ -268,6 +305,13 @@ func NewSocketConfig() *SocketConfig {
 		PingPeriodMs:        8000,
 		SSLCertificate:      "",
 		SSLPrivateKey:       "",
+
+		RateLimitChat:              &RateLimitConfig{Rate: 5, Burst: 10},
+		RateLimitRpc:               &RateLimitConfig{Rate: 10, Burst: 20},
+		RateLimitStorage:           &RateLimitConfig{Rate: 10, Burst: 20},
+		RateLimitDefault:           &RateLimitConfig{Rate: 0, Burst: 0},
+		RateLimitDisconnectAfter:   0,
+		RateLimitViolationWindowMs: 60000,
 	}
 }
 
@@ -293,6 +337,8 @@ func NewDatabaseConfig() *DatabaseConfig {
 type SocialConfig struct {
 	Notification *NotificationConfig `yaml:"notification" json:"notification" usage:"Notification configuration"`
 	Steam        *SocialConfigSteam  `yaml:"steam" json:"steam" usage:"Steam configuration"`
+	Topic        *TopicConfig        `yaml:"topic" json:"topic" usage:"Chat topic configuration"`
+	Moderation   *ModerationConfig   `yaml:"moderation" json:"moderation" usage:"Content moderation configuration"`
 }
 
 // SocialConfigSteam is configuration relevant to Steam
@@ -306,6 +352,29 @@ type NotificationConfig struct {
 	ExpiryMs int64 `yaml:"expiry_ms" json:"expiry_ms" usage:"Notification expiry in milliseconds."`
 }
 
+// TopicConfig is configuration relevant to chat topics
+type TopicConfig struct {
+	DmExpiryMs            int64            `yaml:"dm_expiry_ms" json:"dm_expiry_ms" usage:"Time in milliseconds to keep direct messages. 0 keeps them forever."`
+	RoomExpiryMs          int64            `yaml:"room_expiry_ms" json:"room_expiry_ms" usage:"Time in milliseconds to keep room messages. 0 keeps them forever."`
+	GroupExpiryMs         int64            `yaml:"group_expiry_ms" json:"group_expiry_ms" usage:"Time in milliseconds to keep group messages. 0 keeps them forever."`
+	RoomExpiryOverridesMs map[string]int64 `yaml:"room_expiry_overrides_ms" json:"room_expiry_overrides_ms"` // not supported in FlagOverrides
+	SweepIntervalMs       int64            `yaml:"sweep_interval_ms" json:"sweep_interval_ms" usage:"Time in milliseconds between removals of expired messages. 0 disables removal."`
+	SweepBatchSize        int64            `yaml:"sweep_batch_size" json:"sweep_batch_size" usage:"Maximum number of expired messages to remove in a single query."`
+	DmReadBroadcast       bool             `yaml:"dm_read_broadcast" json:"dm_read_broadcast" usage:"Let the other user in a direct message topic know when messages are read."`
+	Moderators            []string         `yaml:"moderators" json:"moderators" usage:"IDs of users allowed to mute, kick and ban users in any room or group topic."`
+}
+
+// ModerationConfig is configuration relevant to content moderation
+type ModerationConfig struct {
+	Mode         string              `yaml:"mode" json:"mode" usage:"Action to take on content matching a moderation rule: 'mask', 'reject' or 'flag'."`
+	Words        []string            `yaml:"words" json:"words" usage:"Words not allowed in content, for all languages."`
+	Patterns     []string            `yaml:"patterns" json:"patterns" usage:"Regular expressions not allowed to match content, for all languages."`
+	LangWords    map[string][]string `yaml:"lang_words" json:"lang_words"`       // not supported in FlagOverrides
+	LangPatterns map[string][]string `yaml:"lang_patterns" json:"lang_patterns"` // not supported in FlagOverrides
+	Handles      bool                `yaml:"handles" json:"handles" usage:"Also moderate user handles."`
+	GroupNames   bool                `yaml:"group_names" json:"group_names" usage:"Also moderate group names."`
+}
+
 // NewSocialConfig creates a new SocialConfig struct
 func NewSocialConfig() *SocialConfig {
 	return &SocialConfig{
@@ -316,6 +385,25 @@ func NewSocialConfig() *SocialConfig {
 		Notification: &NotificationConfig{
 			ExpiryMs: 86400000, // one day expiry
 		},
+		Topic: &TopicConfig{
+			DmExpiryMs:            0,
+			RoomExpiryMs:          0,
+			GroupExpiryMs:         0,
+			RoomExpiryOverridesMs: make(map[string]int64),
+			SweepIntervalMs:       60000,
+			SweepBatchSize:        1000,
+			DmReadBroadcast:       false,
+			Moderators:            []string{},
+		},
+		Moderation: &ModerationConfig{
+			Mode:         "mask",
+			Words:        []string{},
+			Patterns:     []string{},
+			LangWords:    make(map[string][]string),
+			LangPatterns: make(map[string][]string),
+			Handles:      false,
+			GroupNames:   false,
+		},
 	}
 }
 
@@ -360,3 +448,60 @@ type GooglePurchaseProviderConfig struct {
 	ServiceKeyFilePath string `yaml:"service_key_file" json:"service_key_file" usage:"Absolute file path to the service key JSON file."`
 	TimeoutMs          int    `yaml:"timeout_ms" json:"timeout_ms" usage:"Google connection timeout in milliseconds"`
 }
+
+// StorageConfig is configuration relevant to the storage engine
+type StorageConfig struct {
+	MaxValueSizeBytes      int                     `yaml:"max_value_size_bytes" json:"max_value_size_bytes" usage:"Maximum size of a record value in bytes, before compression."`
+	CompressThresholdBytes int                     `yaml:"compress_threshold_bytes" json:"compress_threshold_bytes" usage:"Record values of at least this size in bytes are stored compressed. 0 disables compression."`
+	BlobMaxSizeBytes       int64                   `yaml:"blob_max_size_bytes" json:"blob_max_size_bytes" usage:"Maximum size of a blob in bytes."`
+	BlobChunkSizeBytes     int                     `yaml:"blob_chunk_size_bytes" json:"blob_chunk_size_bytes" usage:"Blobs are stored in chunks of this size in bytes."`
+	MaxSubscriptions       int                     `yaml:"max_subscriptions" json:"max_subscriptions" usage:"Maximum number of storage change subscriptions each session can have."`
+	Indexes                []*StorageIndexConfig   `yaml:"indexes" json:"indexes"` // not supported in FlagOverrides
+	History                []*StorageHistoryConfig `yaml:"history" json:"history"` // not supported in FlagOverrides
+	Schemas                []*StorageSchemaConfig  `yaml:"schemas" json:"schemas"` // not supported in FlagOverrides
+}
+
+// StorageIndexConfig declares a secondary index on a field in the values of a storage collection
+type StorageIndexConfig struct {
+	Name       string `yaml:"name" json:"name"`
+	Bucket     string `yaml:"bucket" json:"bucket"`
+	Collection string `yaml:"collection" json:"collection"`
+	// Path to the indexed field in the record value, with nested fields separated by '.'.
+	Field string `yaml:"field" json:"field"`
+	// Type of the indexed field value, 'string' or 'number'.
+	Type string `yaml:"type" json:"type"`
+}
+
+// StorageHistoryConfig keeps previous versions of the records in a storage collection
+type StorageHistoryConfig struct {
+	Bucket     string `yaml:"bucket" json:"bucket"`
+	Collection string `yaml:"collection" json:"collection"`
+	// Number of versions to keep for each record, including the current one, or 0 for no limit.
+	MaxVersions int `yaml:"max_versions" json:"max_versions"`
+	// Number of days to keep previous versions for, or 0 for no limit.
+	MaxDays int `yaml:"max_days" json:"max_days"`
+}
+
+// StorageSchemaConfig declares a JSON Schema that record values in a storage collection must match
+type StorageSchemaConfig struct {
+	Bucket     string `yaml:"bucket" json:"bucket"`
+	Collection string `yaml:"collection" json:"collection"`
+	// JSON Schema document, as a JSON string. Only these draft 4 validation keywords are allowed: type, enum, properties,
+	// required, additionalProperties, minProperties, maxProperties, items (including tuples), additionalItems, minItems,
+	// maxItems, uniqueItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, minLength, maxLength and pattern.
+	Schema string `yaml:"schema" json:"schema"`
+}
+
+// NewStorageConfig creates a new StorageConfig struct
+func NewStorageConfig() *StorageConfig {
+	return &StorageConfig{
+		MaxValueSizeBytes:      16000,
+		CompressThresholdBytes: 1024,
+		BlobMaxSizeBytes:       10485760,
+		BlobChunkSizeBytes:     262144,
+		MaxSubscriptions:       100,
+		Indexes:                []*StorageIndexConfig{},
+		History:                []*StorageHistoryConfig{},
+		Schemas:                []*StorageSchemaConfig{},
+	}
+}
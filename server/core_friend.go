@@ -15,14 +15,23 @@
 package server
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
 	"errors"
+	"strconv"
 
 	"encoding/json"
 	"fmt"
 	"go.uber.org/zap"
 )
 
+type friendsListCursor struct {
+	State    int64
+	Position int64
+}
+
 func friendAdd(logger *zap.Logger, db *sql.DB, ns *NotificationService, userID string, handle string, friendID string) error {
 	tx, txErr := db.Begin()
 	if txErr != nil {
@@ -141,3 +150,488 @@ func friendAddHandle(logger *zap.Logger, db *sql.DB, ns *NotificationService, us
 
 	return friendAdd(logger, db, ns, userID, handle, friendID)
 }
+
+// FriendsImport creates mutual friend relationships between the given user and any users
+// linked to the given provider friend IDs, skipping users that already have a relationship.
+// Newly added friends are notified that the user has joined the game.
+func FriendsImport(logger *zap.Logger, db *sql.DB, ns *NotificationService, userID string, handle string, provider string, providerID string, providerFriendIDs []string) (err error) {
+	if len(providerFriendIDs) == 0 {
+		return nil
+	}
+
+	var tx *sql.Tx
+
+	ts := nowMs()
+	friendUserIDs := make([]interface{}, 0)
+	defer func() {
+		if err != nil {
+			logger.Error("Could not import friends", zap.String("provider", provider), zap.Error(err))
+			if tx != nil {
+				if e := tx.Rollback(); e != nil {
+					logger.Error("Could not rollback transaction", zap.Error(e))
+				}
+			}
+		} else {
+			if tx != nil {
+				err = tx.Commit()
+				if err != nil {
+					logger.Error("Could not commit transaction", zap.Error(err))
+				} else {
+					logger.Debug("Imported friends", zap.String("provider", provider), zap.Int("count", len(friendUserIDs)))
+
+					// Send out notifications.
+					if len(friendUserIDs) != 0 {
+						content, e := json.Marshal(map[string]interface{}{"handle": handle, provider + "_id": providerID})
+						if e != nil {
+							logger.Warn("Failed to send friend join notifications", zap.String("provider", provider), zap.Error(e))
+							return
+						}
+						subject := "Your friend has just joined the game"
+						expiresAt := ts + ns.expiryMs
+
+						notifications := make([]*NNotification, len(friendUserIDs))
+						for i, friendUserID := range friendUserIDs {
+							fid := friendUserID.(string)
+							notifications[i] = &NNotification{
+								Id:         generateNewId(),
+								UserID:     fid,
+								Subject:    subject,
+								Content:    content,
+								Code:       NOTIFICATION_FRIEND_JOIN_GAME,
+								SenderID:   userID,
+								CreatedAt:  ts,
+								ExpiresAt:  expiresAt,
+								Persistent: true,
+							}
+						}
+
+						if e := ns.NotificationSend(notifications); e != nil {
+							logger.Warn("Failed to send friend join notifications", zap.String("provider", provider), zap.Error(e))
+						}
+					}
+				}
+			}
+		}
+	}()
+
+	tx, err = db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Find users linked to any of the provider friends that have no existing relationship, in either direction, with the current user.
+	query := "SELECT id FROM users WHERE id != $1 AND " + provider + "_id IN ("
+	friends := []interface{}{userID}
+	for i, providerFriendID := range providerFriendIDs {
+		if i != 0 {
+			query += ", "
+		}
+		friends = append(friends, providerFriendID)
+		query += fmt.Sprintf("$%v", len(friends))
+	}
+	query += `)
+AND NOT EXISTS (
+	SELECT state FROM user_edge
+	WHERE (source_id = $1 AND destination_id = users.id)
+	OR (source_id = users.id AND destination_id = $1)
+)`
+	rows, err := tx.Query(query, friends...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	queryEdge := "INSERT INTO user_edge (source_id, position, updated_at, destination_id, state) VALUES "
+	paramsEdge := []interface{}{userID, ts}
+	queryEdgeMetadata := "UPDATE user_edge_metadata SET count = count + 1, updated_at = $1 WHERE source_id IN ("
+	paramsEdgeMetadata := []interface{}{ts}
+	newFriendUserIDs := make([]interface{}, 0)
+	for rows.Next() {
+		var currentUser string
+		err = rows.Scan(&currentUser)
+		if err != nil {
+			return err
+		}
+
+		if len(paramsEdge) != 2 {
+			queryEdge += ", "
+		}
+		// Each new edge needs a distinct position, it's part of the key and used for friend list ordering.
+		paramsEdge = append(paramsEdge, currentUser, ts+int64(len(newFriendUserIDs)))
+		newFriendUserIDs = append(newFriendUserIDs, currentUser)
+		queryEdge += fmt.Sprintf("($1, $%v, $2, $%v, 0), ($%v, $%v, $2, $1, 0)", len(paramsEdge), len(paramsEdge)-1, len(paramsEdge)-1, len(paramsEdge))
+
+		if len(paramsEdgeMetadata) != 1 {
+			queryEdgeMetadata += ", "
+		}
+		paramsEdgeMetadata = append(paramsEdgeMetadata, currentUser)
+		queryEdgeMetadata += fmt.Sprintf("$%v", len(paramsEdgeMetadata))
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	queryEdgeMetadata += ")"
+
+	// Check if any provider friends are already users, if not there are no new edges to handle.
+	if len(newFriendUserIDs) == 0 {
+		return nil
+	}
+
+	// Insert new friend relationship edges.
+	_, err = tx.Exec(queryEdge, paramsEdge...)
+	if err != nil {
+		return err
+	}
+	// Update edge metadata for each user to increment count.
+	_, err = tx.Exec(queryEdgeMetadata, paramsEdgeMetadata...)
+	if err != nil {
+		return err
+	}
+	// Update edge metadata for current user to bump count by number of new friends.
+	_, err = tx.Exec(`UPDATE user_edge_metadata SET count = count + $1, updated_at = $2 WHERE source_id = $3`, len(newFriendUserIDs), ts, userID)
+	if err != nil {
+		return err
+	}
+
+	// Track the user IDs to notify their friend has joined the game.
+	friendUserIDs = newFriendUserIDs
+	return nil
+}
+
+func friendRemove(logger *zap.Logger, db *sql.DB, userID string, friendID string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil { // don't override value of err
+				logger.Error("Could not rollback transaction", zap.Error(rollbackErr))
+			}
+		} else {
+			if err = tx.Commit(); err != nil {
+				logger.Error("Could not commit transaction", zap.Error(err))
+			}
+		}
+	}()
+
+	updatedAt := nowMs()
+
+	// Remove the edges in both directions, and decrement the counts only for edges that existed.
+	for _, ids := range [][]string{{userID, friendID}, {friendID, userID}} {
+		var res sql.Result
+		res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", ids[0], ids[1])
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected > 0 {
+			_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", ids[0], updatedAt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func friendBlock(logger *zap.Logger, db *sql.DB, userID string, blockedID string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil { // don't override value of err
+				logger.Error("Could not rollback transaction", zap.Error(rollbackErr))
+			}
+		} else {
+			if err = tx.Commit(); err != nil {
+				logger.Error("Could not commit transaction", zap.Error(err))
+			}
+		}
+	}()
+
+	ts := nowMs()
+
+	// Try to update any previous edge between these users.
+	res, err := tx.Exec("UPDATE user_edge SET state = 3, updated_at = $3 WHERE source_id = $1 AND destination_id = $2",
+		userID, blockedID, ts)
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		// If there was no previous edge then create one.
+		query := `INSERT INTO user_edge (source_id, destination_id, state, position, updated_at)
+SELECT source_id, destination_id, state, position, updated_at
+FROM (VALUES
+  ($1::BYTEA, $2::BYTEA, 3, $3::BIGINT, $3::BIGINT)
+) AS ue(source_id, destination_id, state, position, updated_at)
+WHERE EXISTS (SELECT id FROM users WHERE id = $2::BYTEA)`
+		res, err = tx.Exec(query, userID, blockedID, ts)
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			err = errors.New("Could not block user. User ID may not exist")
+			return err
+		}
+
+		// Update the edge count.
+		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count + 1, updated_at = $2 WHERE source_id = $1", userID, ts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Delete opposite relationship if user hasn't blocked you already
+	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state != 3",
+		blockedID, userID)
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 1 {
+		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", blockedID, ts)
+	}
+
+	return err
+}
+
+// FriendsList returns users that have a relationship with the given user, ordered by relationship state and position.
+// A state of -1 returns relationships in any state. A zero limit returns all matching relationships without a cursor.
+// If online is true only friends currently connected according to the tracker are returned.
+func FriendsList(logger *zap.Logger, db *sql.DB, tracker Tracker, userID string, state int64, limit int64, online bool, cursor string) ([]*Friend, string, Error_Code, error) {
+	if state < -1 || state > 3 {
+		return nil, "", BAD_INPUT, errors.New("Invalid friend state filter")
+	}
+
+	params := []interface{}{userID}
+	filterQuery := ""
+	if state >= 0 {
+		params = append(params, state)
+		filterQuery = " AND state = $2"
+	}
+
+	if cursor != "" {
+		var c friendsListCursor
+		if cb, err := base64.StdEncoding.DecodeString(cursor); err != nil {
+			return nil, "", BAD_INPUT, errors.New("Invalid cursor data")
+		} else if err := gob.NewDecoder(bytes.NewReader(cb)).Decode(&c); err != nil {
+			return nil, "", BAD_INPUT, errors.New("Invalid cursor data")
+		}
+
+		// Position is unique per source and state, so together they identify the last returned relationship.
+		params = append(params, c.State, c.Position)
+		filterQuery += " AND (state, position) > ($" + strconv.Itoa(len(params)-1) + ", $" + strconv.Itoa(len(params)) + ")"
+	}
+
+	limitQuery := ""
+	if limit != 0 && !online {
+		// Fetch one extra row to determine if there are more results.
+		params = append(params, limit+1)
+		limitQuery = " LIMIT $" + strconv.Itoa(len(params))
+	}
+
+	query := `
+SELECT id, handle, fullname, avatar_url,
+	lang, location, timezone, metadata,
+	created_at, users.updated_at, state, position
+FROM users, user_edge
+WHERE id = destination_id AND source_id = $1` + filterQuery + `
+ORDER BY state, position` + limitQuery
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Could not get friends, query error", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Could not get friends")
+	}
+	defer rows.Close()
+
+	// If the user is currently online this will be their 'last online at' value.
+	ts := nowMs()
+	friends := make([]*Friend, 0)
+	var newCursor *friendsListCursor
+	hasMore := false
+
+	for rows.Next() {
+		var id sql.NullString
+		var handle sql.NullString
+		var fullname sql.NullString
+		var avatarURL sql.NullString
+		var lang sql.NullString
+		var location sql.NullString
+		var timezone sql.NullString
+		var metadata []byte
+		var createdAt sql.NullInt64
+		var updatedAt sql.NullInt64
+		var edgeState sql.NullInt64
+		var position sql.NullInt64
+
+		err = rows.Scan(&id, &handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata, &createdAt, &updatedAt, &edgeState, &position)
+		if err != nil {
+			logger.Error("Could not get friends, scan error", zap.Error(err))
+			return nil, "", RUNTIME_EXCEPTION, errors.New("Could not get friends")
+		}
+
+		isOnline := len(tracker.ListByTopic("notifications:"+id.String)) != 0
+		if online && !isOnline {
+			continue
+		}
+
+		// There is at least one more result than requested, so the previous one becomes the cursor.
+		if limit != 0 && int64(len(friends)) >= limit {
+			hasMore = true
+			break
+		}
+
+		user := &User{
+			Id:        id.String,
+			Handle:    handle.String,
+			Fullname:  fullname.String,
+			AvatarUrl: avatarURL.String,
+			Lang:      lang.String,
+			Location:  location.String,
+			Timezone:  timezone.String,
+			Metadata:  string(metadata),
+			CreatedAt: createdAt.Int64,
+			UpdatedAt: updatedAt.Int64,
+		}
+		if isOnline {
+			user.LastOnlineAt = ts
+		}
+
+		friends = append(friends, &Friend{
+			User:  user,
+			State: edgeState.Int64,
+		})
+		newCursor = &friendsListCursor{
+			State:    edgeState.Int64,
+			Position: position.Int64,
+		}
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not get friends, query error", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Could not get friends")
+	}
+
+	// Only hand out a cursor if there was at least one more matching result.
+	outgoingCursor := ""
+	if hasMore && newCursor != nil {
+		cursorBuf := new(bytes.Buffer)
+		if err := gob.NewEncoder(cursorBuf).Encode(newCursor); err != nil {
+			logger.Error("Could not create friends list cursor", zap.Error(err))
+			return nil, "", RUNTIME_EXCEPTION, errors.New("Could not get friends")
+		}
+		outgoingCursor = base64.StdEncoding.EncodeToString(cursorBuf.Bytes())
+	}
+
+	return friends, outgoingCursor, 0, nil
+}
+
+// FriendsSuggest returns users who are friends with the given user's friends, ranked by the number of mutual friends.
+// Users that already have a relationship in any state with the given user, including blocks in either direction, are excluded.
+func FriendsSuggest(logger *zap.Logger, db *sql.DB, tracker Tracker, userID string, limit int64) ([]*FriendSuggestion, Error_Code, error) {
+	query := `
+SELECT id, handle, fullname, avatar_url,
+	lang, location, timezone, metadata,
+	created_at, users.updated_at, s.mutual_count
+FROM users
+JOIN (
+	SELECT fof.destination_id AS suggested_id, count(*) AS mutual_count
+	FROM user_edge f
+	JOIN user_edge fof ON fof.source_id = f.destination_id AND fof.state = 0
+	WHERE f.source_id = $1 AND f.state = 0 AND fof.destination_id != $1
+	AND NOT EXISTS (
+		SELECT state FROM user_edge
+		WHERE (source_id = $1 AND destination_id = fof.destination_id)
+		OR (source_id = fof.destination_id AND destination_id = $1)
+	)
+	GROUP BY fof.destination_id
+) AS s ON (s.suggested_id = id)
+WHERE disabled_at = 0
+ORDER BY s.mutual_count DESC, id
+LIMIT $2`
+
+	rows, err := db.Query(query, userID, limit)
+	if err != nil {
+		logger.Error("Could not get friend suggestions, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not get friend suggestions")
+	}
+	defer rows.Close()
+
+	// If the user is currently online this will be their 'last online at' value.
+	ts := nowMs()
+	suggestions := make([]*FriendSuggestion, 0)
+
+	for rows.Next() {
+		var id sql.NullString
+		var handle sql.NullString
+		var fullname sql.NullString
+		var avatarURL sql.NullString
+		var lang sql.NullString
+		var location sql.NullString
+		var timezone sql.NullString
+		var metadata []byte
+		var createdAt sql.NullInt64
+		var updatedAt sql.NullInt64
+		var mutualCount sql.NullInt64
+
+		err = rows.Scan(&id, &handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata, &createdAt, &updatedAt, &mutualCount)
+		if err != nil {
+			logger.Error("Could not get friend suggestions, scan error", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not get friend suggestions")
+		}
+
+		user := &User{
+			Id:        id.String,
+			Handle:    handle.String,
+			Fullname:  fullname.String,
+			AvatarUrl: avatarURL.String,
+			Lang:      lang.String,
+			Location:  location.String,
+			Timezone:  timezone.String,
+			Metadata:  string(metadata),
+			CreatedAt: createdAt.Int64,
+			UpdatedAt: updatedAt.Int64,
+		}
+		if len(tracker.ListByTopic("notifications:"+id.String)) != 0 {
+			user.LastOnlineAt = ts
+		}
+
+		suggestions = append(suggestions, &FriendSuggestion{
+			User:        user,
+			MutualCount: mutualCount.Int64,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not get friend suggestions, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not get friend suggestions")
+	}
+
+	return suggestions, 0, nil
+}
+
+// FriendsMutual returns the users that both of the given users are friends with.
+func FriendsMutual(logger *zap.Logger, db *sql.DB, tracker Tracker, userID string, otherUserID string) ([]*User, Error_Code, error) {
+	if userID == otherUserID {
+		return nil, BAD_INPUT, errors.New("Cannot list mutual friends with self")
+	}
+
+	users, err := querySocialGraph(logger, db, tracker, `
+WHERE id IN (
+	SELECT a.destination_id FROM user_edge a
+	JOIN user_edge b ON b.destination_id = a.destination_id
+	WHERE a.source_id = $1 AND a.state = 0 AND b.source_id = $2 AND b.state = 0
+)`, []interface{}{userID, otherUserID})
+	if err != nil {
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not get mutual friends")
+	}
+
+	return users, 0, nil
+}
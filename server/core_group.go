@@ -16,11 +16,13 @@ package server
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"strconv"
 	"strings"
 
 	"fmt"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 )
 
@@ -460,3 +462,567 @@ WHERE u.id = ge.source_id AND ge.destination_id = $1`
 
 	return users, 0, nil
 }
+
+// GroupRemove deletes a group and all its memberships. If the caller is not the script runtime they must be a group admin.
+func GroupRemove(logger *zap.Logger, db *sql.DB, caller string, groupID string) (code Error_Code, err error) {
+	groupLogger := logger.With(zap.String("group_id", groupID))
+	code = RUNTIME_EXCEPTION
+	failureReason := "Failed to remove group"
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not remove group", zap.Error(err))
+		return code, errors.New(failureReason)
+	}
+	defer func() {
+		if err != nil {
+			groupLogger.Error("Could not remove group", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not rollback transaction", zap.Error(e))
+			}
+			err = errors.New(failureReason)
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not commit transaction", zap.Error(e))
+				code, err = RUNTIME_EXCEPTION, errors.New(failureReason)
+			} else {
+				groupLogger.Info("Removed group")
+			}
+		}
+	}()
+
+	query := "DELETE FROM groups WHERE id = $1"
+	params := []interface{}{groupID}
+	// If the caller is not the script runtime, apply group admin role checks.
+	if caller != "" {
+		query += " AND EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)"
+		params = append(params, caller)
+	}
+
+	res, err := tx.Exec(query, params...)
+	if err != nil {
+		return code, err
+	}
+
+	rowAffected, err := res.RowsAffected()
+	if err != nil {
+		return code, err
+	}
+	if rowAffected == 0 {
+		failureReason = "Could not remove group. Make sure you are a group admin and group exists"
+		return code, errors.New("Could not remove group. User may not be group admin or group may not exist")
+	}
+
+	_, err = tx.Exec("DELETE FROM group_edge WHERE source_id = $1 OR destination_id = $1", groupID)
+	if err != nil {
+		return code, err
+	}
+
+	return 0, nil
+}
+
+// GroupJoin adds the user to a public group, or creates a join request for a private group and notifies the group admins.
+func GroupJoin(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, messageRetention *MessageRetentionService, ns *NotificationService, userID string, handle string, groupID string) (code Error_Code, err error) {
+	groupLogger := logger.With(zap.String("group_id", groupID))
+	code = RUNTIME_EXCEPTION
+	failureReason := "Could not join group"
+
+	ts := nowMs()
+
+	// Group admin user IDs to notify there's a new user join request, if the group is private.
+	var groupName sql.NullString
+	privateGroup := false
+	adminUserIDs := make([]string, 0)
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not add user to group", zap.Error(err))
+		return code, errors.New("Could not add user to group")
+	}
+	defer func() {
+		if err != nil {
+			groupLogger.Error("Could not join group", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not rollback transaction", zap.Error(e))
+			}
+			err = errors.New(failureReason)
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not commit transaction", zap.Error(e))
+				code, err = RUNTIME_EXCEPTION, errors.New(failureReason)
+				return
+			}
+
+			groupLogger.Info("User joined group")
+
+			if !privateGroup {
+				// If the user was added directly.
+				if e := storeAndDeliverMessage(groupLogger, db, tracker, messageRouter, messageRetention, userID, handle, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 1, []byte("{}")); e != nil {
+					groupLogger.Error("Error handling group user join notification topic message", zap.Error(e))
+				}
+			} else if len(adminUserIDs) != 0 {
+				// If the user has requested to join and there are admins to notify.
+				name := groupName.String
+				content, e := json.Marshal(map[string]string{"handle": handle, "name": name})
+				if e != nil {
+					groupLogger.Warn("Failed to send group join request notification", zap.Error(e))
+					return
+				}
+				subject := fmt.Sprintf("%v wants to join your group %v", handle, name)
+				expiresAt := ts + ns.expiryMs
+
+				notifications := make([]*NNotification, len(adminUserIDs))
+				for i, adminUserID := range adminUserIDs {
+					notifications[i] = &NNotification{
+						Id:         generateNewId(),
+						UserID:     adminUserID,
+						Subject:    subject,
+						Content:    content,
+						Code:       NOTIFICATION_GROUP_JOIN_REQUEST,
+						SenderID:   userID,
+						CreatedAt:  ts,
+						ExpiresAt:  expiresAt,
+						Persistent: true,
+					}
+				}
+
+				if e := ns.NotificationSend(notifications); e != nil {
+					groupLogger.Warn("Failed to send group join request notification", zap.Error(e))
+				}
+			}
+		}
+	}()
+
+	var groupState sql.NullInt64
+	err = tx.QueryRow("SELECT state, name FROM groups WHERE id = $1 AND disabled_at = 0", groupID).Scan(&groupState, &groupName)
+	if err != nil {
+		return code, err
+	}
+
+	userState := 1
+	if groupState.Int64 == 1 {
+		privateGroup = true
+		userState = 2
+	}
+
+	res, err := tx.Exec(`
+INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
+VALUES ($1::BYTEA, $2, $2, $3::BYTEA, $4), ($3::BYTEA, $2, $2, $1::BYTEA, $4)`,
+		groupID, ts, userID, userState)
+
+	if err != nil {
+		return code, err
+	}
+
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		failureReason = "Could not accept group join envelope. Group may not exists with the given ID"
+		return code, errors.New(failureReason)
+	}
+
+	// If the group is not private and the user joined directly, increase the group count.
+	if !privateGroup {
+		_, err = tx.Exec("UPDATE groups SET count = count + 1, updated_at = $2 WHERE id = $1", groupID, ts)
+		if err != nil {
+			return code, err
+		}
+	}
+
+	// If group is private, look up admin user IDs to notify about a new user requesting to join.
+	if privateGroup {
+		rows, e := tx.Query("SELECT destination_id FROM group_edge WHERE source_id = $1 AND state = 0", groupID)
+		if e != nil {
+			groupLogger.Warn("Failed to send group join request notification", zap.Error(e))
+			return 0, nil
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var adminUserID sql.NullString
+			e = rows.Scan(&adminUserID)
+			if e != nil {
+				groupLogger.Warn("Failed to send group join request notification", zap.Error(e))
+				return 0, nil
+			}
+			adminUserIDs = append(adminUserIDs, adminUserID.String)
+		}
+	}
+
+	return 0, nil
+}
+
+// GroupLeave removes the user from a group, or withdraws their pending join request. The last group admin cannot leave.
+func GroupLeave(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, messageRetention *MessageRetentionService, userID string, handle string, groupID string) (code Error_Code, err error) {
+	groupLogger := logger.With(zap.String("group_id", groupID))
+	code = RUNTIME_EXCEPTION
+	failureReason := "Could not leave group"
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not leave group", zap.Error(err))
+		return code, errors.New(failureReason)
+	}
+	defer func() {
+		if err != nil {
+			groupLogger.Error("Could not leave group", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not rollback transaction", zap.Error(e))
+			}
+			err = errors.New(failureReason)
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not commit transaction", zap.Error(e))
+				code, err = RUNTIME_EXCEPTION, errors.New(failureReason)
+				return
+			}
+
+			groupLogger.Info("User left group")
+
+			if e := storeAndDeliverMessage(groupLogger, db, tracker, messageRouter, messageRetention, userID, handle, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 3, []byte("{}")); e != nil {
+				groupLogger.Error("Error handling group user leave notification topic message", zap.Error(e))
+			}
+		}
+	}()
+
+	// first remove any invitation from user
+	// and if this wasn't an invitation then
+	// look to see if the user is an admin
+	// and remove the user from group and update group count
+	res, err := tx.Exec(`
+DELETE FROM group_edge
+WHERE
+	(source_id = $1 AND destination_id = $2 AND state = 2)
+OR
+	(source_id = $2 AND destination_id = $1 AND state = 2)`,
+		groupID, userID)
+
+	if err != nil {
+		return code, err
+	}
+
+	if count, _ := res.RowsAffected(); count > 0 {
+		groupLogger.Debug("Group invitation removed.")
+		return 0, nil
+	}
+
+	var adminCount sql.NullInt64
+	err = tx.QueryRow(`
+SELECT COUNT(source_id)	FROM group_edge
+WHERE
+	source_id = $1 AND state = 0
+AND
+	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
+AND
+	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)`,
+		groupID, userID).Scan(&adminCount)
+
+	if err != nil {
+		return code, err
+	}
+
+	if adminCount.Int64 == 1 {
+		code = GROUP_LAST_ADMIN
+		failureReason = "Cannot leave group when you are the last group admin"
+		return code, errors.New(failureReason)
+	}
+
+	res, err = tx.Exec(`
+DELETE FROM group_edge
+WHERE
+	(source_id = $1 AND destination_id = $2)
+OR
+	(source_id = $2 AND destination_id = $1)`,
+		groupID, userID)
+
+	if err != nil {
+		return code, err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		failureReason = "Cannot leave group - Make sure you are part of the group or group exists"
+		return code, errors.New(failureReason)
+	}
+
+	_, err = tx.Exec(`UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID)
+	if err != nil {
+		return code, err
+	}
+
+	return 0, nil
+}
+
+// GroupUserAdd adds a user directly to a group and notifies them. If the caller is not the script runtime they must be a group admin.
+// When called from the script runtime the group topic message is sent on behalf of the added user.
+func GroupUserAdd(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, messageRetention *MessageRetentionService, ns *NotificationService, caller string, callerHandle string, groupID string, userID string) (code Error_Code, err error) {
+	groupLogger := logger.With(zap.String("group_id", groupID), zap.String("user_id", userID))
+	code = RUNTIME_EXCEPTION
+	failureReason := "Could not add user to group"
+
+	ts := nowMs()
+	var handle string
+	var name string
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not add user to group", zap.Error(err))
+		return code, errors.New(failureReason)
+	}
+	defer func() {
+		if err != nil {
+			if _, ok := err.(*pq.Error); ok {
+				groupLogger.Error("Could not add user to group", zap.Error(err))
+			} else {
+				groupLogger.Warn("Could not add user to group", zap.Error(err))
+			}
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not rollback transaction", zap.Error(e))
+			}
+			err = errors.New(failureReason)
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not commit transaction", zap.Error(e))
+				code, err = RUNTIME_EXCEPTION, errors.New(failureReason)
+				return
+			}
+
+			groupLogger.Info("Added user to the group")
+
+			senderID, senderHandle := caller, callerHandle
+			if caller == "" {
+				senderID, senderHandle = userID, handle
+			}
+			data, _ := json.Marshal(map[string]string{"user_id": userID, "handle": handle})
+			if e := storeAndDeliverMessage(groupLogger, db, tracker, messageRouter, messageRetention, senderID, senderHandle, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 2, data); e != nil {
+				groupLogger.Error("Error handling group user added notification topic message", zap.Error(e))
+				return
+			}
+
+			content, e := json.Marshal(map[string]string{"handle": callerHandle, "name": name})
+			if e != nil {
+				groupLogger.Warn("Failed to send group add notification", zap.Error(e))
+				return
+			}
+			subject := fmt.Sprintf("%v has added you to group %v", callerHandle, name)
+			if caller == "" {
+				subject = fmt.Sprintf("You have been added to group %v", name)
+			}
+			if e := ns.NotificationSend([]*NNotification{
+				&NNotification{
+					Id:         generateNewId(),
+					UserID:     userID,
+					Subject:    subject,
+					Content:    content,
+					Code:       NOTIFICATION_GROUP_ADD,
+					SenderID:   caller,
+					CreatedAt:  ts,
+					ExpiresAt:  ts + ns.expiryMs,
+					Persistent: true,
+				},
+			}); e != nil {
+				groupLogger.Warn("Failed to send group add notification", zap.Error(e))
+			}
+		}
+	}()
+
+	// Look up the user being added.
+	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1 AND disabled_at = 0", userID).Scan(&handle)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = errors.New("Could not add user to group. User does not exist")
+		}
+		return code, err
+	}
+
+	// Look up the name of the group.
+	err = tx.QueryRow("SELECT name FROM groups WHERE id = $1", groupID).Scan(&name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = errors.New("Could not add user to group. Group does not exist")
+		}
+		return code, err
+	}
+
+	params := []interface{}{groupID, ts, userID}
+	adminQuery := ""
+	// If the caller is not the script runtime, apply group admin role checks.
+	if caller != "" {
+		params = append(params, caller)
+		adminQuery = "EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1::BYTEA AND destination_id = $4 AND state = 0)\nAND\n  "
+	}
+
+	res, err := tx.Exec(`
+INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
+SELECT data.id, data.position, data.updated_at, data.destination, data.state
+FROM (
+  SELECT $1::BYTEA AS id, $2::BIGINT AS position, $2::BIGINT AS updated_at, $3::BYTEA AS destination, 1 AS state
+  UNION ALL
+  SELECT $3::BYTEA AS id, $2::BIGINT AS position, $2::BIGINT AS updated_at, $1::BYTEA AS destination, 1 AS state
+) AS data
+WHERE
+  `+adminQuery+`EXISTS (SELECT id FROM groups WHERE id = $1::BYTEA AND disabled_at = 0)
+ON CONFLICT (source_id, destination_id)
+DO UPDATE SET state = 1, updated_at = $2::BIGINT`,
+		params...)
+
+	if err != nil {
+		return code, err
+	}
+
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		return code, errors.New("Could not add user to group. Group may not exist or you may not be group admin")
+	}
+
+	_, err = tx.Exec(`UPDATE groups SET count = count + 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID)
+	if err != nil {
+		return code, err
+	}
+
+	return 0, nil
+}
+
+// GroupUserKick removes a user or their pending join request from a group. If the caller is not the script runtime they must be a group admin.
+// When called from the script runtime the group topic message is sent on behalf of the kicked user.
+func GroupUserKick(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, messageRetention *MessageRetentionService, caller string, callerHandle string, groupID string, userID string) (code Error_Code, err error) {
+	groupLogger := logger.With(zap.String("group_id", groupID), zap.String("user_id", userID))
+	code = RUNTIME_EXCEPTION
+	failureReason := "Could not kick user from group"
+
+	var handle string
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not kick user from group", zap.Error(err))
+		return code, errors.New(failureReason)
+	}
+	defer func() {
+		if err != nil {
+			if _, ok := err.(*pq.Error); ok {
+				groupLogger.Error("Could not kick user from group", zap.Error(err))
+			} else {
+				groupLogger.Warn("Could not kick user from group", zap.Error(err))
+			}
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not rollback transaction", zap.Error(e))
+			}
+			err = errors.New(failureReason)
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not commit transaction", zap.Error(e))
+				code, err = RUNTIME_EXCEPTION, errors.New(failureReason)
+				return
+			}
+
+			groupLogger.Info("Kicked user from group")
+
+			senderID, senderHandle := caller, callerHandle
+			if caller == "" {
+				senderID, senderHandle = userID, handle
+			}
+			data, _ := json.Marshal(map[string]string{"user_id": userID, "handle": handle})
+			if e := storeAndDeliverMessage(groupLogger, db, tracker, messageRouter, messageRetention, senderID, senderHandle, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 4, data); e != nil {
+				groupLogger.Error("Error handling group user kicked notification topic message", zap.Error(e))
+			}
+		}
+	}()
+
+	// Check the user's group_edge state. If it's a pending join request being rejected then no need to decrement the group count.
+	var userState int64
+	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID, userID).Scan(&userState)
+
+	params := []interface{}{groupID, userID}
+	adminQuery := ""
+	// If the caller is not the script runtime, apply group admin role checks.
+	if caller != "" {
+		params = append(params, caller)
+		adminQuery = "EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $3 AND state = 0)\nAND\n\t"
+	}
+
+	res, err := tx.Exec(`
+DELETE FROM group_edge
+WHERE
+	`+adminQuery+`EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
+AND
+	(
+		(source_id = $1 AND destination_id = $2)
+	OR
+		(source_id = $2 AND destination_id = $1)
+	)`, params...)
+
+	if err != nil {
+		return code, err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		failureReason = "Cannot kick from group - Make sure user is part of the group and is admin or group exists"
+		return code, errors.New(failureReason)
+	}
+
+	// Join requests aren't reflected in group count.
+	if userState != 2 {
+		_, err = tx.Exec(`UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID)
+		if err != nil {
+			return code, err
+		}
+	}
+
+	// Look up the user being kicked. Allow kicking disabled users.
+	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1", userID).Scan(&handle)
+	if err != nil {
+		return code, err
+	}
+
+	return 0, nil
+}
+
+// GroupUserPromote makes a group member a group admin. If the caller is not the script runtime they must be a group admin.
+// When called from the script runtime the group topic message is sent on behalf of the promoted user.
+func GroupUserPromote(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, messageRetention *MessageRetentionService, caller string, callerHandle string, groupID string, userID string) (Error_Code, error) {
+	groupLogger := logger.With(zap.String("group_id", groupID), zap.String("user_id", userID))
+
+	params := []interface{}{groupID, userID, nowMs()}
+	adminQuery := ""
+	// If the caller is not the script runtime, apply group admin role checks.
+	if caller != "" {
+		params = append(params, caller)
+		adminQuery = "EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $4 AND state = 0)\nAND\n\t"
+	}
+
+	res, err := db.Exec(`
+UPDATE group_edge SET state = 0, updated_at = $3
+WHERE
+	`+adminQuery+`EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
+AND
+	(
+		(source_id = $1 AND destination_id = $2)
+	OR
+		(source_id = $2 AND destination_id = $1)
+	)`, params...)
+
+	if err != nil {
+		groupLogger.Warn("Could not promote user", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not promote user")
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		groupLogger.Warn("Could not promote user - Make sure user is part of the group or group exists")
+		return RUNTIME_EXCEPTION, errors.New("Could not promote user - Make sure user is part of the group or group exists")
+	}
+
+	// Look up the user being promoted. Allow promoting disabled users as long as they're still part of the group.
+	var handle string
+	err = db.QueryRow("SELECT handle FROM users WHERE id = $1", userID).Scan(&handle)
+	if err != nil {
+		groupLogger.Warn("Could not look up promoted user", zap.Error(err))
+		return 0, nil
+	}
+
+	senderID, senderHandle := caller, callerHandle
+	if caller == "" {
+		senderID, senderHandle = userID, handle
+	}
+	data, _ := json.Marshal(map[string]string{"user_id": userID, "handle": handle})
+	if err = storeAndDeliverMessage(groupLogger, db, tracker, messageRouter, messageRetention, senderID, senderHandle, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 5, data); err != nil {
+		groupLogger.Error("Error handling group user promoted notification topic message", zap.Error(err))
+	}
+
+	return 0, nil
+}
@@ -488,7 +488,7 @@ func normalizeLeaderboardRecords(records []*LeaderboardRecord) []*LeaderboardRec
 	return records
 }
 
-func leaderboardSubmit(logger *zap.Logger, db *sql.DB, caller string, leaderboardID string, ownerID string, handle string, lang string, op string, value int64, location string, timezone string, metadata []byte) (*LeaderboardRecord, Error_Code, error) {
+func leaderboardSubmit(logger *zap.Logger, db queryer, caller string, leaderboardID string, ownerID string, handle string, lang string, op string, value int64, location string, timezone string, metadata []byte) (*LeaderboardRecord, Error_Code, error) {
 	var authoritative bool
 	var sortOrder int64
 	var resetSchedule sql.NullString
@@ -591,7 +591,7 @@ func leaderboardSubmit(logger *zap.Logger, db *sql.DB, caller string, leaderboar
 	return record, 0, nil
 }
 
-func leaderboardQueryRecords(logger *zap.Logger, db *sql.DB, leaderboardID string, ownerID string, handle string, lang string, expiresAt int64, updatedAt int64) (*LeaderboardRecord, error) {
+func leaderboardQueryRecords(logger *zap.Logger, db queryer, leaderboardID string, ownerID string, handle string, lang string, expiresAt int64, updatedAt int64) (*LeaderboardRecord, error) {
 	var location sql.NullString
 	var timezone sql.NullString
 	var rankValue int64
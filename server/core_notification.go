@@ -35,6 +35,7 @@ const (
 	NOTIFICATION_GROUP_ADD          int64 = 4
 	NOTIFICATION_GROUP_JOIN_REQUEST int64 = 5
 	NOTIFICATION_FRIEND_JOIN_GAME   int64 = 6
+	NOTIFICATION_DM_MESSAGE         int64 = 7
 )
 
 type notificationResumableCursor struct {
@@ -51,6 +52,7 @@ type NNotification struct {
 	SenderID   string
 	CreatedAt  int64
 	ExpiresAt  int64
+	ReadAt     int64
 	Persistent bool
 }
 
@@ -74,43 +76,120 @@ func NewNotificationService(logger *zap.Logger, db *sql.DB, tracker Tracker, mes
 
 func (n *NotificationService) NotificationSend(notifications []*NNotification) error {
 	persistentNotifications := make([]*NNotification, 0)
-	notificationsByUser := make(map[string][]*NNotification)
 	for _, n := range notifications {
 		// Select persistent notifications for storage.
 		if n.Persistent {
 			persistentNotifications = append(persistentNotifications, n)
 		}
-
-		// Split all notifications by user for grouped delivery later.
-		if ns, ok := notificationsByUser[n.UserID]; ok {
-			notificationsByUser[n.UserID] = append(ns, n)
-		} else {
-			notificationsByUser[n.UserID] = []*NNotification{n}
-		}
 	}
 
 	if len(persistentNotifications) > 0 {
-		if err := n.notificationsSave(persistentNotifications); err != nil {
+		if err := n.notificationsSave(n.db, persistentNotifications); err != nil {
 			return err
 		}
 	}
 
-	for userID, ns := range notificationsByUser {
-		presences := n.tracker.ListByTopic("notifications:" + userID)
-		if len(presences) != 0 {
-			envelope := &Envelope{
-				Payload: &Envelope_LiveNotifications{
-					LiveNotifications: convertNotifications(ns),
-				},
+	n.notificationsDeliver(notifications)
+	return nil
+}
+
+// NotificationSendGroup sends a copy of the notification to every member and admin of a group.
+// Persistent copies are saved in a single transaction, so if an error is returned no member was notified.
+func (n *NotificationService) NotificationSendGroup(groupID string, notification *NNotification) error {
+	rows, err := n.db.Query("SELECT source_id FROM group_edge WHERE destination_id = $1 AND state IN (0, 1)", groupID)
+	if err != nil {
+		n.logger.Error("Could not list group members for notification", zap.Error(err))
+		return errors.New("Could not send notifications")
+	}
+	defer rows.Close()
+
+	userIDs := make([]string, 0)
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			n.logger.Error("Could not scan group member for notification", zap.Error(err))
+			return errors.New("Could not send notifications")
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err = rows.Err(); err != nil {
+		n.logger.Error("Could not read group members for notification", zap.Error(err))
+		return errors.New("Could not send notifications")
+	}
+
+	notifications := make([]*NNotification, 0, len(userIDs))
+	for _, userID := range userIDs {
+		notifications = append(notifications, &NNotification{
+			Id:         generateNewId(),
+			UserID:     userID,
+			Subject:    notification.Subject,
+			Content:    notification.Content,
+			Code:       notification.Code,
+			SenderID:   notification.SenderID,
+			Persistent: notification.Persistent,
+		})
+	}
+
+	if notification.Persistent && len(notifications) > 0 {
+		// Save in batches to keep each insert to a reasonable size, but in a single transaction so either every member is notified or none are.
+		tx, err := n.db.Begin()
+		if err != nil {
+			n.logger.Error("Could not begin group notification transaction", zap.Error(err))
+			return errors.New("Could not send notifications")
+		}
+		batchSize := 100
+		for i := 0; i < len(notifications); i += batchSize {
+			end := i + batchSize
+			if end > len(notifications) {
+				end = len(notifications)
 			}
-			n.messageRouter.Send(n.logger, presences, envelope, true)
+			if err = n.notificationsSave(tx, notifications[i:end]); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			n.logger.Error("Could not commit group notification transaction", zap.Error(err))
+			return errors.New("Could not send notifications")
 		}
 	}
 
+	n.notificationsDeliver(notifications)
 	return nil
 }
 
-func (n *NotificationService) NotificationsList(userID string, limit int64, cursor string) ([]*NNotification, string, error) {
+// NotificationCollapse stores a persistent notification, replacing any existing notification with the same ID, and delivers it if the user is online.
+// Replaced notifications are restored if the user had removed them, and marked unread.
+func (n *NotificationService) NotificationCollapse(notification *NNotification) error {
+	createdAt := nowMs()
+	notification.CreatedAt = createdAt
+	notification.ExpiresAt = createdAt + n.expiryMs
+	notification.Persistent = true
+
+	_, err := n.db.Exec(`
+UPSERT INTO notification (id, user_id, subject, content, code, sender_id, created_at, expires_at, deleted_at, read_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 0, 0)`,
+		notification.Id, notification.UserID, notification.Subject, notification.Content, notification.Code, notification.SenderID, notification.CreatedAt, notification.ExpiresAt)
+	if err != nil {
+		n.logger.Error("Could not save collapsed notification", zap.Error(err))
+		return errors.New("Could not save notifications.")
+	}
+
+	presences := n.tracker.ListByTopic("notifications:" + notification.UserID)
+	if len(presences) != 0 {
+		envelope := &Envelope{
+			Payload: &Envelope_LiveNotifications{
+				LiveNotifications: convertNotifications([]*NNotification{notification}),
+			},
+		}
+		n.messageRouter.Send(n.logger, presences, envelope, true)
+	}
+
+	return nil
+}
+
+// NotificationsList lists a user's notifications with codes between codeMin and codeMax inclusive. A codeMax of 0 means no upper bound.
+func (n *NotificationService) NotificationsList(userID string, limit int64, cursor string, codeMin int64, codeMax int64) ([]*NNotification, string, error) {
 	expiryNow := nowMs()
 	nc := &notificationResumableCursor{}
 	if cursor != "" {
@@ -131,12 +210,18 @@ func (n *NotificationService) NotificationsList(userID string, limit int64, curs
 		nc.NotificationID = ""
 	}
 
-	rows, err := n.db.Query(`
-SELECT id, user_id, subject, content, code, sender_id, created_at, expires_at
+	query := `
+SELECT id, user_id, subject, content, code, sender_id, created_at, expires_at, read_at
 FROM notification
-WHERE user_id = $1 AND deleted_at = 0 AND (expires_at, id) > ($2, $3)
-LIMIT $4
-`, userID, nc.Expiry, nc.NotificationID, limit)
+WHERE user_id = $1 AND deleted_at = 0 AND (expires_at, id) > ($2, $3) AND code >= $5`
+	params := []interface{}{userID, nc.Expiry, nc.NotificationID, limit, codeMin}
+	if codeMax != 0 {
+		query += " AND code <= $6"
+		params = append(params, codeMax)
+	}
+	query += " LIMIT $4"
+
+	rows, err := n.db.Query(query, params...)
 
 	if err != nil {
 		n.logger.Error("Could not retrieve notifications", zap.Error(err))
@@ -146,7 +231,7 @@ LIMIT $4
 	notifications := make([]*NNotification, 0)
 	for rows.Next() {
 		no := &NNotification{Persistent: true}
-		err := rows.Scan(&no.Id, &no.UserID, &no.Subject, &no.Content, &no.Code, &no.SenderID, &no.CreatedAt, &no.ExpiresAt)
+		err := rows.Scan(&no.Id, &no.UserID, &no.Subject, &no.Content, &no.Code, &no.SenderID, &no.CreatedAt, &no.ExpiresAt, &no.ReadAt)
 		if err != nil {
 			n.logger.Error("Could not scan notification from database", zap.Error(err))
 			return nil, "", errors.New("Could not retrieve notifications")
@@ -206,7 +291,85 @@ func (n *NotificationService) NotificationsRemove(userID string, notificationIDs
 	return nil
 }
 
-func (n *NotificationService) notificationsSave(notifications []*NNotification) error {
+// NotificationsRead marks the given notifications as read. Notifications that were already read keep their original read time.
+func (n *NotificationService) NotificationsRead(userID string, notificationIDs []string) error {
+	statements := make([]string, 0)
+	params := []interface{}{
+		nowMs(),
+		userID,
+	}
+
+	for _, id := range notificationIDs {
+		statement := "$" + strconv.Itoa(len(params)+1)
+		statements = append(statements, statement)
+		params = append(params, id)
+	}
+
+	_, err := n.db.Exec("UPDATE notification SET read_at = $1 WHERE user_id = $2 AND read_at = 0 AND id IN ("+strings.Join(statements, ", ")+")", params...)
+
+	if err != nil {
+		n.logger.Error("Could not mark notifications read", zap.Error(err))
+		return errors.New("Could not mark notifications read")
+	}
+
+	return nil
+}
+
+// NotificationsReadAll marks all of a user's notifications as read.
+func (n *NotificationService) NotificationsReadAll(userID string) error {
+	_, err := n.db.Exec("UPDATE notification SET read_at = $1 WHERE user_id = $2 AND deleted_at = 0 AND read_at = 0", nowMs(), userID)
+
+	if err != nil {
+		n.logger.Error("Could not mark all notifications read", zap.Error(err))
+		return errors.New("Could not mark notifications read")
+	}
+
+	return nil
+}
+
+// NotificationsUnreadCount counts a user's unread notifications with codes between codeMin and codeMax inclusive. A codeMax of 0 means no upper bound.
+func (n *NotificationService) NotificationsUnreadCount(userID string, codeMin int64, codeMax int64) (int64, error) {
+	query := "SELECT COUNT(id) FROM notification WHERE user_id = $1 AND deleted_at = 0 AND read_at = 0 AND expires_at > $2 AND code >= $3"
+	params := []interface{}{userID, nowMs(), codeMin}
+	if codeMax != 0 {
+		query += " AND code <= $4"
+		params = append(params, codeMax)
+	}
+
+	var count int64
+	if err := n.db.QueryRow(query, params...).Scan(&count); err != nil {
+		n.logger.Error("Could not count unread notifications", zap.Error(err))
+		return 0, errors.New("Could not count unread notifications")
+	}
+
+	return count, nil
+}
+
+// notificationsDeliver sends notifications to their users' current sessions, grouped by user.
+func (n *NotificationService) notificationsDeliver(notifications []*NNotification) {
+	notificationsByUser := make(map[string][]*NNotification)
+	for _, n := range notifications {
+		if ns, ok := notificationsByUser[n.UserID]; ok {
+			notificationsByUser[n.UserID] = append(ns, n)
+		} else {
+			notificationsByUser[n.UserID] = []*NNotification{n}
+		}
+	}
+
+	for userID, ns := range notificationsByUser {
+		presences := n.tracker.ListByTopic("notifications:" + userID)
+		if len(presences) != 0 {
+			envelope := &Envelope{
+				Payload: &Envelope_LiveNotifications{
+					LiveNotifications: convertNotifications(ns),
+				},
+			}
+			n.messageRouter.Send(n.logger, presences, envelope, true)
+		}
+	}
+}
+
+func (n *NotificationService) notificationsSave(db queryer, notifications []*NNotification) error {
 	createdAt := nowMs()
 	expiresAt := createdAt + n.expiryMs
 
@@ -240,7 +403,7 @@ func (n *NotificationService) notificationsSave(notifications []*NNotification)
 	query := "INSERT INTO notification (id, user_id, subject, content, code, sender_id, created_at, expires_at) VALUES " + strings.Join(statements, ", ")
 	n.logger.Debug("notification save query", zap.String("query", query))
 
-	_, err := n.db.Exec(query, params...)
+	_, err := db.Exec(query, params...)
 	if err != nil {
 		n.logger.Error("Could not save notifications", zap.Error(err))
 		return errors.New("Could not save notifications.")
@@ -259,6 +422,7 @@ func convertTNotifications(nots []*NNotification, cursor string) *TNotifications
 			SenderId:  not.SenderID,
 			CreatedAt: not.CreatedAt,
 			ExpiresAt: not.ExpiresAt,
+			ReadAt:    not.ReadAt,
 		}
 		notifications.Notifications = append(notifications.Notifications, n)
 	}
@@ -276,6 +440,7 @@ func convertNotifications(nots []*NNotification) *Notifications {
 			SenderId:  not.SenderID,
 			CreatedAt: not.CreatedAt,
 			ExpiresAt: not.ExpiresAt,
+			ReadAt:    not.ReadAt,
 		}
 		notifications.Notifications = append(notifications.Notifications, n)
 	}
@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 
 	"encoding/gob"
 	"nakama/pkg/jsonpatch"
@@ -29,6 +30,12 @@ import (
 	"go.uber.org/zap"
 )
 
+// queryer runs queries either directly against the database or within a transaction.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type storageListCursor struct {
 	Bucket     string
 	Collection string
@@ -37,6 +44,43 @@ type storageListCursor struct {
 	Read       int64
 }
 
+type storageListSortCursor struct {
+	Sort       string
+	Descending bool
+	// Previous is set on cursors that page back towards the start of the list.
+	Previous   bool
+	Timestamp  int64
+	UserID     string
+	Bucket     string
+	Collection string
+	Record     string
+}
+
+type storageQueryCursor struct {
+	SortIndex   string
+	Descending  bool
+	StringValue string
+	NumberValue float64
+	UserID      string
+	Record      string
+}
+
+const (
+	STORAGE_LIST_SORT_CREATED_AT = "created_at"
+	STORAGE_LIST_SORT_UPDATED_AT = "updated_at"
+)
+
+// StorageListOptions orders a storage list by record timestamps instead of by key.
+type StorageListOptions struct {
+	// Sort is STORAGE_LIST_SORT_CREATED_AT or STORAGE_LIST_SORT_UPDATED_AT.
+	Sort           string
+	SortDescending bool
+	// StartTime and EndTime limit the list to records whose sort timestamp is at or after the start, and before the end.
+	// Both are in milliseconds, and 0 leaves that end of the range open.
+	StartTime int64
+	EndTime   int64
+}
+
 type StorageKey struct {
 	Bucket     string
 	Collection string
@@ -55,34 +99,102 @@ type StorageData struct {
 	Version         string
 	PermissionRead  int64
 	PermissionWrite int64
+	GroupId         string // this must be GroupId not GroupID
 	CreatedAt       int64
 	UpdatedAt       int64
 	ExpiresAt       int64
 }
 
+// storageQueryFilterOps maps filter ops to their SQL comparison operators, which are also the op names in the runtime.
+var storageQueryFilterOps = map[TStorageQuery_Filter_FilterOp]string{
+	EQUAL:                 "=",
+	LESS_THAN:             "<",
+	LESS_THAN_OR_EQUAL:    "<=",
+	GREATER_THAN:          ">",
+	GREATER_THAN_OR_EQUAL: ">=",
+}
+
+// StorageQueryFilter compares an indexed value field to a string or number, depending on the index type.
+type StorageQueryFilter struct {
+	Index string
+	// Op is one of the TStorageQuery_Filter_FilterOp values.
+	Op int64
+	// Type is STORAGE_INDEX_STRING or STORAGE_INDEX_NUMBER, and must match the index type.
+	Type        string
+	StringValue string
+	NumberValue float64
+}
+
 type StorageKeyUpdate struct {
 	Key             *StorageKey
 	PermissionRead  int64
 	PermissionWrite int64
+	GroupId         string // this must be GroupId not GroupID
 	Patch           jsonpatch.ExtendedPatch
 }
 
-func StorageList(logger *zap.Logger, db *sql.DB, caller string, userID string, bucket string, collection string, limit int64, cursor string) ([]*StorageData, string, Error_Code, error) {
+// storageReadClause matches records a client can read, where the numbered query parameter is the client's user ID.
+// Read permission 2 is public, 1 is the owner only, 3 adds the owner's friends, and 4 adds members of the record's group.
+func storageReadClause(alias string, param int) string {
+	return fmt.Sprintf("(%[1]vread = 2 OR (%[1]vread IN (1, 3, 4) AND %[1]vuser_id = $%[2]v)"+
+		" OR (%[1]vread = 3 AND %[1]vuser_id IN (SELECT destination_id FROM user_edge WHERE source_id = $%[2]v AND state = 0))"+
+		" OR (%[1]vread = 4 AND %[1]vgroup_id IN (SELECT destination_id FROM group_edge WHERE source_id = $%[2]v AND state IN (0, 1))))", alias, param)
+}
+
+// storageValidatePermissions checks read and write permission values, and that group permissions name a group.
+// Write permission 0 is no client writes, 1 is the owner only, and 2 adds members of the record's group.
+func storageValidatePermissions(read int64, write int64, groupID string) error {
+	if read < 0 || read > 4 {
+		return errors.New("Invalid read permission value")
+	}
+	if write < 0 || write > 2 {
+		return errors.New("Invalid write permission value")
+	}
+	if (read == 4 || write == 2) && groupID == "" {
+		return errors.New("A group ID is required for group permissions")
+	}
+	return nil
+}
+
+// StorageList lists records by key, or by timestamp if options set a sort order.
+// It returns the cursor to the next page, and when sorted by timestamp, the cursor to the previous page.
+func StorageList(logger *zap.Logger, db *sql.DB, caller string, userID string, bucket string, collection string, limit int64, cursor string, options *StorageListOptions) ([]*StorageData, string, string, Error_Code, error) {
 	// We list by at least User ID, or bucket as a list criteria.
 	if userID == "" && bucket == "" {
-		return nil, "", BAD_INPUT, errors.New("Either a User ID or a bucket is required as an initial list criteria")
+		return nil, "", "", BAD_INPUT, errors.New("Either a User ID or a bucket is required as an initial list criteria")
 	}
 	if bucket == "" && collection != "" {
-		return nil, "", BAD_INPUT, errors.New("Cannot list by collection without listing by bucket first")
+		return nil, "", "", BAD_INPUT, errors.New("Cannot list by collection without listing by bucket first")
 	}
 
 	// Validate the limit.
 	if limit == 0 {
 		limit = 10
 	} else if limit < 10 || limit > 100 {
-		return nil, "", BAD_INPUT, errors.New("Limit must be between 10 and 100")
+		return nil, "", "", BAD_INPUT, errors.New("Limit must be between 10 and 100")
 	}
 
+	if options != nil {
+		switch options.Sort {
+		case STORAGE_LIST_SORT_CREATED_AT, STORAGE_LIST_SORT_UPDATED_AT:
+			if options.StartTime < 0 || options.EndTime < 0 || (options.EndTime != 0 && options.StartTime >= options.EndTime) {
+				return nil, "", "", BAD_INPUT, errors.New("Invalid time range")
+			}
+			return storageListSorted(logger, db, caller, userID, bucket, collection, limit, cursor, options)
+		case "":
+			if options.SortDescending || options.StartTime != 0 || options.EndTime != 0 {
+				return nil, "", "", BAD_INPUT, errors.New("A sort order is required to sort descending or filter by time")
+			}
+		default:
+			return nil, "", "", BAD_INPUT, fmt.Errorf("Invalid sort order %v", options.Sort)
+		}
+	}
+
+	data, nextCursor, code, err := storageListByKey(logger, db, caller, userID, bucket, collection, limit, cursor)
+	return data, nextCursor, "", code, err
+}
+
+func storageListByKey(logger *zap.Logger, db *sql.DB, caller string, userID string, bucket string, collection string, limit int64, cursor string) ([]*StorageData, string, Error_Code, error) {
 	// Process the incoming cursor if one is provided.
 	var incomingCursor *storageListCursor
 	if len(cursor) != 0 {
@@ -97,7 +209,7 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller string, userID string, b
 	}
 
 	// Set up the query.
-	query := "SELECT user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at FROM storage"
+	query := "SELECT user_id, bucket, collection, record, value, version, read, write, group_id, created_at, updated_at, expires_at FROM storage"
 	params := make([]interface{}, 0)
 
 	// If cursor is present, give keyset clause priority over other parameters.
@@ -153,7 +265,9 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller string, userID string, b
 		// If listing by user first, and the caller is the user listing their own data.
 		query += " AND read >= 1"
 	} else {
-		query += " AND read >= 2"
+		// Other records are visible if public, or shared with the caller as a friend or group member.
+		params = append(params, caller)
+		query += " AND " + storageReadClause("", len(params))
 	}
 
 	params = append(params, limit+1)
@@ -179,6 +293,7 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller string, userID string, b
 	var dataVersion sql.NullString
 	var dataRead sql.NullInt64
 	var dataWrite sql.NullInt64
+	var dataGroupID sql.NullString
 	var dataCreatedAt sql.NullInt64
 	var dataUpdatedAt sql.NullInt64
 	var dataExpiresAt sql.NullInt64
@@ -201,11 +316,16 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller string, userID string, b
 		}
 
 		err := rows.Scan(&dataUserID, &dataBucket, &dataCollection, &dataRecord, &dataValue, &dataVersion,
-			&dataRead, &dataWrite, &dataCreatedAt, &dataUpdatedAt, &dataExpiresAt)
+			&dataRead, &dataWrite, &dataGroupID, &dataCreatedAt, &dataUpdatedAt, &dataExpiresAt)
 		if err != nil {
 			logger.Error("Could not execute storage list query", zap.Error(err))
 			return nil, "", RUNTIME_EXCEPTION, err
 		}
+		dataValue, err = storageDecodeValue(dataValue)
+		if err != nil {
+			logger.Error("Could not decode storage list value", zap.Error(err))
+			return nil, "", RUNTIME_EXCEPTION, err
+		}
 
 		// Accumulate the response.
 		storageData = append(storageData, &StorageData{
@@ -217,6 +337,7 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller string, userID string, b
 			Version:         dataVersion.String,
 			PermissionRead:  dataRead.Int64,
 			PermissionWrite: dataWrite.Int64,
+			GroupId:         dataGroupID.String,
 			CreatedAt:       dataCreatedAt.Int64,
 			UpdatedAt:       dataUpdatedAt.Int64,
 			ExpiresAt:       dataExpiresAt.Int64,
@@ -230,6 +351,455 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller string, userID string, b
 	return storageData, outgoingCursor, 0, nil
 }
 
+// storageListSorted lists records ordered by a timestamp, then by key so records with the same timestamp page consistently.
+func storageListSorted(logger *zap.Logger, db *sql.DB, caller string, userID string, bucket string, collection string, limit int64, cursor string, options *StorageListOptions) ([]*StorageData, string, string, Error_Code, error) {
+	// Process the incoming cursor if one is provided.
+	var incomingCursor *storageListSortCursor
+	if len(cursor) != 0 {
+		if cb, err := base64.StdEncoding.DecodeString(cursor); err != nil {
+			return nil, "", "", BAD_INPUT, errors.New("Invalid cursor data")
+		} else {
+			incomingCursor = &storageListSortCursor{}
+			if err := gob.NewDecoder(bytes.NewReader(cb)).Decode(incomingCursor); err != nil {
+				return nil, "", "", BAD_INPUT, errors.New("Invalid cursor data")
+			}
+		}
+		if incomingCursor.Sort != options.Sort || incomingCursor.Descending != options.SortDescending {
+			return nil, "", "", BAD_INPUT, errors.New("Cursor does not match the list sort order")
+		}
+	}
+
+	// The sort column is one of the known timestamp columns, so it's safe to use in the query.
+	sortColumn := options.Sort
+	query := "SELECT user_id, bucket, collection, record, value, version, read, write, group_id, created_at, updated_at, expires_at FROM storage WHERE deleted_at = 0"
+	params := make([]interface{}, 0)
+
+	if userID != "" {
+		params = append(params, userID)
+		query += fmt.Sprintf(" AND user_id = $%v", len(params))
+	}
+	if bucket != "" {
+		params = append(params, bucket)
+		query += fmt.Sprintf(" AND bucket = $%v", len(params))
+	}
+	if collection != "" {
+		params = append(params, collection)
+		query += fmt.Sprintf(" AND collection = $%v", len(params))
+	}
+	if options.StartTime != 0 {
+		params = append(params, options.StartTime)
+		query += fmt.Sprintf(" AND %v >= $%v", sortColumn, len(params))
+	}
+	if options.EndTime != 0 {
+		params = append(params, options.EndTime)
+		query += fmt.Sprintf(" AND %v < $%v", sortColumn, len(params))
+	}
+
+	// Apply the same read permission rules as listing by key.
+	if caller == "" {
+		query += " AND read >= 0"
+	} else if userID != "" && caller == userID {
+		query += " AND read >= 1"
+	} else {
+		params = append(params, caller)
+		query += " AND " + storageReadClause("", len(params))
+	}
+
+	// A previous page cursor walks the list in the opposite direction, and the page is reversed once read.
+	previous := incomingCursor != nil && incomingCursor.Previous
+	descending := options.SortDescending != previous
+	direction := "ASC"
+	op := ">"
+	if descending {
+		direction = "DESC"
+		op = "<"
+	}
+
+	if incomingCursor != nil {
+		l := len(params)
+		query += fmt.Sprintf(" AND (%v, user_id, bucket, collection, record) %v ($%v, $%v, $%v, $%v, $%v)", sortColumn, op, l+1, l+2, l+3, l+4, l+5)
+		params = append(params, incomingCursor.Timestamp, incomingCursor.UserID, incomingCursor.Bucket, incomingCursor.Collection, incomingCursor.Record)
+	}
+
+	query += fmt.Sprintf(" ORDER BY %v %v, user_id %v, bucket %v, collection %v, record %v", sortColumn, direction, direction, direction, direction, direction)
+
+	params = append(params, limit+1)
+	query += fmt.Sprintf(" LIMIT $%v", len(params))
+
+	// Execute the query.
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Error in storage list", zap.Error(err))
+		return nil, "", "", RUNTIME_EXCEPTION, errors.New("Error listing storage data")
+	}
+	defer rows.Close()
+
+	storageData := make([]*StorageData, 0)
+
+	// Parse the results.
+	var dataUserID sql.NullString
+	var dataBucket sql.NullString
+	var dataCollection sql.NullString
+	var dataRecord sql.NullString
+	var dataValue []byte
+	var dataVersion sql.NullString
+	var dataRead sql.NullInt64
+	var dataWrite sql.NullInt64
+	var dataGroupID sql.NullString
+	var dataCreatedAt sql.NullInt64
+	var dataUpdatedAt sql.NullInt64
+	var dataExpiresAt sql.NullInt64
+	for rows.Next() {
+		err := rows.Scan(&dataUserID, &dataBucket, &dataCollection, &dataRecord, &dataValue, &dataVersion,
+			&dataRead, &dataWrite, &dataGroupID, &dataCreatedAt, &dataUpdatedAt, &dataExpiresAt)
+		if err != nil {
+			logger.Error("Could not execute storage list query", zap.Error(err))
+			return nil, "", "", RUNTIME_EXCEPTION, errors.New("Error listing storage data")
+		}
+		dataValue, err = storageDecodeValue(dataValue)
+		if err != nil {
+			logger.Error("Could not decode storage list value", zap.Error(err))
+			return nil, "", "", RUNTIME_EXCEPTION, errors.New("Error listing storage data")
+		}
+
+		storageData = append(storageData, &StorageData{
+			Bucket:          dataBucket.String,
+			Collection:      dataCollection.String,
+			Record:          dataRecord.String,
+			UserId:          dataUserID.String,
+			Value:           dataValue,
+			Version:         dataVersion.String,
+			PermissionRead:  dataRead.Int64,
+			PermissionWrite: dataWrite.Int64,
+			GroupId:         dataGroupID.String,
+			CreatedAt:       dataCreatedAt.Int64,
+			UpdatedAt:       dataUpdatedAt.Int64,
+			ExpiresAt:       dataExpiresAt.Int64,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not execute storage list query", zap.Error(err))
+		return nil, "", "", RUNTIME_EXCEPTION, errors.New("Error listing storage data")
+	}
+
+	// The extra record only shows there is another page in the direction the list was read.
+	more := int64(len(storageData)) > limit
+	if more {
+		storageData = storageData[:limit]
+	}
+	if previous {
+		for i, j := 0, len(storageData)-1; i < j; i, j = i+1, j-1 {
+			storageData[i], storageData[j] = storageData[j], storageData[i]
+		}
+	}
+	if len(storageData) == 0 {
+		return storageData, "", "", 0, nil
+	}
+
+	// Reading forward from a cursor means there are records before this page, reading back from one means there are records after it.
+	var nextCursor, previousCursor string
+	if more || previous {
+		if nextCursor, err = storageListSortEncodeCursor(options, false, storageData[len(storageData)-1]); err != nil {
+			logger.Error("Error creating storage list cursor", zap.Error(err))
+			return nil, "", "", RUNTIME_EXCEPTION, errors.New("Error listing storage data")
+		}
+	}
+	if (previous && more) || (!previous && incomingCursor != nil) {
+		if previousCursor, err = storageListSortEncodeCursor(options, true, storageData[0]); err != nil {
+			logger.Error("Error creating storage list cursor", zap.Error(err))
+			return nil, "", "", RUNTIME_EXCEPTION, errors.New("Error listing storage data")
+		}
+	}
+
+	return storageData, nextCursor, previousCursor, 0, nil
+}
+
+func storageListSortEncodeCursor(options *StorageListOptions, previous bool, d *StorageData) (string, error) {
+	timestamp := d.CreatedAt
+	if options.Sort == STORAGE_LIST_SORT_UPDATED_AT {
+		timestamp = d.UpdatedAt
+	}
+
+	cursorBuf := new(bytes.Buffer)
+	newCursor := &storageListSortCursor{
+		Sort:       options.Sort,
+		Descending: options.SortDescending,
+		Previous:   previous,
+		Timestamp:  timestamp,
+		UserID:     d.UserId,
+		Bucket:     d.Bucket,
+		Collection: d.Collection,
+		Record:     d.Record,
+	}
+	if err := gob.NewEncoder(cursorBuf).Encode(newCursor); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(cursorBuf.Bytes()), nil
+}
+
+// StorageQuery lists records in a collection whose indexed value fields match all of the filters, optionally sorted by an indexed field.
+// Records without a value for the sort index are not returned when sorting by index.
+func StorageQuery(logger *zap.Logger, db *sql.DB, storage *StorageService, caller string, userID string, bucket string, collection string, filters []*StorageQueryFilter, sortIndex string, sortDescending bool, limit int64, cursor string) ([]*StorageData, string, Error_Code, error) {
+	if bucket == "" || collection == "" {
+		return nil, "", BAD_INPUT, errors.New("Bucket and collection are required")
+	}
+
+	// Validate the limit.
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, "", BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	// Process the incoming cursor if one is provided.
+	var incomingCursor *storageQueryCursor
+	if len(cursor) != 0 {
+		if cb, err := base64.StdEncoding.DecodeString(cursor); err != nil {
+			return nil, "", BAD_INPUT, errors.New("Invalid cursor data")
+		} else {
+			incomingCursor = &storageQueryCursor{}
+			if err := gob.NewDecoder(bytes.NewReader(cb)).Decode(incomingCursor); err != nil {
+				return nil, "", BAD_INPUT, errors.New("Invalid cursor data")
+			}
+		}
+		if incomingCursor.SortIndex != sortIndex || incomingCursor.Descending != sortDescending {
+			return nil, "", BAD_INPUT, errors.New("Cursor does not match the query sort order")
+		}
+	}
+
+	query := "SELECT s.user_id, s.bucket, s.collection, s.record, s.value, s.version, s.read, s.write, s.group_id, s.created_at, s.updated_at, s.expires_at"
+	joins := ""
+	params := []interface{}{bucket, collection}
+
+	// Join the sort index first, so its value can be selected for the cursor.
+	var sortColumn string
+	if sortIndex != "" {
+		index := storage.Indexes().Index(bucket, collection, sortIndex)
+		if index == nil {
+			return nil, "", BAD_INPUT, fmt.Errorf("Unknown sort index %v", sortIndex)
+		}
+		sortColumn = "o.value_" + index.Type
+		query += ", " + sortColumn
+		params = append(params, sortIndex)
+		joins += fmt.Sprintf(" JOIN storage_index o ON o.bucket = s.bucket AND o.collection = s.collection AND o.user_id = s.user_id AND o.record = s.record AND o.name = $%v", len(params))
+	}
+
+	for i, filter := range filters {
+		index := storage.Indexes().Index(bucket, collection, filter.Index)
+		if index == nil {
+			return nil, "", BAD_INPUT, fmt.Errorf("Unknown filter index %v", filter.Index)
+		}
+		if filter.Type != index.Type {
+			return nil, "", BAD_INPUT, fmt.Errorf("Filter value for index %v must be a %v", filter.Index, index.Type)
+		}
+
+		op, ok := storageQueryFilterOps[TStorageQuery_Filter_FilterOp(filter.Op)]
+		if !ok {
+			return nil, "", BAD_INPUT, fmt.Errorf("Invalid filter op %v", filter.Op)
+		}
+
+		alias := fmt.Sprintf("f%v", i)
+		params = append(params, filter.Index)
+		joins += fmt.Sprintf(" JOIN storage_index %v ON %v.bucket = s.bucket AND %v.collection = s.collection AND %v.user_id = s.user_id AND %v.record = s.record AND %v.name = $%v", alias, alias, alias, alias, alias, alias, len(params))
+		if index.Type == STORAGE_INDEX_STRING {
+			params = append(params, filter.StringValue)
+		} else {
+			params = append(params, filter.NumberValue)
+		}
+		joins += fmt.Sprintf(" AND %v.value_%v %v $%v", alias, index.Type, op, len(params))
+	}
+
+	query += " FROM storage s" + joins + " WHERE s.bucket = $1 AND s.collection = $2 AND s.deleted_at = 0"
+
+	if userID != "" {
+		params = append(params, userID)
+		query += fmt.Sprintf(" AND s.user_id = $%v", len(params))
+	}
+
+	// Apply the same read permission rules as storage list.
+	if caller == "" {
+		// Script runtime can list all data regardless of read permission.
+		query += " AND s.read >= 0"
+	} else if userID != "" && caller == userID {
+		// If querying a single user's data, and the caller is that user.
+		query += " AND s.read >= 1"
+	} else {
+		params = append(params, caller)
+		query += " AND " + storageReadClause("s.", len(params))
+	}
+
+	direction := "ASC"
+	op := ">"
+	if sortDescending {
+		direction = "DESC"
+		op = "<"
+	}
+
+	if incomingCursor != nil {
+		if sortColumn != "" {
+			var cursorValue interface{} = incomingCursor.StringValue
+			if strings.HasSuffix(sortColumn, STORAGE_INDEX_NUMBER) {
+				cursorValue = incomingCursor.NumberValue
+			}
+			l := len(params)
+			query += fmt.Sprintf(" AND (%v, s.user_id, s.record) %v ($%v, $%v, $%v)", sortColumn, op, l+1, l+2, l+3)
+			params = append(params, cursorValue, incomingCursor.UserID, incomingCursor.Record)
+		} else {
+			l := len(params)
+			query += fmt.Sprintf(" AND (s.user_id, s.record) %v ($%v, $%v)", op, l+1, l+2)
+			params = append(params, incomingCursor.UserID, incomingCursor.Record)
+		}
+	}
+
+	if sortColumn != "" {
+		query += fmt.Sprintf(" ORDER BY %v %v, s.user_id %v, s.record %v", sortColumn, direction, direction, direction)
+	} else {
+		query += fmt.Sprintf(" ORDER BY s.user_id %v, s.record %v", direction, direction)
+	}
+
+	params = append(params, limit+1)
+	query += fmt.Sprintf(" LIMIT $%v", len(params))
+
+	// Execute the query.
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Error in storage query", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Error querying storage data")
+	}
+	defer rows.Close()
+
+	storageData := make([]*StorageData, 0)
+	var outgoingCursor string
+
+	// Parse the results.
+	var dataUserID sql.NullString
+	var dataBucket sql.NullString
+	var dataCollection sql.NullString
+	var dataRecord sql.NullString
+	var dataValue []byte
+	var dataVersion sql.NullString
+	var dataRead sql.NullInt64
+	var dataWrite sql.NullInt64
+	var dataGroupID sql.NullString
+	var dataCreatedAt sql.NullInt64
+	var dataUpdatedAt sql.NullInt64
+	var dataExpiresAt sql.NullInt64
+	var dataSortString sql.NullString
+	var dataSortNumber sql.NullFloat64
+	for rows.Next() {
+		if int64(len(storageData)) >= limit {
+			cursorBuf := new(bytes.Buffer)
+			newCursor := &storageQueryCursor{
+				SortIndex:   sortIndex,
+				Descending:  sortDescending,
+				StringValue: dataSortString.String,
+				NumberValue: dataSortNumber.Float64,
+				UserID:      dataUserID.String,
+				Record:      dataRecord.String,
+			}
+			if err = gob.NewEncoder(cursorBuf).Encode(newCursor); err != nil {
+				logger.Error("Error creating storage query cursor", zap.Error(err))
+				return nil, "", RUNTIME_EXCEPTION, errors.New("Error querying storage data")
+			}
+			outgoingCursor = base64.StdEncoding.EncodeToString(cursorBuf.Bytes())
+			break
+		}
+
+		dest := []interface{}{&dataUserID, &dataBucket, &dataCollection, &dataRecord, &dataValue, &dataVersion,
+			&dataRead, &dataWrite, &dataGroupID, &dataCreatedAt, &dataUpdatedAt, &dataExpiresAt}
+		if strings.HasSuffix(sortColumn, STORAGE_INDEX_STRING) {
+			dest = append(dest, &dataSortString)
+		} else if strings.HasSuffix(sortColumn, STORAGE_INDEX_NUMBER) {
+			dest = append(dest, &dataSortNumber)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			logger.Error("Could not execute storage query", zap.Error(err))
+			return nil, "", RUNTIME_EXCEPTION, errors.New("Error querying storage data")
+		}
+		if dataValue, err = storageDecodeValue(dataValue); err != nil {
+			logger.Error("Could not decode storage query value", zap.Error(err))
+			return nil, "", RUNTIME_EXCEPTION, errors.New("Error querying storage data")
+		}
+
+		// Accumulate the response.
+		storageData = append(storageData, &StorageData{
+			Bucket:          dataBucket.String,
+			Collection:      dataCollection.String,
+			Record:          dataRecord.String,
+			UserId:          dataUserID.String,
+			Value:           dataValue,
+			Version:         dataVersion.String,
+			PermissionRead:  dataRead.Int64,
+			PermissionWrite: dataWrite.Int64,
+			GroupId:         dataGroupID.String,
+			CreatedAt:       dataCreatedAt.Int64,
+			UpdatedAt:       dataUpdatedAt.Int64,
+			ExpiresAt:       dataExpiresAt.Int64,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not execute storage query", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Error querying storage data")
+	}
+
+	return storageData, outgoingCursor, 0, nil
+}
+
+// StorageSubscribe tracks a session's subscriptions to storage changes, up to maxSubscriptions per session.
+// Subscriptions to another user's records require the user to exist, and subscriptions to a single record require the caller to be able to read it.
+func StorageSubscribe(logger *zap.Logger, db *sql.DB, tracker Tracker, maxSubscriptions int, sessionID string, caller string, meta PresenceMeta, subscriptions []*TStorageSubscribe_Subscription) (Error_Code, error) {
+	topics, errMessage := storageSubscriptionTopics(subscriptions)
+	if errMessage != "" {
+		return BAD_INPUT, errors.New(errMessage)
+	}
+
+	for _, s := range subscriptions {
+		switch {
+		case s.UserId != "" && s.UserId == caller:
+			// Users can always subscribe to their own records.
+		case s.Record != "":
+			// A record the caller cannot read is reported the same as one that does not exist.
+			data, code, err := StorageFetch(logger, db, caller, []*StorageKey{&StorageKey{Bucket: s.Bucket, Collection: s.Collection, Record: s.Record, UserId: s.UserId}})
+			if err != nil {
+				return code, err
+			} else if len(data) == 0 {
+				return BAD_INPUT, errors.New("Storage record not found")
+			}
+		case s.UserId != "":
+			var exists bool
+			if err := db.QueryRow("SELECT EXISTS (SELECT id FROM users WHERE id = $1)", s.UserId).Scan(&exists); err != nil {
+				logger.Error("Could not check user exists for storage subscription", zap.Error(err))
+				return RUNTIME_EXCEPTION, errors.New("Could not subscribe to storage")
+			} else if !exists {
+				return BAD_INPUT, errors.New("User not found")
+			}
+		}
+	}
+
+	// Count the session's existing subscriptions, and the new ones that are not already tracked.
+	count := 0
+	for _, p := range tracker.ListLocalBySession(sessionID) {
+		if strings.HasPrefix(p.Topic, "storage:") {
+			count++
+		}
+	}
+	added := make(map[string]struct{})
+	for _, topic := range topics {
+		if _, ok := added[topic]; !ok && !tracker.CheckLocalByIDTopicUser(sessionID, topic, caller) {
+			added[topic] = struct{}{}
+			count++
+		}
+	}
+	if count > maxSubscriptions {
+		return BAD_INPUT, fmt.Errorf("Too many storage subscriptions, the limit is %v", maxSubscriptions)
+	}
+
+	for _, topic := range topics {
+		tracker.Track(sessionID, topic, caller, meta)
+	}
+	return 0, nil
+}
+
 func StorageFetch(logger *zap.Logger, db *sql.DB, caller string, keys []*StorageKey) ([]*StorageData, Error_Code, error) {
 	// Ensure there is at least one key requested.
 	if len(keys) == 0 {
@@ -237,7 +807,7 @@ func StorageFetch(logger *zap.Logger, db *sql.DB, caller string, keys []*Storage
 	}
 
 	query := `
-SELECT user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at
+SELECT user_id, bucket, collection, record, value, version, read, write, group_id, created_at, updated_at, expires_at
 FROM storage
 WHERE `
 	params := make([]interface{}, 0)
@@ -256,8 +826,8 @@ WHERE `
 		query += fmt.Sprintf("(bucket = $%v AND collection = $%v AND user_id = $%v AND record = $%v AND deleted_at = 0", l+1, l+2, l+3, l+4)
 		params = append(params, key.Bucket, key.Collection, key.UserId, key.Record)
 		if caller != "" {
-			query += fmt.Sprintf(" AND (read = 2 OR (read = 1 AND user_id = $%v))", len(params)+1)
 			params = append(params, caller)
+			query += " AND " + storageReadClause("", len(params))
 		}
 		query += ")"
 	}
@@ -282,16 +852,22 @@ WHERE `
 		var version sql.NullString
 		var read sql.NullInt64
 		var write sql.NullInt64
+		var groupID sql.NullString
 		var createdAt sql.NullInt64
 		var updatedAt sql.NullInt64
 		var expiresAt sql.NullInt64
 
 		err := rows.Scan(&userID, &bucket, &collection, &record, &value, &version,
-			&read, &write, &createdAt, &updatedAt, &expiresAt)
+			&read, &write, &groupID, &createdAt, &updatedAt, &expiresAt)
 		if err != nil {
 			logger.Error("Could not execute storage fetch query", zap.Error(err))
 			return nil, RUNTIME_EXCEPTION, err
 		}
+		value, err = storageDecodeValue(value)
+		if err != nil {
+			logger.Error("Could not decode storage fetch value", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, err
+		}
 
 		// Accumulate the response.
 		storageData = append(storageData, &StorageData{
@@ -303,6 +879,7 @@ WHERE `
 			Version:         version.String,
 			PermissionRead:  read.Int64,
 			PermissionWrite: write.Int64,
+			GroupId:         groupID.String,
 			CreatedAt:       createdAt.Int64,
 			UpdatedAt:       updatedAt.Int64,
 			ExpiresAt:       expiresAt.Int64,
@@ -316,68 +893,107 @@ WHERE `
 	return storageData, 0, nil
 }
 
-func StorageWrite(logger *zap.Logger, db *sql.DB, caller string, data []*StorageData) ([]*StorageKey, Error_Code, error) {
+func StorageWrite(logger *zap.Logger, db *sql.DB, storage *StorageService, caller string, data []*StorageData) ([]*StorageKey, Error_Code, error) {
+	// Start a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not write storage, transaction error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+	}
+
+	keys, changes, code, err := storageWrite(logger, tx, storage, caller, data, nowMs())
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not write storage, rollback error", zap.Error(e))
+		}
+		return nil, code, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("Could not write storage, commit error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+	}
+
+	storage.notify(changes)
+
+	return keys, 0, nil
+}
+
+// storageWrite executes storage writes in the given transaction, which the caller must roll back on error.
+func storageWrite(logger *zap.Logger, tx *sql.Tx, storage *StorageService, caller string, data []*StorageData, ts int64) ([]*StorageKey, []*storageChange, Error_Code, error) {
 	// Ensure there is at least one value requested.
 	if len(data) == 0 {
-		return nil, BAD_INPUT, errors.New("At least one write value is required")
+		return nil, nil, BAD_INPUT, errors.New("At least one write value is required")
 	}
 
 	// Validate all input before starting DB operations.
 	for _, d := range data {
 		// Check the storage identifiers.
 		if d.Bucket == "" || d.Collection == "" || d.Record == "" {
-			return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+			return nil, nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
 		}
 
-		// Check the read permission value.
-		if d.PermissionRead != 0 && d.PermissionRead != 1 && d.PermissionRead != 2 {
-			return nil, BAD_INPUT, errors.New("Invalid read permission value")
-		}
-
-		// Check the write permission value.
-		if d.PermissionWrite != 0 && d.PermissionWrite != 1 {
-			return nil, BAD_INPUT, errors.New("Invalid write permission value")
+		// Check the permission values.
+		if err := storageValidatePermissions(d.PermissionRead, d.PermissionWrite, d.GroupId); err != nil {
+			return nil, nil, BAD_INPUT, err
 		}
 
 		if d.UserId != "" {
 			if caller != "" && caller != d.UserId {
 				// If the caller is a client, only allow them to write their own data.
-				return nil, BAD_INPUT, errors.New("A client can only write their own records")
+				return nil, nil, BAD_INPUT, errors.New("A client can only write their own records")
 			}
 		} else if caller != "" {
 			// If the caller is a client, do not allow them to write global data.
-			return nil, BAD_INPUT, errors.New("A client cannot write global records")
+			return nil, nil, BAD_INPUT, errors.New("A client cannot write global records")
 		}
 
 		// Make this `var js interface{}` if we want to allow top-level JSON arrays.
 		var maybeJSON map[string]interface{}
 		if json.Unmarshal(d.Value, &maybeJSON) != nil {
-			return nil, BAD_INPUT, errors.New("All values must be valid JSON objects")
+			return nil, nil, BAD_INPUT, errors.New("All values must be valid JSON objects")
+		}
+
+		if len(d.Value) > storage.Config().MaxValueSizeBytes {
+			return nil, nil, BAD_INPUT, fmt.Errorf("Values must be at most %v bytes", storage.Config().MaxValueSizeBytes)
+		}
+
+		if err := storage.Schemas().validate(d.Bucket, d.Collection, d.Value); err != nil {
+			return nil, nil, STORAGE_SCHEMA_VIOLATION, fmt.Errorf("Value does not match the collection schema: %v", err.Error())
 		}
 	}
 
 	// Prepare response structure, expect to return as many keys as we're writing.
 	keys := make([]*StorageKey, len(data))
-
-	// Use same timestamp for all operations in this batch.
-	ts := nowMs()
-
-	// Start a transaction.
-	tx, err := db.Begin()
-	if err != nil {
-		logger.Error("Could not write storage, transaction error", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
-	}
+	changes := make([]*storageChange, len(data))
 
 	// Execute each storage write.
 	for i, d := range data {
+		// If the caller is a client, only allow them to share records with groups they belong to.
+		if caller != "" && d.GroupId != "" {
+			member, err := isGroupMember(tx, caller, d.GroupId)
+			if err != nil {
+				logger.Error("Could not write storage, group member error", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+			}
+			if !member {
+				return nil, nil, BAD_INPUT, errors.New("A client can only share records with groups they are a member of")
+			}
+		}
+
 		id := generateNewId()
 		version := fmt.Sprintf("%x", sha256.Sum256(d.Value))
+		storedValue, err := storage.encodeValue(d.Value)
+		if err != nil {
+			logger.Error("Could not write storage, value encode error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+		}
 
 		query := `
-INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, deleted_at)
-SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $10, $10, 0`
-		params := []interface{}{id, d.UserId, d.Bucket, d.Collection, d.Record, d.Value, version, d.PermissionRead, d.PermissionWrite, ts}
+INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, group_id, created_at, updated_at, deleted_at)
+SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $11, $10, $10, 0`
+		params := []interface{}{id, d.UserId, d.Bucket, d.Collection, d.Record, storedValue, version, d.PermissionRead, d.PermissionWrite, ts, d.GroupId}
 
 		if len(d.Version) == 0 {
 			// Simple write.
@@ -387,7 +1003,7 @@ SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $10, $10, 0`
 			}
 			query += `
 ON CONFLICT (bucket, collection, user_id, record, deleted_at)
-DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10`
+DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, group_id = $11, updated_at = $10`
 		} else if d.Version == "*" {
 			// if-none-match
 			query += " WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3::VARCHAR AND collection = $4::VARCHAR AND record = $5::VARCHAR AND deleted_at = 0)"
@@ -395,14 +1011,14 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 			// Any existing record, no matter its write permission, will cause this operation to be rejected.
 		} else {
 			// if-match
-			query += " WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3::VARCHAR AND collection = $4::VARCHAR AND record = $5::VARCHAR AND deleted_at = 0 AND version = $11"
+			query += " WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3::VARCHAR AND collection = $4::VARCHAR AND record = $5::VARCHAR AND deleted_at = 0 AND version = $12"
 			// If needed use an additional clause to enforce permissions.
 			if caller != "" {
-				query += " AND write = 1"
+				query += " AND write >= 1"
 			}
 			query += `)
 ON CONFLICT (bucket, collection, user_id, record, deleted_at)
-DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10`
+DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, group_id = $11, updated_at = $10`
 			params = append(params, d.Version)
 		}
 
@@ -410,19 +1026,18 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 		res, err := tx.Exec(query, params...)
 		if err != nil {
 			logger.Error("Could not write storage, exec error", zap.Error(err))
-			if e := tx.Rollback(); e != nil {
-				logger.Error("Could not write storage, rollback error", zap.Error(e))
-			}
-			return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
 		}
 
 		// Check there was exactly 1 row affected.
 		if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not write storage, rollback error", zap.Error(err))
-			}
-			return nil, STORAGE_REJECTED, errors.New("Storage write rejected: not found, version check failed, or permission denied")
+			return nil, nil, STORAGE_REJECTED, errors.New("Storage write rejected: not found, version check failed, or permission denied")
+		}
+
+		// Keep any secondary indexes on the value up to date.
+		if err = storage.Indexes().write(tx, d.UserId, d.Bucket, d.Collection, d.Record, d.Value); err != nil {
+			logger.Error("Could not write storage, index error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
 		}
 
 		keys[i] = &StorageKey{
@@ -432,64 +1047,85 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 			UserId:     d.UserId,
 			Version:    version,
 		}
+		changes[i] = &storageChange{data: &StorageData{
+			Bucket:          d.Bucket,
+			Collection:      d.Collection,
+			Record:          d.Record,
+			UserId:          d.UserId,
+			Value:           d.Value,
+			Version:         version,
+			PermissionRead:  d.PermissionRead,
+			PermissionWrite: d.PermissionWrite,
+			GroupId:         d.GroupId,
+			UpdatedAt:       ts,
+		}}
+
+		// Keep the new version if the collection has history enabled.
+		if err = storage.History().write(tx, changes[i].data, storedValue, ts); err != nil {
+			logger.Error("Could not write storage, history error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+		}
+	}
+
+	return keys, changes, 0, nil
+}
+
+func StorageUpdate(logger *zap.Logger, db *sql.DB, storage *StorageService, caller string, updates []*StorageKeyUpdate) ([]*StorageKey, Error_Code, error) {
+	// Start a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not update storage, transaction error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+	}
+
+	keys, changes, code, err := storageUpdate(logger, tx, storage, caller, updates, nowMs())
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not update storage, rollback error", zap.Error(e))
+		}
+		return nil, code, err
 	}
 
+	// Commit the transaction.
 	err = tx.Commit()
 	if err != nil {
-		logger.Error("Could not write storage, commit error", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+		logger.Error("Could not update storage, commit error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
 	}
 
+	storage.notify(changes)
+
 	return keys, 0, nil
 }
 
-func StorageUpdate(logger *zap.Logger, db *sql.DB, caller string, updates []*StorageKeyUpdate) ([]*StorageKey, Error_Code, error) {
+// storageUpdate executes storage updates in the given transaction, which the caller must roll back on error.
+func storageUpdate(logger *zap.Logger, tx *sql.Tx, storage *StorageService, caller string, updates []*StorageKeyUpdate, ts int64) ([]*StorageKey, []*storageChange, Error_Code, error) {
 	// Ensure there is at least one update requested.
 	if len(updates) == 0 {
-		return nil, BAD_INPUT, errors.New("At least one update is required")
+		return nil, nil, BAD_INPUT, errors.New("At least one update is required")
 	}
 
 	// Prepare response structure, expect to return as many keys as we're updating.
 	keys := make([]*StorageKey, len(updates))
-
-	// Use the same timestamp for all operations.
-	ts := nowMs()
-
-	// Start a transaction.
-	tx, err := db.Begin()
-	if err != nil {
-		logger.Error("Could not update storage, transaction error", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
-	}
+	changes := make([]*storageChange, len(updates))
 
 	// Process each update one by one.
 	for i, update := range updates {
 		// Check the storage identifiers.
 		if update.Key.Bucket == "" || update.Key.Collection == "" || update.Key.Record == "" {
-			return nil, BAD_INPUT, errors.New(fmt.Sprintf("Invalid update index %v: Invalid values for bucket, collection, or record", i))
+			return nil, nil, BAD_INPUT, errors.New(fmt.Sprintf("Invalid update index %v: Invalid values for bucket, collection, or record", i))
 		}
 
 		// Check permission values.
-		if update.PermissionRead < 0 || update.PermissionRead > 2 {
-			return nil, BAD_INPUT, errors.New(fmt.Sprintf("Invalid update index %v: Invalid read permission", i))
-		}
-		if update.PermissionWrite < 0 || update.PermissionWrite > 1 {
-			return nil, BAD_INPUT, errors.New(fmt.Sprintf("Invalid update index %v: Invalid write permission", i))
+		if err := storageValidatePermissions(update.PermissionRead, update.PermissionWrite, update.GroupId); err != nil {
+			return nil, nil, BAD_INPUT, fmt.Errorf("Invalid update index %v: %v", i, err.Error())
 		}
 
-		// If a user ID is provided, validate the format.
-		if update.Key.UserId != "" {
-			if caller != "" && caller != update.Key.UserId {
-				// If the caller is a client, only allow them to write their own data.
-				return nil, BAD_INPUT, errors.New(fmt.Sprintf("Invalid update index %v: A client can only write their own records", i))
-			}
-		} else if caller != "" {
-			// If the caller is a client, do not allow them to write global data.
-			return nil, BAD_INPUT, errors.New(fmt.Sprintf("Invalid update index %v: A client cannot write global records", i))
-		}
+		// Clients may update other users' records, or global records, only if the record is shared with their group.
+		owner := caller == "" || (update.Key.UserId != "" && caller == update.Key.UserId)
 
 		query := `
-SELECT user_id, bucket, collection, record, value, version, write
+SELECT user_id, bucket, collection, record, value, version, read, write, group_id
 FROM storage
 WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0`
 
@@ -500,31 +1136,63 @@ WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND delet
 		var record sql.NullString
 		var value []byte
 		var version string
+		var read sql.NullInt64
 		var write sql.NullInt64
-		err = tx.QueryRow(query, update.Key.Bucket, update.Key.Collection, update.Key.UserId, update.Key.Record).
-			Scan(&userID, &bucket, &collection, &record, &value, &version, &write)
+		var groupID sql.NullString
+		err := tx.QueryRow(query, update.Key.Bucket, update.Key.Collection, update.Key.UserId, update.Key.Record).
+			Scan(&userID, &bucket, &collection, &record, &value, &version, &read, &write, &groupID)
 		if err != nil && err != sql.ErrNoRows {
 			// Only fail on critical database or row scan errors.
 			// If no row was available we still allow storage updates to perform fresh inserts.
 			logger.Error("Could not update storage, query row error", zap.Error(err))
-			if e := tx.Rollback(); e != nil {
-				logger.Error("Could not update storage, rollback error", zap.Error(e))
-			}
-			return nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+		}
+		if value, err = storageDecodeValue(value); err != nil {
+			logger.Error("Could not update storage, value decode error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
 		}
 
 		// Check if we need an immediate version compare.
 		// If-None-Match and there's an existing version OR If-Match and the existing version doesn't match.
 		if update.Key.Version != "" && ((update.Key.Version == "*" && version != "") || (update.Key.Version != "*" && update.Key.Version != version)) {
-			if e := tx.Rollback(); e != nil {
-				logger.Error("Could not update storage, rollback error", zap.Error(e))
-			}
-			return nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
+			return nil, nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
 		}
 
 		// Check write permission if caller is not script runtime.
-		if caller != "" && write.Valid && write.Int64 != 1 {
-			return nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
+		permissionRead := update.PermissionRead
+		permissionWrite := update.PermissionWrite
+		permissionGroupID := update.GroupId
+		if owner {
+			if caller != "" && write.Valid && write.Int64 < 1 {
+				return nil, nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
+			}
+			// Owners may only share records with groups they belong to.
+			if caller != "" && update.GroupId != "" {
+				member, err := isGroupMember(tx, caller, update.GroupId)
+				if err != nil {
+					logger.Error("Could not update storage, group member error", zap.Error(err))
+					return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+				}
+				if !member {
+					return nil, nil, BAD_INPUT, fmt.Errorf("Invalid update index %v: A client can only share records with groups they are a member of", i)
+				}
+			}
+		} else {
+			// Group members can only change the value of an existing record, which keeps its permissions.
+			if version == "" || write.Int64 != 2 {
+				return nil, nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
+			}
+			member, err := isGroupMember(tx, caller, groupID.String)
+			if err != nil {
+				logger.Error("Could not update storage, group member error", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+			}
+			if !member {
+				return nil, nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
+			}
+			permissionRead = read.Int64
+			permissionWrite = write.Int64
+			permissionGroupID = groupID.String
 		}
 
 		// Allow updates to create new records.
@@ -535,30 +1203,40 @@ WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND delet
 		// Apply the patch operations.
 		newValue, err := update.Patch.Apply(value)
 		if err != nil {
-			if e := tx.Rollback(); e != nil {
-				logger.Error("Could not update storage, rollback error", zap.Error(e))
-			}
-			return nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: %v", i, err.Error()))
+			return nil, nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: %v", i, err.Error()))
+		}
+		if len(newValue) > storage.Config().MaxValueSizeBytes {
+			return nil, nil, BAD_INPUT, fmt.Errorf("Invalid update index %v: Values must be at most %v bytes", i, storage.Config().MaxValueSizeBytes)
+		}
+		if err = storage.Schemas().validate(update.Key.Bucket, update.Key.Collection, newValue); err != nil {
+			return nil, nil, STORAGE_SCHEMA_VIOLATION, fmt.Errorf("Storage update index %v rejected: Value does not match the collection schema: %v", i, err.Error())
 		}
 		newVersion := fmt.Sprintf("%x", sha256.Sum256(newValue))
+		storedValue, err := storage.encodeValue(newValue)
+		if err != nil {
+			logger.Error("Could not update storage, value encode error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+		}
 
 		query = `
-INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, deleted_at)
-SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $10, $10, 0`
-		params := []interface{}{generateNewId(), update.Key.UserId, update.Key.Bucket, update.Key.Collection, update.Key.Record, newValue, newVersion, update.PermissionRead, update.PermissionWrite, ts}
+INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, group_id, created_at, updated_at, deleted_at)
+SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $11, $10, $10, 0`
+		params := []interface{}{generateNewId(), update.Key.UserId, update.Key.Bucket, update.Key.Collection, update.Key.Record, storedValue, newVersion, permissionRead, permissionWrite, ts, permissionGroupID}
 		if version == "" {
 			// Treat this as an if-none-match.
 			query += " WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3::VARCHAR AND collection = $4::VARCHAR AND record = $5::VARCHAR AND deleted_at = 0)"
 		} else {
 			// if-match
-			query += " WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3::VARCHAR AND collection = $4::VARCHAR AND record = $5::VARCHAR AND deleted_at = 0 AND version = $11"
+			query += " WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3::VARCHAR AND collection = $4::VARCHAR AND record = $5::VARCHAR AND deleted_at = 0 AND version = $12"
 			// If needed use an additional clause to enforce permissions.
-			if caller != "" {
-				query += " AND write = 1"
+			if !owner {
+				query += " AND write = 2"
+			} else if caller != "" {
+				query += " AND write >= 1"
 			}
 			query += `)
 ON CONFLICT (bucket, collection, user_id, record, deleted_at)
-DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10`
+DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, group_id = $11, updated_at = $10`
 			params = append(params, version)
 		}
 
@@ -566,19 +1244,18 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 		res, err := tx.Exec(query, params...)
 		if err != nil {
 			logger.Error("Could not update storage, exec error", zap.Error(err))
-			if e := tx.Rollback(); e != nil {
-				logger.Error("Could not update storage, rollback error", zap.Error(e))
-			}
-			return nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
 		}
 
 		// Check there was exactly 1 row affected.
 		if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not update storage, rollback error", zap.Error(err))
-			}
-			return nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
+			return nil, nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
+		}
+
+		// Keep any secondary indexes on the value up to date.
+		if err = storage.Indexes().write(tx, update.Key.UserId, update.Key.Bucket, update.Key.Collection, update.Key.Record, newValue); err != nil {
+			logger.Error("Could not update storage, index error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
 		}
 
 		keys[i] = &StorageKey{
@@ -588,25 +1265,74 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 			UserId:     update.Key.UserId,
 			Version:    newVersion,
 		}
+		changes[i] = &storageChange{data: &StorageData{
+			Bucket:          update.Key.Bucket,
+			Collection:      update.Key.Collection,
+			Record:          update.Key.Record,
+			UserId:          update.Key.UserId,
+			Value:           newValue,
+			Version:         newVersion,
+			PermissionRead:  permissionRead,
+			PermissionWrite: permissionWrite,
+			GroupId:         permissionGroupID,
+			UpdatedAt:       ts,
+		}}
+
+		// Keep the new version if the collection has history enabled.
+		if err = storage.History().write(tx, changes[i].data, storedValue, ts); err != nil {
+			logger.Error("Could not update storage, history error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+		}
+	}
+
+	return keys, changes, 0, nil
+}
+
+func StorageRemove(logger *zap.Logger, db *sql.DB, storage *StorageService, caller string, keys []*StorageKey) (Error_Code, error) {
+	// Start a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not remove storage, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+	}
+
+	changes, code, err := storageRemove(logger, tx, storage, caller, keys, nowMs())
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			// Rollback to explicitly end the transaction, but will return an error if there are no updates yet.
+			logger.Debug("Could not rollback transaction in remove storage", zap.Error(e))
+		}
+		return code, err
+	}
+
+	// Nothing to delete.
+	if len(changes) == 0 {
+		if e := tx.Rollback(); e != nil {
+			// Rollback to explicitly end the transaction, but will return an error because there are no updates yet.
+			logger.Debug("Could not rollback transaction in remove storage after no deletes needed", zap.Error(e))
+		}
+		return 0, nil
 	}
 
-	// Commit the transaction.
 	err = tx.Commit()
 	if err != nil {
-		logger.Error("Could not update storage, commit error", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+		logger.Error("Could not remove storage, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
 	}
 
-	return keys, 0, nil
+	storage.notify(changes)
+
+	return 0, nil
 }
 
-func StorageRemove(logger *zap.Logger, db *sql.DB, caller string, keys []*StorageKey) (Error_Code, error) {
+// storageRemove executes storage removes in the given transaction, which the caller must roll back on error.
+func storageRemove(logger *zap.Logger, tx *sql.Tx, storage *StorageService, caller string, keys []*StorageKey, ts int64) ([]*storageChange, Error_Code, error) {
 	// Ensure there is at least one key requested.
 	if len(keys) == 0 {
-		return BAD_INPUT, errors.New("At least one remove key is required")
+		return nil, BAD_INPUT, errors.New("At least one remove key is required")
 	}
 
-	query := "SELECT id, bucket, collection, record, user_id, write, version FROM storage WHERE "
+	query := "SELECT id, bucket, collection, record, user_id, read, write, group_id, version FROM storage WHERE "
 	params := []interface{}{}
 
 	ops := make(map[struct {
@@ -620,18 +1346,18 @@ func StorageRemove(logger *zap.Logger, db *sql.DB, caller string, keys []*Storag
 	for i, key := range keys {
 		// Check the storage identifiers.
 		if key.Bucket == "" || key.Collection == "" || key.Record == "" {
-			return BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+			return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
 		}
 
 		// If a user ID is provided, validate the format.
 		if key.UserId != "" {
 			if caller != "" && caller != key.UserId {
 				// If the caller is a client, only allow them to write their own data.
-				return BAD_INPUT, errors.New("A client can only remove their own records")
+				return nil, BAD_INPUT, errors.New("A client can only remove their own records")
 			}
 		} else if caller != "" {
 			// If the caller is a client, do not allow them to write global data.
-			return BAD_INPUT, errors.New("A client cannot remove global records")
+			return nil, BAD_INPUT, errors.New("A client cannot remove global records")
 		}
 
 		if i != 0 {
@@ -655,44 +1381,32 @@ func StorageRemove(logger *zap.Logger, db *sql.DB, caller string, keys []*Storag
 		}] = key
 	}
 
-	// Start a transaction.
-	tx, err := db.Begin()
-	if err != nil {
-		logger.Error("Could not remove storage, transaction error", zap.Error(err))
-		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
-	}
-
 	// Execute the query.
 	queryRes, err := tx.Query(query, params...)
 	if err != nil {
 		logger.Error("Could not remove storage, query error", zap.Error(err))
-		if e := tx.Rollback(); e != nil {
-			// Rollback to explicitly end the transaction, but will return an error because there are no updates yet.
-			logger.Debug("Could not rollback transaction in remove storage after query error", zap.Error(e))
-		}
-		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not remove storage")
 	}
 	defer queryRes.Close()
 
 	query = "UPDATE storage SET deleted_at = $1, updated_at = $1 WHERE id IN ("
-	params = []interface{}{nowMs()}
+	params = []interface{}{ts}
+	changes := make([]*storageChange, 0)
 
 	var id sql.NullString
 	var bucket sql.NullString
 	var collection sql.NullString
 	var record sql.NullString
 	var userId sql.NullString
+	var read sql.NullInt64
 	var write sql.NullInt64
+	var groupId sql.NullString
 	var version sql.NullString
 	for queryRes.Next() {
-		err = queryRes.Scan(&id, &bucket, &collection, &record, &userId, &write, &version)
+		err = queryRes.Scan(&id, &bucket, &collection, &record, &userId, &read, &write, &groupId, &version)
 		if err != nil {
 			logger.Error("Could not remove storage, scan error", zap.Error(err))
-			if e := tx.Rollback(); e != nil {
-				// Rollback to explicitly end the transaction, but will return an error because there are no updates yet.
-				logger.Debug("Could not rollback transaction in remove storage after scan error", zap.Error(e))
-			}
-			return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not remove storage")
 		}
 
 		key := ops[struct {
@@ -708,21 +1422,13 @@ func StorageRemove(logger *zap.Logger, db *sql.DB, caller string, keys []*Storag
 		}]
 
 		// Check permission.
-		if caller != "" && write.Int64 != 1 {
-			if e := tx.Rollback(); e != nil {
-				// Rollback to explicitly end the transaction, but will return an error because there are no updates yet.
-				logger.Debug("Could not rollback transaction in remove storage after permission rejected", zap.Error(e))
-			}
-			return STORAGE_REJECTED, errors.New("Storage remove rejected: not found, version check failed, or permission denied")
+		if caller != "" && write.Int64 < 1 {
+			return nil, STORAGE_REJECTED, errors.New("Storage remove rejected: not found, version check failed, or permission denied")
 		}
 
 		// Check version.
 		if key.Version != "" && key.Version != version.String {
-			if e := tx.Rollback(); e != nil {
-				// Rollback to explicitly end the transaction, but will return an error because there are no updates yet.
-				logger.Debug("Could not rollback transaction in remove storage after version rejected", zap.Error(e))
-			}
-			return STORAGE_REJECTED, errors.New("Storage remove rejected: not found, version check failed, or permission denied")
+			return nil, STORAGE_REJECTED, errors.New("Storage remove rejected: not found, version check failed, or permission denied")
 		}
 
 		l := len(params)
@@ -731,32 +1437,41 @@ func StorageRemove(logger *zap.Logger, db *sql.DB, caller string, keys []*Storag
 		}
 		query += fmt.Sprintf("$%v", l+1)
 		params = append(params, id.String)
+		changes = append(changes, &storageChange{
+			data: &StorageData{
+				Bucket:          key.Bucket,
+				Collection:      key.Collection,
+				Record:          key.Record,
+				UserId:          key.UserId,
+				Version:         version.String,
+				PermissionRead:  read.Int64,
+				PermissionWrite: write.Int64,
+				GroupId:         groupId.String,
+				UpdatedAt:       ts,
+			},
+			removed: true,
+		})
 	}
 
 	// Nothing to delete.
-	if len(params) == 1 {
-		if e := tx.Rollback(); e != nil {
-			// Rollback to explicitly end the transaction, but will return an error because there are no updates yet.
-			logger.Debug("Could not rollback transaction in remove storage after no deletes needed", zap.Error(e))
-		}
-		return 0, nil
+	if len(changes) == 0 {
+		return changes, 0, nil
 	}
 
 	query += ")"
 	_, err = tx.Exec(query, params...)
 	if err != nil {
 		logger.Error("Could not remove storage, exec error", zap.Error(err))
-		if e := tx.Rollback(); e != nil {
-			logger.Warn("Could not rollback transaction in remove storage after exec error", zap.Error(e))
-		}
-		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not remove storage")
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		logger.Error("Could not remove storage, commit error", zap.Error(err))
-		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+	// Removed records no longer appear in any secondary index.
+	for _, change := range changes {
+		if err = storage.Indexes().remove(tx, change.data.UserId, change.data.Bucket, change.data.Collection, change.data.Record); err != nil {
+			logger.Error("Could not remove storage, index error", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+		}
 	}
 
-	return 0, nil
+	return changes, 0, nil
 }
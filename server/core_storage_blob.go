@@ -0,0 +1,363 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+// StorageBlob describes a binary payload kept in storage, with the same keys and permissions as storage records.
+// The content itself is stored separately in chunks.
+type StorageBlob struct {
+	Bucket          string
+	Collection      string
+	Record          string
+	UserId          string // this must be UserId not UserID
+	ContentType     string
+	Size            int64
+	Version         string
+	PermissionRead  int64
+	PermissionWrite int64
+	GroupId         string
+	CreatedAt       int64
+	UpdatedAt       int64
+
+	id     []byte
+	chunks int64
+}
+
+// StorageBlobWrite stores the content read from r as a blob, replacing any existing blob with the same key.
+// The blob version works as a storage record write version: empty to always write, "*" to only write if there is no existing blob,
+// or a version to only write if it matches the existing blob.
+// Content is stored as it is read, so only the final step of replacing the existing blob runs in a transaction.
+func StorageBlobWrite(logger *zap.Logger, db *sql.DB, storage *StorageService, caller string, blob *StorageBlob, r io.Reader) (*StorageKey, Error_Code, error) {
+	// Check the storage identifiers.
+	if blob.Bucket == "" || blob.Collection == "" || blob.Record == "" {
+		return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+	}
+
+	// Check the permission values.
+	if err := storageValidatePermissions(blob.PermissionRead, blob.PermissionWrite, blob.GroupId); err != nil {
+		return nil, BAD_INPUT, err
+	}
+	if blob.PermissionWrite == 2 {
+		return nil, BAD_INPUT, errors.New("Invalid write permission value")
+	}
+
+	if blob.UserId != "" {
+		if caller != "" && caller != blob.UserId {
+			// If the caller is a client, only allow them to write their own data.
+			return nil, BAD_INPUT, errors.New("A client can only write their own blobs")
+		}
+	} else if caller != "" {
+		// If the caller is a client, do not allow them to write global data.
+		return nil, BAD_INPUT, errors.New("A client cannot write global blobs")
+	}
+
+	// If the caller is a client, only allow them to share blobs with groups they belong to.
+	if caller != "" && blob.GroupId != "" {
+		member, err := isGroupMember(db, caller, blob.GroupId)
+		if err != nil {
+			logger.Error("Could not write storage blob, group member error", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage blob")
+		}
+		if !member {
+			return nil, BAD_INPUT, errors.New("A client can only share blobs with groups they are a member of")
+		}
+	}
+
+	contentType := blob.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Reject the write before reading any content if the existing blob already rules it out.
+	existingID, existingVersion, existingWrite, exists, err := storageBlobExisting(db, blob)
+	if err != nil {
+		logger.Error("Could not write storage blob, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage blob")
+	}
+	if !storageBlobWriteAllowed(caller, blob, exists, existingVersion, existingWrite) {
+		return nil, STORAGE_REJECTED, errors.New("Storage blob write rejected: not found, version check failed, or permission denied")
+	}
+
+	// Store the new content in chunks under a new ID, so the existing content is untouched until it is replaced.
+	// Each chunk is committed on its own so large blobs do not exceed the database's transaction size limits.
+	id := []byte(generateNewId())
+	size, chunks, version, code, err := storageBlobWriteChunks(logger, db, storage.Config(), id, r)
+	if err != nil {
+		storageBlobRemoveChunks(logger, db, id)
+		return nil, code, err
+	}
+
+	// Finalise the blob in a transaction, checking the existing blob again in case it changed during the upload.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not write storage blob, transaction error", zap.Error(err))
+		storageBlobRemoveChunks(logger, db, id)
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage blob")
+	}
+
+	existingID, existingVersion, existingWrite, exists, err = storageBlobExisting(tx, blob)
+	if err != nil {
+		logger.Error("Could not write storage blob, query error", zap.Error(err))
+		code, err = RUNTIME_EXCEPTION, errors.New("Could not write storage blob")
+	} else if !storageBlobWriteAllowed(caller, blob, exists, existingVersion, existingWrite) {
+		code, err = STORAGE_REJECTED, errors.New("Storage blob write rejected: not found, version check failed, or permission denied")
+	} else {
+		_, err = tx.Exec(`
+INSERT INTO storage_blob (id, user_id, bucket, collection, record, content_type, size, chunks, version, read, write, group_id, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $13)
+ON CONFLICT (bucket, collection, user_id, record)
+DO UPDATE SET id = $1, content_type = $6, size = $7, chunks = $8, version = $9, read = $10, write = $11, group_id = $12, updated_at = $13`,
+			id, blob.UserId, blob.Bucket, blob.Collection, blob.Record, contentType, size, chunks, version, blob.PermissionRead, blob.PermissionWrite, blob.GroupId, nowMs())
+		if err != nil {
+			logger.Error("Could not write storage blob, exec error", zap.Error(err))
+			code, err = RUNTIME_EXCEPTION, errors.New("Could not write storage blob")
+		}
+	}
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not write storage blob, rollback error", zap.Error(e))
+		}
+		storageBlobRemoveChunks(logger, db, id)
+		return nil, code, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("Could not write storage blob, commit error", zap.Error(err))
+		storageBlobRemoveChunks(logger, db, id)
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage blob")
+	}
+
+	// The replaced content is no longer referenced.
+	if exists {
+		storageBlobRemoveChunks(logger, db, existingID)
+	}
+
+	return &StorageKey{
+		Bucket:     blob.Bucket,
+		Collection: blob.Collection,
+		Record:     blob.Record,
+		UserId:     blob.UserId,
+		Version:    version,
+	}, 0, nil
+}
+
+func storageBlobExisting(db queryer, blob *StorageBlob) ([]byte, string, int64, bool, error) {
+	var id []byte
+	var version string
+	var write int64
+	err := db.QueryRow("SELECT id, version, write FROM storage_blob WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4",
+		blob.Bucket, blob.Collection, blob.UserId, blob.Record).Scan(&id, &version, &write)
+	if err == sql.ErrNoRows {
+		return nil, "", 0, false, nil
+	} else if err != nil {
+		return nil, "", 0, false, err
+	}
+	return id, version, write, true, nil
+}
+
+func storageBlobWriteAllowed(caller string, blob *StorageBlob, exists bool, existingVersion string, existingWrite int64) bool {
+	return !((!exists && blob.Version != "" && blob.Version != "*") ||
+		(exists && blob.Version == "*") ||
+		(exists && blob.Version != "" && blob.Version != existingVersion) ||
+		(exists && caller != "" && existingWrite != 1))
+}
+
+// storageBlobWriteChunks stores the content read from r as chunks of the given blob ID, and returns its size, chunk count and version.
+func storageBlobWriteChunks(logger *zap.Logger, db *sql.DB, config *StorageConfig, id []byte, r io.Reader) (int64, int64, string, Error_Code, error) {
+	hash := sha256.New()
+	buf := make([]byte, config.BlobChunkSizeBytes)
+	size := int64(0)
+	chunks := int64(0)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			size += int64(n)
+			if size > config.BlobMaxSizeBytes {
+				return 0, 0, "", BAD_INPUT, fmt.Errorf("Blobs must be at most %v bytes", config.BlobMaxSizeBytes)
+			}
+			hash.Write(buf[:n])
+			if _, e := db.Exec("INSERT INTO storage_blob_chunk (blob_id, seq, data) VALUES ($1, $2, $3)", id, chunks, buf[:n]); e != nil {
+				logger.Error("Could not write storage blob, chunk error", zap.Error(e))
+				return 0, 0, "", RUNTIME_EXCEPTION, errors.New("Could not write storage blob")
+			}
+			chunks++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			logger.Warn("Could not write storage blob, read error", zap.Error(err))
+			return 0, 0, "", BAD_INPUT, errors.New("Could not read storage blob content")
+		}
+	}
+	return size, chunks, fmt.Sprintf("%x", hash.Sum(nil)), 0, nil
+}
+
+// storageBlobRemoveChunks removes content that no blob references. Failures only leave unreferenced chunks behind.
+func storageBlobRemoveChunks(logger *zap.Logger, db *sql.DB, id []byte) {
+	if _, err := db.Exec("DELETE FROM storage_blob_chunk WHERE blob_id = $1", id); err != nil {
+		logger.Warn("Could not remove storage blob chunks", zap.Error(err))
+	}
+}
+
+// StorageBlobFetch looks up a blob the caller can read, or returns nil if there is no such blob.
+func StorageBlobFetch(logger *zap.Logger, db *sql.DB, caller string, key *StorageKey) (*StorageBlob, Error_Code, error) {
+	// Check the storage identifiers.
+	if key.Bucket == "" || key.Collection == "" || key.Record == "" {
+		return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+	}
+
+	query := `
+SELECT id, content_type, size, chunks, version, read, write, group_id, created_at, updated_at
+FROM storage_blob
+WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4`
+	params := []interface{}{key.Bucket, key.Collection, key.UserId, key.Record}
+	if caller != "" {
+		params = append(params, caller)
+		query += " AND " + storageReadClause("", len(params))
+	}
+
+	blob := &StorageBlob{
+		Bucket:     key.Bucket,
+		Collection: key.Collection,
+		Record:     key.Record,
+		UserId:     key.UserId,
+	}
+	var groupID []byte
+	err := db.QueryRow(query, params...).Scan(&blob.id, &blob.ContentType, &blob.Size, &blob.chunks, &blob.Version,
+		&blob.PermissionRead, &blob.PermissionWrite, &groupID, &blob.CreatedAt, &blob.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 0, nil
+		}
+		logger.Error("Could not fetch storage blob", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not fetch storage blob")
+	}
+	blob.GroupId = string(groupID)
+
+	return blob, 0, nil
+}
+
+// StorageBlobRead streams the content of a blob returned by StorageBlobFetch to w, one chunk at a time.
+func StorageBlobRead(logger *zap.Logger, db *sql.DB, blob *StorageBlob, w io.Writer) error {
+	rows, err := db.Query("SELECT data FROM storage_blob_chunk WHERE blob_id = $1 ORDER BY seq", blob.id)
+	if err != nil {
+		logger.Error("Could not read storage blob, query error", zap.Error(err))
+		return errors.New("Could not read storage blob")
+	}
+	defer rows.Close()
+
+	chunks := int64(0)
+	var data []byte
+	for rows.Next() {
+		if err = rows.Scan(&data); err != nil {
+			logger.Error("Could not read storage blob, scan error", zap.Error(err))
+			return errors.New("Could not read storage blob")
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		chunks++
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not read storage blob, rows error", zap.Error(err))
+		return errors.New("Could not read storage blob")
+	}
+
+	// The blob was replaced or removed while it was being read.
+	if chunks != blob.chunks {
+		return errors.New("Storage blob changed while it was being read")
+	}
+
+	return nil
+}
+
+// StorageBlobRemove removes a blob and its content. If the key has a version, the blob is only removed if it matches.
+func StorageBlobRemove(logger *zap.Logger, db *sql.DB, caller string, key *StorageKey) (Error_Code, error) {
+	// Check the storage identifiers.
+	if key.Bucket == "" || key.Collection == "" || key.Record == "" {
+		return BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+	}
+
+	if key.UserId != "" {
+		if caller != "" && caller != key.UserId {
+			// If the caller is a client, only allow them to remove their own data.
+			return BAD_INPUT, errors.New("A client can only remove their own blobs")
+		}
+	} else if caller != "" {
+		// If the caller is a client, do not allow them to remove global data.
+		return BAD_INPUT, errors.New("A client cannot remove global blobs")
+	}
+
+	// Start a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not remove storage blob, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not remove storage blob")
+	}
+
+	var id []byte
+	var version string
+	var write int64
+	err = tx.QueryRow("SELECT id, version, write FROM storage_blob WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4",
+		key.Bucket, key.Collection, key.UserId, key.Record).Scan(&id, &version, &write)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Debug("Could not rollback transaction in remove storage blob", zap.Error(e))
+		}
+		if err == sql.ErrNoRows {
+			// Nothing to remove.
+			return 0, nil
+		}
+		logger.Error("Could not remove storage blob, query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not remove storage blob")
+	}
+
+	// Check the write permission and version.
+	if (caller != "" && write != 1) || (key.Version != "" && key.Version != version) {
+		if e := tx.Rollback(); e != nil {
+			logger.Debug("Could not rollback transaction in remove storage blob", zap.Error(e))
+		}
+		return STORAGE_REJECTED, errors.New("Storage blob remove rejected: not found, version check failed, or permission denied")
+	}
+
+	_, err = tx.Exec("DELETE FROM storage_blob WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4", key.Bucket, key.Collection, key.UserId, key.Record)
+	if err != nil {
+		logger.Error("Could not remove storage blob, exec error", zap.Error(err))
+		if e := tx.Rollback(); e != nil {
+			logger.Warn("Could not rollback transaction in remove storage blob after exec error", zap.Error(e))
+		}
+		return RUNTIME_EXCEPTION, errors.New("Could not remove storage blob")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("Could not remove storage blob, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not remove storage blob")
+	}
+
+	storageBlobRemoveChunks(logger, db, id)
+
+	return 0, nil
+}
@@ -0,0 +1,322 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Import a record only if there is no live record with the same key.
+	STORAGE_IMPORT_CONFLICT_SKIP = "skip"
+	// Import a record, replacing any live record with the same key.
+	STORAGE_IMPORT_CONFLICT_OVERWRITE = "overwrite"
+	// Import a record only if there is no live record with the same key, or the live record has the same version as the imported one.
+	STORAGE_IMPORT_CONFLICT_IF_VERSION_MATCHES = "if-version-matches"
+
+	storageExportBatchSize = 1000
+	storageImportBatchSize = 1000
+	// Exported values are not compressed, so import lines can be much larger than stored records.
+	storageImportMaxLineBytes = 64 * 1024 * 1024
+)
+
+// StorageExportRecord is a single storage record in an export, written as one JSON object per line.
+type StorageExportRecord struct {
+	Bucket          string          `json:"bucket"`
+	Collection      string          `json:"collection"`
+	Record          string          `json:"record"`
+	UserId          string          `json:"user_id"` // this must be UserId not UserID
+	Value           json.RawMessage `json:"value"`
+	Version         string          `json:"version"`
+	PermissionRead  int64           `json:"permission_read"`
+	PermissionWrite int64           `json:"permission_write"`
+	GroupId         string          `json:"group_id,omitempty"` // this must be GroupId not GroupID
+	CreatedAt       int64           `json:"created_at"`
+	UpdatedAt       int64           `json:"updated_at"`
+	ExpiresAt       int64           `json:"expires_at"`
+}
+
+// StorageImportResult counts what happened to the records in an import.
+type StorageImportResult struct {
+	Imported int
+	// Records not imported because of the conflict policy.
+	Skipped int
+}
+
+// StorageExport writes the live records in a bucket, optionally only one collection and one user's records, as JSON lines.
+// It returns the number of records written.
+func StorageExport(logger *zap.Logger, db *sql.DB, bucket string, collection string, userID string, w io.Writer) (int, error) {
+	if bucket == "" {
+		return 0, errors.New("A bucket is required")
+	}
+
+	query := `
+SELECT collection, user_id, record, value, version, read, write, group_id, created_at, updated_at, expires_at
+FROM storage
+WHERE bucket = $1 AND deleted_at = 0`
+	params := []interface{}{bucket}
+	if collection != "" {
+		params = append(params, collection)
+		query += fmt.Sprintf(" AND collection = $%v", len(params))
+	}
+	if userID != "" {
+		params = append(params, userID)
+		query += fmt.Sprintf(" AND user_id = $%v", len(params))
+	}
+
+	encoder := json.NewEncoder(w)
+	count := 0
+	var last *StorageExportRecord
+	for {
+		// Page through the records in key order so the export does not hold one long-running query open.
+		pageQuery := query
+		pageParams := params
+		if last != nil {
+			l := len(pageParams)
+			pageQuery += fmt.Sprintf(" AND (collection, user_id, record) > ($%v, $%v, $%v)", l+1, l+2, l+3)
+			pageParams = append(pageParams, last.Collection, last.UserId, last.Record)
+		}
+		pageQuery += fmt.Sprintf(" ORDER BY collection, user_id, record LIMIT %v", storageExportBatchSize)
+
+		rows, err := db.Query(pageQuery, pageParams...)
+		if err != nil {
+			logger.Error("Could not export storage, query error", zap.Error(err))
+			return count, errors.New("Could not export storage")
+		}
+
+		page := 0
+		for rows.Next() {
+			var groupID sql.NullString
+			var value []byte
+			record := &StorageExportRecord{Bucket: bucket}
+			err = rows.Scan(&record.Collection, &record.UserId, &record.Record, &value, &record.Version,
+				&record.PermissionRead, &record.PermissionWrite, &groupID, &record.CreatedAt, &record.UpdatedAt, &record.ExpiresAt)
+			if err != nil {
+				rows.Close()
+				logger.Error("Could not export storage, scan error", zap.Error(err))
+				return count, errors.New("Could not export storage")
+			}
+			if value, err = storageDecodeValue(value); err != nil {
+				rows.Close()
+				logger.Error("Could not export storage, value decode error", zap.Error(err))
+				return count, errors.New("Could not export storage")
+			}
+			record.Value = value
+			record.GroupId = groupID.String
+
+			if err = encoder.Encode(record); err != nil {
+				rows.Close()
+				return count, fmt.Errorf("Could not write storage export: %v", err.Error())
+			}
+			last = record
+			page++
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			logger.Error("Could not export storage, rows error", zap.Error(err))
+			return count, errors.New("Could not export storage")
+		}
+
+		if page < storageExportBatchSize {
+			return count, nil
+		}
+	}
+}
+
+// StorageImport reads records written by StorageExport and stores them with their versions, permissions and timestamps.
+// The result counts records up to any error, and is never nil.
+// Records are imported in batches, each in its own transaction, so an error leaves earlier batches in place.
+// A dry run checks every record and counts the outcome, but rolls back every batch.
+func StorageImport(logger *zap.Logger, db *sql.DB, storage *StorageService, r io.Reader, conflict string, dryRun bool) (*StorageImportResult, error) {
+	result := &StorageImportResult{}
+	switch conflict {
+	case STORAGE_IMPORT_CONFLICT_SKIP, STORAGE_IMPORT_CONFLICT_OVERWRITE, STORAGE_IMPORT_CONFLICT_IF_VERSION_MATCHES:
+	default:
+		return result, fmt.Errorf("Unknown conflict policy %v", conflict)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), storageImportMaxLineBytes)
+
+	line := 0
+	batch := make([]*StorageExportRecord, 0, storageImportBatchSize)
+	for {
+		more := scanner.Scan()
+		if more {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			record := &StorageExportRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+				return result, fmt.Errorf("Invalid record on line %v: %v", line, err.Error())
+			}
+			if err := storageImportValidate(record); err != nil {
+				return result, fmt.Errorf("Invalid record on line %v: %v", line, err.Error())
+			}
+			batch = append(batch, record)
+		} else if err := scanner.Err(); err != nil {
+			return result, fmt.Errorf("Could not read storage import after line %v: %v", line, err.Error())
+		}
+
+		if len(batch) == storageImportBatchSize || (!more && len(batch) != 0) {
+			if err := storageImportBatch(logger, db, storage, batch, conflict, dryRun, result); err != nil {
+				return result, fmt.Errorf("Could not import records before line %v: %v", line+1, err.Error())
+			}
+			batch = batch[:0]
+		}
+
+		if !more {
+			return result, nil
+		}
+	}
+}
+
+func storageImportValidate(record *StorageExportRecord) error {
+	if record.Bucket == "" || record.Collection == "" || record.Record == "" {
+		return errors.New("Invalid values for bucket, collection, or record")
+	}
+	if err := storageValidatePermissions(record.PermissionRead, record.PermissionWrite, record.GroupId); err != nil {
+		return err
+	}
+
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(record.Value, &maybeJSON) != nil {
+		return errors.New("Value must be a valid JSON object")
+	}
+	return nil
+}
+
+func storageImportBatch(logger *zap.Logger, db *sql.DB, storage *StorageService, batch []*StorageExportRecord, conflict string, dryRun bool, result *StorageImportResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not import storage, transaction error", zap.Error(err))
+		return errors.New("Could not import storage")
+	}
+
+	imported, skipped, err := storageImportTx(logger, tx, storage, batch, conflict)
+	if err != nil || dryRun {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not import storage, rollback error", zap.Error(e))
+		}
+		if err != nil {
+			return err
+		}
+	} else if err = tx.Commit(); err != nil {
+		logger.Error("Could not import storage, commit error", zap.Error(err))
+		return errors.New("Could not import storage")
+	}
+
+	result.Imported += imported
+	result.Skipped += skipped
+	return nil
+}
+
+func storageImportTx(logger *zap.Logger, tx *sql.Tx, storage *StorageService, batch []*StorageExportRecord, conflict string) (int, int, error) {
+	ts := nowMs()
+	imported := 0
+	skipped := 0
+
+	for _, record := range batch {
+		if len(record.Value) > storage.Config().MaxValueSizeBytes {
+			return 0, 0, fmt.Errorf("Value of record %v must be at most %v bytes", record.Record, storage.Config().MaxValueSizeBytes)
+		}
+		if err := storage.Schemas().validate(record.Bucket, record.Collection, record.Value); err != nil {
+			return 0, 0, fmt.Errorf("Value of record %v does not match the collection schema: %v", record.Record, err.Error())
+		}
+
+		if conflict != STORAGE_IMPORT_CONFLICT_OVERWRITE {
+			var version string
+			err := tx.QueryRow("SELECT version FROM storage WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0",
+				record.Bucket, record.Collection, record.UserId, record.Record).Scan(&version)
+			if err != nil && err != sql.ErrNoRows {
+				logger.Error("Could not import storage, query error", zap.Error(err))
+				return 0, 0, errors.New("Could not import storage")
+			}
+			exists := err == nil
+			if exists && (conflict == STORAGE_IMPORT_CONFLICT_SKIP || version != record.Version) {
+				skipped++
+				continue
+			}
+		}
+
+		// Keep versions and timestamps from the export, filling in any that are missing.
+		data := &StorageData{
+			Bucket:          record.Bucket,
+			Collection:      record.Collection,
+			Record:          record.Record,
+			UserId:          record.UserId,
+			Value:           record.Value,
+			Version:         record.Version,
+			PermissionRead:  record.PermissionRead,
+			PermissionWrite: record.PermissionWrite,
+			GroupId:         record.GroupId,
+			CreatedAt:       record.CreatedAt,
+			UpdatedAt:       record.UpdatedAt,
+			ExpiresAt:       record.ExpiresAt,
+		}
+		if data.Version == "" {
+			data.Version = fmt.Sprintf("%x", sha256.Sum256(data.Value))
+		}
+		if data.CreatedAt == 0 {
+			data.CreatedAt = ts
+		}
+		if data.UpdatedAt == 0 {
+			data.UpdatedAt = data.CreatedAt
+		}
+
+		storedValue, err := storage.encodeValue(data.Value)
+		if err != nil {
+			logger.Error("Could not import storage, value encode error", zap.Error(err))
+			return 0, 0, errors.New("Could not import storage")
+		}
+
+		_, err = tx.Exec(`
+INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, group_id, created_at, updated_at, expires_at, deleted_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, 0)
+ON CONFLICT (bucket, collection, user_id, record, deleted_at)
+DO UPDATE SET value = $6, version = $7, read = $8, write = $9, group_id = $10, created_at = $11, updated_at = $12, expires_at = $13`,
+			generateNewId(), data.UserId, data.Bucket, data.Collection, data.Record, storedValue, data.Version,
+			data.PermissionRead, data.PermissionWrite, data.GroupId, data.CreatedAt, data.UpdatedAt, data.ExpiresAt)
+		if err != nil {
+			logger.Error("Could not import storage, exec error", zap.Error(err))
+			return 0, 0, errors.New("Could not import storage")
+		}
+
+		if err = storage.Indexes().write(tx, data.UserId, data.Bucket, data.Collection, data.Record, data.Value); err != nil {
+			logger.Error("Could not import storage, index error", zap.Error(err))
+			return 0, 0, errors.New("Could not import storage")
+		}
+		if err = storage.History().write(tx, data, storedValue, data.UpdatedAt); err != nil {
+			logger.Error("Could not import storage, history error", zap.Error(err))
+			return 0, 0, errors.New("Could not import storage")
+		}
+
+		imported++
+	}
+
+	return imported, skipped, nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+type storageHistoryCursor struct {
+	CreatedAt int64
+	ID        []byte
+}
+
+// StorageHistoryList lists the kept versions of a record, newest first.
+// Each version is returned with the time it was written as its updated time.
+func StorageHistoryList(logger *zap.Logger, db *sql.DB, storage *StorageService, caller string, key *StorageKey, limit int64, cursor string) ([]*StorageData, string, Error_Code, error) {
+	// Check the storage identifiers.
+	if key.Bucket == "" || key.Collection == "" || key.Record == "" {
+		return nil, "", BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+	}
+
+	if key.UserId != "" {
+		if caller != "" && caller != key.UserId {
+			// If the caller is a client, only allow them to list history of their own data.
+			return nil, "", BAD_INPUT, errors.New("A client can only list history of their own records")
+		}
+	} else if caller != "" {
+		// If the caller is a client, do not allow them to list history of global data.
+		return nil, "", BAD_INPUT, errors.New("A client cannot list history of global records")
+	}
+
+	if !storage.History().Enabled(key.Bucket, key.Collection) {
+		return nil, "", BAD_INPUT, errors.New("Storage history is not enabled for this collection")
+	}
+
+	// Validate the limit.
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, "", BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	// Process the incoming cursor if one is provided.
+	var incomingCursor *storageHistoryCursor
+	if len(cursor) != 0 {
+		if cb, err := base64.StdEncoding.DecodeString(cursor); err != nil {
+			return nil, "", BAD_INPUT, errors.New("Invalid cursor data")
+		} else {
+			incomingCursor = &storageHistoryCursor{}
+			if err := gob.NewDecoder(bytes.NewReader(cb)).Decode(incomingCursor); err != nil {
+				return nil, "", BAD_INPUT, errors.New("Invalid cursor data")
+			}
+		}
+	}
+
+	// Drop expired versions first, the record may not have been rewritten since they expired.
+	if err := storage.History().prune(db, key.Bucket, key.Collection, key.UserId, key.Record, nowMs()); err != nil {
+		logger.Error("Could not list storage history, prune error", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Could not list storage history")
+	}
+
+	query := `
+SELECT id, value, version, read, write, group_id, created_at
+FROM storage_history
+WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4`
+	params := []interface{}{key.Bucket, key.Collection, key.UserId, key.Record}
+
+	// Clients can see versions they could read on the record itself.
+	if caller != "" {
+		query += " AND read >= 1"
+	}
+	if incomingCursor != nil {
+		query += " AND (created_at, id) < ($5, $6)"
+		params = append(params, incomingCursor.CreatedAt, incomingCursor.ID)
+	}
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%v", len(params)+1)
+	params = append(params, limit+1)
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Could not list storage history, query error", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Could not list storage history")
+	}
+	defer rows.Close()
+
+	storageData := make([]*StorageData, 0)
+	var outgoingCursor string
+
+	var id []byte
+	var value []byte
+	var version []byte
+	var read int64
+	var write int64
+	var groupID []byte
+	var createdAt int64
+	for rows.Next() {
+		if int64(len(storageData)) >= limit {
+			cursorBuf := new(bytes.Buffer)
+			newCursor := &storageHistoryCursor{
+				CreatedAt: storageData[len(storageData)-1].UpdatedAt,
+				ID:        id,
+			}
+			if err := gob.NewEncoder(cursorBuf).Encode(newCursor); err != nil {
+				logger.Error("Could not create new cursor", zap.Error(err))
+				return nil, "", RUNTIME_EXCEPTION, errors.New("Could not list storage history")
+			}
+			outgoingCursor = base64.StdEncoding.EncodeToString(cursorBuf.Bytes())
+			break
+		}
+
+		err = rows.Scan(&id, &value, &version, &read, &write, &groupID, &createdAt)
+		if err != nil {
+			logger.Error("Could not list storage history, scan error", zap.Error(err))
+			return nil, "", RUNTIME_EXCEPTION, errors.New("Could not list storage history")
+		}
+		if value, err = storageDecodeValue(value); err != nil {
+			logger.Error("Could not list storage history, value decode error", zap.Error(err))
+			return nil, "", RUNTIME_EXCEPTION, errors.New("Could not list storage history")
+		}
+
+		storageData = append(storageData, &StorageData{
+			Bucket:          key.Bucket,
+			Collection:      key.Collection,
+			Record:          key.Record,
+			UserId:          key.UserId,
+			Value:           value,
+			Version:         string(version),
+			PermissionRead:  read,
+			PermissionWrite: write,
+			GroupId:         string(groupID),
+			UpdatedAt:       createdAt,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not list storage history, rows error", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Could not list storage history")
+	}
+
+	return storageData, outgoingCursor, 0, nil
+}
+
+// StorageHistoryRestore writes a kept version of a record back as its current value.
+// If the key has a version the restore only succeeds if the record's current version matches it.
+func StorageHistoryRestore(logger *zap.Logger, db *sql.DB, storage *StorageService, key *StorageKey, version string) (*StorageKey, Error_Code, error) {
+	// Check the storage identifiers.
+	if key.Bucket == "" || key.Collection == "" || key.Record == "" {
+		return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+	}
+	if version == "" {
+		return nil, BAD_INPUT, errors.New("A version to restore is required")
+	}
+
+	// Start a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not restore storage history, transaction error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not restore storage history")
+	}
+
+	// Expired versions cannot be restored, even if the record has not been rewritten since they expired.
+	if err = storage.History().prune(tx, key.Bucket, key.Collection, key.UserId, key.Record, nowMs()); err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not restore storage history, rollback error", zap.Error(e))
+		}
+		logger.Error("Could not restore storage history, prune error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not restore storage history")
+	}
+
+	var value []byte
+	var read int64
+	var write int64
+	var groupID []byte
+	err = tx.QueryRow(`
+SELECT value, read, write, group_id
+FROM storage_history
+WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND version = $5
+ORDER BY created_at DESC
+LIMIT 1`, key.Bucket, key.Collection, key.UserId, key.Record, version).Scan(&value, &read, &write, &groupID)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not restore storage history, rollback error", zap.Error(e))
+		}
+		if err == sql.ErrNoRows {
+			return nil, BAD_INPUT, errors.New("Storage history version not found")
+		}
+		logger.Error("Could not restore storage history, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not restore storage history")
+	}
+	if value, err = storageDecodeValue(value); err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not restore storage history, rollback error", zap.Error(e))
+		}
+		logger.Error("Could not restore storage history, value decode error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not restore storage history")
+	}
+
+	data := &StorageData{
+		Bucket:          key.Bucket,
+		Collection:      key.Collection,
+		Record:          key.Record,
+		UserId:          key.UserId,
+		Value:           value,
+		Version:         key.Version,
+		PermissionRead:  read,
+		PermissionWrite: write,
+		GroupId:         string(groupID),
+	}
+	keys, changes, code, err := storageWrite(logger, tx, storage, "", []*StorageData{data}, nowMs())
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not restore storage history, rollback error", zap.Error(e))
+		}
+		return nil, code, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("Could not restore storage history, commit error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not restore storage history")
+	}
+
+	storage.notify(changes)
+
+	return keys[0], 0, nil
+}
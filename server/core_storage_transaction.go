@@ -0,0 +1,138 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// LeaderboardSubmit is a leaderboard record submission that runs as part of a storage transaction.
+type LeaderboardSubmit struct {
+	LeaderboardID string
+	OwnerID       string
+	Handle        string
+	Lang          string
+	Op            string
+	Value         int64
+	Location      string
+	Timezone      string
+	Metadata      []byte
+}
+
+// StorageTransactionOp is a single operation in a storage transaction. Exactly one field must be set.
+type StorageTransactionOp struct {
+	Write             *StorageData
+	Update            *StorageKeyUpdate
+	Remove            *StorageKey
+	LeaderboardSubmit *LeaderboardSubmit
+}
+
+// StorageTransactionResult is the outcome of the operation at the same index in a storage transaction.
+// Writes and updates set Key, leaderboard submits set LeaderboardRecord, and removes set neither.
+type StorageTransactionResult struct {
+	Key               *StorageKey
+	LeaderboardRecord *LeaderboardRecord
+}
+
+// StorageTransaction runs storage writes, updates and removes for any users, along with leaderboard submits,
+// in order in a single database transaction. If any operation fails, including version checks, none take effect.
+func StorageTransaction(logger *zap.Logger, db *sql.DB, storage *StorageService, caller string, ops []*StorageTransactionOp) ([]*StorageTransactionResult, Error_Code, error) {
+	// Ensure there is at least one operation requested.
+	if len(ops) == 0 {
+		return nil, BAD_INPUT, errors.New("At least one operation is required")
+	}
+
+	for i, op := range ops {
+		set := 0
+		if op.Write != nil {
+			set++
+		}
+		if op.Update != nil {
+			set++
+		}
+		if op.Remove != nil {
+			set++
+		}
+		if op.LeaderboardSubmit != nil {
+			set++
+		}
+		if set != 1 {
+			return nil, BAD_INPUT, fmt.Errorf("Invalid operation index %v: Exactly one operation must be set", i)
+		}
+	}
+
+	// Use same timestamp for all storage operations in this transaction.
+	ts := nowMs()
+
+	// Start a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not run storage transaction, transaction error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not run storage transaction")
+	}
+
+	results := make([]*StorageTransactionResult, len(ops))
+	changes := make([]*storageChange, 0)
+	for i, op := range ops {
+		result := &StorageTransactionResult{}
+		var opChanges []*storageChange
+		var code Error_Code
+		var err error
+
+		switch {
+		case op.Write != nil:
+			var keys []*StorageKey
+			keys, opChanges, code, err = storageWrite(logger, tx, storage, caller, []*StorageData{op.Write}, ts)
+			if err == nil {
+				result.Key = keys[0]
+			}
+		case op.Update != nil:
+			var keys []*StorageKey
+			keys, opChanges, code, err = storageUpdate(logger, tx, storage, caller, []*StorageKeyUpdate{op.Update}, ts)
+			if err == nil {
+				result.Key = keys[0]
+			}
+		case op.Remove != nil:
+			opChanges, code, err = storageRemove(logger, tx, storage, caller, []*StorageKey{op.Remove}, ts)
+		case op.LeaderboardSubmit != nil:
+			s := op.LeaderboardSubmit
+			result.LeaderboardRecord, code, err = leaderboardSubmit(logger, tx, caller, s.LeaderboardID, s.OwnerID, s.Handle, s.Lang, s.Op, s.Value, s.Location, s.Timezone, s.Metadata)
+		}
+
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not run storage transaction, rollback error", zap.Error(e))
+			}
+			return nil, code, fmt.Errorf("Storage transaction operation index %v failed: %v", i, err.Error())
+		}
+
+		results[i] = result
+		changes = append(changes, opChanges...)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("Could not run storage transaction, commit error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not run storage transaction")
+	}
+
+	storage.notify(changes)
+
+	return results, 0, nil
+}
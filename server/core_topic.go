@@ -0,0 +1,632 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// messageTopic returns the stored topic value and topic type for a topic ID.
+func messageTopic(topic *TopicId) (string, int64) {
+	switch topic.Id.(type) {
+	case *TopicId_Dm:
+		return topic.GetDm(), 0
+	case *TopicId_Room:
+		return topic.GetRoom(), 1
+	case *TopicId_GroupId:
+		return topic.GetGroupId(), 2
+	}
+	return "", 0
+}
+
+// dmOtherUser returns the other participant in a direct message topic, or false if the user is not a participant.
+// Direct message topic IDs are the two participants' user IDs concatenated, so only an exact half matches.
+func dmOtherUser(dm string, userID string) (string, bool) {
+	if userID == "" || len(dm) != 2*len(userID) {
+		return "", false
+	}
+	if dm[:len(userID)] == userID {
+		return dm[len(userID):], true
+	} else if dm[len(userID):] == userID {
+		return dm[:len(userID)], true
+	}
+	return "", false
+}
+
+// Assumes `topic` has already been validated, or was constructed internally.
+func storeMessage(logger *zap.Logger, db *sql.DB, messageRetention *MessageRetentionService, userID string, handle string, topic *TopicId, msgType int64, data []byte) (string, int64, int64, error) {
+	topicValue, topicType := messageTopic(topic)
+	createdAt := nowMs()
+	messageID := generateNewId()
+	expiresAt := messageRetention.ExpiresAt(topic, createdAt)
+	_, err := db.Exec(`
+INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		topicValue, topicType, messageID, userID, createdAt, expiresAt, handle, msgType, data)
+	if err != nil {
+		logger.Error("Failed to insert new message", zap.Error(err))
+		return "", 0, 0, err
+	}
+
+	return messageID, createdAt, expiresAt, nil
+}
+
+func deliverMessage(logger *zap.Logger, tracker Tracker, messageRouter MessageRouter, userID string, handle string, topic *TopicId, msgType int64, data []byte, messageID string, createdAt int64, expiresAt int64) {
+	deliverTopicMessage(logger, tracker, messageRouter, &TopicMessage{
+		Topic:     topic,
+		UserId:    userID,
+		MessageId: messageID,
+		CreatedAt: createdAt,
+		ExpiresAt: expiresAt,
+		Handle:    handle,
+		Type:      msgType,
+		Data:      string(data),
+	})
+}
+
+// trackerTopicFor returns the presence tracker topic for a topic ID.
+func trackerTopicFor(topic *TopicId) string {
+	switch topic.Id.(type) {
+	case *TopicId_Dm:
+		return "dm:" + topic.GetDm()
+	case *TopicId_Room:
+		return "room:" + topic.GetRoom()
+	case *TopicId_GroupId:
+		return "group:" + topic.GetGroupId()
+	}
+	return ""
+}
+
+func deliverTopicMessage(logger *zap.Logger, tracker Tracker, messageRouter MessageRouter, message *TopicMessage) {
+	outgoing := &Envelope{Payload: &Envelope_TopicMessage{TopicMessage: message}}
+
+	presences := tracker.ListByTopic(trackerTopicFor(message.Topic))
+	messageRouter.Send(logger, presences, outgoing, true)
+}
+
+func storeAndDeliverMessage(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, messageRetention *MessageRetentionService, userID string, handle string, topic *TopicId, msgType int64, data []byte) error {
+	messageID, createdAt, expiresAt, err := storeMessage(logger, db, messageRetention, userID, handle, topic, msgType, data)
+	if err != nil {
+		return err
+	}
+	deliverMessage(logger, tracker, messageRouter, userID, handle, topic, msgType, data, messageID, createdAt, expiresAt)
+	return nil
+}
+
+// TopicMessageUpdate replaces the data of a chat message. Only the message author, or a group admin for group topics, can update it.
+func TopicMessageUpdate(logger *zap.Logger, db *sql.DB, userID string, topic *TopicId, messageID string, data []byte) (*TopicMessage, Error_Code, error) {
+	topicValue, topicType := messageTopic(topic)
+	updatedAt := nowMs()
+
+	message := &TopicMessage{
+		Topic:     topic,
+		MessageId: messageID,
+		UpdatedAt: updatedAt,
+		Data:      string(data),
+	}
+	err := db.QueryRow(`
+UPDATE message SET data = $4, updated_at = $5
+WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND type = 0
+AND (user_id = $6 OR (topic_type = 2 AND EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $6 AND state = 0)))
+RETURNING user_id, created_at, expires_at, handle, type`,
+		topicValue, topicType, messageID, data, updatedAt, userID).Scan(&message.UserId, &message.CreatedAt, &message.ExpiresAt, &message.Handle, &message.Type)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, BAD_INPUT, errors.New("Message not found, or not allowed to update it")
+		}
+		logger.Error("Could not update message", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not update message")
+	}
+
+	return message, 0, nil
+}
+
+// TopicMessageRemove deletes a chat message. Only the message author, or a group admin for group topics, can remove it.
+func TopicMessageRemove(logger *zap.Logger, db *sql.DB, userID string, topic *TopicId, messageID string) (*TopicMessage, Error_Code, error) {
+	topicValue, topicType := messageTopic(topic)
+
+	message := &TopicMessage{
+		Topic:     topic,
+		MessageId: messageID,
+		UpdatedAt: nowMs(),
+		Removed:   true,
+	}
+	err := db.QueryRow(`
+DELETE FROM message
+WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND type = 0
+AND (user_id = $4 OR (topic_type = 2 AND EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $4 AND state = 0)))
+RETURNING user_id, created_at, expires_at, handle, type`,
+		topicValue, topicType, messageID, userID).Scan(&message.UserId, &message.CreatedAt, &message.ExpiresAt, &message.Handle, &message.Type)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, BAD_INPUT, errors.New("Message not found, or not allowed to remove it")
+		}
+		logger.Error("Could not remove message", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not remove message")
+	}
+
+	return message, 0, nil
+}
+
+// ensureReadCursor makes sure a user has a read cursor for a topic, so the topic shows in their unread counts.
+func ensureReadCursor(db *sql.DB, userID string, topic *TopicId) error {
+	topicValue, topicType := messageTopic(topic)
+	_, err := db.Exec(`
+INSERT INTO message_read (user_id, topic, topic_type, message_id, read_at, updated_at)
+VALUES ($1, $2, $3, '', 0, $4)
+ON CONFLICT (user_id, topic, topic_type) DO NOTHING`, userID, topicValue, topicType, nowMs())
+	return err
+}
+
+// TopicMessagesRead moves the user's read cursor for a topic forward to the given message, and returns the message creation time.
+func TopicMessagesRead(logger *zap.Logger, db *sql.DB, userID string, topic *TopicId, messageID string) (int64, Error_Code, error) {
+	// Check the user can see the topic.
+	switch topic.Id.(type) {
+	case *TopicId_Dm:
+		if _, ok := dmOtherUser(topic.GetDm(), userID); !ok {
+			return 0, BAD_INPUT, errors.New("Topic not valid")
+		}
+	case *TopicId_GroupId:
+		member, err := isGroupMember(db, userID, topic.GetGroupId())
+		if err != nil {
+			logger.Error("Could not check if user is group member", zap.Error(err))
+			return 0, RUNTIME_EXCEPTION, errors.New("Failed to look up group membership")
+		} else if !member {
+			return 0, BAD_INPUT, errors.New("Group not found, or not a member")
+		}
+	}
+
+	topicValue, topicType := messageTopic(topic)
+
+	var readAt int64
+	err := db.QueryRow("SELECT created_at FROM message WHERE topic = $1 AND topic_type = $2 AND message_id = $3", topicValue, topicType, messageID).Scan(&readAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, BAD_INPUT, errors.New("Message not found")
+		}
+		logger.Error("Could not look up message to mark read", zap.Error(err))
+		return 0, RUNTIME_EXCEPTION, errors.New("Could not mark messages read")
+	}
+
+	_, err = db.Exec(`
+INSERT INTO message_read (user_id, topic, topic_type, message_id, read_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (user_id, topic, topic_type) DO UPDATE SET message_id = excluded.message_id, read_at = excluded.read_at, updated_at = excluded.updated_at
+WHERE message_read.read_at < excluded.read_at`,
+		userID, topicValue, topicType, messageID, readAt, nowMs())
+	if err != nil {
+		logger.Error("Could not mark messages read", zap.Error(err))
+		return 0, RUNTIME_EXCEPTION, errors.New("Could not mark messages read")
+	}
+
+	return readAt, 0, nil
+}
+
+// TopicsUnreadList counts unread messages for each topic the user has a read cursor for, and each group they're a member of.
+func TopicsUnreadList(logger *zap.Logger, db *sql.DB, userID string) ([]*TTopicsUnread_TopicUnread, Error_Code, error) {
+	rows, err := db.Query(`
+SELECT t.topic, t.topic_type, t.message_id, COUNT(m.message_id)
+FROM (
+	SELECT topic, topic_type, message_id, read_at FROM message_read WHERE user_id = $1
+	UNION ALL
+	SELECT destination_id, 2, '', 0 FROM group_edge
+	WHERE source_id = $1 AND state IN (0, 1)
+	AND destination_id NOT IN (SELECT topic FROM message_read WHERE user_id = $1 AND topic_type = 2)
+) AS t
+LEFT JOIN message m ON m.topic = t.topic AND m.topic_type = t.topic_type AND m.created_at > t.read_at
+	AND m.user_id != $1 AND (m.expires_at = 0 OR m.expires_at > $2)
+GROUP BY t.topic, t.topic_type, t.message_id`, userID, nowMs())
+	if err != nil {
+		logger.Error("Could not count unread messages", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not count unread messages")
+	}
+	defer rows.Close()
+
+	topics := make([]*TTopicsUnread_TopicUnread, 0)
+	for rows.Next() {
+		var topicValue []byte
+		var topicType int64
+		var messageID []byte
+		var count int64
+		if err = rows.Scan(&topicValue, &topicType, &messageID, &count); err != nil {
+			logger.Error("Could not scan unread message counts", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not count unread messages")
+		}
+
+		topic := &TopicId{}
+		switch topicType {
+		case 0:
+			topic.Id = &TopicId_Dm{Dm: string(topicValue)}
+		case 1:
+			topic.Id = &TopicId_Room{Room: string(topicValue)}
+		case 2:
+			topic.Id = &TopicId_GroupId{GroupId: string(topicValue)}
+		}
+
+		topics = append(topics, &TTopicsUnread_TopicUnread{
+			Topic:     topic,
+			Count:     count,
+			MessageId: string(messageID),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not read unread message counts", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not count unread messages")
+	}
+
+	return topics, 0, nil
+}
+
+// TopicSignalSend delivers an ephemeral signal, such as a typing indicator, to the other users in a topic the sender has joined.
+// Signals are never stored.
+func TopicSignalSend(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, sessionID string, userID string, handle string, topic *TopicId, data string, reliable bool) (Error_Code, error) {
+	dataBytes := []byte(data)
+	if len(dataBytes) == 0 || len(dataBytes) > 256 {
+		return BAD_INPUT, errors.New("Data is required and must be 1-256 JSON bytes")
+	}
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(dataBytes, &maybeJSON) != nil {
+		return BAD_INPUT, errors.New("Data must be a valid JSON object")
+	}
+
+	trackerTopic, errMessage := messageTrackerTopic(topic)
+	if errMessage != "" {
+		return BAD_INPUT, errors.New(errMessage)
+	}
+	if !tracker.CheckLocalByIDTopicUser(sessionID, trackerTopic, userID) {
+		return BAD_INPUT, errors.New("Must join topic before sending signals")
+	}
+	if code, err := checkTopicNotRestricted(logger, db, topic, userID); err != nil {
+		return code, err
+	}
+
+	ps := tracker.ListByTopic(trackerTopic)
+	for i := 0; i < len(ps); i++ {
+		if ps[i].ID.SessionID == sessionID {
+			// Don't echo back to sender.
+			ps[i] = ps[len(ps)-1]
+			ps = ps[:len(ps)-1]
+			break
+		}
+	}
+
+	outgoing := &Envelope{Payload: &Envelope_TopicSignal{TopicSignal: &TopicSignal{
+		Topic:  topic,
+		UserId: userID,
+		Handle: handle,
+		Data:   data,
+	}}}
+	messageRouter.Send(logger, ps, outgoing, reliable)
+	return 0, nil
+}
+
+// isGroupMember checks if the user is a member or admin of the group.
+func isGroupMember(db queryer, userID string, groupID string) (bool, error) {
+	var state int64
+	err := db.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", userID, groupID).Scan(&state)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+
+		return false, err
+	}
+	return state == 0 || state == 1, nil
+}
+
+// escapeLikePattern escapes wildcard characters so the text matches literally in a LIKE pattern.
+func escapeLikePattern(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+}
+
+// TopicMessagesSearch searches a topic's message history, newest first. Each non-empty filter must match:
+// text is a case-insensitive match within the message data, senderID is the user who sent the message,
+// and startTime and endTime bound the message creation time inclusively.
+// If a caller is given they must be able to access the topic, an empty caller is the script runtime.
+func TopicMessagesSearch(logger *zap.Logger, db *sql.DB, caller string, topic *TopicId, text string, senderID string, startTime int64, endTime int64, limit int64, cursor string) ([]*TopicMessage, string, Error_Code, error) {
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, "", BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+	if startTime != 0 && endTime != 0 && startTime > endTime {
+		return nil, "", BAD_INPUT, errors.New("Start time must not be after end time")
+	}
+
+	var incomingCursor *messageCursor
+	if cursor != "" {
+		if cb, err := base64.StdEncoding.DecodeString(cursor); err != nil {
+			return nil, "", BAD_INPUT, errors.New("Invalid cursor data")
+		} else {
+			incomingCursor = &messageCursor{}
+			if err := gob.NewDecoder(bytes.NewReader(cb)).Decode(incomingCursor); err != nil {
+				return nil, "", BAD_INPUT, errors.New("Invalid cursor data")
+			}
+		}
+	}
+
+	// Check the caller can see the topic.
+	if caller != "" {
+		switch topic.Id.(type) {
+		case *TopicId_Dm:
+			if _, ok := dmOtherUser(topic.GetDm(), caller); !ok {
+				return nil, "", BAD_INPUT, errors.New("Topic not valid")
+			}
+		case *TopicId_GroupId:
+			member, err := isGroupMember(db, caller, topic.GetGroupId())
+			if err != nil {
+				logger.Error("Could not check if user is group member", zap.Error(err))
+				return nil, "", RUNTIME_EXCEPTION, errors.New("Failed to look up group membership")
+			} else if !member {
+				return nil, "", BAD_INPUT, errors.New("Group not found, or not a member")
+			}
+		}
+	}
+
+	topicValue, topicType := messageTopic(topic)
+	query := "SELECT message_id, user_id, created_at, expires_at, updated_at, handle, type, data FROM message WHERE topic = $1 AND topic_type = $2 AND (expires_at = 0 OR expires_at > $3)"
+	params := []interface{}{topicValue, topicType, nowMs()}
+
+	if text != "" {
+		params = append(params, "%"+escapeLikePattern(text)+"%")
+		query += fmt.Sprintf(" AND data::STRING ILIKE $%v", len(params))
+	}
+	if senderID != "" {
+		params = append(params, senderID)
+		query += fmt.Sprintf(" AND user_id = $%v", len(params))
+	}
+	if startTime != 0 {
+		params = append(params, startTime)
+		query += fmt.Sprintf(" AND created_at >= $%v", len(params))
+	}
+	if endTime != 0 {
+		params = append(params, endTime)
+		query += fmt.Sprintf(" AND created_at <= $%v", len(params))
+	}
+	if incomingCursor != nil {
+		i := len(params)
+		query += fmt.Sprintf(" AND (created_at, message_id, user_id) < ($%v, $%v, $%v)", i+1, i+2, i+3)
+		params = append(params, incomingCursor.CreatedAt, incomingCursor.MessageID, incomingCursor.UserID)
+	}
+
+	params = append(params, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, message_id DESC, user_id DESC LIMIT $%v", len(params))
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Could not search topic messages", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Could not search topic messages")
+	}
+	defer rows.Close()
+
+	messages := make([]*TopicMessage, 0)
+	var outgoingCursor string
+	var messageID string
+	var userID string
+	var createdAt int64
+	var expiresAt int64
+	var updatedAt int64
+	var handle string
+	var msgType int64
+	var data []byte
+	for rows.Next() {
+		if int64(len(messages)) >= limit {
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&messageCursor{MessageID: messageID, UserID: userID, CreatedAt: createdAt}); err != nil {
+				logger.Error("Error creating topic messages search cursor", zap.Error(err))
+				return nil, "", RUNTIME_EXCEPTION, errors.New("Could not search topic messages")
+			}
+			outgoingCursor = base64.StdEncoding.EncodeToString(cursorBuf.Bytes())
+			break
+		}
+		if err = rows.Scan(&messageID, &userID, &createdAt, &expiresAt, &updatedAt, &handle, &msgType, &data); err != nil {
+			logger.Error("Error scanning topic messages search", zap.Error(err))
+			return nil, "", RUNTIME_EXCEPTION, errors.New("Could not search topic messages")
+		}
+
+		messages = append(messages, &TopicMessage{
+			Topic:     topic,
+			UserId:    userID,
+			MessageId: messageID,
+			CreatedAt: createdAt,
+			ExpiresAt: expiresAt,
+			UpdatedAt: updatedAt,
+			Handle:    handle,
+			Type:      msgType,
+			Data:      string(data),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Error reading topic messages search", zap.Error(err))
+		return nil, "", RUNTIME_EXCEPTION, errors.New("Could not search topic messages")
+	}
+
+	return messages, outgoingCursor, 0, nil
+}
+
+// TopicMute stops a user sending messages to a room or group topic until the given time.
+func TopicMute(logger *zap.Logger, db *sql.DB, topic *TopicId, userID string, mutedUntil int64) (Error_Code, error) {
+	topicValue, topicType := messageTopic(topic)
+	updatedAt := nowMs()
+	_, err := db.Exec(`
+INSERT INTO topic_moderation (topic, topic_type, user_id, muted_until, updated_at)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (topic, topic_type, user_id) DO UPDATE SET muted_until = excluded.muted_until, updated_at = excluded.updated_at`,
+		topicValue, topicType, userID, mutedUntil, updatedAt)
+	if err != nil {
+		logger.Error("Could not mute user in topic", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not mute user in topic")
+	}
+	return 0, nil
+}
+
+// TopicUnmute lets a muted user send messages to a topic again.
+func TopicUnmute(logger *zap.Logger, db *sql.DB, topic *TopicId, userID string) (Error_Code, error) {
+	topicValue, topicType := messageTopic(topic)
+	_, err := db.Exec("UPDATE topic_moderation SET muted_until = 0, updated_at = $4 WHERE topic = $1 AND topic_type = $2 AND user_id = $3",
+		topicValue, topicType, userID, nowMs())
+	if err != nil {
+		logger.Error("Could not unmute user in topic", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not unmute user in topic")
+	}
+	return 0, nil
+}
+
+// TopicKick removes all of a user's presences from a topic. They are free to join again unless also banned.
+func TopicKick(logger *zap.Logger, tracker Tracker, messageRouter MessageRouter, topic *TopicId, userID string) {
+	t := trackerTopicFor(topic)
+	presences := tracker.ListByTopicUser(t, userID)
+	if len(presences) == 0 {
+		return
+	}
+
+	leaves := make([]*UserPresence, len(presences))
+	for i, p := range presences {
+		tracker.Untrack(p.ID.SessionID, t, userID)
+		leaves[i] = &UserPresence{
+			UserId:    p.UserID,
+			SessionId: p.ID.SessionID,
+			Handle:    p.Meta.Handle,
+		}
+	}
+
+	// Other topic members are told about the leave as usual, but the kicked sessions are no longer in the topic so tell them directly.
+	outgoing := &Envelope{Payload: &Envelope_TopicPresence{TopicPresence: &TopicPresence{Topic: topic, Leaves: leaves}}}
+	messageRouter.Send(logger, presences, outgoing, true)
+}
+
+// TopicBan kicks a user from a topic and stops them joining it again.
+func TopicBan(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, topic *TopicId, userID string) (Error_Code, error) {
+	topicValue, topicType := messageTopic(topic)
+	updatedAt := nowMs()
+	_, err := db.Exec(`
+INSERT INTO topic_moderation (topic, topic_type, user_id, banned_at, updated_at)
+VALUES ($1, $2, $3, $4, $4)
+ON CONFLICT (topic, topic_type, user_id) DO UPDATE SET banned_at = excluded.banned_at, updated_at = excluded.updated_at`,
+		topicValue, topicType, userID, updatedAt)
+	if err != nil {
+		logger.Error("Could not ban user from topic", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not ban user from topic")
+	}
+
+	TopicKick(logger, tracker, messageRouter, topic, userID)
+	return 0, nil
+}
+
+// TopicUnban lets a banned user join a topic again.
+func TopicUnban(logger *zap.Logger, db *sql.DB, topic *TopicId, userID string) (Error_Code, error) {
+	topicValue, topicType := messageTopic(topic)
+	_, err := db.Exec("UPDATE topic_moderation SET banned_at = 0, updated_at = $4 WHERE topic = $1 AND topic_type = $2 AND user_id = $3",
+		topicValue, topicType, userID, nowMs())
+	if err != nil {
+		logger.Error("Could not unban user from topic", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not unban user from topic")
+	}
+	return 0, nil
+}
+
+// topicRestrictions returns whether a user is currently muted or banned in a topic.
+func topicRestrictions(db *sql.DB, topic *TopicId, userID string) (bool, bool, error) {
+	topicValue, topicType := messageTopic(topic)
+	var mutedUntil int64
+	var bannedAt int64
+	err := db.QueryRow("SELECT muted_until, banned_at FROM topic_moderation WHERE topic = $1 AND topic_type = $2 AND user_id = $3",
+		topicValue, topicType, userID).Scan(&mutedUntil, &bannedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	return mutedUntil > nowMs(), bannedAt > 0, nil
+}
+
+// checkTopicNotRestricted returns an error if the user is muted or banned in the topic. Direct message topics are never restricted.
+func checkTopicNotRestricted(logger *zap.Logger, db *sql.DB, topic *TopicId, userID string) (Error_Code, error) {
+	if _, ok := topic.Id.(*TopicId_Dm); ok {
+		return 0, nil
+	}
+
+	muted, banned, err := topicRestrictions(db, topic, userID)
+	if err != nil {
+		logger.Error("Could not check topic restrictions", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Failed to look up topic restrictions")
+	} else if banned {
+		return TOPIC_RESTRICTED, errors.New("Banned from topic")
+	} else if muted {
+		return TOPIC_RESTRICTED, errors.New("Muted in topic")
+	}
+	return 0, nil
+}
+
+// notifyDmRecipient sends the other user in a direct message topic a notification about a new message, if they have not joined the topic.
+// There is a single notification per conversation, which is replaced with the latest message and unread message count.
+func notifyDmRecipient(logger *zap.Logger, db *sql.DB, tracker Tracker, notificationService *NotificationService, userID string, handle string, topic *TopicId, messageID string, data []byte) error {
+	dm := topic.GetDm()
+	recipientID, ok := dmOtherUser(dm, userID)
+	if !ok {
+		return errors.New("Sender is not part of the direct message topic")
+	}
+	if len(tracker.ListByTopicUser("dm:"+dm, recipientID)) != 0 {
+		return nil
+	}
+
+	var unread int64
+	err := db.QueryRow(`
+SELECT COUNT(*) FROM message
+WHERE topic = $1 AND topic_type = 0 AND user_id != $2 AND (expires_at = 0 OR expires_at > $3)
+AND created_at > COALESCE((SELECT read_at FROM message_read WHERE user_id = $2 AND topic = $1 AND topic_type = 0), 0)`,
+		dm, recipientID, nowMs()).Scan(&unread)
+	if err != nil {
+		logger.Error("Could not count unread direct messages", zap.Error(err))
+		return err
+	}
+
+	content, err := json.Marshal(map[string]interface{}{
+		"handle":       handle,
+		"topic":        dm,
+		"message_id":   messageID,
+		"data":         json.RawMessage(data),
+		"unread_count": unread,
+	})
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("%v sent you a message", handle)
+	if unread > 1 {
+		subject = fmt.Sprintf("%v sent you %v messages", handle, unread)
+	}
+
+	return notificationService.NotificationCollapse(&NNotification{
+		// The same ID for every notification about this conversation lets newer notifications replace older ones.
+		Id:       base64.RawURLEncoding.EncodeToString(uuid.NewV5(uuid.NamespaceOID, recipientID+":"+dm).Bytes()),
+		UserID:   recipientID,
+		Subject:  subject,
+		Content:  content,
+		Code:     NOTIFICATION_DM_MESSAGE,
+		SenderID: userID,
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MessageRetentionService decides when topic messages expire, and periodically removes expired messages.
+type MessageRetentionService struct {
+	logger *zap.Logger
+	db     *sql.DB
+	config *TopicConfig
+	stop   chan struct{}
+}
+
+// NewMessageRetentionService creates a new MessageRetentionService and starts the expired message sweeper.
+func NewMessageRetentionService(logger *zap.Logger, db *sql.DB, config *TopicConfig) *MessageRetentionService {
+	m := &MessageRetentionService{
+		logger: logger,
+		db:     db,
+		config: config,
+		stop:   make(chan struct{}),
+	}
+
+	if config.SweepIntervalMs > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(config.SweepIntervalMs) * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-m.stop:
+					return
+				case <-ticker.C:
+					m.Sweep()
+				}
+			}
+		}()
+	}
+
+	return m
+}
+
+// Stop ends the expired message sweeper.
+func (m *MessageRetentionService) Stop() {
+	close(m.stop)
+}
+
+// ExpiresAt returns the expiry time for a message created in the given topic at the given time, or 0 if it should not expire.
+// A nil service never expires messages.
+func (m *MessageRetentionService) ExpiresAt(topic *TopicId, createdAt int64) int64 {
+	if m == nil {
+		return 0
+	}
+
+	var expiryMs int64
+	switch topic.Id.(type) {
+	case *TopicId_Dm:
+		expiryMs = m.config.DmExpiryMs
+	case *TopicId_Room:
+		expiryMs = m.config.RoomExpiryMs
+		if override, ok := m.config.RoomExpiryOverridesMs[topic.GetRoom()]; ok {
+			expiryMs = override
+		}
+	case *TopicId_GroupId:
+		expiryMs = m.config.GroupExpiryMs
+	}
+
+	if expiryMs <= 0 {
+		return 0
+	}
+	return createdAt + expiryMs
+}
+
+// Sweep deletes expired messages in batches, and returns how many were removed.
+func (m *MessageRetentionService) Sweep() int64 {
+	batchSize := m.config.SweepBatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	var total int64
+	now := nowMs()
+	for {
+		res, err := m.db.Exec("DELETE FROM message WHERE expires_at > 0 AND expires_at <= $1 LIMIT $2", now, batchSize)
+		if err != nil {
+			m.logger.Error("Could not remove expired messages", zap.Error(err))
+			break
+		}
+		count, err := res.RowsAffected()
+		if err != nil {
+			m.logger.Error("Could not count expired messages removed", zap.Error(err))
+			break
+		}
+		total += count
+		if count < batchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		m.logger.Debug("Removed expired messages", zap.Int64("count", total))
+	}
+	return total
+}
@@ -0,0 +1,292 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	MODERATION_ALLOW  = "allow"
+	MODERATION_MASK   = "mask"
+	MODERATION_REJECT = "reject"
+	MODERATION_FLAG   = "flag"
+)
+
+const (
+	MODERATION_KIND_CHAT       = "chat"
+	MODERATION_KIND_HANDLE     = "handle"
+	MODERATION_KIND_GROUP_NAME = "group_name"
+)
+
+// ModerationService checks user content against configured word lists and patterns, and lets the script runtime override decisions.
+type ModerationService struct {
+	logger      *zap.Logger
+	config      *ModerationConfig
+	runtimePool *RuntimePool
+	rules       []*regexp.Regexp
+	langRules   map[string][]*regexp.Regexp
+}
+
+// NewModerationService creates a new ModerationService, or returns an error if the configuration is not valid.
+func NewModerationService(logger *zap.Logger, config *ModerationConfig, runtimePool *RuntimePool) (*ModerationService, error) {
+	switch config.Mode {
+	case MODERATION_MASK, MODERATION_REJECT, MODERATION_FLAG:
+	default:
+		return nil, fmt.Errorf("Moderation mode must be one of '%v', '%v' or '%v'", MODERATION_MASK, MODERATION_REJECT, MODERATION_FLAG)
+	}
+
+	rules, err := compileModerationRules(config.Words, config.Patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	langRules := make(map[string][]*regexp.Regexp)
+	for lang, words := range config.LangWords {
+		r, err := compileModerationRules(words, nil)
+		if err != nil {
+			return nil, err
+		}
+		lang = strings.ToLower(lang)
+		langRules[lang] = append(langRules[lang], r...)
+	}
+	for lang, patterns := range config.LangPatterns {
+		r, err := compileModerationRules(nil, patterns)
+		if err != nil {
+			return nil, err
+		}
+		lang = strings.ToLower(lang)
+		langRules[lang] = append(langRules[lang], r...)
+	}
+
+	return &ModerationService{
+		logger:      logger,
+		config:      config,
+		runtimePool: runtimePool,
+		rules:       rules,
+		langRules:   langRules,
+	}, nil
+}
+
+func compileModerationRules(words []string, patterns []string) ([]*regexp.Regexp, error) {
+	rules := make([]*regexp.Regexp, 0)
+
+	if len(words) != 0 {
+		quoted := make([]string, 0, len(words))
+		for _, word := range words {
+			if word == "" {
+				continue
+			}
+			q := regexp.QuoteMeta(word)
+			// Only match whole words, where word boundaries make sense for the characters involved.
+			if isWordByte(word[0]) {
+				q = `\b` + q
+			}
+			if isWordByte(word[len(word)-1]) {
+				q = q + `\b`
+			}
+			quoted = append(quoted, q)
+		}
+		if len(quoted) != 0 {
+			rule, err := regexp.Compile("(?i)(?:" + strings.Join(quoted, "|") + ")")
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	for _, pattern := range patterns {
+		rule, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid moderation pattern %q: %v", pattern, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+// Enabled returns true if content of the given kind should be moderated.
+func (m *ModerationService) Enabled(kind string) bool {
+	if m == nil {
+		return false
+	}
+	switch kind {
+	case MODERATION_KIND_HANDLE:
+		return m.config.Handles
+	case MODERATION_KIND_GROUP_NAME:
+		return m.config.GroupNames
+	}
+	return true
+}
+
+// Filter checks a single piece of text against the rules for a language, and returns it with any matches masked.
+func (m *ModerationService) Filter(lang string, text string) (string, bool) {
+	matched := false
+	mask := func(s string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(s))
+	}
+
+	rules := m.rules
+	lang = strings.ToLower(lang)
+	if r, ok := m.langRules[lang]; ok {
+		rules = append(rules[:len(rules):len(rules)], r...)
+	} else if i := strings.IndexAny(lang, "-_"); i > 0 {
+		// Fall back to the primary language, for example "en" for "en-US".
+		if r, ok := m.langRules[lang[:i]]; ok {
+			rules = append(rules[:len(rules):len(rules)], r...)
+		}
+	}
+
+	for _, rule := range rules {
+		if rule.MatchString(text) {
+			matched = true
+			text = rule.ReplaceAllStringFunc(text, mask)
+		}
+	}
+	return text, matched
+}
+
+// filterJSON masks matches in all string values in a JSON object, keeping keys as they are.
+func (m *ModerationService) filterJSON(lang string, data string) (string, bool, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return "", false, err
+	}
+
+	var walk func(v interface{}) (interface{}, bool)
+	walk = func(v interface{}) (interface{}, bool) {
+		switch t := v.(type) {
+		case string:
+			return m.Filter(lang, t)
+		case []interface{}:
+			matched := false
+			for i, e := range t {
+				var ok bool
+				t[i], ok = walk(e)
+				matched = matched || ok
+			}
+			return t, matched
+		case map[string]interface{}:
+			matched := false
+			for k, e := range t {
+				var ok bool
+				t[k], ok = walk(e)
+				matched = matched || ok
+			}
+			return t, matched
+		}
+		return v, false
+	}
+
+	value, matched := walk(value)
+	if !matched {
+		return data, false, nil
+	}
+	masked, err := json.Marshal(value)
+	if err != nil {
+		return "", false, err
+	}
+	return string(masked), true, nil
+}
+
+// Moderate runs content of the given kind through the moderation rules and any registered runtime moderation function.
+// Returns the content to use, which may be masked, and the action taken. Content is never returned with a reject action.
+// Chat content is expected to be a JSON object, only string values are checked.
+func (m *ModerationService) Moderate(logger *zap.Logger, session session, kind string, content string) (string, string, error) {
+	if !m.Enabled(kind) {
+		return content, MODERATION_ALLOW, nil
+	}
+
+	var masked string
+	var matched bool
+	if kind == MODERATION_KIND_CHAT {
+		var err error
+		if masked, matched, err = m.filterJSON(session.Lang(), content); err != nil {
+			return "", "", err
+		}
+	} else {
+		masked, matched = m.Filter(session.Lang(), content)
+	}
+
+	action := MODERATION_ALLOW
+	if matched {
+		action = m.config.Mode
+	}
+
+	// Let the runtime override the decision, and optionally the content.
+	var override string
+	if m.runtimePool != nil && m.runtimePool.HasModeration() {
+		runtime := m.runtimePool.Get()
+		fn := runtime.GetRuntimeCallback(MODERATION, "")
+		if fn != nil {
+			result, fnErr := runtime.InvokeFunctionModeration(fn, session.UserID(), session.Handle(), session.Expiry(), map[string]interface{}{
+				"Kind":    kind,
+				"Lang":    session.Lang(),
+				"Content": content,
+				"Masked":  masked,
+				"Action":  action,
+			})
+			m.runtimePool.Put(runtime)
+			if fnErr != nil {
+				logger.Error("Runtime moderation function caused an error", zap.Error(fnErr))
+				return "", "", fnErr
+			}
+			if result != nil {
+				if a, ok := result["Action"]; ok {
+					switch a {
+					case MODERATION_ALLOW, MODERATION_MASK, MODERATION_REJECT, MODERATION_FLAG:
+						action = a.(string)
+					default:
+						return "", "", errors.New("Runtime moderation function returned an invalid action")
+					}
+				}
+				if c, ok := result["Content"]; ok {
+					if override, ok = c.(string); !ok {
+						return "", "", errors.New("Runtime moderation function returned invalid content")
+					}
+				}
+			}
+		} else {
+			m.runtimePool.Put(runtime)
+		}
+	}
+
+	switch action {
+	case MODERATION_REJECT:
+		return "", action, nil
+	case MODERATION_MASK:
+		content = masked
+	case MODERATION_FLAG:
+		logger.Warn("Content flagged by moderation", zap.String("user_id", session.UserID()), zap.String("kind", kind), zap.String("content", content))
+	}
+	if override != "" {
+		content = override
+	}
+
+	return content, action, nil
+}
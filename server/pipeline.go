@@ -31,11 +31,14 @@ type pipeline struct {
 	matchmaker          Matchmaker
 	hmacSecretByte      []byte
 	messageRouter       MessageRouter
+	messageRetention    *MessageRetentionService
+	storageService      *StorageService
 	sessionRegistry     *SessionRegistry
 	socialClient        *social.Client
 	runtimePool         *RuntimePool
 	purchaseService     *PurchaseService
 	notificationService *NotificationService
+	moderationService   *ModerationService
 	jsonpbMarshaler     *jsonpb.Marshaler
 	jsonpbUnmarshaler   *jsonpb.Unmarshaler
 }
@@ -46,11 +49,14 @@ func NewPipeline(config Config,
 	tracker Tracker,
 	matchmaker Matchmaker,
 	messageRouter MessageRouter,
+	messageRetention *MessageRetentionService,
+	storageService *StorageService,
 	registry *SessionRegistry,
 	socialClient *social.Client,
 	runtimePool *RuntimePool,
 	purchaseService *PurchaseService,
-	notificationService *NotificationService) *pipeline {
+	notificationService *NotificationService,
+	moderationService *ModerationService) *pipeline {
 	return &pipeline{
 		config:              config,
 		db:                  db,
@@ -58,11 +64,14 @@ func NewPipeline(config Config,
 		matchmaker:          matchmaker,
 		hmacSecretByte:      []byte(config.GetSession().EncryptionKey),
 		messageRouter:       messageRouter,
+		messageRetention:    messageRetention,
+		storageService:      storageService,
 		sessionRegistry:     registry,
 		socialClient:        socialClient,
 		runtimePool:         runtimePool,
 		purchaseService:     purchaseService,
 		notificationService: notificationService,
+		moderationService:   moderationService,
 		jsonpbMarshaler: &jsonpb.Marshaler{
 			EnumsAsInts:  true,
 			EmitDefaults: false,
@@ -86,6 +95,16 @@ func (p *pipeline) processRequest(logger *zap.Logger, session session, originalE
 	messageType := fmt.Sprintf("%T", originalEnvelope.Payload)
 	logger.Debug("Received message", zap.String("type", messageType))
 
+	if rateLimiter := session.RateLimiter(); rateLimiter != nil && !rateLimiter.Allow(messageType) {
+		session.Send(ErrorMessage(originalEnvelope.CollationId, RATE_LIMITED, "Rate limit exceeded"), reliable)
+		if disconnectAfter := p.config.GetSocket().RateLimitDisconnectAfter; disconnectAfter > 0 && rateLimiter.Violations() >= disconnectAfter {
+			logger.Warn("Disconnecting session after repeated rate limit violations", zap.Int("violations", rateLimiter.Violations()))
+			p.sessionRegistry.remove(session)
+			session.Close()
+		}
+		return
+	}
+
 	messageType = RUNTIME_MESSAGES[messageType]
 	envelope, fnErr := RuntimeBeforeHook(p.runtimePool, p.jsonpbMarshaler, p.jsonpbUnmarshaler, messageType, originalEnvelope, session)
 	if fnErr != nil {
@@ -120,6 +139,12 @@ func (p *pipeline) processRequest(logger *zap.Logger, session session, originalE
 		p.friendBlock(logger, session, envelope)
 	case *Envelope_FriendsList:
 		p.friendsList(logger, session, envelope)
+	case *Envelope_FriendsImport:
+		p.friendsImport(logger, session, envelope)
+	case *Envelope_FriendsSuggest:
+		p.friendsSuggest(logger, session, envelope)
+	case *Envelope_FriendsMutual:
+		p.friendsMutual(logger, session, envelope)
 
 	case *Envelope_GroupsCreate:
 		p.groupCreate(logger, session, envelope)
@@ -154,6 +179,20 @@ func (p *pipeline) processRequest(logger *zap.Logger, session session, originalE
 		p.topicMessageSend(logger, session, envelope)
 	case *Envelope_TopicMessagesList:
 		p.topicMessagesList(logger, session, envelope)
+	case *Envelope_TopicMessageUpdate:
+		p.topicMessageUpdate(logger, session, envelope)
+	case *Envelope_TopicMessageRemove:
+		p.topicMessageRemove(logger, session, envelope)
+	case *Envelope_TopicMessagesRead:
+		p.topicMessagesRead(logger, session, envelope)
+	case *Envelope_TopicsUnreadList:
+		p.topicsUnreadList(logger, session, envelope)
+	case *Envelope_TopicSignalSend:
+		p.topicSignalSend(logger, session, envelope, reliable)
+	case *Envelope_TopicModerate:
+		p.topicModerate(logger, session, envelope)
+	case *Envelope_TopicMessagesSearch:
+		p.topicMessagesSearch(logger, session, envelope)
 
 	case *Envelope_MatchCreate:
 		p.matchCreate(logger, session, envelope)
@@ -179,6 +218,14 @@ func (p *pipeline) processRequest(logger *zap.Logger, session session, originalE
 		p.storageUpdate(logger, session, envelope)
 	case *Envelope_StorageRemove:
 		p.storageRemove(logger, session, envelope)
+	case *Envelope_StorageQuery:
+		p.storageQuery(logger, session, envelope)
+	case *Envelope_StorageSubscribe:
+		p.storageSubscribe(logger, session, envelope)
+	case *Envelope_StorageUnsubscribe:
+		p.storageUnsubscribe(logger, session, envelope)
+	case *Envelope_StorageHistoryList:
+		p.storageHistoryList(logger, session, envelope)
 
 	case *Envelope_LeaderboardsList:
 		p.leaderboardsList(logger, session, envelope)
@@ -199,6 +246,12 @@ func (p *pipeline) processRequest(logger *zap.Logger, session session, originalE
 		p.notificationsList(logger, session, envelope)
 	case *Envelope_NotificationsRemove:
 		p.notificationsRemove(logger, session, envelope)
+	case *Envelope_NotificationsRead:
+		p.notificationsRead(logger, session, envelope)
+	case *Envelope_NotificationsReadAll:
+		p.notificationsReadAll(logger, session, envelope)
+	case *Envelope_NotificationsUnreadCount:
+		p.notificationsUnreadCount(logger, session, envelope)
 
 	default:
 		session.Send(ErrorMessage(envelope.CollationId, UNRECOGNIZED_PAYLOAD, "Unrecognized payload"), reliable)
@@ -208,6 +261,21 @@ func (p *pipeline) processRequest(logger *zap.Logger, session session, originalE
 	RuntimeAfterHook(logger, p.runtimePool, p.jsonpbMarshaler, messageType, envelope, session)
 }
 
+// moderate runs content through the moderation service, and sends an error if it can't be used.
+// Returns the content to use, and whether processing should continue.
+func (p *pipeline) moderate(logger *zap.Logger, session session, envelope *Envelope, kind string, content string) (string, bool) {
+	result, action, err := p.moderationService.Moderate(logger, session, kind, content)
+	if err != nil {
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not moderate content"), true)
+		return "", false
+	}
+	if action == MODERATION_REJECT {
+		session.Send(ErrorMessage(envelope.CollationId, CONTENT_REJECTED, "Content rejected by moderation"), true)
+		return "", false
+	}
+	return result, true
+}
+
 func ErrorMessageRuntimeException(collationID string, message string) *Envelope {
 	return ErrorMessage(collationID, RUNTIME_EXCEPTION, message)
 }
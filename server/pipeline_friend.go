@@ -16,10 +16,7 @@ package server
 
 import (
 	"database/sql"
-	"errors"
-
-	"encoding/json"
-	"fmt"
+	"strconv"
 
 	"github.com/lib/pq"
 	"go.uber.org/zap"
@@ -81,206 +78,46 @@ FROM users ` + filterQuery
 	return users, nil
 }
 
-func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID string, handle string, fbid string, accessToken string) {
-	var tx *sql.Tx
-	var err error
-
-	ts := nowMs()
-	friendUserIDs := make([]interface{}, 0)
-	defer func() {
-		if err != nil {
-			logger.Error("Could not import friends from Facebook", zap.Error(err))
-			if tx != nil {
-				err = tx.Rollback()
-				if err != nil {
-					logger.Error("Could not rollback transaction", zap.Error(err))
-				}
-			}
-		} else {
-			if tx != nil {
-				err = tx.Commit()
-				if err != nil {
-					logger.Error("Could not commit transaction", zap.Error(err))
-				} else {
-					logger.Debug("Imported friends from Facebook")
-
-					// Send out notifications.
-					if len(friendUserIDs) != 0 {
-						content, err := json.Marshal(map[string]interface{}{"handle": handle, "facebook_id": fbid})
-						if err != nil {
-							logger.Warn("Failed to send Facebook friend join notifications", zap.Error(err))
-							return
-						}
-						subject := "Your friend has just joined the game"
-						expiresAt := ts + p.notificationService.expiryMs
-
-						notifications := make([]*NNotification, len(friendUserIDs))
-						for i, friendUserID := range friendUserIDs {
-							fid := friendUserID.(string)
-							notifications[i] = &NNotification{
-								Id:         generateNewId(),
-								UserID:     fid,
-								Subject:    subject,
-								Content:    content,
-								Code:       NOTIFICATION_FRIEND_JOIN_GAME,
-								SenderID:   userID,
-								CreatedAt:  ts,
-								ExpiresAt:  expiresAt,
-								Persistent: true,
-							}
-						}
-
-						err = p.notificationService.NotificationSend(notifications)
-						if err != nil {
-							logger.Warn("Failed to send Facebook friend join notifications", zap.Error(err))
-						}
-					}
-				}
-			}
-		}
-	}()
-
+func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID string, handle string, fbid string, accessToken string) error {
 	fbFriends, err := p.socialClient.GetFacebookFriends(accessToken)
 	if err != nil {
-		return
-	}
-	if len(fbFriends) == 0 {
-		return
-	}
-
-	tx, err = p.db.Begin()
-	if err != nil {
-		return
+		logger.Error("Could not import friends from Facebook", zap.Error(err))
+		return err
 	}
 
-	query := "SELECT id FROM users WHERE facebook_id IN ("
-	friends := make([]interface{}, len(fbFriends))
+	friendIDs := make([]string, len(fbFriends))
 	for i, fbFriend := range fbFriends {
-		if i != 0 {
-			query += ", "
-		}
-		query += fmt.Sprintf("$%v", i+1)
-		friends[i] = fbFriend.ID
-	}
-	query += ")"
-	rows, err := tx.Query(query, friends...)
-	if err != nil {
-		return
+		friendIDs[i] = fbFriend.ID
 	}
-	defer rows.Close()
-
-	queryEdge := "INSERT INTO user_edge (source_id, position, updated_at, destination_id, state) VALUES "
-	paramsEdge := []interface{}{userID, ts}
-	queryEdgeMetadata := "UPDATE user_edge_metadata SET count = count + 1, updated_at = $1 WHERE source_id IN ("
-	paramsEdgeMetadata := []interface{}{ts}
-	for rows.Next() {
-		var currentUser []byte
-		err = rows.Scan(&currentUser)
-		if err != nil {
-			return
-		}
-
-		if len(paramsEdge) != 2 {
-			queryEdge += ", "
-		}
-		paramsEdge = append(paramsEdge, currentUser)
-		queryEdge += fmt.Sprintf("($1, $2, $2, $%v, 0), ($%v, $2, $2, $1, 0)", len(paramsEdge), len(paramsEdge))
+	return FriendsImport(logger, p.db, p.notificationService, userID, handle, "facebook", fbid, friendIDs)
+}
 
-		if len(paramsEdgeMetadata) != 1 {
-			queryEdgeMetadata += ", "
-		}
-		paramsEdgeMetadata = append(paramsEdgeMetadata, currentUser)
-		queryEdgeMetadata += fmt.Sprintf("$%v", len(paramsEdgeMetadata))
-	}
-	err = rows.Err()
+func (p *pipeline) addGoogleFriends(logger *zap.Logger, userID string, handle string, googleID string, accessToken string) error {
+	googleFriends, err := p.socialClient.GetGoogleFriends(accessToken)
 	if err != nil {
-		return
-	}
-	queryEdgeMetadata += ")"
-
-	// Check if any Facebook friends are already users, if not there are no new edges to handle.
-	if len(paramsEdge) <= 2 {
-		return
+		logger.Error("Could not import friends from Google", zap.Error(err))
+		return err
 	}
 
-	// Insert new friend relationship edges.
-	_, err = tx.Exec(queryEdge, paramsEdge...)
-	if err != nil {
-		return
-	}
-	// Update edge metadata for each user to increment count.
-	_, err = tx.Exec(queryEdgeMetadata, paramsEdgeMetadata...)
-	if err != nil {
-		return
+	friendIDs := make([]string, len(googleFriends))
+	for i, googleFriend := range googleFriends {
+		friendIDs[i] = googleFriend.ID
 	}
-	// Update edge metadata for current user to bump count by number of new friends.
-	_, err = tx.Exec(`UPDATE user_edge_metadata SET count = $1, updated_at = $2 WHERE source_id = $3`, len(paramsEdge)-2, ts, userID)
-	if err != nil {
-		return
-	}
-
-	// Track the user IDs to notify their friend has joined the game.
-	friendUserIDs = paramsEdge[2:]
+	return FriendsImport(logger, p.db, p.notificationService, userID, handle, "google", googleID, friendIDs)
 }
 
-func (p *pipeline) getFriends(tracker Tracker, filterQuery string, userID string) ([]*Friend, error) {
-	query := `
-SELECT id, handle, fullname, avatar_url,
-	lang, location, timezone, metadata,
-	created_at, users.updated_at, state
-FROM users, user_edge ` + filterQuery
-
-	rows, err := p.db.Query(query, userID)
+func (p *pipeline) addSteamFriends(logger *zap.Logger, userID string, handle string, steamID string) error {
+	steamFriends, err := p.socialClient.GetSteamFriends(p.config.GetSocial().Steam.PublisherKey, steamID)
 	if err != nil {
-		return nil, err
+		logger.Error("Could not import friends from Steam", zap.Error(err))
+		return err
 	}
-	defer rows.Close()
-
-	// If the user is currently online this will be their 'last online at' value.
-	ts := nowMs()
-	friends := make([]*Friend, 0)
-
-	for rows.Next() {
-		var id sql.NullString
-		var handle sql.NullString
-		var fullname sql.NullString
-		var avatarURL sql.NullString
-		var lang sql.NullString
-		var location sql.NullString
-		var timezone sql.NullString
-		var metadata []byte
-		var createdAt sql.NullInt64
-		var updatedAt sql.NullInt64
-		var state sql.NullInt64
-
-		err = rows.Scan(&id, &handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata, &createdAt, &updatedAt, &state)
-		if err != nil {
-			return nil, err
-		}
-
-		user := &User{
-			Id:        id.String,
-			Handle:    handle.String,
-			Fullname:  fullname.String,
-			AvatarUrl: avatarURL.String,
-			Lang:      lang.String,
-			Location:  location.String,
-			Timezone:  timezone.String,
-			Metadata:  string(metadata),
-			CreatedAt: createdAt.Int64,
-			UpdatedAt: updatedAt.Int64,
-		}
-		if len(tracker.ListByTopic("notifications:"+id.String)) != 0 {
-			user.LastOnlineAt = ts
-		}
 
-		friends = append(friends, &Friend{
-			User:  user,
-			State: state.Int64,
-		})
+	friendIDs := make([]string, len(steamFriends))
+	for i, steamFriend := range steamFriends {
+		friendIDs[i] = strconv.FormatUint(steamFriend.SteamID, 10)
 	}
-
-	return friends, nil
+	return FriendsImport(logger, p.db, p.notificationService, userID, handle, "steam", steamID, friendIDs)
 }
 
 func (p *pipeline) friendAdd(l *zap.Logger, session session, envelope *Envelope) {
@@ -367,50 +204,14 @@ func (p *pipeline) friendRemove(l *zap.Logger, session session, envelope *Envelo
 		return
 	}
 
-	tx, err := p.db.Begin()
-	if err != nil {
+	if err := friendRemove(logger, p.db, session.UserID(), friendID); err != nil {
 		logger.Error("Could not remove friend", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to remove friend"), true)
 		return
 	}
-	defer func() {
-		if err != nil {
-			logger.Error("Could not remove friend", zap.Error(err))
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
-
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to remove friend"), true)
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to remove friend"), true)
-			} else {
-				logger.Info("Removed friend")
-				session.Send(&Envelope{CollationId: envelope.CollationId}, true)
-			}
-		}
-	}()
-
-	updatedAt := nowMs()
-
-	res, err := tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", session.UserID(), friendID)
-	rowsAffected, _ := res.RowsAffected()
-	if err == nil && rowsAffected > 0 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", session.UserID(), updatedAt)
-	}
-
-	if err != nil {
-		return
-	}
 
-	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", friendID, session.UserID())
-	rowsAffected, _ = res.RowsAffected()
-	if err == nil && rowsAffected > 0 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", friendID, updatedAt)
-	}
+	logger.Info("Removed friend")
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
 func (p *pipeline) friendBlock(l *zap.Logger, session session, envelope *Envelope) {
@@ -437,92 +238,190 @@ func (p *pipeline) friendBlock(l *zap.Logger, session session, envelope *Envelop
 		return
 	}
 
-	tx, err := p.db.Begin()
-	if err != nil {
-		logger.Error("Could not block user", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to block friend"), true)
-		return
-	}
-	defer func() {
-		if err != nil {
-			if _, ok := err.(*pq.Error); ok {
-				logger.Error("Could not block user", zap.Error(err))
-			} else {
-				logger.Warn("Could not block user", zap.Error(err))
-			}
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
-
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not block user"), true)
+	if err := friendBlock(logger, p.db, session.UserID(), userID); err != nil {
+		if _, ok := err.(*pq.Error); ok {
+			logger.Error("Could not block user", zap.Error(err))
 		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not block user"), true)
-			} else {
-				logger.Info("User blocked")
-				session.Send(&Envelope{CollationId: envelope.CollationId}, true)
-			}
+			logger.Warn("Could not block user", zap.Error(err))
 		}
-	}()
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not block user"), true)
+		return
+	}
+
+	logger.Info("User blocked")
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+}
 
-	ts := nowMs()
+func (p *pipeline) friendsList(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetFriendsList()
 
-	// Try to update any previous edge between these users.
-	res, err := tx.Exec("UPDATE user_edge SET state = 3, updated_at = $3 WHERE source_id = $1 AND destination_id = $2",
-		session.UserID(), userID, ts)
+	limit := incoming.PageLimit
+	if limit != 0 && (limit < 10 || limit > 100) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Page limit must be between 10 and 100"), true)
+		return
+	}
+
+	state := int64(-1)
+	if f, ok := incoming.Filter.(*TFriendsList_State); ok {
+		state = f.State
+	}
 
+	friends, cursor, code, err := FriendsList(logger, p.db, p.tracker, session.UserID(), state, limit, incoming.Online, incoming.Cursor)
 	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
 	}
 
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
-		// If there was no previous edge then create one.
-		query := `INSERT INTO user_edge (source_id, destination_id, state, position, updated_at)
-SELECT source_id, destination_id, state, position, updated_at
-FROM (VALUES
-  ($1::BYTEA, $2::BYTEA, 3, $3::BIGINT, $3::BIGINT)
-) AS ue(source_id, destination_id, state, position, updated_at)
-WHERE EXISTS (SELECT id FROM users WHERE id = $2::BYTEA)`
-		res, err = tx.Exec(query, session.UserID(), userID, ts)
-		if err != nil {
-			return
-		}
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Friends{Friends: &TFriends{
+		Friends: friends,
+		Cursor:  cursor,
+	}}}, true)
+}
 
-		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
-			err = errors.New("Could not block user. User ID may not exist")
-			return
-		}
+func (p *pipeline) friendsImport(logger *zap.Logger, session session, envelope *Envelope) {
+	// Route to correct import handler
+	switch envelope.GetFriendsImport().Id.(type) {
+	case *TFriendsImport_Facebook:
+		p.friendsImportFacebook(logger, session, envelope)
+	case *TFriendsImport_Google:
+		p.friendsImportGoogle(logger, session, envelope)
+	case *TFriendsImport_Steam:
+		p.friendsImportSteam(logger, session, envelope)
+	default:
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid payload"), true)
+		return
+	}
+}
 
-		// Update the edge count.
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count + 1, updated_at = $2 WHERE source_id = $1", session.UserID(), ts)
-		if err != nil {
-			return
-		}
+func (p *pipeline) friendsImportFacebook(logger *zap.Logger, session session, envelope *Envelope) {
+	accessToken := envelope.GetFriendsImport().GetFacebook()
+	if accessToken == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Access token is required"), true)
+		return
+	} else if invalidCharsRegex.MatchString(accessToken) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Facebook access token, no spaces or control characters allowed"), true)
+		return
+	}
+
+	fbProfile, err := p.socialClient.GetFacebookProfile(accessToken)
+	if err != nil {
+		logger.Warn("Could not get Facebook profile", zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not get Facebook profile"), true)
+		return
 	}
 
-	// Delete opposite relationship if user hasn't blocked you already
-	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state != 3",
-		userID, session.UserID())
+	var linkedID sql.NullString
+	if err = p.db.QueryRow("SELECT facebook_id FROM users WHERE id = $1", session.UserID()).Scan(&linkedID); err != nil {
+		logger.Error("Could not look up linked Facebook ID", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to import friends"), true)
+		return
+	} else if linkedID.String != fbProfile.ID {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Facebook profile is not linked to the current user"), true)
+		return
+	}
+
+	if err = p.addFacebookFriends(logger, session.UserID(), session.Handle(), fbProfile.ID, accessToken); err != nil {
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to import friends"), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+}
+
+func (p *pipeline) friendsImportGoogle(logger *zap.Logger, session session, envelope *Envelope) {
+	accessToken := envelope.GetFriendsImport().GetGoogle()
+	if accessToken == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Access token is required"), true)
+		return
+	} else if invalidCharsRegex.MatchString(accessToken) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Google access token, no spaces or control characters allowed"), true)
+		return
+	}
 
+	googleProfile, err := p.socialClient.GetGoogleProfile(accessToken)
 	if err != nil {
+		logger.Warn("Could not get Google profile", zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not get Google profile"), true)
+		return
+	}
+
+	var linkedID sql.NullString
+	if err = p.db.QueryRow("SELECT google_id FROM users WHERE id = $1", session.UserID()).Scan(&linkedID); err != nil {
+		logger.Error("Could not look up linked Google ID", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to import friends"), true)
+		return
+	} else if linkedID.String != googleProfile.ID {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Google profile is not linked to the current user"), true)
 		return
 	}
 
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 1 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", userID, ts)
+	if err = p.addGoogleFriends(logger, session.UserID(), session.Handle(), googleProfile.ID, accessToken); err != nil {
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to import friends"), true)
+		return
 	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
-func (p *pipeline) friendsList(logger *zap.Logger, session session, envelope *Envelope) {
-	friends, err := p.getFriends(p.tracker, "WHERE id = destination_id AND source_id = $1", session.UserID())
+func (p *pipeline) friendsImportSteam(logger *zap.Logger, session session, envelope *Envelope) {
+	if p.config.GetSocial().Steam.PublisherKey == "" {
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Steam friends import not available"), true)
+		return
+	}
+
+	if !envelope.GetFriendsImport().GetSteam() {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid payload"), true)
+		return
+	}
+
+	var linkedID sql.NullString
+	if err := p.db.QueryRow("SELECT steam_id FROM users WHERE id = $1", session.UserID()).Scan(&linkedID); err != nil {
+		logger.Error("Could not look up linked Steam ID", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to import friends"), true)
+		return
+	} else if linkedID.String == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "No Steam profile is linked to the current user"), true)
+		return
+	}
+
+	if err := p.addSteamFriends(logger, session.UserID(), session.Handle(), linkedID.String); err != nil {
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to import friends"), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+}
+
+func (p *pipeline) friendsSuggest(logger *zap.Logger, session session, envelope *Envelope) {
+	limit := envelope.GetFriendsSuggest().Limit
+	if limit == 0 {
+		limit = 10
+	} else if limit < 1 || limit > 100 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Limit must be between 1 and 100"), true)
+		return
+	}
+
+	suggestions, code, err := FriendsSuggest(logger, p.db, p.tracker, session.UserID(), limit)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_FriendSuggestions{FriendSuggestions: &TFriendSuggestions{Suggestions: suggestions}}}, true)
+}
+
+func (p *pipeline) friendsMutual(logger *zap.Logger, session session, envelope *Envelope) {
+	userID := envelope.GetFriendsMutual().UserId
+	if userID == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID must be present"), true)
+		return
+	}
+
+	users, code, err := FriendsMutual(logger, p.db, p.tracker, session.UserID(), userID)
 	if err != nil {
-		logger.Error("Could not get friends", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get friends"), true)
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
 	}
 
-	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Friends{Friends: &TFriends{Friends: friends}}}, true)
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Users{Users: &TUsers{Users: users}}}, true)
 }
@@ -16,7 +16,6 @@ package server
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
@@ -24,9 +23,6 @@ import (
 	"strconv"
 	"strings"
 
-	"fmt"
-
-	"github.com/lib/pq"
 	"go.uber.org/zap"
 )
 
@@ -55,6 +51,13 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session session, envelope *En
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group name is mandatory."), true)
 		return
 	}
+	if p.moderationService.Enabled(MODERATION_KIND_GROUP_NAME) {
+		name, ok := p.moderate(logger, session, envelope, MODERATION_KIND_GROUP_NAME, g.Name)
+		if !ok {
+			return
+		}
+		g.Name = name
+	}
 
 	var group *Group
 
@@ -188,6 +191,13 @@ func (p *pipeline) groupUpdate(l *zap.Logger, session session, envelope *Envelop
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata must be a valid JSON object"), true)
 		return
 	}
+	if g.Name != "" && p.moderationService.Enabled(MODERATION_KIND_GROUP_NAME) {
+		name, ok := p.moderate(l, session, envelope, MODERATION_KIND_GROUP_NAME, g.Name)
+		if !ok {
+			return
+		}
+		g.Name = name
+	}
 
 	code, err := GroupsUpdate(l, p.db, session.UserID(), []*TGroupsUpdate_GroupUpdate{g})
 	if err != nil {
@@ -215,58 +225,12 @@ func (p *pipeline) groupRemove(l *zap.Logger, session session, envelope *Envelop
 		return
 	}
 
-	logger := l.With(zap.String("group_id", groupID))
-	failureReason := "Failed to remove group"
-
-	tx, err := p.db.Begin()
-	if err != nil {
-		logger.Error("Could not remove group", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason), true)
-		return
-	}
-	defer func() {
-		if err != nil {
-			logger.Error("Could not remove group", zap.Error(err))
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason), true)
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason), true)
-			} else {
-				logger.Info("Removed group")
-				session.Send(&Envelope{CollationId: envelope.CollationId}, true)
-			}
-		}
-	}()
-
-	res, err := tx.Exec(`
-DELETE FROM groups
-WHERE
-	id = $1
-AND
-	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)
-	`, groupID, session.UserID())
-
-	if err != nil {
-		return
-	}
-
-	rowAffected, err := res.RowsAffected()
-	if err != nil {
-		return
-	}
-	if rowAffected == 0 {
-		err = errors.New("Could not remove group. User may not be group admin or group may not exist")
-		failureReason = "Could not remove group. Make sure you are a group admin and group exists"
+	if code, err := GroupRemove(l, p.db, session.UserID(), groupID); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
 	}
 
-	_, err = tx.Exec("DELETE FROM group_edge WHERE source_id = $1 OR destination_id = $1", groupID)
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
 func (p *pipeline) groupsFetch(logger *zap.Logger, session session, envelope *Envelope) {
@@ -495,135 +459,12 @@ func (p *pipeline) groupJoin(l *zap.Logger, session session, envelope *Envelope)
 		return
 	}
 
-	logger := l.With(zap.String("group_id", groupID))
-
-	ts := nowMs()
-
-	// Group admin user IDs to notify there's a new user join request, if the group is private.
-	var groupName sql.NullString
-	privateGroup := false
-	adminUserIDs := make([]string, 0)
-
-	tx, err := p.db.Begin()
-	if err != nil {
-		logger.Error("Could not add user to group", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"), true)
-		return
-	}
-	defer func() {
-		if err != nil {
-			logger.Error("Could not join group", zap.Error(err))
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
-
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not join group"), true)
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not join group"), true)
-			} else {
-				logger.Info("User joined group")
-				session.Send(&Envelope{CollationId: envelope.CollationId}, true)
-
-				if !privateGroup {
-					// If the user was added directly.
-					err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 1, []byte("{}"))
-					if err != nil {
-						logger.Error("Error handling group user join notification topic message", zap.Error(err))
-					}
-				} else if len(adminUserIDs) != 0 {
-					// If the user has requested to join and there are admins to notify.
-					handle := session.Handle()
-					name := groupName.String
-					content, err := json.Marshal(map[string]string{"handle": handle, "name": name})
-					if err != nil {
-						logger.Warn("Failed to send group join request notification", zap.Error(err))
-						return
-					}
-					subject := fmt.Sprintf("%v wants to join your group %v", handle, name)
-					userID := session.UserID()
-					expiresAt := ts + p.notificationService.expiryMs
-
-					notifications := make([]*NNotification, len(adminUserIDs))
-					for i, adminUserID := range adminUserIDs {
-						notifications[i] = &NNotification{
-							Id:         generateNewId(),
-							UserID:     adminUserID,
-							Subject:    subject,
-							Content:    content,
-							Code:       NOTIFICATION_GROUP_JOIN_REQUEST,
-							SenderID:   userID,
-							CreatedAt:  ts,
-							ExpiresAt:  expiresAt,
-							Persistent: true,
-						}
-					}
-
-					err = p.notificationService.NotificationSend(notifications)
-					if err != nil {
-						logger.Warn("Failed to send group join request notification", zap.Error(err))
-					}
-				}
-			}
-		}
-	}()
-
-	var groupState sql.NullInt64
-	err = tx.QueryRow("SELECT state, name FROM groups WHERE id = $1 AND disabled_at = 0", groupID).Scan(&groupState, &groupName)
-	if err != nil {
-		return
-	}
-
-	userState := 1
-	if groupState.Int64 == 1 {
-		privateGroup = true
-		userState = 2
-	}
-
-	res, err := tx.Exec(`
-INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
-VALUES ($1::BYTEA, $2, $2, $3::BYTEA, $4), ($3::BYTEA, $2, $2, $1::BYTEA, $4)`,
-		groupID, ts, session.UserID(), userState)
-
-	if err != nil {
-		return
-	}
-
-	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not accept group join envelope. Group may not exists with the given ID"), true)
-		return
-	}
-
-	// If the group is not private and the user joined directly, increase the group count.
-	if !privateGroup {
-		_, err = tx.Exec("UPDATE groups SET count = count + 1, updated_at = $2 WHERE id = $1", groupID, ts)
-	}
-	if err != nil {
+	if code, err := GroupJoin(l, p.db, p.tracker, p.messageRouter, p.messageRetention, p.notificationService, session.UserID(), session.Handle(), groupID); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
 	}
 
-	// If group is private, look up admin user IDs to notify about a new user requesting to join.
-	if privateGroup {
-		rows, e := tx.Query("SELECT destination_id FROM group_edge WHERE source_id = $1 AND state = 0", groupID)
-		if e != nil {
-			logger.Warn("Failed to send group join request notification", zap.Error(e))
-			return
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var adminUserID sql.NullString
-			e = rows.Scan(&adminUserID)
-			if e != nil {
-				logger.Warn("Failed to send group join request notification", zap.Error(e))
-				return
-			}
-			adminUserIDs = append(adminUserIDs, adminUserID.String)
-		}
-	}
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
 func (p *pipeline) groupLeave(l *zap.Logger, session session, envelope *Envelope) {
@@ -642,107 +483,12 @@ func (p *pipeline) groupLeave(l *zap.Logger, session session, envelope *Envelope
 		return
 	}
 
-	logger := l.With(zap.String("group_id", groupID))
-
-	code := RUNTIME_EXCEPTION
-	failureReason := "Could not leave group"
-	tx, err := p.db.Begin()
-	if err != nil {
-		logger.Error("Could not leave group", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason), true)
-		return
-	}
-	defer func() {
-		if err != nil {
-			logger.Error("Could not leave group", zap.Error(err))
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
-
-			session.Send(ErrorMessage(envelope.CollationId, code, failureReason), true)
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason), true)
-			} else {
-				logger.Info("User left group")
-				session.Send(&Envelope{CollationId: envelope.CollationId}, true)
-
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 3, []byte("{}"))
-				if err != nil {
-					logger.Error("Error handling group user leave notification topic message", zap.Error(err))
-				}
-			}
-		}
-	}()
-
-	// first remove any invitation from user
-	// and if this wasn't an invitation then
-	// look to see if the user is an admin
-	// and remove the user from group and update group count
-	res, err := tx.Exec(`
-DELETE FROM group_edge
-WHERE
-	(source_id = $1 AND destination_id = $2 AND state = 2)
-OR
-	(source_id = $2 AND destination_id = $1 AND state = 2)`,
-		groupID, session.UserID())
-
-	if err != nil {
-		return
-	}
-
-	if count, _ := res.RowsAffected(); count > 0 {
-		logger.Debug("Group invitation removed.")
-		return
-	}
-
-	var adminCount sql.NullInt64
-	err = tx.QueryRow(`
-SELECT COUNT(source_id)	FROM group_edge
-WHERE
-	source_id = $1 AND state = 0
-AND
-	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
-AND
-	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)`,
-		groupID, session.UserID()).Scan(&adminCount)
-
-	if err != nil {
-		return
-	}
-
-	if adminCount.Int64 == 1 {
-		code = GROUP_LAST_ADMIN
-		failureReason = "Cannot leave group when you are the last group admin"
-		err = errors.New("Cannot leave group when you are the last group admin")
-		return
-	}
-
-	res, err = tx.Exec(`
-DELETE FROM group_edge
-WHERE
-	(source_id = $1 AND destination_id = $2)
-OR
-	(source_id = $2 AND destination_id = $1)`,
-		groupID, session.UserID())
-
-	if err != nil {
-		return
-	}
-
-	if count, _ := res.RowsAffected(); count == 0 {
-		failureReason = "Cannot leave group - Make sure you are part of the group or group exists"
-		err = errors.New("Cannot leave group - Make sure you are part of the group or group exists")
+	if code, err := GroupLeave(l, p.db, p.tracker, p.messageRouter, p.messageRetention, session.UserID(), session.Handle(), groupID); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
 	}
 
-	_, err = tx.Exec(`UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID)
-	if err != nil {
-		return
-	}
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
 func (p *pipeline) groupUserAdd(l *zap.Logger, session session, envelope *Envelope) {
@@ -768,119 +514,12 @@ func (p *pipeline) groupUserAdd(l *zap.Logger, session session, envelope *Envelo
 		return
 	}
 
-	logger := l.With(zap.String("group_id", groupID), zap.String("user_id", userID))
-	ts := nowMs()
-	var handle string
-	var name string
-
-	tx, err := p.db.Begin()
-	if err != nil {
-		logger.Error("Could not add user to group", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"), true)
-		return
-	}
-	defer func() {
-		if err != nil {
-			if _, ok := err.(*pq.Error); ok {
-				logger.Error("Could not add user to group", zap.Error(err))
-			} else {
-				logger.Warn("Could not add user to group", zap.Error(err))
-			}
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
-
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"), true)
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"), true)
-			} else {
-				logger.Info("Added user to the group")
-				session.Send(&Envelope{CollationId: envelope.CollationId}, true)
-
-				data, _ := json.Marshal(map[string]string{"user_id": userID, "handle": handle})
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 2, data)
-				if err != nil {
-					logger.Error("Error handling group user added notification topic message", zap.Error(err))
-					return
-				}
-
-				adminHandle := session.Handle()
-				content, err := json.Marshal(map[string]string{"handle": adminHandle, "name": name})
-				if err != nil {
-					logger.Warn("Failed to send group add notification", zap.Error(err))
-					return
-				}
-				err = p.notificationService.NotificationSend([]*NNotification{
-					&NNotification{
-						Id:         generateNewId(),
-						UserID:     userID,
-						Subject:    fmt.Sprintf("%v has added you to group %v", adminHandle, name),
-						Content:    content,
-						Code:       NOTIFICATION_GROUP_ADD,
-						SenderID:   session.UserID(),
-						CreatedAt:  ts,
-						ExpiresAt:  ts + p.notificationService.expiryMs,
-						Persistent: true,
-					},
-				})
-				if err != nil {
-					logger.Warn("Failed to send group add notification", zap.Error(err))
-				}
-			}
-		}
-	}()
-
-	// Look up the user being added.
-	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1 AND disabled_at = 0", userID).Scan(&handle)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			err = errors.New("Could not add user to group. User does not exist")
-		}
-		return
-	}
-
-	// Look up the name of the group.
-	err = tx.QueryRow("SELECT name FROM groups WHERE id = $1", groupID).Scan(&name)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			err = errors.New("Could not add user to group. Group does not exist")
-		}
-		return
-	}
-
-	res, err := tx.Exec(`
-INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
-SELECT data.id, data.position, data.updated_at, data.destination, data.state
-FROM (
-  SELECT $1::BYTEA AS id, $2::BIGINT AS position, $2::BIGINT AS updated_at, $3::BYTEA AS destination, 1 AS state
-  UNION ALL
-  SELECT $3::BYTEA AS id, $2::BIGINT AS position, $2::BIGINT AS updated_at, $1::BYTEA AS destination, 1 AS state
-) AS data
-WHERE
-  EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1::BYTEA AND destination_id = $4 AND state = 0)
-AND
-  EXISTS (SELECT id FROM groups WHERE id = $1::BYTEA AND disabled_at = 0)
-ON CONFLICT (source_id, destination_id)
-DO UPDATE SET state = 1, updated_at = $2::BIGINT`,
-		groupID, ts, userID, session.UserID())
-
-	if err != nil {
-		return
-	}
-
-	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
-		err = errors.New("Could not add user to group. Group may not exist or you may not be group admin")
+	if code, err := GroupUserAdd(l, p.db, p.tracker, p.messageRouter, p.messageRetention, p.notificationService, session.UserID(), session.Handle(), groupID, userID); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
 	}
 
-	_, err = tx.Exec(`UPDATE groups SET count = count + 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID)
-	if err != nil {
-		return
-	}
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
 func (p *pipeline) groupUserKick(l *zap.Logger, session session, envelope *Envelope) {
@@ -913,87 +552,12 @@ func (p *pipeline) groupUserKick(l *zap.Logger, session session, envelope *Envel
 		return
 	}
 
-	logger := l.With(zap.String("group_id", groupID), zap.String("user_id", userID))
-	var handle string
-
-	failureReason := "Could not kick user from group"
-	tx, err := p.db.Begin()
-	if err != nil {
-		logger.Error("Could not kick user from group", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason), true)
-		return
-	}
-	defer func() {
-		if err != nil {
-			if _, ok := err.(*pq.Error); ok {
-				logger.Error("Could not kick user from group", zap.Error(err))
-			} else {
-				logger.Warn("Could not kick user from group", zap.Error(err))
-			}
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
-
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason), true)
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason), true)
-			} else {
-				logger.Info("Kicked user from group")
-				session.Send(&Envelope{CollationId: envelope.CollationId}, true)
-
-				data, _ := json.Marshal(map[string]string{"user_id": userID, "handle": handle})
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 4, data)
-				if err != nil {
-					logger.Error("Error handling group user kicked notification topic message", zap.Error(err))
-				}
-			}
-		}
-	}()
-
-	// Check the user's group_edge state. If it's a pending join request being rejected then no need to decrement the group count.
-	var userState int64
-	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID, userID).Scan(&userState)
-
-	res, err := tx.Exec(`
-DELETE FROM group_edge
-WHERE
-	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $3 AND state = 0)
-AND
-	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
-AND
-	(
-		(source_id = $1 AND destination_id = $2)
-	OR
-		(source_id = $2 AND destination_id = $1)
-	)`, groupID, userID, session.UserID())
-
-	if err != nil {
-		return
-	}
-
-	if count, _ := res.RowsAffected(); count == 0 {
-		failureReason = "Cannot kick from group - Make sure user is part of the group and is admin or group exists"
-		err = errors.New("Cannot kick from group - Make sure user is part of the group and is admin or group exists")
+	if code, err := GroupUserKick(l, p.db, p.tracker, p.messageRouter, p.messageRetention, session.UserID(), session.Handle(), groupID, userID); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
 	}
 
-	// Join requests aren't reflected in group count.
-	if userState != 2 {
-		_, err = tx.Exec(`UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID)
-		if err != nil {
-			return
-		}
-	}
-
-	// Look up the user being kicked. Allow kicking disabled users.
-	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1", userID).Scan(&handle)
-	if err != nil {
-		return
-	}
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
 func (p *pipeline) groupUserPromote(l *zap.Logger, session session, envelope *Envelope) {
@@ -1024,45 +588,10 @@ func (p *pipeline) groupUserPromote(l *zap.Logger, session session, envelope *En
 		return
 	}
 
-	logger := l.With(zap.String("group_id", groupID), zap.String("user_id", userID))
-
-	res, err := p.db.Exec(`
-UPDATE group_edge SET state = 0, updated_at = $4
-WHERE
-	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $3 AND state = 0)
-AND
-	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
-AND
-	(
-		(source_id = $1 AND destination_id = $2)
-	OR
-		(source_id = $2 AND destination_id = $1)
-	)`, groupID, userID, session.UserID(), nowMs())
-
-	if err != nil {
-		logger.Warn("Could not promote user", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not promote user"), true)
-		return
-	}
-
-	if count, _ := res.RowsAffected(); count == 0 {
-		logger.Warn("Could not promote user - Make sure user is part of the group or group exists")
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not promote user - Make sure user is part of the group or group exists"), true)
-		return
-	}
-
-	// Look up the user being promoted. Allow promoting disabled users as long as they're still part of the group.
-	var handle string
-	err = p.db.QueryRow("SELECT handle FROM users WHERE id = $1", userID).Scan(&handle)
-	if err != nil {
+	if code, err := GroupUserPromote(l, p.db, p.tracker, p.messageRouter, p.messageRetention, session.UserID(), session.Handle(), groupID, userID); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
 	}
 
-	data, _ := json.Marshal(map[string]string{"user_id": userID, "handle": handle})
-	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID}}, 5, data)
-	if err != nil {
-		logger.Error("Error handling group user promoted notification topic message", zap.Error(err))
-	}
-
 	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
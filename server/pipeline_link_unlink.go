@@ -198,6 +198,8 @@ AND NOT EXISTS
 		return
 	}
 
+	p.addGoogleFriends(logger, session.UserID(), session.Handle(), googleProfile.ID, accessToken)
+
 	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
@@ -261,6 +263,7 @@ func (p *pipeline) linkSteam(logger *zap.Logger, session session, envelope *Enve
 		return
 	}
 
+	steamID := strconv.FormatUint(steamProfile.SteamID, 10)
 	res, err := p.db.Exec(`
 UPDATE users
 SET steam_id = $2, updated_at = $3
@@ -270,7 +273,7 @@ AND NOT EXISTS
      FROM users
      WHERE steam_id = $2)`,
 		session.UserID(),
-		strconv.FormatUint(steamProfile.SteamID, 10),
+		steamID,
 		nowMs())
 
 	if err != nil {
@@ -282,6 +285,8 @@ AND NOT EXISTS
 		return
 	}
 
+	p.addSteamFriends(logger, session.UserID(), session.Handle(), steamID)
+
 	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
 
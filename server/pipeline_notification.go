@@ -19,12 +19,17 @@ import "go.uber.org/zap"
 func (p *pipeline) notificationsList(logger *zap.Logger, session session, envelope *Envelope) {
 	incoming := envelope.GetNotificationsList()
 
+	if incoming.CodeMin < 0 || incoming.CodeMax < 0 || (incoming.CodeMax != 0 && incoming.CodeMin > incoming.CodeMax) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid notification code range"), true)
+		return
+	}
+
 	if incoming.GetLimit() < 10 || incoming.GetLimit() > 100 {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Limit must be between 10 and 100"), true)
 		return
 	}
 
-	nots, cursor, err := p.notificationService.NotificationsList(session.UserID(), incoming.GetLimit(), incoming.GetResumableCursor())
+	nots, cursor, err := p.notificationService.NotificationsList(session.UserID(), incoming.GetLimit(), incoming.GetResumableCursor(), incoming.CodeMin, incoming.CodeMax)
 	if err != nil {
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, err.Error()), true)
 		return
@@ -48,3 +53,45 @@ func (p *pipeline) notificationsRemove(logger *zap.Logger, session session, enve
 
 	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
 }
+
+func (p *pipeline) notificationsRead(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetNotificationsRead()
+
+	if len(incoming.NotificationIds) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "There must be at least one notification ID to mark read."), true)
+		return
+	}
+
+	if err := p.notificationService.NotificationsRead(session.UserID(), incoming.NotificationIds); err != nil {
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+}
+
+func (p *pipeline) notificationsReadAll(logger *zap.Logger, session session, envelope *Envelope) {
+	if err := p.notificationService.NotificationsReadAll(session.UserID()); err != nil {
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+}
+
+func (p *pipeline) notificationsUnreadCount(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetNotificationsUnreadCount()
+
+	if incoming.CodeMin < 0 || incoming.CodeMax < 0 || (incoming.CodeMax != 0 && incoming.CodeMin > incoming.CodeMax) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid notification code range"), true)
+		return
+	}
+
+	count, err := p.notificationService.NotificationsUnreadCount(session.UserID(), incoming.CodeMin, incoming.CodeMax)
+	if err != nil {
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_NotificationsUnread{NotificationsUnread: &TNotificationsUnread{Count: count}}}, true)
+}
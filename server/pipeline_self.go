@@ -122,6 +122,14 @@ func (p *pipeline) selfUpdate(logger *zap.Logger, session session, envelope *Env
 		}
 	}
 
+	if update.Handle != "" && p.moderationService.Enabled(MODERATION_KIND_HANDLE) {
+		handle, ok := p.moderate(logger, session, envelope, MODERATION_KIND_HANDLE, update.Handle)
+		if !ok {
+			return
+		}
+		update.Handle = handle
+	}
+
 	// Run the update.
 	code, err := SelfUpdate(logger, p.db, []*SelfUpdateOp{&SelfUpdateOp{
 		UserId:    session.UserID(),
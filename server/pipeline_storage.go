@@ -27,7 +27,14 @@ import (
 func (p *pipeline) storageList(logger *zap.Logger, session session, envelope *Envelope) {
 	incoming := envelope.GetStorageList()
 
-	data, cursor, code, err := StorageList(logger, p.db, session.UserID(), incoming.UserId, incoming.Bucket, incoming.Collection, incoming.Limit, incoming.Cursor)
+	options := &StorageListOptions{
+		Sort:           incoming.Sort,
+		SortDescending: incoming.SortDescending,
+		StartTime:      incoming.StartTime,
+		EndTime:        incoming.EndTime,
+	}
+
+	data, cursor, previousCursor, code, err := StorageList(logger, p.db, session.UserID(), incoming.UserId, incoming.Bucket, incoming.Collection, incoming.Limit, incoming.Cursor, options)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
@@ -44,6 +51,53 @@ func (p *pipeline) storageList(logger *zap.Logger, session session, envelope *En
 			Version:         d.Version,
 			PermissionRead:  int32(d.PermissionRead),
 			PermissionWrite: int32(d.PermissionWrite),
+			GroupId:         d.GroupId,
+			CreatedAt:       d.CreatedAt,
+			UpdatedAt:       d.UpdatedAt,
+			ExpiresAt:       d.ExpiresAt,
+		}
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData, Cursor: cursor, PreviousCursor: previousCursor}}}, true)
+}
+
+func (p *pipeline) storageQuery(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetStorageQuery()
+
+	filters := make([]*StorageQueryFilter, len(incoming.Filters))
+	for i, f := range incoming.Filters {
+		filters[i] = &StorageQueryFilter{
+			Index:       f.Index,
+			Op:          f.Op,
+			StringValue: f.GetStringValue(),
+			NumberValue: f.GetNumberValue(),
+		}
+		switch f.Value.(type) {
+		case *TStorageQuery_Filter_StringValue:
+			filters[i].Type = STORAGE_INDEX_STRING
+		case *TStorageQuery_Filter_NumberValue:
+			filters[i].Type = STORAGE_INDEX_NUMBER
+		}
+	}
+
+	data, cursor, code, err := StorageQuery(logger, p.db, p.storageService, session.UserID(), incoming.UserId, incoming.Bucket, incoming.Collection, filters, incoming.SortIndex, incoming.SortDescending, incoming.Limit, incoming.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	storageData := make([]*TStorageData_StorageData, len(data))
+	for i, d := range data {
+		storageData[i] = &TStorageData_StorageData{
+			Bucket:          d.Bucket,
+			Collection:      d.Collection,
+			Record:          d.Record,
+			UserId:          d.UserId,
+			Value:           string(d.Value),
+			Version:         d.Version,
+			PermissionRead:  int32(d.PermissionRead),
+			PermissionWrite: int32(d.PermissionWrite),
+			GroupId:         d.GroupId,
 			CreatedAt:       d.CreatedAt,
 			UpdatedAt:       d.UpdatedAt,
 			ExpiresAt:       d.ExpiresAt,
@@ -53,6 +107,40 @@ func (p *pipeline) storageList(logger *zap.Logger, session session, envelope *En
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData, Cursor: cursor}}}, true)
 }
 
+func (p *pipeline) storageHistoryList(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetStorageHistoryList()
+
+	key := &StorageKey{
+		Bucket:     incoming.Bucket,
+		Collection: incoming.Collection,
+		Record:     incoming.Record,
+		UserId:     incoming.UserId,
+	}
+	data, cursor, code, err := StorageHistoryList(logger, p.db, p.storageService, session.UserID(), key, incoming.Limit, incoming.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	storageData := make([]*TStorageData_StorageData, len(data))
+	for i, d := range data {
+		storageData[i] = &TStorageData_StorageData{
+			Bucket:          d.Bucket,
+			Collection:      d.Collection,
+			Record:          d.Record,
+			UserId:          d.UserId,
+			Value:           string(d.Value),
+			Version:         d.Version,
+			PermissionRead:  int32(d.PermissionRead),
+			PermissionWrite: int32(d.PermissionWrite),
+			GroupId:         d.GroupId,
+			UpdatedAt:       d.UpdatedAt,
+		}
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData, Cursor: cursor}}}, true)
+}
+
 func (p *pipeline) storageFetch(logger *zap.Logger, session session, envelope *Envelope) {
 	incoming := envelope.GetStorageFetch()
 	if len(incoming.Keys) == 0 {
@@ -87,6 +175,7 @@ func (p *pipeline) storageFetch(logger *zap.Logger, session session, envelope *E
 			Version:         d.Version,
 			PermissionRead:  int32(d.PermissionRead),
 			PermissionWrite: int32(d.PermissionWrite),
+			GroupId:         d.GroupId,
 			CreatedAt:       d.CreatedAt,
 			UpdatedAt:       d.UpdatedAt,
 			ExpiresAt:       d.ExpiresAt,
@@ -114,10 +203,11 @@ func (p *pipeline) storageWrite(logger *zap.Logger, session session, envelope *E
 			Version:         d.Version,
 			PermissionRead:  int64(d.PermissionRead),
 			PermissionWrite: int64(d.PermissionWrite),
+			GroupId:         d.GroupId,
 		}
 	}
 
-	keys, code, err := StorageWrite(logger, p.db, session.UserID(), data)
+	keys, code, err := StorageWrite(logger, p.db, p.storageService, session.UserID(), data)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
@@ -154,7 +244,7 @@ func (p *pipeline) storageRemove(logger *zap.Logger, session session, envelope *
 		}
 	}
 
-	code, err := StorageRemove(logger, p.db, session.UserID(), keys)
+	code, err := StorageRemove(logger, p.db, p.storageService, session.UserID(), keys)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
 		return
@@ -172,15 +262,21 @@ func (p *pipeline) storageUpdate(logger *zap.Logger, session session, envelope *
 
 	keyUpdates := make([]*StorageKeyUpdate, len(incoming.Updates))
 	for i, update := range incoming.Updates {
+		userID := update.Key.UserId
+		if userID == "" {
+			userID = session.UserID()
+		}
+
 		keyUpdate := &StorageKeyUpdate{
 			PermissionRead:  int64(update.PermissionRead),
 			PermissionWrite: int64(update.PermissionWrite),
+			GroupId:         update.GroupId,
 			Key: &StorageKey{
 				Bucket:     update.Key.Bucket,
 				Collection: update.Key.Collection,
 				Record:     update.Key.Record,
 				Version:    update.Key.Version,
-				UserId:     session.UserID(),
+				UserId:     userID,
 			},
 		}
 
@@ -213,6 +309,16 @@ func (p *pipeline) storageUpdate(logger *zap.Logger, session session, envelope *
 				opString = "test"
 			case COMPARE:
 				opString = "compare"
+			case CLAMP:
+				opString = "clamp"
+			case MULTIPLY:
+				opString = "multiply"
+			case BOUNDED_INCR:
+				opString = "bounded_incr"
+			case REMOVE_VALUE:
+				opString = "remove_value"
+			case ADD_TO_SET:
+				opString = "add_to_set"
 			default:
 				session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid update operation supplied"), true)
 				return
@@ -233,6 +339,14 @@ func (p *pipeline) storageUpdate(logger *zap.Logger, session session, envelope *
 				"conditional": &conditional,
 				"assert":      &assert,
 			}
+			if op.Min != "" {
+				min := json.RawMessage(op.Min)
+				jsonOp["min"] = &min
+			}
+			if op.Max != "" {
+				max := json.RawMessage(op.Max)
+				jsonOp["max"] = &max
+			}
 			jsonOps[i] = jsonOp
 		}
 
@@ -246,7 +360,7 @@ func (p *pipeline) storageUpdate(logger *zap.Logger, session session, envelope *
 		keyUpdates[i] = keyUpdate
 	}
 
-	updatedKeys, errCode, err := StorageUpdate(logger, p.db, session.UserID(), keyUpdates)
+	updatedKeys, errCode, err := StorageUpdate(logger, p.db, p.storageService, session.UserID(), keyUpdates)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, errCode, err.Error()), true)
 		return
@@ -263,3 +377,31 @@ func (p *pipeline) storageUpdate(logger *zap.Logger, session session, envelope *
 	}
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageKeys{StorageKeys: &TStorageKeys{Keys: storageKeys}}}, true)
 }
+
+func (p *pipeline) storageSubscribe(logger *zap.Logger, session session, envelope *Envelope) {
+	meta := PresenceMeta{
+		Handle: session.Handle(),
+		Format: session.Format(),
+	}
+	code, err := StorageSubscribe(logger, p.db, p.tracker, p.config.GetStorage().MaxSubscriptions, session.ID(), session.UserID(), meta, envelope.GetStorageSubscribe().Subscriptions)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+}
+
+func (p *pipeline) storageUnsubscribe(logger *zap.Logger, session session, envelope *Envelope) {
+	topics, errMessage := storageSubscriptionTopics(envelope.GetStorageUnsubscribe().Subscriptions)
+	if errMessage != "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, errMessage), true)
+		return
+	}
+
+	for _, topic := range topics {
+		p.tracker.Untrack(session.ID(), topic, session.UserID())
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+}
@@ -85,6 +85,11 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session session, envelope *Enve
 			trackerTopic = "dm:" + otherUserID + userID
 		}
 		dmOtherUserID = otherUserID
+
+		// Make sure the other user sees this topic in their unread counts.
+		if err = ensureReadCursor(p.db, otherUserID, topic); err != nil {
+			logger.Warn("Could not create direct message read cursor", zap.Error(err))
+		}
 	case *TTopicsJoin_TopicJoin_Room:
 		// Check input is valid room name.
 		room := t.GetRoom()
@@ -132,6 +137,19 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session session, envelope *Enve
 		return
 	}
 
+	// Check the user is not banned from the topic.
+	if dmOtherUserID == "" {
+		_, banned, err := topicRestrictions(p.db, topic, session.UserID())
+		if err != nil {
+			logger.Error("Could not check topic restrictions", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to look up topic restrictions"), true)
+			return
+		} else if banned {
+			session.Send(ErrorMessage(envelope.CollationId, TOPIC_RESTRICTED, "Banned from topic"), true)
+			return
+		}
+	}
+
 	handle := session.Handle()
 
 	// Track the presence, and gather current member list.
@@ -279,49 +297,14 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session session, envelop
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Data must be a valid JSON object"), true)
 		return
 	}
-
-	var trackerTopic string
-	switch topic.Id.(type) {
-	case *TopicId_Dm:
-		// Check input is valid DM topic.
-		dmID := topic.GetDm()
-		if dmID == "" {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic not valid"), true)
-			return
-		}
-
-		trackerTopic = "dm:" + dmID
-	case *TopicId_Room:
-		// Check input is valid room name.
-		room := topic.GetRoom()
-		if len(room) < 1 || len(room) > 64 {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name is required and must be 1-64 chars"), true)
-			return
-		}
-		if controlCharsRegex.MatchString(room) {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name must not contain control chars"), true)
-			return
-		}
-		if !utf8.ValidString(room) {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name must only contain valid UTF-8 bytes"), true)
-			return
-		}
-
-		trackerTopic = "room:" + room
-	case *TopicId_GroupId:
-		// Check input is valid ID.
-		groupID := topic.GetGroupId()
-		if groupID == "" {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID not valid"), true)
-			return
-		}
-
-		trackerTopic = "group:" + groupID
-	case nil:
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "No topic ID found"), true)
+	dataBytes, ok := p.moderateMessageData(logger, session, envelope, dataBytes)
+	if !ok {
 		return
-	default:
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unrecognized topic ID"), true)
+	}
+
+	trackerTopic, errMessage := messageTrackerTopic(topic)
+	if errMessage != "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, errMessage), true)
 		return
 	}
 
@@ -329,6 +312,9 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session session, envelop
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before sending messages"), true)
 		return
 	}
+	if !p.checkNotRestricted(logger, session, envelope, topic) {
+		return
+	}
 
 	// Store message to history.
 	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, 0, dataBytes)
@@ -348,6 +334,102 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session session, envelop
 
 	// Deliver message to topic.
 	p.deliverMessage(logger, session, topic, 0, dataBytes, messageID, handle, createdAt, expiresAt)
+
+	// Let the other user know about direct messages if they're not in the conversation.
+	if _, ok := topic.Id.(*TopicId_Dm); ok {
+		if err := notifyDmRecipient(logger, p.db, p.tracker, p.notificationService, session.UserID(), handle, topic, messageID, dataBytes); err != nil {
+			logger.Warn("Failed to send direct message notification", zap.Error(err))
+		}
+	}
+}
+
+func (p *pipeline) topicMessageUpdate(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetTopicMessageUpdate()
+	if incoming.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"), true)
+		return
+	}
+	if incoming.MessageId == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message ID is required"), true)
+		return
+	}
+	dataBytes := []byte(incoming.Data)
+	if len(dataBytes) == 0 || len(dataBytes) > 1000 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Data is required and must be 1-1000 JSON bytes"), true)
+		return
+	}
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(dataBytes, &maybeJSON) != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Data must be a valid JSON object"), true)
+		return
+	}
+	dataBytes, ok := p.moderateMessageData(logger, session, envelope, dataBytes)
+	if !ok {
+		return
+	}
+
+	trackerTopic, errMessage := messageTrackerTopic(incoming.Topic)
+	if errMessage != "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, errMessage), true)
+		return
+	}
+	if !p.tracker.CheckLocalByIDTopicUser(session.ID(), trackerTopic, session.UserID()) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before updating messages"), true)
+		return
+	}
+	if !p.checkNotRestricted(logger, session, envelope, incoming.Topic) {
+		return
+	}
+
+	message, code, err := TopicMessageUpdate(logger, p.db, session.UserID(), incoming.Topic, incoming.MessageId, dataBytes)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	ack := &TTopicMessageAck{
+		MessageId: message.MessageId,
+		CreatedAt: message.CreatedAt,
+		ExpiresAt: message.ExpiresAt,
+		Handle:    message.Handle,
+		UpdatedAt: message.UpdatedAt,
+	}
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessageAck{TopicMessageAck: ack}}, true)
+
+	deliverTopicMessage(logger, p.tracker, p.messageRouter, message)
+}
+
+func (p *pipeline) topicMessageRemove(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetTopicMessageRemove()
+	if incoming.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"), true)
+		return
+	}
+	if incoming.MessageId == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message ID is required"), true)
+		return
+	}
+
+	trackerTopic, errMessage := messageTrackerTopic(incoming.Topic)
+	if errMessage != "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, errMessage), true)
+		return
+	}
+	if !p.tracker.CheckLocalByIDTopicUser(session.ID(), trackerTopic, session.UserID()) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before removing messages"), true)
+		return
+	}
+
+	message, code, err := TopicMessageRemove(logger, p.db, session.UserID(), incoming.Topic, incoming.MessageId)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+
+	// Let topic members know the message is gone.
+	deliverTopicMessage(logger, p.tracker, p.messageRouter, message)
 }
 
 func (p *pipeline) topicMessagesList(logger *zap.Logger, session session, envelope *Envelope) {
@@ -440,8 +522,8 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session session, envelo
 		return
 	}
 
-	query := "SELECT message_id, user_id, created_at, expires_at, handle, type, data FROM message WHERE topic = $2 AND topic_type = $3"
-	params := []interface{}{limit + 1, topicString, topicType}
+	query := "SELECT message_id, user_id, created_at, expires_at, updated_at, handle, type, data FROM message WHERE topic = $2 AND topic_type = $3 AND (expires_at = 0 OR expires_at > $4)"
+	params := []interface{}{limit + 1, topicString, topicType, nowMs()}
 
 	// Only paginate if all cursor components are available.
 	if input.Cursor != "" {
@@ -458,7 +540,7 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session session, envelo
 			if input.Forward {
 				op = ">"
 			}
-			query += " AND (created_at, message_id, user_id) " + op + " ($4, $5, $6)"
+			query += " AND (created_at, message_id, user_id) " + op + " ($5, $6, $7)"
 			params = append(params, c.CreatedAt, c.MessageID, c.UserID)
 		}
 	}
@@ -484,6 +566,7 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session session, envelo
 	var userID string
 	var createdAt int64
 	var expiresAt int64
+	var updatedAt int64
 	var handle string
 	var msgType int64
 	var data []byte
@@ -497,7 +580,7 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session session, envelo
 			cursor = base64.StdEncoding.EncodeToString(cursorBuf.Bytes())
 			break
 		}
-		err = rows.Scan(&messageID, &userID, &createdAt, &expiresAt, &handle, &msgType, &data)
+		err = rows.Scan(&messageID, &userID, &createdAt, &expiresAt, &updatedAt, &handle, &msgType, &data)
 		if err != nil {
 			logger.Error("Error scanning topic messages list", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error scanning topic messages list"), true)
@@ -510,6 +593,7 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session session, envelo
 			MessageId: messageID,
 			CreatedAt: createdAt,
 			ExpiresAt: expiresAt,
+			UpdatedAt: updatedAt,
 			Handle:    handle,
 			Type:      msgType,
 			Data:      string(data),
@@ -525,17 +609,240 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session session, envelo
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessages{TopicMessages: &TTopicMessages{Messages: messages, Cursor: cursor}}}, true)
 }
 
-func (p *pipeline) isGroupMember(userID string, groupID string) (bool, error) {
+func (p *pipeline) topicMessagesSearch(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetTopicMessagesSearch()
+	if incoming.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"), true)
+		return
+	}
+	if _, errMessage := messageTrackerTopic(incoming.Topic); errMessage != "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, errMessage), true)
+		return
+	}
+
+	messages, cursor, code, err := TopicMessagesSearch(logger, p.db, session.UserID(), incoming.Topic, incoming.Text, incoming.UserId, incoming.StartTime, incoming.EndTime, incoming.Limit, incoming.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessages{TopicMessages: &TTopicMessages{Messages: messages, Cursor: cursor}}}, true)
+}
+
+func (p *pipeline) topicSignalSend(logger *zap.Logger, session session, envelope *Envelope, reliable bool) {
+	incoming := envelope.GetTopicSignalSend()
+	if incoming.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"), true)
+		return
+	}
+
+	code, err := TopicSignalSend(logger, p.db, p.tracker, p.messageRouter, session.ID(), session.UserID(), session.Handle(), incoming.Topic, incoming.Data, reliable)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+	}
+}
+
+func (p *pipeline) topicModerate(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetTopicModerate()
+	if incoming.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"), true)
+		return
+	}
+	if incoming.UserId == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID is required"), true)
+		return
+	}
+	if incoming.UserId == session.UserID() {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Cannot moderate self"), true)
+		return
+	}
+	if _, errMessage := messageTrackerTopic(incoming.Topic); errMessage != "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, errMessage), true)
+		return
+	}
+	if _, ok := incoming.Topic.Id.(*TopicId_Dm); ok {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Direct message topics cannot be moderated"), true)
+		return
+	}
+
+	moderator, err := p.isTopicModerator(session.UserID(), incoming.Topic)
+	if err != nil {
+		logger.Error("Could not check if user is topic moderator", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to look up topic moderators"), true)
+		return
+	} else if !moderator {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Not allowed to moderate topic"), true)
+		return
+	}
+
+	var code Error_Code
+	switch incoming.Action {
+	case 0:
+		if incoming.DurationMs <= 0 {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Mute duration must be greater than 0"), true)
+			return
+		}
+		code, err = TopicMute(logger, p.db, incoming.Topic, incoming.UserId, nowMs()+incoming.DurationMs)
+	case 1:
+		code, err = TopicUnmute(logger, p.db, incoming.Topic, incoming.UserId)
+	case 2:
+		TopicKick(logger, p.tracker, p.messageRouter, incoming.Topic, incoming.UserId)
+	case 3:
+		code, err = TopicBan(logger, p.db, p.tracker, p.messageRouter, incoming.Topic, incoming.UserId)
+	case 4:
+		code, err = TopicUnban(logger, p.db, incoming.Topic, incoming.UserId)
+	default:
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unrecognized moderation action"), true)
+		return
+	}
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+}
+
+// checkNotRestricted sends an error and returns false if the user is muted or banned in the topic.
+func (p *pipeline) checkNotRestricted(logger *zap.Logger, session session, envelope *Envelope, topic *TopicId) bool {
+	if code, err := checkTopicNotRestricted(logger, p.db, topic, session.UserID()); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return false
+	}
+	return true
+}
+
+// isTopicModerator checks if a user is a configured topic moderator, or an admin of the group for group topics.
+func (p *pipeline) isTopicModerator(userID string, topic *TopicId) (bool, error) {
+	for _, moderator := range p.config.GetSocial().Topic.Moderators {
+		if moderator == userID {
+			return true, nil
+		}
+	}
+
+	if _, ok := topic.Id.(*TopicId_GroupId); !ok {
+		return false, nil
+	}
+
 	var state int64
-	err := p.db.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", userID, groupID).Scan(&state)
+	err := p.db.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", topic.GetGroupId(), userID).Scan(&state)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
 		}
-
 		return false, err
 	}
-	return state == 0 || state == 1, nil
+	return state == 0, nil
+}
+
+func (p *pipeline) topicMessagesRead(logger *zap.Logger, session session, envelope *Envelope) {
+	incoming := envelope.GetTopicMessagesRead()
+	if incoming.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"), true)
+		return
+	}
+	if incoming.MessageId == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message ID is required"), true)
+		return
+	}
+
+	trackerTopic, errMessage := messageTrackerTopic(incoming.Topic)
+	if errMessage != "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, errMessage), true)
+		return
+	}
+
+	readAt, code, err := TopicMessagesRead(logger, p.db, session.UserID(), incoming.Topic, incoming.MessageId)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId}, true)
+
+	// Let the other user in a direct message topic know, if enabled.
+	if _, ok := incoming.Topic.Id.(*TopicId_Dm); ok && p.config.GetSocial().Topic.DmReadBroadcast {
+		outgoing := &Envelope{Payload: &Envelope_TopicRead{TopicRead: &TopicRead{
+			Topic:     incoming.Topic,
+			UserId:    session.UserID(),
+			MessageId: incoming.MessageId,
+			ReadAt:    readAt,
+		}}}
+		p.messageRouter.Send(logger, p.tracker.ListByTopic(trackerTopic), outgoing, true)
+	}
+}
+
+func (p *pipeline) topicsUnreadList(logger *zap.Logger, session session, envelope *Envelope) {
+	topics, code, err := TopicsUnreadList(logger, p.db, session.UserID())
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()), true)
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicsUnread{TopicsUnread: &TTopicsUnread{Topics: topics}}}, true)
+}
+
+// messageTrackerTopic validates a topic ID and returns its tracker topic, or an error message if it's not valid.
+func messageTrackerTopic(topic *TopicId) (string, string) {
+	switch topic.Id.(type) {
+	case *TopicId_Dm:
+		// Check input is valid DM topic.
+		dmID := topic.GetDm()
+		if dmID == "" {
+			return "", "Topic not valid"
+		}
+
+		return "dm:" + dmID, ""
+	case *TopicId_Room:
+		// Check input is valid room name.
+		room := topic.GetRoom()
+		if len(room) < 1 || len(room) > 64 {
+			return "", "Room name is required and must be 1-64 chars"
+		}
+		if controlCharsRegex.MatchString(room) {
+			return "", "Room name must not contain control chars"
+		}
+		if !utf8.ValidString(room) {
+			return "", "Room name must only contain valid UTF-8 bytes"
+		}
+
+		return "room:" + room, ""
+	case *TopicId_GroupId:
+		// Check input is valid ID.
+		groupID := topic.GetGroupId()
+		if groupID == "" {
+			return "", "Group ID not valid"
+		}
+
+		return "group:" + groupID, ""
+	case nil:
+		return "", "No topic ID found"
+	default:
+		return "", "Unrecognized topic ID"
+	}
+}
+
+// moderateMessageData runs chat message data through moderation, and checks any replaced data is still valid.
+func (p *pipeline) moderateMessageData(logger *zap.Logger, session session, envelope *Envelope, dataBytes []byte) ([]byte, bool) {
+	data, ok := p.moderate(logger, session, envelope, MODERATION_KIND_CHAT, string(dataBytes))
+	if !ok {
+		return nil, false
+	}
+	if data == string(dataBytes) {
+		return dataBytes, true
+	}
+
+	var maybeJSON map[string]interface{}
+	if len(data) == 0 || len(data) > 1000 || json.Unmarshal([]byte(data), &maybeJSON) != nil {
+		logger.Warn("Moderated message data is not a valid JSON object of 1-1000 bytes")
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not moderate content"), true)
+		return nil, false
+	}
+	return []byte(data), true
+}
+
+func (p *pipeline) isGroupMember(userID string, groupID string) (bool, error) {
+	return isGroupMember(p.db, userID, groupID)
 }
 
 func (p *pipeline) userExistsAndDoesNotBlock(checkUserID string, blocksUserID string) (bool, error) {
@@ -553,70 +860,15 @@ WHERE id = $1 AND NOT EXISTS (
 
 // Assumes `topic` has already been validated, or was constructed internally.
 func (p *pipeline) storeMessage(logger *zap.Logger, session session, topic *TopicId, msgType int64, data []byte) (string, string, int64, int64, error) {
-	var topicValue string
-	var topicType int64
-	switch topic.Id.(type) {
-	case *TopicId_Dm:
-		topicValue = topic.GetDm()
-		topicType = 0
-	case *TopicId_Room:
-		topicValue = topic.GetRoom()
-		topicType = 1
-	case *TopicId_GroupId:
-		topicValue = topic.GetGroupId()
-		topicType = 2
-	}
-	createdAt := nowMs()
-	messageID := generateNewId()
-	expiresAt := int64(0)
 	handle := session.Handle()
-	_, err := p.db.Exec(`
-INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-		topicValue, topicType, messageID, session.UserID(), createdAt, expiresAt, handle, msgType, data)
-	if err != nil {
-		logger.Error("Failed to insert new message", zap.Error(err))
-		return "", "", 0, 0, err
-	}
-
-	return messageID, handle, createdAt, expiresAt, nil
+	messageID, createdAt, expiresAt, err := storeMessage(logger, p.db, p.messageRetention, session.UserID(), handle, topic, msgType, data)
+	return messageID, handle, createdAt, expiresAt, err
 }
 
 func (p *pipeline) deliverMessage(logger *zap.Logger, session session, topic *TopicId, msgType int64, data []byte, messageID string, handle string, createdAt int64, expiresAt int64) {
-	var trackerTopic string
-	switch topic.Id.(type) {
-	case *TopicId_Dm:
-		trackerTopic = "dm:" + topic.GetDm()
-	case *TopicId_Room:
-		trackerTopic = "room:" + topic.GetRoom()
-	case *TopicId_GroupId:
-		trackerTopic = "group:" + topic.GetGroupId()
-	}
-
-	outgoing := &Envelope{
-		Payload: &Envelope_TopicMessage{
-			TopicMessage: &TopicMessage{
-				Topic:     topic,
-				UserId:    session.UserID(),
-				MessageId: messageID,
-				CreatedAt: createdAt,
-				ExpiresAt: expiresAt,
-				Handle:    handle,
-				Type:      msgType,
-				Data:      string(data),
-			},
-		},
-	}
-
-	presences := p.tracker.ListByTopic(trackerTopic)
-	p.messageRouter.Send(logger, presences, outgoing, true)
+	deliverMessage(logger, p.tracker, p.messageRouter, session.UserID(), handle, topic, msgType, data, messageID, createdAt, expiresAt)
 }
 
 func (p *pipeline) storeAndDeliverMessage(logger *zap.Logger, session session, topic *TopicId, msgType int64, data []byte) error {
-	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, msgType, data)
-	if err != nil {
-		return err
-	}
-	p.deliverMessage(logger, session, topic, msgType, data, messageID, handle, createdAt, expiresAt)
-	return nil
+	return storeAndDeliverMessage(logger, p.db, p.tracker, p.messageRouter, p.messageRetention, session.UserID(), session.Handle(), topic, msgType, data)
 }
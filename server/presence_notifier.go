@@ -46,8 +46,8 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 
 	// Group joins and leaves by topic.
 	for _, p := range joins {
-		// The "notifications:..." topics are a special case that does not generate presence notifications.
-		if strings.HasPrefix(p.Topic, "notifications") {
+		// The "notifications:..." and "storage:..." topics are special cases that do not generate presence notifications.
+		if strings.HasPrefix(p.Topic, "notifications") || strings.HasPrefix(p.Topic, "storage:") {
 			continue
 		}
 
@@ -59,8 +59,8 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 		}
 	}
 	for _, p := range leaves {
-		// The "notifications:..." topics are a special case that does not generate presence notifications.
-		if strings.HasPrefix(p.Topic, "notifications") {
+		// The "notifications:..." and "storage:..." topics are special cases that do not generate presence notifications.
+		if strings.HasPrefix(p.Topic, "notifications") || strings.HasPrefix(p.Topic, "storage:") {
 			continue
 		}
 
@@ -0,0 +1,116 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter tracks token buckets for a single session, one per message type.
+type RateLimiter struct {
+	sync.Mutex
+	config     *SocketConfig
+	buckets    map[string]*tokenBucket
+	violations []time.Time
+}
+
+// chatMessageTypes are the payload types that send chat content to other users.
+var chatMessageTypes = map[string]bool{
+	"*server.Envelope_TopicMessageSend":   true,
+	"*server.Envelope_TopicMessageUpdate": true,
+	"*server.Envelope_TopicMessageRemove": true,
+	"*server.Envelope_TopicSignalSend":    true,
+}
+
+// NewRateLimiter creates a new RateLimiter for a session.
+func NewRateLimiter(config *SocketConfig) *RateLimiter {
+	return &RateLimiter{
+		config:  config,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// rateLimitFor returns the limit that applies to a message type, as named by its payload type.
+func (r *RateLimiter) rateLimitFor(messageType string) *RateLimitConfig {
+	switch {
+	case chatMessageTypes[messageType]:
+		return r.config.RateLimitChat
+	case messageType == "*server.Envelope_Rpc":
+		return r.config.RateLimitRpc
+	case strings.HasPrefix(messageType, "*server.Envelope_Storage"):
+		return r.config.RateLimitStorage
+	}
+	return r.config.RateLimitDefault
+}
+
+// Allow consumes a token for the given message type, and returns false if its rate limit was exceeded.
+func (r *RateLimiter) Allow(messageType string) bool {
+	limit := r.rateLimitFor(messageType)
+	if limit == nil || limit.Rate <= 0 {
+		return true
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	b, ok := r.buckets[messageType]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		r.buckets[messageType] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		r.violations = append(r.pruneViolations(now), now)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Violations returns the number of times this session exceeded a rate limit within the violation window.
+func (r *RateLimiter) Violations() int {
+	r.Lock()
+	defer r.Unlock()
+	r.violations = r.pruneViolations(time.Now())
+	return len(r.violations)
+}
+
+// pruneViolations drops violations older than the violation window. Must be called with the lock held.
+func (r *RateLimiter) pruneViolations(now time.Time) []time.Time {
+	cutoff := now.Add(-time.Duration(r.config.RateLimitViolationWindowMs) * time.Millisecond)
+	i := 0
+	for i < len(r.violations) && !r.violations[i].After(cutoff) {
+		i++
+	}
+	return r.violations[i:]
+}
@@ -45,14 +45,15 @@ type RuntimeModule struct {
 }
 
 type RuntimePool struct {
-	regHTTP   map[string]struct{}
-	regRPC    map[string]struct{}
-	regBefore map[string]struct{}
-	regAfter  map[string]struct{}
-	pool      *sync.Pool
+	regHTTP       map[string]struct{}
+	regRPC        map[string]struct{}
+	regBefore     map[string]struct{}
+	regAfter      map[string]struct{}
+	regModeration bool
+	pool          *sync.Pool
 }
 
-func NewRuntimePool(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config *RuntimeConfig, tracker Tracker, notificationService *NotificationService) (*RuntimePool, error) {
+func NewRuntimePool(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config *RuntimeConfig, tracker Tracker, messageRouter MessageRouter, messageRetention *MessageRetentionService, storageService *StorageService, notificationService *NotificationService) (*RuntimePool, error) {
 	if err := os.MkdirAll(config.Path, os.ModePerm); err != nil {
 		return nil, err
 	}
@@ -107,6 +108,7 @@ func NewRuntimePool(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, con
 	regRPC := make(map[string]struct{})
 	regBefore := make(map[string]struct{})
 	regAfter := make(map[string]struct{})
+	regModeration := false
 
 	// Initialize a one-off runtime to ensure startup code runs and modules are valid.
 	vm := lua.NewState(lua.Options{
@@ -120,7 +122,7 @@ func NewRuntimePool(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, con
 		vm.Push(lua.LString(name))
 		vm.Call(1, 0)
 	}
-	nakamaModule := NewNakamaModule(logger, db, vm, tracker, notificationService, cbufferPool,
+	nakamaModule := NewNakamaModule(logger, db, vm, tracker, messageRouter, messageRetention, storageService, notificationService, cbufferPool,
 		func(path string) {
 			regHTTP[path] = struct{}{}
 			logger.Info("Registered HTTP function invocation", zap.String("path", path))
@@ -133,6 +135,9 @@ func NewRuntimePool(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, con
 		}, func(messageName string) {
 			regAfter[messageName] = struct{}{}
 			logger.Info("Registered After function invocation", zap.String("message", messageName))
+		}, func() {
+			regModeration = true
+			logger.Info("Registered Moderation function invocation")
 		})
 	vm.PreloadModule("nakama", nakamaModule.Loader)
 	r := &Runtime{
@@ -152,10 +157,11 @@ func NewRuntimePool(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, con
 	r.Stop()
 
 	return &RuntimePool{
-		regHTTP:   regHTTP,
-		regRPC:    regRPC,
-		regBefore: regBefore,
-		regAfter:  regAfter,
+		regHTTP:       regHTTP,
+		regRPC:        regRPC,
+		regBefore:     regBefore,
+		regAfter:      regAfter,
+		regModeration: regModeration,
 		pool: &sync.Pool{
 			New: func() interface{} {
 				vm := lua.NewState(lua.Options{
@@ -171,7 +177,7 @@ func NewRuntimePool(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, con
 					vm.Call(1, 0)
 				}
 
-				nakamaModule := NewNakamaModule(logger, db, vm, tracker, notificationService, cbufferPool, nil, nil, nil, nil)
+				nakamaModule := NewNakamaModule(logger, db, vm, tracker, messageRouter, messageRetention, storageService, notificationService, cbufferPool, nil, nil, nil, nil, nil)
 				vm.PreloadModule("nakama", nakamaModule.Loader)
 
 				r := &Runtime{
@@ -211,6 +217,10 @@ func (rp *RuntimePool) HasAfter(messageName string) bool {
 	return ok
 }
 
+func (rp *RuntimePool) HasModeration() bool {
+	return rp.regModeration
+}
+
 func (rp *RuntimePool) Get() *Runtime {
 	return rp.pool.Get().(*Runtime)
 }
@@ -308,6 +318,8 @@ func (r *Runtime) GetRuntimeCallback(e ExecutionMode, key string) *lua.LFunction
 		return cp.Before[key]
 	case AFTER:
 		return cp.After[key]
+	case MODERATION:
+		return cp.Moderation
 	}
 
 	return nil
@@ -448,6 +460,30 @@ func (r *Runtime) InvokeFunctionHTTP(fn *lua.LFunction, uid string, handle strin
 	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
 }
 
+func (r *Runtime) InvokeFunctionModeration(fn *lua.LFunction, uid string, handle string, sessionExpiry int64, payload map[string]interface{}) (map[string]interface{}, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, MODERATION, uid, handle, sessionExpiry)
+	var lv lua.LValue
+	if payload != nil {
+		lv = ConvertMap(l, payload)
+	}
+
+	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if retValue.Type() == lua.LTTable {
+		return ConvertLuaTable(retValue.(*lua.LTable)), nil
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
 func (r *Runtime) invokeFunction(l *lua.LState, fn *lua.LFunction, ctx *lua.LTable, payload lua.LValue) (lua.LValue, error) {
 	l.Push(lua.LString(__nakamaReturnValue))
 	l.Push(fn)
@@ -29,6 +29,7 @@ const (
 	HTTP
 	JOB
 	LEADERBOARD_RESET
+	MODERATION
 )
 
 func (e ExecutionMode) String() string {
@@ -45,6 +46,8 @@ func (e ExecutionMode) String() string {
 		return "job"
 	case LEADERBOARD_RESET:
 		return "leaderboard_reset"
+	case MODERATION:
+		return "moderation"
 	}
 
 	return ""
@@ -15,56 +15,73 @@
 package server
 
 var RUNTIME_MESSAGES = map[string]string{
-	"*server.AuthenticateRequest_Device":       "authenticaterequest_device",
-	"*server.AuthenticateRequest_Custom":       "authenticaterequest_custom",
-	"*server.AuthenticateRequest_Email_":       "authenticaterequest_email",
-	"*server.AuthenticateRequest_Facebook":     "authenticaterequest_facebook",
-	"*server.AuthenticateRequest_Google":       "authenticaterequest_google",
-	"*server.AuthenticateRequest_Steam":        "authenticaterequest_steam",
-	"*server.AuthenticateRequest_GameCenter_":  "authenticaterequest_gamecenter",
-	"*server.Envelope_Logout":                  "logout",
-	"*server.Envelope_Link":                    "tlink",
-	"*server.Envelope_Unlink":                  "tunlink",
-	"*server.Envelope_SelfFetch":               "tselffetch",
-	"*server.Envelope_SelfUpdate":              "tselfupdate",
-	"*server.Envelope_UsersFetch":              "tusersfetch",
-	"*server.Envelope_FriendsAdd":              "tfriendsadd",
-	"*server.Envelope_FriendsRemove":           "tfriendsremove",
-	"*server.Envelope_FriendsBlock":            "tfriendsblock",
-	"*server.Envelope_FriendsList":             "tfriendslist",
-	"*server.Envelope_GroupsCreate":            "tgroupscreate",
-	"*server.Envelope_GroupsUpdate":            "tgroupsupdate",
-	"*server.Envelope_GroupsRemove":            "tgroupsremove",
-	"*server.Envelope_GroupsSelfList":          "tgroupsselflist",
-	"*server.Envelope_GroupsFetch":             "tgroupsfetch",
-	"*server.Envelope_GroupsList":              "tgroupslist",
-	"*server.Envelope_GroupUsersList":          "tgroupuserslist",
-	"*server.Envelope_GroupsJoin":              "tgroupsjoin",
-	"*server.Envelope_GroupsLeave":             "tgroupsleave",
-	"*server.Envelope_GroupUsersAdd":           "tgroupusersadd",
-	"*server.Envelope_GroupUsersKick":          "tgroupuserskick",
-	"*server.Envelope_GroupUsersPromote":       "tgroupuserspromote",
-	"*server.Envelope_TopicsJoin":              "ttopicsjoin",
-	"*server.Envelope_TopicsLeave":             "ttopicsleave",
-	"*server.Envelope_TopicMessageSend":        "ttopicmessagesend",
-	"*server.Envelope_TopicMessageAck":         "ttopicmessageack",
-	"*server.Envelope_TopicMessagesList":       "ttopicmessageslist",
-	"*server.Envelope_MatchmakeAdd":            "tmatchmakeadd",
-	"*server.Envelope_MatchmakeTicket":         "tmatchmaketicket",
-	"*server.Envelope_MatchmakeRemove":         "tmatchmakeremove",
-	"*server.Envelope_MatchCreate":             "tmatchcreate",
-	"*server.Envelope_MatchesJoin":             "tmatchesjoin",
-	"*server.Envelope_MatchDataSend":           "matchdatasend",
-	"*server.Envelope_MatchesLeave":            "tmatchesleave",
-	"*server.Envelope_StorageList":             "tstoragelist",
-	"*server.Envelope_StorageFetch":            "tstoragefetch",
-	"*server.Envelope_StorageWrite":            "tstoragewrite",
-	"*server.Envelope_StorageRemove":           "tstorageremove",
-	"*server.Envelope_LeaderboardsList":        "tleaderboardslist",
-	"*server.Envelope_LeaderboardRecordsWrite": "tleaderboardrecordswrite",
-	"*server.Envelope_LeaderboardRecordsFetch": "tleaderboardrecordsfetch",
-	"*server.Envelope_LeaderboardRecordsList":  "tleaderboardrecordslist",
-	"*server.Envelope_Rpc":                     "trpc",
-	"*server.Envelope_NotificationsList":       "tnotificationslist",
-	"*server.Envelope_NotificationsRemove":     "tnotificationsremove",
+	"*server.AuthenticateRequest_Device":        "authenticaterequest_device",
+	"*server.AuthenticateRequest_Custom":        "authenticaterequest_custom",
+	"*server.AuthenticateRequest_Email_":        "authenticaterequest_email",
+	"*server.AuthenticateRequest_Facebook":      "authenticaterequest_facebook",
+	"*server.AuthenticateRequest_Google":        "authenticaterequest_google",
+	"*server.AuthenticateRequest_Steam":         "authenticaterequest_steam",
+	"*server.AuthenticateRequest_GameCenter_":   "authenticaterequest_gamecenter",
+	"*server.Envelope_Logout":                   "logout",
+	"*server.Envelope_Link":                     "tlink",
+	"*server.Envelope_Unlink":                   "tunlink",
+	"*server.Envelope_SelfFetch":                "tselffetch",
+	"*server.Envelope_SelfUpdate":               "tselfupdate",
+	"*server.Envelope_UsersFetch":               "tusersfetch",
+	"*server.Envelope_FriendsAdd":               "tfriendsadd",
+	"*server.Envelope_FriendsRemove":            "tfriendsremove",
+	"*server.Envelope_FriendsBlock":             "tfriendsblock",
+	"*server.Envelope_FriendsList":              "tfriendslist",
+	"*server.Envelope_FriendsImport":            "tfriendsimport",
+	"*server.Envelope_FriendsSuggest":           "tfriendssuggest",
+	"*server.Envelope_FriendsMutual":            "tfriendsmutual",
+	"*server.Envelope_GroupsCreate":             "tgroupscreate",
+	"*server.Envelope_GroupsUpdate":             "tgroupsupdate",
+	"*server.Envelope_GroupsRemove":             "tgroupsremove",
+	"*server.Envelope_GroupsSelfList":           "tgroupsselflist",
+	"*server.Envelope_GroupsFetch":              "tgroupsfetch",
+	"*server.Envelope_GroupsList":               "tgroupslist",
+	"*server.Envelope_GroupUsersList":           "tgroupuserslist",
+	"*server.Envelope_GroupsJoin":               "tgroupsjoin",
+	"*server.Envelope_GroupsLeave":              "tgroupsleave",
+	"*server.Envelope_GroupUsersAdd":            "tgroupusersadd",
+	"*server.Envelope_GroupUsersKick":           "tgroupuserskick",
+	"*server.Envelope_GroupUsersPromote":        "tgroupuserspromote",
+	"*server.Envelope_TopicsJoin":               "ttopicsjoin",
+	"*server.Envelope_TopicsLeave":              "ttopicsleave",
+	"*server.Envelope_TopicMessageSend":         "ttopicmessagesend",
+	"*server.Envelope_TopicMessageAck":          "ttopicmessageack",
+	"*server.Envelope_TopicMessagesList":        "ttopicmessageslist",
+	"*server.Envelope_TopicMessageUpdate":       "ttopicmessageupdate",
+	"*server.Envelope_TopicMessageRemove":       "ttopicmessageremove",
+	"*server.Envelope_TopicMessagesRead":        "ttopicmessagesread",
+	"*server.Envelope_TopicsUnreadList":         "ttopicsunreadlist",
+	"*server.Envelope_TopicSignalSend":          "ttopicsignalsend",
+	"*server.Envelope_TopicModerate":            "ttopicmoderate",
+	"*server.Envelope_TopicMessagesSearch":      "ttopicmessagessearch",
+	"*server.Envelope_MatchmakeAdd":             "tmatchmakeadd",
+	"*server.Envelope_MatchmakeTicket":          "tmatchmaketicket",
+	"*server.Envelope_MatchmakeRemove":          "tmatchmakeremove",
+	"*server.Envelope_MatchCreate":              "tmatchcreate",
+	"*server.Envelope_MatchesJoin":              "tmatchesjoin",
+	"*server.Envelope_MatchDataSend":            "matchdatasend",
+	"*server.Envelope_MatchesLeave":             "tmatchesleave",
+	"*server.Envelope_StorageList":              "tstoragelist",
+	"*server.Envelope_StorageFetch":             "tstoragefetch",
+	"*server.Envelope_StorageWrite":             "tstoragewrite",
+	"*server.Envelope_StorageRemove":            "tstorageremove",
+	"*server.Envelope_StorageQuery":             "tstoragequery",
+	"*server.Envelope_StorageSubscribe":         "tstoragesubscribe",
+	"*server.Envelope_StorageUnsubscribe":       "tstorageunsubscribe",
+	"*server.Envelope_StorageHistoryList":       "tstoragehistorylist",
+	"*server.Envelope_LeaderboardsList":         "tleaderboardslist",
+	"*server.Envelope_LeaderboardRecordsWrite":  "tleaderboardrecordswrite",
+	"*server.Envelope_LeaderboardRecordsFetch":  "tleaderboardrecordsfetch",
+	"*server.Envelope_LeaderboardRecordsList":   "tleaderboardrecordslist",
+	"*server.Envelope_Rpc":                      "trpc",
+	"*server.Envelope_NotificationsList":        "tnotificationslist",
+	"*server.Envelope_NotificationsRemove":      "tnotificationsremove",
+	"*server.Envelope_NotificationsRead":        "tnotificationsread",
+	"*server.Envelope_NotificationsReadAll":     "tnotificationsreadall",
+	"*server.Envelope_NotificationsUnreadCount": "tnotificationsunreadcount",
 }
@@ -49,22 +49,28 @@ type Callbacks struct {
 	RPC    map[string]*lua.LFunction
 	Before map[string]*lua.LFunction
 	After  map[string]*lua.LFunction
+
+	Moderation *lua.LFunction
 }
 
 type NakamaModule struct {
 	logger              *zap.Logger
 	db                  *sql.DB
 	tracker             Tracker
+	messageRouter       MessageRouter
+	messageRetention    *MessageRetentionService
+	storageService      *StorageService
 	notificationService *NotificationService
 	cbufferPool         *CbufferPool
 	announceHTTP        func(string)
 	announceRPC         func(string)
 	announceBefore      func(string)
 	announceAfter       func(string)
+	announceModeration  func()
 	client              *http.Client
 }
 
-func NewNakamaModule(logger *zap.Logger, db *sql.DB, l *lua.LState, tracker Tracker, notificationService *NotificationService, cbufferPool *CbufferPool, announceHTTP func(string), announceRPC func(string), announceBefore func(string), announceAfter func(string)) *NakamaModule {
+func NewNakamaModule(logger *zap.Logger, db *sql.DB, l *lua.LState, tracker Tracker, messageRouter MessageRouter, messageRetention *MessageRetentionService, storageService *StorageService, notificationService *NotificationService, cbufferPool *CbufferPool, announceHTTP func(string), announceRPC func(string), announceBefore func(string), announceAfter func(string), announceModeration func()) *NakamaModule {
 	l.SetContext(context.WithValue(context.Background(), CALLBACKS, &Callbacks{
 		RPC:    make(map[string]*lua.LFunction),
 		Before: make(map[string]*lua.LFunction),
@@ -75,12 +81,16 @@ func NewNakamaModule(logger *zap.Logger, db *sql.DB, l *lua.LState, tracker Trac
 		logger:              logger,
 		db:                  db,
 		tracker:             tracker,
+		messageRouter:       messageRouter,
+		messageRetention:    messageRetention,
+		storageService:      storageService,
 		notificationService: notificationService,
 		cbufferPool:         cbufferPool,
 		announceHTTP:        announceHTTP,
 		announceRPC:         announceRPC,
 		announceBefore:      announceBefore,
 		announceAfter:       announceAfter,
+		announceModeration:  announceModeration,
 		client: &http.Client{
 			Timeout: 5 * time.Second,
 		},
@@ -112,15 +122,21 @@ func (n *NakamaModule) Loader(l *lua.LState) int {
 		"register_before":                n.registerBefore,
 		"register_after":                 n.registerAfter,
 		"register_http":                  n.registerHTTP,
+		"register_moderation":            n.registerModeration,
 		"users_fetch_id":                 n.usersFetchId,
 		"users_fetch_handle":             n.usersFetchHandle,
 		"users_update":                   n.usersUpdate,
 		"users_ban":                      n.usersBan,
 		"storage_list":                   n.storageList,
+		"storage_query":                  n.storageQuery,
 		"storage_fetch":                  n.storageFetch,
 		"storage_write":                  n.storageWrite,
 		"storage_update":                 n.storageUpdate,
 		"storage_remove":                 n.storageRemove,
+		"storage_transaction":            n.storageTransaction,
+		"storage_history_list":           n.storageHistoryList,
+		"storage_history_restore":        n.storageHistoryRestore,
+		"storage_register_schema":        n.storageRegisterSchema,
 		"leaderboard_create":             n.leaderboardCreate,
 		"leaderboard_submit_incr":        n.leaderboardSubmitIncr,
 		"leaderboard_submit_decr":        n.leaderboardSubmitDecr,
@@ -132,7 +148,26 @@ func (n *NakamaModule) Loader(l *lua.LState) int {
 		"groups_update":                  n.groupsUpdate,
 		"group_users_list":               n.groupUsersList,
 		"groups_user_list":               n.groupsUserList,
+		"groups_remove":                  n.groupsRemove,
+		"groups_join":                    n.groupsJoin,
+		"groups_leave":                   n.groupsLeave,
+		"group_users_add":                n.groupUsersAdd,
+		"group_users_kick":               n.groupUsersKick,
+		"group_users_promote":            n.groupUsersPromote,
+		"friends_list":                   n.friendsList,
+		"friends_add":                    n.friendsAdd,
+		"friends_remove":                 n.friendsRemove,
+		"friends_block":                  n.friendsBlock,
+		"friends_suggest":                n.friendsSuggest,
+		"friends_mutual":                 n.friendsMutual,
+		"topic_mute":                     n.topicMute,
+		"topic_unmute":                   n.topicUnmute,
+		"topic_kick":                     n.topicKick,
+		"topic_ban":                      n.topicBan,
+		"topic_unban":                    n.topicUnban,
+		"topic_messages_search":          n.topicMessagesSearch,
 		"notifications_send_id":          n.notificationsSendId,
+		"notifications_send_group":       n.notificationsSendGroup,
 		"event_publish":                  n.eventPublish,
 	})
 
@@ -594,6 +629,17 @@ func (n *NakamaModule) registerHTTP(l *lua.LState) int {
 	return 0
 }
 
+func (n *NakamaModule) registerModeration(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Moderation = fn
+	if n.announceModeration != nil {
+		n.announceModeration()
+	}
+	return 0
+}
+
 func (n *NakamaModule) usersFetchId(l *lua.LState) int {
 	lt := l.CheckTable(1)
 	userIds, ok := convertLuaValue(lt).([]interface{})
@@ -831,7 +877,51 @@ func (n *NakamaModule) storageList(l *lua.LState) int {
 	limit := l.CheckInt64(4)
 	cursor := l.OptString(5, "")
 
-	values, newCursor, _, err := StorageList(n.logger, n.db, "", userID, bucket, collection, limit, cursor)
+	var options *StorageListOptions
+	if optionsTable := l.OptTable(6, nil); optionsTable != nil {
+		options = &StorageListOptions{}
+		conversionError := false
+		optionsTable.ForEach(func(k lua.LValue, v lua.LValue) {
+			if conversionError {
+				return
+			}
+			switch k.String() {
+			case "Sort":
+				if v.Type() != lua.LTString {
+					conversionError = true
+					l.ArgError(6, "expects Sort to be string")
+					return
+				}
+				options.Sort = v.String()
+			case "SortDescending":
+				if v.Type() != lua.LTBool {
+					conversionError = true
+					l.ArgError(6, "expects SortDescending to be boolean")
+					return
+				}
+				options.SortDescending = lua.LVAsBool(v)
+			case "StartTime", "EndTime":
+				if v.Type() != lua.LTNumber {
+					conversionError = true
+					l.ArgError(6, fmt.Sprintf("expects %s to be number", k.String()))
+					return
+				}
+				if k.String() == "StartTime" {
+					options.StartTime = int64(lua.LVAsNumber(v))
+				} else {
+					options.EndTime = int64(lua.LVAsNumber(v))
+				}
+			default:
+				conversionError = true
+				l.ArgError(6, fmt.Sprintf("unrecognised argument in list options: %s", k.String()))
+			}
+		})
+		if conversionError {
+			return 0
+		}
+	}
+
+	values, newCursor, previousCursor, _, err := StorageList(n.logger, n.db, "", userID, bucket, collection, limit, cursor, options)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to list storage: %s", err.Error()))
 		return 0
@@ -862,9 +952,269 @@ func (n *NakamaModule) storageList(l *lua.LState) int {
 		l.Push(lua.LNil)
 	}
 
+	// Convert and push the previous page cursor, only set on sorted lists.
+	if previousCursor != "" {
+		l.Push(lua.LString(previousCursor))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 3
+}
+
+func (n *NakamaModule) storageQuery(l *lua.LState) int {
+	bucket := l.CheckString(1)
+	if bucket == "" {
+		l.ArgError(1, "expects a valid bucket")
+		return 0
+	}
+	collection := l.CheckString(2)
+	if collection == "" {
+		l.ArgError(2, "expects a valid collection")
+		return 0
+	}
+
+	var userID, sortIndex, cursor string
+	var sortDescending bool
+	var limit int64
+	filters := make([]*StorageQueryFilter, 0)
+	conversionError := false
+	if queryTable := l.OptTable(3, nil); queryTable != nil {
+		queryTable.ForEach(func(k lua.LValue, v lua.LValue) {
+			if conversionError {
+				return
+			}
+			switch k.String() {
+			case "UserId", "SortIndex", "Cursor":
+				if v.Type() != lua.LTString {
+					conversionError = true
+					l.ArgError(3, fmt.Sprintf("expects %s to be string", k.String()))
+					return
+				}
+				switch k.String() {
+				case "UserId":
+					userID = v.String()
+				case "SortIndex":
+					sortIndex = v.String()
+				case "Cursor":
+					cursor = v.String()
+				}
+			case "SortDescending":
+				if v.Type() != lua.LTBool {
+					conversionError = true
+					l.ArgError(3, "expects SortDescending to be boolean")
+					return
+				}
+				sortDescending = lua.LVAsBool(v)
+			case "Limit":
+				if v.Type() != lua.LTNumber {
+					conversionError = true
+					l.ArgError(3, "expects Limit to be number")
+					return
+				}
+				limit = int64(lua.LVAsNumber(v))
+			case "Filters":
+				filtersTable, ok := v.(*lua.LTable)
+				if !ok {
+					conversionError = true
+					l.ArgError(3, "expects Filters to be a table")
+					return
+				}
+				filtersTable.ForEach(func(_ lua.LValue, fv lua.LValue) {
+					if conversionError {
+						return
+					}
+					filterTable, ok := fv.(*lua.LTable)
+					if !ok {
+						conversionError = true
+						l.ArgError(3, "expects each filter to be a table")
+						return
+					}
+
+					filter := &StorageQueryFilter{Index: filterTable.RawGetString("Index").String()}
+					index := n.storageService.Indexes().Index(bucket, collection, filter.Index)
+					if index == nil {
+						conversionError = true
+						l.ArgError(3, fmt.Sprintf("unknown filter index %s", filter.Index))
+						return
+					}
+
+					opName := filterTable.RawGetString("Op").String()
+					found := false
+					for op, name := range storageQueryFilterOps {
+						if name == opName {
+							filter.Op = int64(op)
+							found = true
+							break
+						}
+					}
+					if !found {
+						conversionError = true
+						l.ArgError(3, "expects filter Op to be one of '=', '<', '<=', '>' or '>='")
+						return
+					}
+
+					filter.Type = index.Type
+					value := filterTable.RawGetString("Value")
+					switch {
+					case index.Type == STORAGE_INDEX_STRING && value.Type() == lua.LTString:
+						filter.StringValue = value.String()
+					case index.Type == STORAGE_INDEX_NUMBER && value.Type() == lua.LTNumber:
+						filter.NumberValue = float64(lua.LVAsNumber(value))
+					default:
+						conversionError = true
+						l.ArgError(3, fmt.Sprintf("expects filter Value to be a %s for index %s", index.Type, filter.Index))
+						return
+					}
+
+					filters = append(filters, filter)
+				})
+			default:
+				conversionError = true
+				l.ArgError(3, fmt.Sprintf("unrecognised argument in query: %s", k.String()))
+			}
+		})
+	}
+	if conversionError {
+		return 0
+	}
+
+	values, newCursor, _, err := StorageQuery(n.logger, n.db, n.storageService, "", userID, bucket, collection, filters, sortIndex, sortDescending, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to query storage: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, v := range values {
+		vm := structs.Map(v)
+
+		valueMap := make(map[string]interface{})
+		err = json.Unmarshal(v.Value, &valueMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert value to json: %s", err.Error()))
+			return 0
+		}
+
+		lt := ConvertMap(l, vm)
+		lt.RawSetString("Value", ConvertMap(l, valueMap))
+		lv.RawSetInt(i+1, lt)
+	}
+	l.Push(lv)
+
+	// Convert and push the new cursor, if any.
+	if newCursor != "" {
+		l.Push(lua.LString(newCursor))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 2
+}
+
+func (n *NakamaModule) storageHistoryList(l *lua.LState) int {
+	key := &StorageKey{
+		Bucket:     l.CheckString(1),
+		Collection: l.CheckString(2),
+		Record:     l.CheckString(3),
+		UserId:     l.OptString(4, ""),
+	}
+	limit := l.OptInt64(5, 0)
+	cursor := l.OptString(6, "")
+
+	values, newCursor, _, err := StorageHistoryList(n.logger, n.db, n.storageService, "", key, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list storage history: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the versions.
+	lv := l.NewTable()
+	for i, v := range values {
+		vm := structs.Map(v)
+
+		valueMap := make(map[string]interface{})
+		err = json.Unmarshal(v.Value, &valueMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert value to json: %s", err.Error()))
+			return 0
+		}
+
+		lt := ConvertMap(l, vm)
+		lt.RawSetString("Value", ConvertMap(l, valueMap))
+		lv.RawSetInt(i+1, lt)
+	}
+	l.Push(lv)
+
+	// Convert and push the new cursor, if any.
+	if newCursor != "" {
+		l.Push(lua.LString(newCursor))
+	} else {
+		l.Push(lua.LNil)
+	}
+
 	return 2
 }
 
+func (n *NakamaModule) storageRegisterSchema(l *lua.LState) int {
+	bucket := l.CheckString(1)
+	collection := l.CheckString(2)
+
+	// The schema can be given as a JSON string or as a table.
+	var schema []byte
+	switch v := l.Get(3); v.Type() {
+	case lua.LTString:
+		schema = []byte(v.String())
+	case lua.LTTable:
+		var err error
+		schema, err = json.Marshal(convertLuaValue(v))
+		if err != nil {
+			l.ArgError(3, fmt.Sprintf("expects a valid schema: %s", err.Error()))
+			return 0
+		}
+	default:
+		l.ArgError(3, "expects a schema as a JSON string or table")
+		return 0
+	}
+
+	schemas := n.storageService.Schemas()
+	if schemas == nil {
+		l.RaiseError("failed to register storage schema: storage is not available")
+		return 0
+	}
+	if err := schemas.Register(bucket, collection, schema); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to register storage schema: %s", err.Error()))
+		return 0
+	}
+	return 0
+}
+
+func (n *NakamaModule) storageHistoryRestore(l *lua.LState) int {
+	key := &StorageKey{
+		Bucket:     l.CheckString(1),
+		Collection: l.CheckString(2),
+		Record:     l.CheckString(3),
+		UserId:     l.OptString(4, ""),
+	}
+	version := l.CheckString(5)
+	if version == "" {
+		l.ArgError(5, "expects a valid version")
+		return 0
+	}
+	// Optionally only restore if the record has not changed since this version was seen.
+	key.Version = l.OptString(6, "")
+
+	restoredKey, _, err := StorageHistoryRestore(n.logger, n.db, n.storageService, key, version)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to restore storage history: %s", err.Error()))
+		return 0
+	}
+
+	l.Push(ConvertMap(l, structs.Map(restoredKey)))
+	return 1
+}
+
 func (n *NakamaModule) storageFetch(l *lua.LState) int {
 	keysTable := l.CheckTable(1)
 	if keysTable == nil || keysTable.Len() == 0 {
@@ -992,112 +1342,11 @@ func (n *NakamaModule) storageWrite(l *lua.LState) int {
 	}
 
 	data := make([]*StorageData, len(dataMap))
-	idx := 0
-	for _, k := range dataMap {
-		var bucket string
-		if b, ok := k["Bucket"]; !ok {
-			l.ArgError(1, "expects a bucket in each key")
-			return 0
-		} else {
-			if bs, ok := b.(string); !ok {
-				l.ArgError(1, "bucket must be a string")
-				return 0
-			} else {
-				bucket = bs
-			}
-		}
-		var collection string
-		if c, ok := k["Collection"]; !ok {
-			l.ArgError(1, "expects a collection in each key")
-			return 0
-		} else {
-			if cs, ok := c.(string); !ok {
-				l.ArgError(1, "collection must be a string")
-				return 0
-			} else {
-				collection = cs
-			}
-		}
-		var record string
-		if r, ok := k["Record"]; !ok {
-			l.ArgError(1, "expects a record in each key")
-			return 0
-		} else {
-			if rs, ok := r.(string); !ok {
-				l.ArgError(1, "record must be a string")
-				return 0
-			} else {
-				record = rs
-			}
-		}
-		var value []byte
-		if v, ok := k["Value"]; !ok {
-			l.ArgError(1, "expects a value in each key")
-			return 0
-		} else {
-			if vs, ok := v.(map[string]interface{}); !ok {
-				l.ArgError(1, "value must be a table")
-				return 0
-			} else {
-				dataJson, err := json.Marshal(vs)
-				if err != nil {
-					l.RaiseError("could not convert value to JSON: %v", err.Error())
-					return 0
-				}
-				value = dataJson
-			}
-		}
-		var userID string
-		if u, ok := k["UserId"]; ok {
-			if us, ok := u.(string); !ok {
-				l.ArgError(1, "expects valid user IDs in each value, when provided")
-				return 0
-			} else {
-				userID = us
-			}
-		}
-		var version string
-		if v, ok := k["Version"]; ok {
-			if vs, ok := v.(string); !ok {
-				l.ArgError(1, "version must be a string")
-				return 0
-			} else {
-				version = vs
-			}
-		}
-		readPermission := int64(1)
-		if r, ok := k["PermissionRead"]; ok {
-			if rf, ok := r.(float64); !ok {
-				l.ArgError(1, "permission read must be a number")
-				return 0
-			} else {
-				readPermission = int64(rf)
-			}
-		}
-		writePermission := int64(1)
-		if w, ok := k["PermissionWrite"]; ok {
-			if wf, ok := w.(float64); !ok {
-				l.ArgError(1, "permission read must be a number")
-				return 0
-			} else {
-				writePermission = int64(wf)
-			}
-		}
-
-		data[idx] = &StorageData{
-			Bucket:          bucket,
-			Collection:      collection,
-			Record:          record,
-			UserId:          userID,
-			Value:           value,
-			Version:         version,
-			PermissionRead:  readPermission,
-			PermissionWrite: writePermission,
-		}
-		idx++
+	for i, k := range dataMap {
+		data[i] = convertLuaStorageData(l, 1, k)
 	}
 
-	keys, _, err := StorageWrite(n.logger, n.db, "", data)
+	keys, _, err := StorageWrite(n.logger, n.db, n.storageService, "", data)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to write storage: %s", err.Error()))
 		return 0
@@ -1130,120 +1379,20 @@ func (n *NakamaModule) storageUpdate(l *lua.LState) int {
 			return
 		}
 
-		// Initialise fields where default values for their types are not the logical defaults needed.
-		update := &StorageKeyUpdate{
-			Key:             &StorageKey{},
-			PermissionRead:  int64(1),
-			PermissionWrite: int64(1),
+		update, err := convertLuaStorageKeyUpdate(updateTable)
+		if err != "" {
+			conversionError = err
+			return
 		}
-
-		updateTable.ForEach(func(k lua.LValue, v lua.LValue) {
-			switch k.String() {
-			case "Bucket":
-				if v.Type() != lua.LTString {
-					conversionError = "expects valid buckets in each update"
-					return
-				}
-				update.Key.Bucket = v.String()
-			case "Collection":
-				if v.Type() != lua.LTString {
-					conversionError = "expects valid collections in each update"
-					return
-				}
-				update.Key.Collection = v.String()
-			case "Record":
-				if v.Type() != lua.LTString {
-					conversionError = "expects valid records in each update"
-					return
-				}
-				update.Key.Record = v.String()
-			case "UserId":
-				if v.Type() != lua.LTString {
-					conversionError = "expects valid user IDs in each update"
-					return
-				}
-				update.Key.UserId = v.String()
-			case "Version":
-				if v.Type() != lua.LTString {
-					conversionError = "expects valid versions in each update"
-					return
-				}
-				update.Key.Version = v.String()
-			case "PermissionRead":
-				if v.Type() != lua.LTNumber {
-					conversionError = "expects valid read permissions in each update"
-					return
-				}
-				update.PermissionRead = int64(lua.LVAsNumber(v))
-			case "PermissionWrite":
-				if v.Type() != lua.LTNumber {
-					conversionError = "expects valid write permissions in each update"
-					return
-				}
-				update.PermissionWrite = int64(lua.LVAsNumber(v))
-			case "Update":
-				if v.Type() != lua.LTTable {
-					conversionError = "expects valid patch op in each update"
-					return
-				}
-
-				vi, ok := convertLuaValue(v).([]interface{})
-				if !ok {
-					conversionError = "expects valid patch op in each update"
-					return
-				}
-
-				// Lowercase all key names in op declarations.
-				// eg. the Lua patch op: {{Op = "incr", Path = "/foo", Value = 1}}
-				// becomes the JSON:     [{"op": "incr", "path": "/foo", "value": 1}]
-				for _, vim := range vi {
-					vm, ok := vim.(map[string]interface{})
-					if !ok {
-						conversionError = "expects valid patch op in each update"
-						return
-					}
-					for vmK, vmV := range vm {
-						vmKlower := strings.ToLower(vmK)
-						if vmKlower != vmK {
-							delete(vm, vmK)
-							vm[vmKlower] = vmV
-						}
-					}
-				}
-
-				ve, err := json.Marshal(vi)
-				if err != nil {
-					conversionError = "expects valid patch op in each update"
-					return
-				}
-				patch, err := jsonpatch.DecodeExtendedPatch(ve)
-				if err != nil {
-					conversionError = "expects valid patch op in each update"
-					return
-				}
-				update.Patch = patch
-			}
-		})
-
-		// If there was an inner error allow it to propagate.
-		if conversionError != "" {
-			return
-		}
-
-		// Check it's a valid update op.
-		if update.Key.Bucket == "" || update.Key.Collection == "" || update.Key.Record == "" || update.Patch == nil {
-			conversionError = "expects each update to contain at least bucket, collection, record, and update"
-			return
-		}
-		updates = append(updates, update)
-	})
+		updates = append(updates, update)
+	})
 
 	if conversionError != "" {
 		l.ArgError(1, conversionError)
 		return 0
 	}
 
-	keys, _, err := StorageUpdate(n.logger, n.db, "", updates)
+	keys, _, err := StorageUpdate(n.logger, n.db, n.storageService, "", updates)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to update storage: %s", err.Error()))
 		return 0
@@ -1281,76 +1430,126 @@ func (n *NakamaModule) storageRemove(l *lua.LState) int {
 	}
 
 	keys := make([]*StorageKey, len(keyMap))
-	idx := 0
-	for _, k := range keyMap {
-		var bucket string
-		if b, ok := k["Bucket"]; !ok {
-			l.ArgError(1, "expects a bucket in each key")
-			return 0
-		} else {
-			if bs, ok := b.(string); !ok {
-				l.ArgError(1, "bucket must be a string")
-				return 0
-			} else {
-				bucket = bs
-			}
+	for i, k := range keyMap {
+		keys[i] = convertLuaStorageKey(l, 1, k)
+	}
+
+	if _, err := StorageRemove(n.logger, n.db, n.storageService, "", keys); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to remove storage: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) storageTransaction(l *lua.LState) int {
+	opsTable := l.CheckTable(1)
+	if opsTable == nil || opsTable.Len() == 0 {
+		l.ArgError(1, "expects a valid set of operations")
+		return 0
+	}
+
+	ops := make([]*StorageTransactionOp, 0, opsTable.Len())
+	conversionError := ""
+	opsTable.ForEach(func(i lua.LValue, o lua.LValue) {
+		if conversionError != "" {
+			return
 		}
-		var collection string
-		if c, ok := k["Collection"]; !ok {
-			l.ArgError(1, "expects a collection in each key")
-			return 0
-		} else {
-			if cs, ok := c.(string); !ok {
-				l.ArgError(1, "collection must be a string")
-				return 0
-			} else {
-				collection = cs
-			}
+		opTable, ok := o.(*lua.LTable)
+		if !ok {
+			conversionError = "expects a valid set of operations"
+			return
 		}
-		var record string
-		if r, ok := k["Record"]; !ok {
-			l.ArgError(1, "expects a record in each key")
-			return 0
-		} else {
-			if rs, ok := r.(string); !ok {
-				l.ArgError(1, "record must be a string")
-				return 0
-			} else {
-				record = rs
-			}
+
+		opName := opTable.RawGetString("Op")
+		if opName.Type() != lua.LTString {
+			conversionError = "expects each operation to contain an Op"
+			return
 		}
-		var userID string
-		if u, ok := k["UserId"]; ok {
-			if us, ok := u.(string); !ok {
-				l.ArgError(1, "expects valid user IDs in each key, when provided")
-				return 0
-			} else {
-				userID = us
+
+		switch op := opName.String(); op {
+		case "write":
+			m, ok := convertLuaValue(opTable).(map[string]interface{})
+			if !ok {
+				conversionError = "expects a valid write operation"
+				return
+			}
+			ops = append(ops, &StorageTransactionOp{Write: convertLuaStorageData(l, 1, m)})
+		case "update":
+			update, err := convertLuaStorageKeyUpdate(opTable)
+			if err != "" {
+				conversionError = err
+				return
+			}
+			ops = append(ops, &StorageTransactionOp{Update: update})
+		case "remove":
+			m, ok := convertLuaValue(opTable).(map[string]interface{})
+			if !ok {
+				conversionError = "expects a valid remove operation"
+				return
 			}
+			ops = append(ops, &StorageTransactionOp{Remove: convertLuaStorageKey(l, 1, m)})
+		case "leaderboard_submit_incr", "leaderboard_submit_decr", "leaderboard_submit_set", "leaderboard_submit_best":
+			submit := &LeaderboardSubmit{Op: strings.TrimPrefix(op, "leaderboard_submit_")}
+			if v := opTable.RawGetString("LeaderboardId"); v.Type() == lua.LTString {
+				submit.LeaderboardID = v.String()
+			}
+			if v := opTable.RawGetString("OwnerId"); v.Type() == lua.LTString {
+				submit.OwnerID = v.String()
+			}
+			v := opTable.RawGetString("Value")
+			if submit.LeaderboardID == "" || submit.OwnerID == "" || v.Type() != lua.LTNumber {
+				conversionError = "expects each leaderboard submit to contain a LeaderboardId, OwnerId and Value"
+				return
+			}
+			submit.Value = int64(lua.LVAsNumber(v))
+			submit.Handle = lua.LVAsString(opTable.RawGetString("Handle"))
+			submit.Lang = lua.LVAsString(opTable.RawGetString("Lang"))
+			submit.Location = lua.LVAsString(opTable.RawGetString("Location"))
+			submit.Timezone = lua.LVAsString(opTable.RawGetString("Timezone"))
+			if metadata, ok := opTable.RawGetString("Metadata").(*lua.LTable); ok {
+				metadataBytes, err := json.Marshal(ConvertLuaTable(metadata))
+				if err != nil {
+					conversionError = "expects valid leaderboard record metadata"
+					return
+				}
+				submit.Metadata = metadataBytes
+			}
+			ops = append(ops, &StorageTransactionOp{LeaderboardSubmit: submit})
+		default:
+			conversionError = fmt.Sprintf("unknown operation %s", op)
 		}
-		var version string
-		if v, ok := k["Version"]; ok {
-			if vs, ok := v.(string); !ok {
-				l.ArgError(1, "version must be a string")
+	})
+
+	if conversionError != "" {
+		l.ArgError(1, conversionError)
+		return 0
+	}
+
+	results, _, err := StorageTransaction(n.logger, n.db, n.storageService, "", ops)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to run storage transaction: %s", err.Error()))
+		return 0
+	}
+
+	// Results are returned in operation order. Removes have an empty result.
+	lv := l.NewTable()
+	for i, r := range results {
+		switch {
+		case r.Key != nil:
+			lv.RawSetInt(i+1, ConvertMap(l, structs.Map(r.Key)))
+		case r.LeaderboardRecord != nil:
+			lt, err := convertLeaderboardRecord(l, r.LeaderboardRecord)
+			if err != nil {
+				l.RaiseError(fmt.Sprintf("failed to convert leaderboard record metadata to json: %s", err.Error()))
 				return 0
-			} else {
-				version = vs
 			}
+			lv.RawSetInt(i+1, lt)
+		default:
+			lv.RawSetInt(i+1, l.NewTable())
 		}
-		keys[idx] = &StorageKey{
-			Bucket:     bucket,
-			Collection: collection,
-			Record:     record,
-			UserId:     userID,
-			Version:    version,
-		}
-		idx++
 	}
 
-	if _, err := StorageRemove(n.logger, n.db, "", keys); err != nil {
-		l.RaiseError(fmt.Sprintf("failed to remove storage: %s", err.Error()))
-	}
-	return 0
+	l.Push(lv)
+	return 1
 }
 
 func (n *NakamaModule) leaderboardCreate(l *lua.LState) int {
@@ -1420,22 +1619,29 @@ func (n *NakamaModule) leaderboardSubmit(l *lua.LState, op string) int {
 		return 0
 	}
 
-	rm := structs.Map(record)
-
-	outgoingMetadataMap := make(map[string]interface{})
-	err = json.Unmarshal([]byte(record.Metadata), &outgoingMetadataMap)
+	lv, err := convertLeaderboardRecord(l, record)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to convert leaderboard record metadata to json: %s", err.Error()))
 		return 0
 	}
 
-	lv := ConvertMap(l, rm)
-	lv.RawSetString("Metadata", ConvertMap(l, outgoingMetadataMap))
-
 	l.Push(lv)
 	return 1
 }
 
+func convertLeaderboardRecord(l *lua.LState, record *LeaderboardRecord) (*lua.LTable, error) {
+	rm := structs.Map(record)
+
+	outgoingMetadataMap := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(record.Metadata), &outgoingMetadataMap); err != nil {
+		return nil, err
+	}
+
+	lv := ConvertMap(l, rm)
+	lv.RawSetString("Metadata", ConvertMap(l, outgoingMetadataMap))
+	return lv, nil
+}
+
 func (n *NakamaModule) leaderboardRecordsListUser(l *lua.LState) int {
 	leaderboardID := l.CheckString(1)
 	if leaderboardID == "" {
@@ -1892,126 +2098,1016 @@ func (n *NakamaModule) groupsUserList(l *lua.LState) int {
 	return 1
 }
 
-func (n *NakamaModule) notificationsSendId(l *lua.LState) int {
-	notificationsTable := l.CheckTable(1)
-	if notificationsTable == nil {
-		l.ArgError(1, "expects a valid set of notifications")
+func (n *NakamaModule) groupsRemove(l *lua.LState) int {
+	groupID := l.CheckString(1)
+	if groupID == "" {
+		l.ArgError(1, "expects a valid group ID")
 		return 0
 	}
 
-	conversionError := false
-	notifications := make([]*NNotification, 0)
-	notificationsTable.ForEach(func(i lua.LValue, g lua.LValue) {
-		notificationTable, ok := g.(*lua.LTable)
-		if !ok {
-			conversionError = true
-			l.ArgError(1, "expects a valid set of notifications")
-			return
-		}
-
-		notification := &NNotification{}
-		notificationTable.ForEach(func(k lua.LValue, v lua.LValue) {
-			switch k.String() {
-			case "Persistent":
-				if v.Type() != lua.LTBool {
-					conversionError = true
-					l.ArgError(1, "expects Persistent to be boolean")
-					return
-				}
-				notification.Persistent = lua.LVAsBool(v)
-			case "Subject":
-				if v.Type() != lua.LTString {
-					conversionError = true
-					l.ArgError(1, "expects Subject to be string")
-					return
-				}
-				notification.Subject = v.String()
-			case "Content":
-				if v.Type() != lua.LTTable {
-					conversionError = true
-					l.ArgError(1, "expects Content to be a table")
-					return
-				}
-
-				contentMap := ConvertLuaTable(v.(*lua.LTable))
-				contentBytes, err := json.Marshal(contentMap)
-				if err != nil {
-					conversionError = true
-					l.ArgError(1, fmt.Sprintf("failed to convert content: %s", err.Error()))
-					return
-				}
-
-				notification.Content = contentBytes
-			case "Code":
-				if v.Type() != lua.LTNumber {
-					conversionError = true
-					l.ArgError(1, "expects Code to be number")
-					return
-				}
-				number := int64(lua.LVAsNumber(v))
-				if number <= 100 {
-					l.ArgError(1, "expects Code to number above 100")
-					return
-				}
-				notification.Code = int64(number)
-			case "UserId":
-				if v.Type() != lua.LTString {
-					conversionError = true
-					l.ArgError(1, "expects UserId to be string")
-					return
-				}
-				u := v.String()
-				if u == "" {
-					l.ArgError(1, "expects UserId to be a valid UUID")
-					return
-				}
-				notification.UserID = u
-			case "SenderId":
-				if v.Type() == lua.LTNil {
-					return
-				}
-				if v.Type() != lua.LTString {
-					conversionError = true
-					l.ArgError(1, "expects SenderId to be string")
-					return
-				}
-				u := v.String()
-				if u == "" {
-					l.ArgError(1, "expects SenderId to be a valid UUID")
-					return
-				}
-				notification.SenderID = u
-			}
-		})
-
-		if notification.Subject == "" {
-			l.ArgError(1, "expects Subject to be non-empty")
-			return
-		} else if len(notification.Content) == 0 {
-			l.ArgError(1, "expects Content to be a valid JSON")
-			return
-		} else if len(notification.UserID) == 0 {
-			l.ArgError(1, "expects UserId to be a valid UUID")
-			return
-		}
-
-		notification.Id = generateNewId()
+	if _, err := GroupRemove(n.logger, n.db, "", groupID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to remove group: %s", err.Error()))
+	}
+	return 0
+}
 
-		notifications = append(notifications, notification)
-	})
+func (n *NakamaModule) groupsJoin(l *lua.LState) int {
+	groupID := l.CheckString(1)
+	if groupID == "" {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
 
-	if conversionError {
+	userID := l.CheckString(2)
+	if userID == "" {
+		l.ArgError(2, "expects a valid user ID")
 		return 0
 	}
 
-	err := n.notificationService.NotificationSend(notifications)
-	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to send notifications: %s", err.Error()))
+	var handle string
+	if err := n.db.QueryRow("SELECT handle FROM users WHERE id = $1 AND disabled_at = 0", userID).Scan(&handle); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to join group: %s", err.Error()))
+		return 0
 	}
 
+	if _, err := GroupJoin(n.logger, n.db, n.tracker, n.messageRouter, n.messageRetention, n.notificationService, userID, handle, groupID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to join group: %s", err.Error()))
+	}
 	return 0
 }
 
-func (n *NakamaModule) eventPublish(l *lua.LState) int {
-	return 0
+func (n *NakamaModule) groupsLeave(l *lua.LState) int {
+	groupID := l.CheckString(1)
+	if groupID == "" {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+
+	userID := l.CheckString(2)
+	if userID == "" {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	// Allow disabled users to leave groups.
+	var handle string
+	if err := n.db.QueryRow("SELECT handle FROM users WHERE id = $1", userID).Scan(&handle); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to leave group: %s", err.Error()))
+		return 0
+	}
+
+	if _, err := GroupLeave(n.logger, n.db, n.tracker, n.messageRouter, n.messageRetention, userID, handle, groupID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to leave group: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupUsersAdd(l *lua.LState) int {
+	groupID := l.CheckString(1)
+	if groupID == "" {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+
+	userID := l.CheckString(2)
+	if userID == "" {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err := GroupUserAdd(n.logger, n.db, n.tracker, n.messageRouter, n.messageRetention, n.notificationService, "", "", groupID, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to add user to group: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupUsersKick(l *lua.LState) int {
+	groupID := l.CheckString(1)
+	if groupID == "" {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+
+	userID := l.CheckString(2)
+	if userID == "" {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err := GroupUserKick(n.logger, n.db, n.tracker, n.messageRouter, n.messageRetention, "", "", groupID, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to kick user from group: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupUsersPromote(l *lua.LState) int {
+	groupID := l.CheckString(1)
+	if groupID == "" {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+
+	userID := l.CheckString(2)
+	if userID == "" {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err := GroupUserPromote(n.logger, n.db, n.tracker, n.messageRouter, n.messageRetention, "", "", groupID, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to promote user: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) friendsList(l *lua.LState) int {
+	userID := l.CheckString(1)
+	if userID == "" {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	state := l.OptInt64(2, -1)
+	if state < -1 || state > 3 {
+		l.ArgError(2, "expects state to be one of friend(0), invite(1), invited(2) or blocked(3)")
+		return 0
+	}
+
+	limit := l.OptInt64(3, 0)
+	if limit < 0 {
+		l.ArgError(3, "expects limit to be 0 or greater")
+		return 0
+	}
+
+	online := l.OptBool(4, false)
+	cursor := l.OptString(5, "")
+
+	friends, newCursor, _, err := FriendsList(n.logger, n.db, n.tracker, userID, state, limit, online, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list friends: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, f := range friends {
+		fm := structs.Map(f)
+
+		metadataMap := make(map[string]interface{})
+		err = json.Unmarshal([]byte(f.User.Metadata), &metadataMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert metadata to json: %s", err.Error()))
+			return 0
+		}
+
+		ft := ConvertMap(l, fm)
+		ft.RawGetString("User").(*lua.LTable).RawSetString("Metadata", ConvertMap(l, metadataMap))
+		lv.RawSetInt(i+1, ft)
+	}
+
+	l.Push(lv)
+
+	// Convert and push the new cursor, if any.
+	if newCursor != "" {
+		l.Push(lua.LString(newCursor))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 2
+}
+
+func (n *NakamaModule) friendsAdd(l *lua.LState) int {
+	userID := l.CheckString(1)
+	if userID == "" {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	friendID := l.CheckString(2)
+	if friendID == "" {
+		l.ArgError(2, "expects a valid friend ID")
+		return 0
+	} else if friendID == userID {
+		l.ArgError(2, "cannot add self as friend")
+		return 0
+	}
+
+	// The handle is needed for the notification sent to the friend.
+	var handle string
+	if err := n.db.QueryRow("SELECT handle FROM users WHERE id = $1", userID).Scan(&handle); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to add friend: %s", err.Error()))
+		return 0
+	}
+
+	if err := friendAdd(n.logger, n.db, n.notificationService, userID, handle, friendID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to add friend: %s", err.Error()))
+		return 0
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) friendsRemove(l *lua.LState) int {
+	userID := l.CheckString(1)
+	if userID == "" {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	friendID := l.CheckString(2)
+	if friendID == "" {
+		l.ArgError(2, "expects a valid friend ID")
+		return 0
+	} else if friendID == userID {
+		l.ArgError(2, "cannot remove self as friend")
+		return 0
+	}
+
+	if err := friendRemove(n.logger, n.db, userID, friendID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to remove friend: %s", err.Error()))
+		return 0
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) friendsBlock(l *lua.LState) int {
+	userID := l.CheckString(1)
+	if userID == "" {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	blockedID := l.CheckString(2)
+	if blockedID == "" {
+		l.ArgError(2, "expects a valid user ID to block")
+		return 0
+	} else if blockedID == userID {
+		l.ArgError(2, "cannot block self")
+		return 0
+	}
+
+	if err := friendBlock(n.logger, n.db, userID, blockedID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to block user: %s", err.Error()))
+		return 0
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) friendsSuggest(l *lua.LState) int {
+	userID := l.CheckString(1)
+	if userID == "" {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	limit := l.OptInt64(2, 10)
+	if limit < 1 || limit > 100 {
+		l.ArgError(2, "expects limit to be between 1 and 100")
+		return 0
+	}
+
+	suggestions, _, err := FriendsSuggest(n.logger, n.db, n.tracker, userID, limit)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to get friend suggestions: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, s := range suggestions {
+		sm := structs.Map(s)
+
+		metadataMap := make(map[string]interface{})
+		err = json.Unmarshal([]byte(s.User.Metadata), &metadataMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert metadata to json: %s", err.Error()))
+			return 0
+		}
+
+		st := ConvertMap(l, sm)
+		st.RawGetString("User").(*lua.LTable).RawSetString("Metadata", ConvertMap(l, metadataMap))
+		lv.RawSetInt(i+1, st)
+	}
+
+	l.Push(lv)
+
+	return 1
+}
+
+func (n *NakamaModule) friendsMutual(l *lua.LState) int {
+	userID := l.CheckString(1)
+	if userID == "" {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	otherUserID := l.CheckString(2)
+	if otherUserID == "" {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	users, _, err := FriendsMutual(n.logger, n.db, n.tracker, userID, otherUserID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to get mutual friends: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, u := range users {
+		um := structs.Map(u)
+
+		metadataMap := make(map[string]interface{})
+		err = json.Unmarshal([]byte(u.Metadata), &metadataMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert metadata to json: %s", err.Error()))
+			return 0
+		}
+
+		ut := ConvertMap(l, um)
+		ut.RawSetString("Metadata", ConvertMap(l, metadataMap))
+		lv.RawSetInt(i+1, ut)
+	}
+
+	l.Push(lv)
+
+	return 1
+}
+
+// checkModeratedTopic reads a topic type and name from the first two arguments, which must be a room or group topic.
+func checkModeratedTopic(l *lua.LState) *TopicId {
+	topicType := l.CheckString(1)
+	name := l.CheckString(2)
+	if name == "" {
+		l.ArgError(2, "expects a valid topic name or group ID")
+		return nil
+	}
+
+	switch topicType {
+	case "room":
+		return &TopicId{Id: &TopicId_Room{Room: name}}
+	case "group":
+		return &TopicId{Id: &TopicId_GroupId{GroupId: name}}
+	}
+	l.ArgError(1, "expects topic type to be 'room' or 'group'")
+	return nil
+}
+
+func (n *NakamaModule) topicMute(l *lua.LState) int {
+	topic := checkModeratedTopic(l)
+	if topic == nil {
+		return 0
+	}
+
+	userID := l.CheckString(3)
+	if userID == "" {
+		l.ArgError(3, "expects a valid user ID")
+		return 0
+	}
+
+	durationMs := l.CheckInt64(4)
+	if durationMs <= 0 {
+		l.ArgError(4, "expects duration to be greater than 0")
+		return 0
+	}
+
+	if _, err := TopicMute(n.logger, n.db, topic, userID, nowMs()+durationMs); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to mute user in topic: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) topicUnmute(l *lua.LState) int {
+	topic := checkModeratedTopic(l)
+	if topic == nil {
+		return 0
+	}
+
+	userID := l.CheckString(3)
+	if userID == "" {
+		l.ArgError(3, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err := TopicUnmute(n.logger, n.db, topic, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to unmute user in topic: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) topicKick(l *lua.LState) int {
+	topic := checkModeratedTopic(l)
+	if topic == nil {
+		return 0
+	}
+
+	userID := l.CheckString(3)
+	if userID == "" {
+		l.ArgError(3, "expects a valid user ID")
+		return 0
+	}
+
+	TopicKick(n.logger, n.tracker, n.messageRouter, topic, userID)
+	return 0
+}
+
+func (n *NakamaModule) topicBan(l *lua.LState) int {
+	topic := checkModeratedTopic(l)
+	if topic == nil {
+		return 0
+	}
+
+	userID := l.CheckString(3)
+	if userID == "" {
+		l.ArgError(3, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err := TopicBan(n.logger, n.db, n.tracker, n.messageRouter, topic, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to ban user from topic: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) topicUnban(l *lua.LState) int {
+	topic := checkModeratedTopic(l)
+	if topic == nil {
+		return 0
+	}
+
+	userID := l.CheckString(3)
+	if userID == "" {
+		l.ArgError(3, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err := TopicUnban(n.logger, n.db, topic, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to unban user from topic: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) topicMessagesSearch(l *lua.LState) int {
+	topicType := l.CheckString(1)
+	name := l.CheckString(2)
+	if name == "" {
+		l.ArgError(2, "expects a valid topic name, group ID or direct message topic")
+		return 0
+	}
+
+	var topic *TopicId
+	switch topicType {
+	case "dm":
+		topic = &TopicId{Id: &TopicId_Dm{Dm: name}}
+	case "room":
+		topic = &TopicId{Id: &TopicId_Room{Room: name}}
+	case "group":
+		topic = &TopicId{Id: &TopicId_GroupId{GroupId: name}}
+	default:
+		l.ArgError(1, "expects topic type to be 'dm', 'room' or 'group'")
+		return 0
+	}
+
+	var text, senderID, cursor string
+	var startTime, endTime, limit int64
+	conversionError := false
+	if queryTable := l.OptTable(3, nil); queryTable != nil {
+		queryTable.ForEach(func(k lua.LValue, v lua.LValue) {
+			if conversionError {
+				return
+			}
+			switch k.String() {
+			case "Text", "UserId", "Cursor":
+				if v.Type() != lua.LTString {
+					conversionError = true
+					l.ArgError(3, fmt.Sprintf("expects %s to be string", k.String()))
+					return
+				}
+				switch k.String() {
+				case "Text":
+					text = v.String()
+				case "UserId":
+					senderID = v.String()
+				case "Cursor":
+					cursor = v.String()
+				}
+			case "StartTime", "EndTime", "Limit":
+				if v.Type() != lua.LTNumber {
+					conversionError = true
+					l.ArgError(3, fmt.Sprintf("expects %s to be number", k.String()))
+					return
+				}
+				number := int64(lua.LVAsNumber(v))
+				switch k.String() {
+				case "StartTime":
+					startTime = number
+				case "EndTime":
+					endTime = number
+				case "Limit":
+					limit = number
+				}
+			default:
+				conversionError = true
+				l.ArgError(3, fmt.Sprintf("unrecognised argument in query: %s", k.String()))
+			}
+		})
+	}
+	if conversionError {
+		return 0
+	}
+
+	// An empty caller searches any topic.
+	caller := l.OptString(4, "")
+
+	messages, newCursor, _, err := TopicMessagesSearch(n.logger, n.db, caller, topic, text, senderID, startTime, endTime, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to search topic messages: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the messages.
+	lv := l.NewTable()
+	for i, m := range messages {
+		dataMap := make(map[string]interface{})
+		if err = json.Unmarshal([]byte(m.Data), &dataMap); err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert message data to json: %s", err.Error()))
+			return 0
+		}
+
+		mt := ConvertMap(l, map[string]interface{}{
+			"UserId":    m.UserId,
+			"MessageId": m.MessageId,
+			"CreatedAt": m.CreatedAt,
+			"ExpiresAt": m.ExpiresAt,
+			"UpdatedAt": m.UpdatedAt,
+			"Handle":    m.Handle,
+			"Type":      m.Type,
+		})
+		mt.RawSetString("Data", ConvertMap(l, dataMap))
+		lv.RawSetInt(i+1, mt)
+	}
+	l.Push(lv)
+
+	// Convert and push the new cursor, if any.
+	if newCursor != "" {
+		l.Push(lua.LString(newCursor))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 2
+}
+
+func (n *NakamaModule) notificationsSendId(l *lua.LState) int {
+	notificationsTable := l.CheckTable(1)
+	if notificationsTable == nil {
+		l.ArgError(1, "expects a valid set of notifications")
+		return 0
+	}
+
+	conversionError := false
+	notifications := make([]*NNotification, 0)
+	notificationsTable.ForEach(func(i lua.LValue, g lua.LValue) {
+		notificationTable, ok := g.(*lua.LTable)
+		if !ok {
+			conversionError = true
+			l.ArgError(1, "expects a valid set of notifications")
+			return
+		}
+
+		notification := convertLuaNotification(l, 1, notificationTable, true)
+		if notification == nil {
+			conversionError = true
+			return
+		}
+
+		notifications = append(notifications, notification)
+	})
+
+	if conversionError {
+		return 0
+	}
+
+	err := n.notificationService.NotificationSend(notifications)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to send notifications: %s", err.Error()))
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) notificationsSendGroup(l *lua.LState) int {
+	groupID := l.CheckString(1)
+	if groupID == "" {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+
+	notification := convertLuaNotification(l, 2, l.CheckTable(2), false)
+	if notification == nil {
+		return 0
+	}
+
+	if err := n.notificationService.NotificationSendGroup(groupID, notification); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to send group notifications: %s", err.Error()))
+	}
+
+	return 0
+}
+
+// convertLuaNotification reads a notification from a table argument, and returns nil if it isn't valid.
+func convertLuaNotification(l *lua.LState, argn int, notificationTable *lua.LTable, requireUserID bool) *NNotification {
+	conversionError := false
+	notification := &NNotification{}
+	notificationTable.ForEach(func(k lua.LValue, v lua.LValue) {
+		switch k.String() {
+		case "Persistent":
+			if v.Type() != lua.LTBool {
+				conversionError = true
+				l.ArgError(argn, "expects Persistent to be boolean")
+				return
+			}
+			notification.Persistent = lua.LVAsBool(v)
+		case "Subject":
+			if v.Type() != lua.LTString {
+				conversionError = true
+				l.ArgError(argn, "expects Subject to be string")
+				return
+			}
+			notification.Subject = v.String()
+		case "Content":
+			if v.Type() != lua.LTTable {
+				conversionError = true
+				l.ArgError(argn, "expects Content to be a table")
+				return
+			}
+
+			contentMap := ConvertLuaTable(v.(*lua.LTable))
+			contentBytes, err := json.Marshal(contentMap)
+			if err != nil {
+				conversionError = true
+				l.ArgError(argn, fmt.Sprintf("failed to convert content: %s", err.Error()))
+				return
+			}
+
+			notification.Content = contentBytes
+		case "Code":
+			if v.Type() != lua.LTNumber {
+				conversionError = true
+				l.ArgError(argn, "expects Code to be number")
+				return
+			}
+			number := int64(lua.LVAsNumber(v))
+			if number <= 100 {
+				l.ArgError(argn, "expects Code to number above 100")
+				return
+			}
+			notification.Code = int64(number)
+		case "UserId":
+			if v.Type() != lua.LTString {
+				conversionError = true
+				l.ArgError(argn, "expects UserId to be string")
+				return
+			}
+			u := v.String()
+			if u == "" {
+				l.ArgError(argn, "expects UserId to be a valid UUID")
+				return
+			}
+			notification.UserID = u
+		case "SenderId":
+			if v.Type() == lua.LTNil {
+				return
+			}
+			if v.Type() != lua.LTString {
+				conversionError = true
+				l.ArgError(argn, "expects SenderId to be string")
+				return
+			}
+			u := v.String()
+			if u == "" {
+				l.ArgError(argn, "expects SenderId to be a valid UUID")
+				return
+			}
+			notification.SenderID = u
+		}
+	})
+	if conversionError {
+		return nil
+	}
+
+	if notification.Subject == "" {
+		l.ArgError(argn, "expects Subject to be non-empty")
+		return nil
+	} else if len(notification.Content) == 0 {
+		l.ArgError(argn, "expects Content to be a valid JSON")
+		return nil
+	} else if requireUserID && len(notification.UserID) == 0 {
+		l.ArgError(argn, "expects UserId to be a valid UUID")
+		return nil
+	}
+
+	notification.Id = generateNewId()
+	return notification
+}
+
+func (n *NakamaModule) eventPublish(l *lua.LState) int {
+	return 0
+}
+
+func convertLuaStorageData(l *lua.LState, argn int, k map[string]interface{}) *StorageData {
+	var bucket string
+	if b, ok := k["Bucket"]; !ok {
+		l.ArgError(argn, "expects a bucket in each key")
+		return nil
+	} else {
+		if bs, ok := b.(string); !ok {
+			l.ArgError(argn, "bucket must be a string")
+			return nil
+		} else {
+			bucket = bs
+		}
+	}
+	var collection string
+	if c, ok := k["Collection"]; !ok {
+		l.ArgError(argn, "expects a collection in each key")
+		return nil
+	} else {
+		if cs, ok := c.(string); !ok {
+			l.ArgError(argn, "collection must be a string")
+			return nil
+		} else {
+			collection = cs
+		}
+	}
+	var record string
+	if r, ok := k["Record"]; !ok {
+		l.ArgError(argn, "expects a record in each key")
+		return nil
+	} else {
+		if rs, ok := r.(string); !ok {
+			l.ArgError(argn, "record must be a string")
+			return nil
+		} else {
+			record = rs
+		}
+	}
+	var value []byte
+	if v, ok := k["Value"]; !ok {
+		l.ArgError(argn, "expects a value in each key")
+		return nil
+	} else {
+		if vs, ok := v.(map[string]interface{}); !ok {
+			l.ArgError(argn, "value must be a table")
+			return nil
+		} else {
+			dataJson, err := json.Marshal(vs)
+			if err != nil {
+				l.RaiseError("could not convert value to JSON: %v", err.Error())
+				return nil
+			}
+			value = dataJson
+		}
+	}
+	var userID string
+	if u, ok := k["UserId"]; ok {
+		if us, ok := u.(string); !ok {
+			l.ArgError(argn, "expects valid user IDs in each value, when provided")
+			return nil
+		} else {
+			userID = us
+		}
+	}
+	var version string
+	if v, ok := k["Version"]; ok {
+		if vs, ok := v.(string); !ok {
+			l.ArgError(argn, "version must be a string")
+			return nil
+		} else {
+			version = vs
+		}
+	}
+	readPermission := int64(1)
+	if r, ok := k["PermissionRead"]; ok {
+		if rf, ok := r.(float64); !ok {
+			l.ArgError(argn, "permission read must be a number")
+			return nil
+		} else {
+			readPermission = int64(rf)
+		}
+	}
+	writePermission := int64(1)
+	if w, ok := k["PermissionWrite"]; ok {
+		if wf, ok := w.(float64); !ok {
+			l.ArgError(argn, "permission read must be a number")
+			return nil
+		} else {
+			writePermission = int64(wf)
+		}
+	}
+	var groupID string
+	if g, ok := k["GroupId"]; ok {
+		if gs, ok := g.(string); !ok {
+			l.ArgError(argn, "group ID must be a string")
+			return nil
+		} else {
+			groupID = gs
+		}
+	}
+
+	return &StorageData{
+		Bucket:          bucket,
+		Collection:      collection,
+		Record:          record,
+		UserId:          userID,
+		Value:           value,
+		Version:         version,
+		PermissionRead:  readPermission,
+		PermissionWrite: writePermission,
+		GroupId:         groupID,
+	}
+}
+
+func convertLuaStorageKey(l *lua.LState, argn int, k map[string]interface{}) *StorageKey {
+	var bucket string
+	if b, ok := k["Bucket"]; !ok {
+		l.ArgError(argn, "expects a bucket in each key")
+		return nil
+	} else {
+		if bs, ok := b.(string); !ok {
+			l.ArgError(argn, "bucket must be a string")
+			return nil
+		} else {
+			bucket = bs
+		}
+	}
+	var collection string
+	if c, ok := k["Collection"]; !ok {
+		l.ArgError(argn, "expects a collection in each key")
+		return nil
+	} else {
+		if cs, ok := c.(string); !ok {
+			l.ArgError(argn, "collection must be a string")
+			return nil
+		} else {
+			collection = cs
+		}
+	}
+	var record string
+	if r, ok := k["Record"]; !ok {
+		l.ArgError(argn, "expects a record in each key")
+		return nil
+	} else {
+		if rs, ok := r.(string); !ok {
+			l.ArgError(argn, "record must be a string")
+			return nil
+		} else {
+			record = rs
+		}
+	}
+	var userID string
+	if u, ok := k["UserId"]; ok {
+		if us, ok := u.(string); !ok {
+			l.ArgError(argn, "expects valid user IDs in each key, when provided")
+			return nil
+		} else {
+			userID = us
+		}
+	}
+	var version string
+	if v, ok := k["Version"]; ok {
+		if vs, ok := v.(string); !ok {
+			l.ArgError(argn, "version must be a string")
+			return nil
+		} else {
+			version = vs
+		}
+	}
+	return &StorageKey{
+		Bucket:     bucket,
+		Collection: collection,
+		Record:     record,
+		UserId:     userID,
+		Version:    version,
+	}
+}
+
+// convertLuaStorageKeyUpdate converts a Lua storage update table, or returns a conversion error message.
+func convertLuaStorageKeyUpdate(updateTable *lua.LTable) (*StorageKeyUpdate, string) {
+	conversionError := ""
+
+	// Initialise fields where default values for their types are not the logical defaults needed.
+	update := &StorageKeyUpdate{
+		Key:             &StorageKey{},
+		PermissionRead:  int64(1),
+		PermissionWrite: int64(1),
+	}
+
+	updateTable.ForEach(func(k lua.LValue, v lua.LValue) {
+		switch k.String() {
+		case "Bucket":
+			if v.Type() != lua.LTString {
+				conversionError = "expects valid buckets in each update"
+				return
+			}
+			update.Key.Bucket = v.String()
+		case "Collection":
+			if v.Type() != lua.LTString {
+				conversionError = "expects valid collections in each update"
+				return
+			}
+			update.Key.Collection = v.String()
+		case "Record":
+			if v.Type() != lua.LTString {
+				conversionError = "expects valid records in each update"
+				return
+			}
+			update.Key.Record = v.String()
+		case "UserId":
+			if v.Type() != lua.LTString {
+				conversionError = "expects valid user IDs in each update"
+				return
+			}
+			update.Key.UserId = v.String()
+		case "Version":
+			if v.Type() != lua.LTString {
+				conversionError = "expects valid versions in each update"
+				return
+			}
+			update.Key.Version = v.String()
+		case "PermissionRead":
+			if v.Type() != lua.LTNumber {
+				conversionError = "expects valid read permissions in each update"
+				return
+			}
+			update.PermissionRead = int64(lua.LVAsNumber(v))
+		case "PermissionWrite":
+			if v.Type() != lua.LTNumber {
+				conversionError = "expects valid write permissions in each update"
+				return
+			}
+			update.PermissionWrite = int64(lua.LVAsNumber(v))
+		case "GroupId":
+			if v.Type() != lua.LTString {
+				conversionError = "expects valid group IDs in each update"
+				return
+			}
+			update.GroupId = v.String()
+		case "Update":
+			if v.Type() != lua.LTTable {
+				conversionError = "expects valid patch op in each update"
+				return
+			}
+
+			vi, ok := convertLuaValue(v).([]interface{})
+			if !ok {
+				conversionError = "expects valid patch op in each update"
+				return
+			}
+
+			// Lowercase all key names in op declarations.
+			// eg. the Lua patch op: {{Op = "incr", Path = "/foo", Value = 1}}
+			// becomes the JSON:     [{"op": "incr", "path": "/foo", "value": 1}]
+			for _, vim := range vi {
+				vm, ok := vim.(map[string]interface{})
+				if !ok {
+					conversionError = "expects valid patch op in each update"
+					return
+				}
+				for vmK, vmV := range vm {
+					vmKlower := strings.ToLower(vmK)
+					if vmKlower != vmK {
+						delete(vm, vmK)
+						vm[vmKlower] = vmV
+					}
+				}
+			}
+
+			ve, err := json.Marshal(vi)
+			if err != nil {
+				conversionError = "expects valid patch op in each update"
+				return
+			}
+			patch, err := jsonpatch.DecodeExtendedPatch(ve)
+			if err != nil {
+				conversionError = "expects valid patch op in each update"
+				return
+			}
+			update.Patch = patch
+		}
+	})
+
+	// If there was an inner error allow it to propagate.
+	if conversionError != "" {
+		return nil, conversionError
+	}
+
+	// Check it's a valid update op.
+	if update.Key.Bucket == "" || update.Key.Collection == "" || update.Key.Record == "" || update.Patch == nil {
+		return nil, "expects each update to contain at least bucket, collection, record, and update"
+	}
+	return update, ""
 }
@@ -33,6 +33,7 @@ type session interface {
 
 	Lang() string
 	Expiry() int64
+	RateLimiter() *RateLimiter
 	Consume(func(logger *zap.Logger, session session, envelope *Envelope, reliable bool))
 	Unregister()
 
@@ -303,10 +303,14 @@ func (a *authenticationService) configure() {
 
 	}).Methods("POST", "OPTIONS")
 
-	CORSHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type", "User-Agent"})
+	a.mux.HandleFunc("/storage/blob/{bucket}/{collection}/{record}", a.handleStorageBlob).Methods("GET", "PUT", "DELETE", "OPTIONS")
+
+	CORSHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type", "User-Agent", "If-Match", "If-None-Match"})
+	CORSMethods := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE"})
 	CORSOrigins := handlers.AllowedOrigins([]string{"*"})
+	CORSExposedHeaders := handlers.ExposedHeaders([]string{"ETag"})
 
-	handlerWithCORS := handlers.CORS(CORSHeaders, CORSOrigins)(a.mux)
+	handlerWithCORS := handlers.CORS(CORSHeaders, CORSMethods, CORSOrigins, CORSExposedHeaders)(a.mux)
 
 	a.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", a.config.GetSocket().Port), Handler: handlerWithCORS}
 
@@ -803,10 +807,18 @@ func (a *authenticationService) register(authReq *AuthenticateRequest) (string,
 		}
 	case *AuthenticateRequest_Google:
 		registerFunc = a.registerGoogle
+		registerHook = func(authReq *AuthenticateRequest, userID string, handle string, identifier string) {
+			l := a.logger.With(zap.String("user_id", userID))
+			a.pipeline.addGoogleFriends(l, userID, handle, identifier, authReq.GetGoogle())
+		}
 	case *AuthenticateRequest_GameCenter_:
 		registerFunc = a.registerGameCenter
 	case *AuthenticateRequest_Steam:
 		registerFunc = a.registerSteam
+		registerHook = func(authReq *AuthenticateRequest, userID string, handle string, identifier string) {
+			l := a.logger.With(zap.String("user_id", userID))
+			a.pipeline.addSteamFriends(l, userID, handle, identifier)
+		}
 	case *AuthenticateRequest_Email_:
 		registerFunc = a.registerEmail
 	case *AuthenticateRequest_Custom:
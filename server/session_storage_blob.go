@@ -0,0 +1,144 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// handleStorageBlob streams blob content to and from clients over HTTP.
+//
+// GET downloads a blob, with an optional "user_id" query parameter for blobs owned by other users.
+// PUT uploads the request body as one of the caller's blobs, with optional "permission_read", "permission_write" and
+// "group_id" query parameters, and If-Match or If-None-Match: * headers for version checks.
+// DELETE removes one of the caller's blobs, with an optional If-Match header.
+func (a *authenticationService) handleStorageBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid, _, _, auth := a.authenticateToken(r.URL.Query().Get("token"))
+	if !auth {
+		http.Error(w, "Missing or invalid token", 401)
+		return
+	}
+
+	vars := mux.Vars(r)
+	key := &StorageKey{
+		Bucket:     vars["bucket"],
+		Collection: vars["collection"],
+		Record:     vars["record"],
+		UserId:     uid,
+	}
+
+	switch r.Method {
+	case "GET":
+		if userID := r.URL.Query().Get("user_id"); userID != "" {
+			key.UserId = userID
+		}
+		blob, code, err := StorageBlobFetch(a.logger, a.db, uid, key)
+		if err != nil {
+			http.Error(w, err.Error(), storageBlobHTTPStatus(code))
+			return
+		}
+		if blob == nil {
+			http.Error(w, "Blob not found", 404)
+			return
+		}
+
+		w.Header().Set("Content-Type", blob.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(blob.Size, 10))
+		w.Header().Set("ETag", storageBlobETag(blob.Version))
+		w.WriteHeader(200)
+		if err = StorageBlobRead(a.logger, a.db, blob, w); err != nil {
+			// The response has started, so the client sees a short body.
+			a.logger.Warn("Could not send storage blob", zap.Error(err))
+		}
+
+	case "PUT":
+		blob := &StorageBlob{
+			Bucket:          key.Bucket,
+			Collection:      key.Collection,
+			Record:          key.Record,
+			UserId:          key.UserId,
+			ContentType:     r.Header.Get("Content-Type"),
+			Version:         storageBlobETagVersion(r.Header.Get("If-Match")),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+			GroupId:         r.URL.Query().Get("group_id"),
+		}
+		if r.Header.Get("If-None-Match") == "*" {
+			blob.Version = "*"
+		}
+		for param, permission := range map[string]*int64{"permission_read": &blob.PermissionRead, "permission_write": &blob.PermissionWrite} {
+			if value := r.URL.Query().Get(param); value != "" {
+				p, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					http.Error(w, "Invalid "+param, 400)
+					return
+				}
+				*permission = p
+			}
+		}
+
+		defer r.Body.Close()
+		storageKey, code, err := StorageBlobWrite(a.logger, a.db, a.pipeline.storageService, uid, blob, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), storageBlobHTTPStatus(code))
+			return
+		}
+
+		w.Header().Set("ETag", storageBlobETag(storageKey.Version))
+		w.WriteHeader(200)
+
+	case "DELETE":
+		key.Version = storageBlobETagVersion(r.Header.Get("If-Match"))
+		if code, err := StorageBlobRemove(a.logger, a.db, uid, key); err != nil {
+			http.Error(w, err.Error(), storageBlobHTTPStatus(code))
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+// storageBlobETag formats a blob version as a quoted entity tag, as RFC 7232 requires.
+func storageBlobETag(version string) string {
+	return `"` + version + `"`
+}
+
+// storageBlobETagVersion returns the blob version in an If-Match header, with or without its quotes.
+func storageBlobETagVersion(header string) string {
+	header = strings.TrimSpace(header)
+	if len(header) >= 2 && strings.HasPrefix(header, `"`) && strings.HasSuffix(header, `"`) {
+		return header[1 : len(header)-1]
+	}
+	return header
+}
+
+func storageBlobHTTPStatus(code Error_Code) int {
+	switch code {
+	case BAD_INPUT:
+		return 400
+	case STORAGE_REJECTED:
+		return 412
+	default:
+		return 500
+	}
+}
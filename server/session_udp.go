@@ -41,6 +41,7 @@ type udpSession struct {
 	clientInstance   *multicode.ClientInstance
 	pingTicker       *time.Ticker
 	pingTickerStopCh chan bool
+	rateLimiter      *RateLimiter
 	unregister       func(s session)
 }
 
@@ -62,6 +63,7 @@ func NewUDPSession(logger *zap.Logger, config Config, userID string, handle stri
 		stopped:          false,
 		clientInstance:   clientInstance,
 		pingTicker:       time.NewTicker(time.Duration(config.GetSocket().PingPeriodMs) * time.Millisecond),
+		rateLimiter:      NewRateLimiter(config.GetSocket()),
 		pingTickerStopCh: make(chan bool),
 		unregister:       unregister,
 	}
@@ -95,6 +97,10 @@ func (s *udpSession) Expiry() int64 {
 	return s.expiry
 }
 
+func (s *udpSession) RateLimiter() *RateLimiter {
+	return s.rateLimiter
+}
+
 func (s *udpSession) Consume(processRequest func(logger *zap.Logger, session session, envelope *Envelope, reliable bool)) {
 	defer s.cleanupClosedConnection()
 
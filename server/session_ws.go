@@ -46,6 +46,7 @@ type wsSession struct {
 	jsonpbUnmarshaler *jsonpb.Unmarshaler
 	pingTicker        *time.Ticker
 	pingTickerStopCh  chan bool
+	rateLimiter       *RateLimiter
 	unregister        func(s session)
 }
 
@@ -71,6 +72,7 @@ func NewWSSession(logger *zap.Logger, config Config, userID string, handle strin
 		jsonpbUnmarshaler: jsonpbUnmarshaler,
 		stopped:           false,
 		pingTicker:        time.NewTicker(time.Duration(config.GetSocket().PingPeriodMs) * time.Millisecond),
+		rateLimiter:       NewRateLimiter(config.GetSocket()),
 		pingTickerStopCh:  make(chan bool),
 		unregister:        unregister,
 	}
@@ -104,6 +106,10 @@ func (s *wsSession) Expiry() int64 {
 	return s.expiry
 }
 
+func (s *wsSession) RateLimiter() *RateLimiter {
+	return s.rateLimiter
+}
+
 func (s *wsSession) Consume(processRequest func(logger *zap.Logger, session session, envelope *Envelope, reliable bool)) {
 	defer s.cleanupClosedConnection()
 	s.conn.SetReadLimit(s.config.GetSocket().MaxMessageSizeBytes)
@@ -0,0 +1,120 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// StorageHistory keeps previous versions of records in the storage collections that enable it in configuration.
+type StorageHistory struct {
+	collections map[storageCollectionKey]*StorageHistoryConfig
+}
+
+// NewStorageHistory creates a new StorageHistory, or returns an error if a history declaration is not valid.
+func NewStorageHistory(config *StorageConfig) (*StorageHistory, error) {
+	h := &StorageHistory{
+		collections: make(map[storageCollectionKey]*StorageHistoryConfig),
+	}
+
+	for _, history := range config.History {
+		if history.Bucket == "" || history.Collection == "" {
+			return nil, fmt.Errorf("storage history requires a bucket and collection: %v", history)
+		}
+		if history.MaxVersions < 0 || history.MaxDays < 0 {
+			return nil, fmt.Errorf("storage history for bucket %v collection %v must not have negative limits", history.Bucket, history.Collection)
+		}
+		if history.MaxVersions == 0 && history.MaxDays == 0 {
+			return nil, fmt.Errorf("storage history for bucket %v collection %v requires max versions or max days", history.Bucket, history.Collection)
+		}
+
+		key := storageCollectionKey{bucket: history.Bucket, collection: history.Collection}
+		if _, ok := h.collections[key]; ok {
+			return nil, fmt.Errorf("storage history is declared more than once for bucket %v collection %v", history.Bucket, history.Collection)
+		}
+		h.collections[key] = history
+	}
+
+	return h, nil
+}
+
+// Enabled returns true if history is kept for records in the collection. A nil StorageHistory keeps no history.
+func (h *StorageHistory) Enabled(bucket string, collection string) bool {
+	if h == nil {
+		return false
+	}
+	_, ok := h.collections[storageCollectionKey{bucket: bucket, collection: collection}]
+	return ok
+}
+
+// write keeps a new version of a record, with its value as stored, then drops versions beyond the collection's limits.
+func (h *StorageHistory) write(tx *sql.Tx, d *StorageData, value []byte, ts int64) error {
+	if !h.Enabled(d.Bucket, d.Collection) {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+INSERT INTO storage_history (id, user_id, bucket, collection, record, value, version, read, write, group_id, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		generateNewId(), d.UserId, d.Bucket, d.Collection, d.Record, value, d.Version, d.PermissionRead, d.PermissionWrite, d.GroupId, ts)
+	if err != nil {
+		return err
+	}
+
+	return h.prune(tx, d.Bucket, d.Collection, d.UserId, d.Record, ts)
+}
+
+// prune drops kept versions of a record beyond the collection's limits, if the collection keeps history.
+// The newest version is always kept. Records that are never rewritten are pruned when their history is read.
+func (h *StorageHistory) prune(db queryer, bucket, collection, userID, record string, ts int64) error {
+	if h == nil {
+		return nil
+	}
+	history, ok := h.collections[storageCollectionKey{bucket: bucket, collection: collection}]
+	if !ok {
+		return nil
+	}
+
+	if history.MaxVersions > 0 {
+		_, err := db.Exec(`
+DELETE FROM storage_history
+WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND id IN (
+  SELECT id FROM storage_history
+  WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4
+  ORDER BY created_at DESC, id DESC
+  OFFSET $5
+)`, bucket, collection, userID, record, history.MaxVersions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if history.MaxDays > 0 {
+		_, err := db.Exec(`
+DELETE FROM storage_history
+WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND created_at < $5 AND id NOT IN (
+  SELECT id FROM storage_history
+  WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4
+  ORDER BY created_at DESC, id DESC
+  LIMIT 1
+)`, bucket, collection, userID, record, ts-int64(history.MaxDays)*24*60*60*1000)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	STORAGE_INDEX_STRING = "string"
+	STORAGE_INDEX_NUMBER = "number"
+)
+
+type storageCollectionKey struct {
+	bucket     string
+	collection string
+}
+
+// StorageIndex maintains secondary indexes on fields in storage record values, as declared in configuration.
+// Index entries are written as records are written and updated. Records that already exist when an index is
+// added to the configuration are not indexed until they next change, or until the collection is reindexed.
+type StorageIndex struct {
+	indexes map[storageCollectionKey]map[string]*StorageIndexConfig
+}
+
+// NewStorageIndex creates a new StorageIndex, or returns an error if an index declaration is not valid.
+func NewStorageIndex(config *StorageConfig) (*StorageIndex, error) {
+	s := &StorageIndex{
+		indexes: make(map[storageCollectionKey]map[string]*StorageIndexConfig),
+	}
+
+	for _, index := range config.Indexes {
+		if index.Name == "" || index.Bucket == "" || index.Collection == "" || index.Field == "" {
+			return nil, fmt.Errorf("storage index requires a name, bucket, collection and field: %v", index)
+		}
+		if index.Type != STORAGE_INDEX_STRING && index.Type != STORAGE_INDEX_NUMBER {
+			return nil, fmt.Errorf("storage index %v type must be 'string' or 'number'", index.Name)
+		}
+
+		key := storageCollectionKey{bucket: index.Bucket, collection: index.Collection}
+		collectionIndexes, ok := s.indexes[key]
+		if !ok {
+			collectionIndexes = make(map[string]*StorageIndexConfig)
+			s.indexes[key] = collectionIndexes
+		}
+		if _, ok := collectionIndexes[index.Name]; ok {
+			return nil, fmt.Errorf("storage index %v is declared more than once for bucket %v collection %v", index.Name, index.Bucket, index.Collection)
+		}
+		collectionIndexes[index.Name] = index
+	}
+
+	return s, nil
+}
+
+// Index returns the named index for a collection, or nil if there is no such index.
+// A nil StorageIndex has no indexes.
+func (s *StorageIndex) Index(bucket string, collection string, name string) *StorageIndexConfig {
+	if s == nil {
+		return nil
+	}
+	return s.indexes[storageCollectionKey{bucket: bucket, collection: collection}][name]
+}
+
+// write replaces the index entries for a record with those extracted from its new value.
+func (s *StorageIndex) write(tx *sql.Tx, userID string, bucket string, collection string, record string, value []byte) error {
+	if s == nil {
+		return nil
+	}
+	collectionIndexes, ok := s.indexes[storageCollectionKey{bucket: bucket, collection: collection}]
+	if !ok {
+		return nil
+	}
+
+	if err := s.remove(tx, userID, bucket, collection, record); err != nil {
+		return err
+	}
+
+	var valueMap map[string]interface{}
+	if err := json.Unmarshal(value, &valueMap); err != nil {
+		return err
+	}
+
+	for name, index := range collectionIndexes {
+		fieldValue, ok := storageIndexFieldValue(valueMap, index.Field)
+		if !ok {
+			continue
+		}
+
+		var stringValue, numberValue interface{}
+		switch index.Type {
+		case STORAGE_INDEX_STRING:
+			v, ok := fieldValue.(string)
+			if !ok {
+				continue
+			}
+			stringValue = v
+		case STORAGE_INDEX_NUMBER:
+			v, ok := fieldValue.(float64)
+			if !ok {
+				continue
+			}
+			numberValue = v
+		}
+
+		_, err := tx.Exec(`
+INSERT INTO storage_index (bucket, collection, name, user_id, record, value_string, value_number)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, bucket, collection, name, userID, record, stringValue, numberValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove deletes all index entries for a record.
+func (s *StorageIndex) remove(tx *sql.Tx, userID string, bucket string, collection string, record string) error {
+	if s == nil {
+		return nil
+	}
+	if _, ok := s.indexes[storageCollectionKey{bucket: bucket, collection: collection}]; !ok {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM storage_index WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4", bucket, collection, userID, record)
+	return err
+}
+
+// CheckEntries logs a warning for each index with no entries in a collection that has records,
+// which usually means the index was added after the records were written and the collection needs a reindex.
+func (s *StorageIndex) CheckEntries(logger *zap.Logger, db *sql.DB) {
+	if s == nil {
+		return
+	}
+
+	for key, collectionIndexes := range s.indexes {
+		var records bool
+		err := db.QueryRow("SELECT EXISTS (SELECT record FROM storage WHERE bucket = $1 AND collection = $2 AND deleted_at = 0)", key.bucket, key.collection).Scan(&records)
+		if err != nil {
+			logger.Warn("Could not check storage index entries", zap.String("bucket", key.bucket), zap.String("collection", key.collection), zap.Error(err))
+			continue
+		}
+		if !records {
+			continue
+		}
+
+		for name := range collectionIndexes {
+			var entries bool
+			err := db.QueryRow("SELECT EXISTS (SELECT record FROM storage_index WHERE bucket = $1 AND collection = $2 AND name = $3)", key.bucket, key.collection, name).Scan(&entries)
+			if err != nil {
+				logger.Warn("Could not check storage index entries", zap.String("bucket", key.bucket), zap.String("collection", key.collection), zap.String("index", name), zap.Error(err))
+			} else if !entries {
+				logger.Warn("Storage index has no entries for existing records, run 'nakama storage reindex' to index them", zap.String("bucket", key.bucket), zap.String("collection", key.collection), zap.String("index", name))
+			}
+		}
+	}
+}
+
+// Reindex rebuilds the index entries for every live record in a collection, and returns how many records were indexed.
+// Records are reindexed in batches, each in its own transaction, so concurrent writes are not blocked for long.
+func (s *StorageIndex) Reindex(logger *zap.Logger, db *sql.DB, bucket string, collection string) (int, error) {
+	if bucket == "" || collection == "" {
+		return 0, fmt.Errorf("storage reindex requires a bucket and collection")
+	}
+	if s == nil || s.indexes[storageCollectionKey{bucket: bucket, collection: collection}] == nil {
+		return 0, fmt.Errorf("no storage indexes are configured for bucket %v collection %v", bucket, collection)
+	}
+
+	count := 0
+	var lastUserID, lastRecord string
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			logger.Error("Could not begin storage reindex transaction", zap.Error(err))
+			return count, fmt.Errorf("could not reindex storage")
+		}
+
+		rows, err := tx.Query(`
+SELECT user_id, record, value FROM storage
+WHERE bucket = $1 AND collection = $2 AND deleted_at = 0 AND (user_id, record) > ($3, $4)
+ORDER BY user_id, record
+LIMIT 1000`, bucket, collection, lastUserID, lastRecord)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("Could not list records to reindex", zap.Error(err))
+			return count, fmt.Errorf("could not reindex storage")
+		}
+
+		type reindexRecord struct {
+			userID string
+			record string
+			value  []byte
+		}
+		records := make([]*reindexRecord, 0)
+		for rows.Next() {
+			r := &reindexRecord{}
+			if err = rows.Scan(&r.userID, &r.record, &r.value); err != nil {
+				break
+			}
+			records = append(records, r)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			tx.Rollback()
+			logger.Error("Could not read records to reindex", zap.Error(err))
+			return count, fmt.Errorf("could not reindex storage")
+		}
+
+		for _, r := range records {
+			value, err := storageDecodeValue(r.value)
+			if err == nil {
+				err = s.write(tx, r.userID, bucket, collection, r.record, value)
+			}
+			if err != nil {
+				tx.Rollback()
+				logger.Error("Could not reindex record", zap.String("user_id", r.userID), zap.String("record", r.record), zap.Error(err))
+				return count, fmt.Errorf("could not reindex storage")
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			logger.Error("Could not commit storage reindex transaction", zap.Error(err))
+			return count, fmt.Errorf("could not reindex storage")
+		}
+
+		count += len(records)
+		if len(records) < 1000 {
+			return count, nil
+		}
+		lastUserID = records[len(records)-1].userID
+		lastRecord = records[len(records)-1].record
+	}
+}
+
+// storageIndexFieldValue looks up a field in a JSON object, with nested fields separated by '.'.
+func storageIndexFieldValue(value map[string]interface{}, field string) (interface{}, bool) {
+	path := strings.Split(field, ".")
+	var current interface{} = value
+	for _, p := range path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"nakama/pkg/jsonschema"
+)
+
+// StorageSchemas holds the JSON Schemas that record values must match, by storage collection.
+// Schemas come from configuration and can also be registered by the script runtime.
+type StorageSchemas struct {
+	sync.RWMutex
+	collections map[storageCollectionKey]*jsonschema.Schema
+}
+
+// NewStorageSchemas creates a new StorageSchemas, or returns an error if a schema declaration is not valid.
+func NewStorageSchemas(config *StorageConfig) (*StorageSchemas, error) {
+	s := &StorageSchemas{
+		collections: make(map[storageCollectionKey]*jsonschema.Schema),
+	}
+
+	for _, schema := range config.Schemas {
+		key := storageCollectionKey{bucket: schema.Bucket, collection: schema.Collection}
+		if _, ok := s.collections[key]; ok {
+			return nil, fmt.Errorf("storage schema is declared more than once for bucket %v collection %v", schema.Bucket, schema.Collection)
+		}
+		if err := s.Register(schema.Bucket, schema.Collection, []byte(schema.Schema)); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Register sets the JSON Schema for a collection, replacing any schema it already has.
+// Records already in the collection are not checked, the schema applies to later writes and updates.
+func (s *StorageSchemas) Register(bucket string, collection string, schema []byte) error {
+	if bucket == "" || collection == "" {
+		return fmt.Errorf("storage schema requires a bucket and collection")
+	}
+	compiled, err := jsonschema.Compile(schema)
+	if err != nil {
+		return fmt.Errorf("storage schema for bucket %v collection %v is not valid: %v", bucket, collection, err)
+	}
+
+	s.Lock()
+	s.collections[storageCollectionKey{bucket: bucket, collection: collection}] = compiled
+	s.Unlock()
+	return nil
+}
+
+// validate checks a record value against its collection's schema, if there is one. A nil StorageSchemas accepts any value.
+func (s *StorageSchemas) validate(bucket string, collection string, value []byte) error {
+	if s == nil {
+		return nil
+	}
+
+	s.RLock()
+	schema, ok := s.collections[storageCollectionKey{bucket: bucket, collection: collection}]
+	s.RUnlock()
+	if !ok {
+		return nil
+	}
+	return schema.Validate(value)
+}
@@ -0,0 +1,313 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Record values are JSON objects, so values stored compressed can be told apart by the gzip header.
+var storageValueGzipHeader = []byte{0x1f, 0x8b}
+
+// StorageService holds the configured behaviour that applies when storage records change,
+// such as secondary indexes, version history and change notifications to subscribed sessions.
+type StorageService struct {
+	logger        *zap.Logger
+	db            *sql.DB
+	config        *StorageConfig
+	tracker       Tracker
+	messageRouter MessageRouter
+	indexes       *StorageIndex
+	history       *StorageHistory
+	schemas       *StorageSchemas
+}
+
+type storageChange struct {
+	data    *StorageData
+	removed bool
+}
+
+// NewStorageService creates a new StorageService, or returns an error if the configuration is not valid.
+func NewStorageService(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, config *StorageConfig) (*StorageService, error) {
+	indexes, err := NewStorageIndex(config)
+	if err != nil {
+		return nil, err
+	}
+	history, err := NewStorageHistory(config)
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := NewStorageSchemas(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StorageService{
+		logger:        logger,
+		db:            db,
+		config:        config,
+		tracker:       tracker,
+		messageRouter: messageRouter,
+		indexes:       indexes,
+		history:       history,
+		schemas:       schemas,
+	}, nil
+}
+
+// Config returns the storage configuration. A nil StorageService has the default configuration.
+func (s *StorageService) Config() *StorageConfig {
+	if s == nil {
+		return NewStorageConfig()
+	}
+	return s.config
+}
+
+// Indexes returns the configured secondary indexes. A nil StorageService has no indexes.
+func (s *StorageService) Indexes() *StorageIndex {
+	if s == nil {
+		return nil
+	}
+	return s.indexes
+}
+
+// History returns the collections that keep record history. A nil StorageService keeps no history.
+func (s *StorageService) History() *StorageHistory {
+	if s == nil {
+		return nil
+	}
+	return s.history
+}
+
+// Schemas returns the JSON Schemas record values must match. A nil StorageService has no schemas.
+func (s *StorageService) Schemas() *StorageSchemas {
+	if s == nil {
+		return nil
+	}
+	return s.schemas
+}
+
+// storageSubscriptionTopic returns the tracker topic for a storage subscription.
+// Subscriptions are to a bucket, collection, or a user's records in a collection, or to a single record key.
+// Each part of the key is prefixed with its length, so keys containing separators cannot match other keys.
+func storageSubscriptionTopic(bucket string, collection string, userID string, record string) string {
+	parts := []string{bucket}
+	switch {
+	case record != "":
+		parts = append(parts, collection, userID, record)
+	case userID != "":
+		parts = append(parts, collection, userID)
+	case collection != "":
+		parts = append(parts, collection)
+	}
+
+	topic := "storage:"
+	for _, part := range parts {
+		topic += strconv.Itoa(len(part)) + ":" + part
+	}
+	return topic
+}
+
+// storageSubscriptionTopics validates subscriptions and returns their tracker topics, or an error message if one is not valid.
+func storageSubscriptionTopics(subscriptions []*TStorageSubscribe_Subscription) ([]string, string) {
+	if len(subscriptions) == 0 {
+		return nil, "At least one subscription is required"
+	}
+
+	topics := make([]string, len(subscriptions))
+	for i, s := range subscriptions {
+		if s.Bucket == "" {
+			return nil, "Bucket is required"
+		}
+		if s.Collection == "" && (s.UserId != "" || s.Record != "") {
+			return nil, "Collection is required to subscribe by user or record"
+		}
+		topics[i] = storageSubscriptionTopic(s.Bucket, s.Collection, s.UserId, s.Record)
+	}
+	return topics, ""
+}
+
+// notify pushes committed changes to sessions subscribed to the changed records, if they can read them.
+func (s *StorageService) notify(changes []*storageChange) {
+	if s == nil || s.tracker == nil || s.messageRouter == nil {
+		return
+	}
+
+	for _, change := range changes {
+		d := change.data
+
+		// A record read permission of 0 means no client can read it.
+		if d.PermissionRead == 0 {
+			continue
+		}
+
+		topics := []string{
+			storageSubscriptionTopic(d.Bucket, "", "", ""),
+			storageSubscriptionTopic(d.Bucket, d.Collection, "", ""),
+			storageSubscriptionTopic(d.Bucket, d.Collection, d.UserId, d.Record),
+		}
+		if d.UserId != "" {
+			topics = append(topics, storageSubscriptionTopic(d.Bucket, d.Collection, d.UserId, ""))
+		}
+
+		// Each session receives a change once, even with several matching subscriptions.
+		seen := make(map[PresenceID]struct{})
+		presences := make([]Presence, 0)
+		for _, topic := range topics {
+			for _, p := range s.tracker.ListByTopic(topic) {
+				if _, ok := seen[p.ID]; ok {
+					continue
+				}
+				seen[p.ID] = struct{}{}
+				presences = append(presences, p)
+			}
+		}
+
+		// Records that are not public are only sent to users who could read them.
+		if d.PermissionRead != 2 && len(presences) != 0 {
+			userIDs := make([]string, 0, len(presences))
+			for _, p := range presences {
+				userIDs = append(userIDs, p.UserID)
+			}
+			readers := s.readers(userIDs, d)
+			allowed := presences[:0]
+			for _, p := range presences {
+				if readers[p.UserID] {
+					allowed = append(allowed, p)
+				}
+			}
+			presences = allowed
+		}
+		if len(presences) == 0 {
+			continue
+		}
+
+		outgoing := &Envelope{Payload: &Envelope_StorageChanges{StorageChanges: &StorageChanges{
+			Changes: []*StorageChanges_StorageChange{
+				&StorageChanges_StorageChange{
+					Data: &TStorageData_StorageData{
+						Bucket:          d.Bucket,
+						Collection:      d.Collection,
+						Record:          d.Record,
+						UserId:          d.UserId,
+						Value:           string(d.Value),
+						Version:         d.Version,
+						PermissionRead:  int32(d.PermissionRead),
+						PermissionWrite: int32(d.PermissionWrite),
+						GroupId:         d.GroupId,
+						CreatedAt:       d.CreatedAt,
+						UpdatedAt:       d.UpdatedAt,
+						ExpiresAt:       d.ExpiresAt,
+					},
+					Removed: change.removed,
+				},
+			},
+		}}}
+		s.messageRouter.Send(s.logger, presences, outgoing, true)
+	}
+}
+
+// readers returns which of the users can read a record that is not public, following the same rules as storage fetch.
+// Friends or group members are looked up for all the users in one query.
+func (s *StorageService) readers(userIDs []string, d *StorageData) map[string]bool {
+	readers := make(map[string]bool, len(userIDs))
+
+	params := make([]interface{}, 0, len(userIDs)+1)
+	statements := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if userID == d.UserId {
+			readers[userID] = d.PermissionRead != 0
+			continue
+		}
+		if _, ok := readers[userID]; ok {
+			continue
+		}
+		readers[userID] = false
+		params = append(params, userID)
+		statements = append(statements, "$"+strconv.Itoa(len(params)+1))
+	}
+	if len(statements) == 0 {
+		return readers
+	}
+
+	var query string
+	switch d.PermissionRead {
+	case 3:
+		query = "SELECT source_id FROM user_edge WHERE destination_id = $1 AND state = 0 AND source_id IN (" + strings.Join(statements, ", ") + ")"
+		params = append([]interface{}{d.UserId}, params...)
+	case 4:
+		query = "SELECT source_id FROM group_edge WHERE destination_id = $1 AND state IN (0, 1) AND source_id IN (" + strings.Join(statements, ", ") + ")"
+		params = append([]interface{}{d.GroupId}, params...)
+	default:
+		return readers
+	}
+
+	rows, err := s.db.Query(query, params...)
+	if err != nil {
+		s.logger.Error("Could not check storage change readers", zap.Error(err))
+		return readers
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			s.logger.Error("Could not check storage change readers", zap.Error(err))
+			return readers
+		}
+		readers[userID] = true
+	}
+	if err = rows.Err(); err != nil {
+		s.logger.Error("Could not check storage change readers", zap.Error(err))
+	}
+	return readers
+}
+
+// encodeValue returns a record value as it should be stored, compressed if it reaches the configured threshold.
+func (s *StorageService) encodeValue(value []byte) ([]byte, error) {
+	threshold := s.Config().CompressThresholdBytes
+	if threshold == 0 || len(value) < threshold {
+		return value, nil
+	}
+
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// storageDecodeValue returns a stored record value as it was written, decompressing it if needed.
+func storageDecodeValue(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, storageValueGzipHeader) {
+		return value, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
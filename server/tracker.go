@@ -57,6 +57,8 @@ type Tracker interface {
 	ListLocalByTopic(topic string) []Presence
 	// List presences by topic and user ID.
 	ListByTopicUser(topic string, userID string) []Presence
+	// List presences on the current node by session ID.
+	ListLocalBySession(sessionID string) []Presence
 }
 
 type presenceCompact struct {
@@ -239,6 +241,18 @@ func (t *TrackerService) ListByTopicUser(topic string, userID string) []Presence
 	return ps
 }
 
+func (t *TrackerService) ListLocalBySession(sessionID string) []Presence {
+	ps := make([]Presence, 0)
+	t.RLock()
+	for pc, m := range t.values {
+		if pc.ID.SessionID == sessionID && pc.ID.Node == t.name {
+			ps = append(ps, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	t.RUnlock()
+	return ps
+}
+
 func (t *TrackerService) notifyDiffListeners(joins, leaves []Presence) {
 	go func() {
 		for _, f := range t.diffListeners {
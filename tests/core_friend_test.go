@@ -0,0 +1,336 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"database/sql"
+	"nakama/server"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func createFriendEdge(db *sql.DB, sourceID string, destinationID string, state int64, position int64) error {
+	_, err := db.Exec(`
+INSERT INTO user_edge (source_id, destination_id, state, position, updated_at)
+VALUES ($1, $2, $3, $4, $4)`, sourceID, destinationID, state, position)
+	return err
+}
+
+func setupFriends(t *testing.T, db *sql.DB) (string, []string) {
+	userID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Friends in positions 1-3, then one pending invite and one block.
+	friendIDs := make([]string, 0)
+	states := []int64{0, 0, 0, 1, 3}
+	for i, state := range states {
+		friendID, err := createUser(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = createFriendEdge(db, userID, friendID, state, int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+		friendIDs = append(friendIDs, friendID)
+	}
+
+	return userID, friendIDs
+}
+
+func TestFriendsListAll(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID, friendIDs := setupFriends(t, db)
+	tracker := server.NewTrackerService("test-tracker")
+
+	friends, cursor, _, err := server.FriendsList(logger, db, tracker, userID, -1, 0, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != len(friendIDs) {
+		t.Fatalf("Expected %v friends but was %v", len(friendIDs), len(friends))
+	}
+	if cursor != "" {
+		t.Fatal("Expected empty cursor")
+	}
+	for i, friend := range friends {
+		if friend.User.Id != friendIDs[i] {
+			t.Fatalf("Expected friend %v to be %v but was %v", i, friendIDs[i], friend.User.Id)
+		}
+	}
+}
+
+func TestFriendsListStateFilter(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID, friendIDs := setupFriends(t, db)
+	tracker := server.NewTrackerService("test-tracker")
+
+	friends, _, _, err := server.FriendsList(logger, db, tracker, userID, 3, 0, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 1 {
+		t.Fatalf("Expected 1 blocked user but was %v", len(friends))
+	}
+	if friends[0].User.Id != friendIDs[4] || friends[0].State != 3 {
+		t.Fatal("Expected blocked user to be listed")
+	}
+}
+
+func TestFriendsListPagination(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID, friendIDs := setupFriends(t, db)
+	tracker := server.NewTrackerService("test-tracker")
+
+	friends, cursor, _, err := server.FriendsList(logger, db, tracker, userID, 0, 2, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 2 {
+		t.Fatalf("Expected 2 friends but was %v", len(friends))
+	}
+	if cursor == "" {
+		t.Fatal("Expected cursor")
+	}
+
+	friends, cursor, _, err = server.FriendsList(logger, db, tracker, userID, 0, 2, false, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 1 {
+		t.Fatalf("Expected 1 friend but was %v", len(friends))
+	}
+	if friends[0].User.Id != friendIDs[2] {
+		t.Fatal("Expected last friend on second page")
+	}
+	if cursor != "" {
+		t.Fatal("Expected empty cursor")
+	}
+}
+
+func TestFriendsListOnline(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID, friendIDs := setupFriends(t, db)
+	tracker := server.NewTrackerService("test-tracker")
+	tracker.Track(uuid.NewV4().String(), "notifications:"+friendIDs[1], friendIDs[1], server.PresenceMeta{})
+
+	friends, _, _, err := server.FriendsList(logger, db, tracker, userID, 0, 0, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 1 {
+		t.Fatalf("Expected 1 online friend but was %v", len(friends))
+	}
+	if friends[0].User.Id != friendIDs[1] || friends[0].User.LastOnlineAt == 0 {
+		t.Fatal("Expected online friend to be listed")
+	}
+}
+
+func TestFriendsListInvalidCursor(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tracker := server.NewTrackerService("test-tracker")
+	_, _, code, err := server.FriendsList(logger, db, tracker, uuid.NewV4().String(), -1, 10, false, "not a cursor")
+	if err == nil {
+		t.Fatal("Expected error but was nil")
+	}
+	if code != server.BAD_INPUT {
+		t.Fatalf("Expected BAD_INPUT but was %v", code)
+	}
+}
+
+func TestFriendsListInvalidState(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tracker := server.NewTrackerService("test-tracker")
+	for _, state := range []int64{-5, -2, 4} {
+		_, _, code, err := server.FriendsList(logger, db, tracker, uuid.NewV4().String(), state, 10, false, "")
+		if err == nil {
+			t.Fatalf("Expected error for state %v but was nil", state)
+		}
+		if code != server.BAD_INPUT {
+			t.Fatalf("Expected BAD_INPUT for state %v but was %v", state, code)
+		}
+	}
+}
+
+func TestFriendsSuggestAndMutual(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ids := make([]string, 6)
+	for i := range ids {
+		if ids[i], err = createUser(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c, d, e, f := ids[0], ids[1], ids[2], ids[3], ids[4], ids[5]
+
+	// A is friends with B and C, both are friends with D, only B is friends with E and F.
+	// F has blocked A so must never be suggested.
+	edges := [][]string{{a, b}, {b, a}, {a, c}, {c, a}, {b, d}, {d, b}, {c, d}, {d, c}, {b, e}, {e, b}, {b, f}, {f, b}}
+	for i, edge := range edges {
+		if err = createFriendEdge(db, edge[0], edge[1], 0, int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = createFriendEdge(db, f, a, 3, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := server.NewTrackerService("test-tracker")
+	suggestions, _, err := server.FriendsSuggest(logger, db, tracker, a, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 2 {
+		t.Fatalf("Expected 2 suggestions but was %v", len(suggestions))
+	}
+	if suggestions[0].User.Id != d || suggestions[0].MutualCount != 2 {
+		t.Fatal("Expected first suggestion to have 2 mutual friends")
+	}
+	if suggestions[1].User.Id != e || suggestions[1].MutualCount != 1 {
+		t.Fatal("Expected second suggestion to have 1 mutual friend")
+	}
+
+	mutual, _, err := server.FriendsMutual(logger, db, tracker, a, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutual) != 2 {
+		t.Fatalf("Expected 2 mutual friends but was %v", len(mutual))
+	}
+}
+
+func createGoogleUser(db *sql.DB, googleID string) (string, error) {
+	userID := uuid.NewV4().String()
+	ts := time.Now().UTC().UnixNano() / int64(time.Millisecond)
+	_, err := db.Exec(`
+INSERT INTO users (id, handle, google_id, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $4)`, userID, generateString(), googleID, ts)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec("INSERT INTO user_edge_metadata (source_id, count, state, updated_at) VALUES ($1, 0, 0, $2)", userID, ts)
+	return userID, err
+}
+
+func TestFriendsImport(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ns := server.NewNotificationService(logger, db, server.NewTrackerService("test-tracker"), &fakeMessageRouter{}, server.NewSocialConfig().Notification)
+
+	userID, err := createGoogleUser(db, "g"+generateString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	googleFriendIDs := make([]string, 0)
+	friendIDs := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		googleFriendID := "g" + generateString()
+		friendID, err := createGoogleUser(db, googleFriendID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		googleFriendIDs = append(googleFriendIDs, googleFriendID)
+		friendIDs = append(friendIDs, friendID)
+	}
+	// Provider friends that are not users are skipped.
+	googleFriendIDs = append(googleFriendIDs, "g"+generateString())
+
+	err = server.FriendsImport(logger, db, ns, userID, generateString(), "google", "g"+generateString(), googleFriendIDs)
+	assert.Nil(t, err, "err was not nil")
+
+	rows, err := db.Query("SELECT destination_id, position, state FROM user_edge WHERE source_id = $1", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	positions := make(map[int64]bool)
+	destinationIDs := make([]string, 0)
+	for rows.Next() {
+		var destinationID string
+		var position int64
+		var state int64
+		if err = rows.Scan(&destinationID, &position, &state); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(0), state, "state was not 0")
+		positions[position] = true
+		destinationIDs = append(destinationIDs, destinationID)
+	}
+	sort.Strings(friendIDs)
+	sort.Strings(destinationIDs)
+	assert.Equal(t, friendIDs, destinationIDs, "friends did not match")
+	assert.Len(t, positions, 3, "positions were not distinct")
+
+	var count int64
+	err = db.QueryRow("SELECT count FROM user_edge_metadata WHERE source_id = $1", userID).Scan(&count)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(3), count, "count was not 3")
+	for _, friendID := range friendIDs {
+		var state int64
+		err = db.QueryRow("SELECT state FROM user_edge WHERE source_id = $1 AND destination_id = $2", friendID, userID).Scan(&state)
+		assert.Nil(t, err, "reverse edge was not created")
+		assert.Equal(t, int64(0), state, "reverse state was not 0")
+	}
+
+	// Importing again does not duplicate relationships.
+	err = server.FriendsImport(logger, db, ns, userID, generateString(), "google", "g"+generateString(), googleFriendIDs)
+	assert.Nil(t, err, "err was not nil")
+	err = db.QueryRow("SELECT count FROM user_edge_metadata WHERE source_id = $1", userID).Scan(&count)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(3), count, "count was not 3")
+}
@@ -77,7 +77,7 @@ func testNotificationServiceSend(t *testing.T) {
 }
 
 func testNotificationServiceList(t *testing.T) {
-	notifications, cursor, err := notificationService.NotificationsList(notificationUserID, 10, "")
+	notifications, cursor, err := notificationService.NotificationsList(notificationUserID, 10, "", 0, 0)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -115,3 +115,178 @@ func testNotificationServiceRemove(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestNotificationCollapse(t *testing.T) {
+	ns, err := setupNotificationService()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4().String()
+	notificationID := uuid.NewV4().String()
+	for _, subject := range []string{"first", "second"} {
+		err = ns.NotificationCollapse(&server.NNotification{
+			Id:       notificationID,
+			UserID:   userID,
+			Subject:  subject,
+			Content:  []byte("{}"),
+			Code:     101,
+			SenderID: userID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notifications, _, err := ns.NotificationsList(userID, 10, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 1 {
+		t.Fatalf("Expected 1 notification but was %v", len(notifications))
+	}
+	if notifications[0].Subject != "second" {
+		t.Fatalf("Expected latest notification but was %v", notifications[0].Subject)
+	}
+}
+
+func TestNotificationsReadAndUnreadCount(t *testing.T) {
+	ns, err := setupNotificationService()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4().String()
+	notifications := make([]*server.NNotification, 0)
+	for _, code := range []int64{server.NOTIFICATION_FRIEND_REQUEST, 101, 102} {
+		notifications = append(notifications, &server.NNotification{
+			Id:         uuid.NewV4().String(),
+			UserID:     userID,
+			Subject:    "test",
+			Content:    []byte("{}"),
+			Code:       code,
+			Persistent: true,
+		})
+	}
+	if err = ns.NotificationSend(notifications); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err := ns.NotificationsUnreadCount(userID, 0, 0); err != nil {
+		t.Fatal(err)
+	} else if count != 3 {
+		t.Fatalf("Expected 3 unread but was %v", count)
+	}
+	if count, err := ns.NotificationsUnreadCount(userID, 101, 0); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("Expected 2 unread custom notifications but was %v", count)
+	}
+
+	if err = ns.NotificationsRead(userID, []string{notifications[1].Id}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := ns.NotificationsUnreadCount(userID, 0, 0); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("Expected 2 unread but was %v", count)
+	}
+
+	list, _, err := ns.NotificationsList(userID, 10, "", 101, 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ReadAt == 0 {
+		t.Fatalf("Expected 1 read notification but was %v", list)
+	}
+
+	if err = ns.NotificationsReadAll(userID); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := ns.NotificationsUnreadCount(userID, 0, 0); err != nil {
+		t.Fatal(err)
+	} else if count != 0 {
+		t.Fatalf("Expected 0 unread but was %v", count)
+	}
+}
+
+func TestNotificationsListCodeRange(t *testing.T) {
+	ns, err := setupNotificationService()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.NewV4().String()
+	notifications := make([]*server.NNotification, 0)
+	for _, code := range []int64{server.NOTIFICATION_FRIEND_REQUEST, server.NOTIFICATION_GROUP_ADD, 101} {
+		notifications = append(notifications, &server.NNotification{
+			Id:         uuid.NewV4().String(),
+			UserID:     userID,
+			Subject:    "test",
+			Content:    []byte("{}"),
+			Code:       code,
+			Persistent: true,
+		})
+	}
+	if err = ns.NotificationSend(notifications); err != nil {
+		t.Fatal(err)
+	}
+
+	system, _, err := ns.NotificationsList(userID, 10, "", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(system) != 2 {
+		t.Fatalf("Expected 2 system notifications but was %v", len(system))
+	}
+
+	custom, _, err := ns.NotificationsList(userID, 10, "", 101, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(custom) != 1 || custom[0].Code != 101 {
+		t.Fatalf("Expected 1 custom notification but was %v", custom)
+	}
+}
+
+func TestNotificationSendGroup(t *testing.T) {
+	ns, err := setupNotificationService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// More members than fit in a single insert batch.
+	groupID := uuid.NewV4().String()
+	for i := 0; i < 150; i++ {
+		_, err = db.Exec(`
+INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
+VALUES ($1, 1, 1, $2, 1), ($2, 1, 1, $1, 1)`, uuid.NewV4().String(), groupID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subject := generateString()
+	err = ns.NotificationSendGroup(groupID, &server.NNotification{
+		Subject:    subject,
+		Content:    []byte("{}"),
+		Code:       101,
+		Persistent: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM notification WHERE subject = $1", subject).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 150 {
+		t.Fatalf("Expected 150 notifications but was %v", count)
+	}
+}
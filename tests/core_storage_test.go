@@ -15,13 +15,18 @@
 package tests
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"nakama/server"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	"nakama/pkg/jsonpatch"
 )
 
@@ -44,7 +49,7 @@ func TestStorageWriteRuntimeGlobalSingle(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -111,7 +116,7 @@ func TestStorageWriteRuntimeGlobalMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -170,7 +175,7 @@ func TestStorageWriteRuntimeUserMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -211,7 +216,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -236,7 +241,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -260,7 +265,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExists(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, "", data)
+	keys, code, err = server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -290,7 +295,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -314,7 +319,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExistsFail(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, "", data)
+	keys, code, err = server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -340,7 +345,7 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -370,7 +375,7 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -394,7 +399,7 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchExists(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, "", data)
+	keys, code, err = server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -428,7 +433,7 @@ func TestStorageWriteRuntimeGlobalMultipleIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -453,7 +458,7 @@ func TestStorageWritePipelineSingleGlobalNotAllowed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.NewV4().String(), data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.NewV4().String(), data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -479,7 +484,7 @@ func TestStorageWritePipelineSingleOtherClientNotAllowed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.NewV4().String(), data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uuid.NewV4().String(), data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -507,7 +512,7 @@ func TestStorageWritePipelineUserSingle(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -558,7 +563,7 @@ func TestStorageWritePipelineUserMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -616,7 +621,7 @@ func TestStorageWriteRuntimeGlobalMultipleSameKey(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -690,7 +695,7 @@ func TestStorageWritePipelineUserMultipleSameKey(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -751,7 +756,7 @@ func TestStorageWritePipelineIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -779,7 +784,7 @@ func TestStorageWritePipelineIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -803,7 +808,7 @@ func TestStorageWritePipelineIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -832,7 +837,7 @@ func TestStorageWritePipelineIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -856,7 +861,7 @@ func TestStorageWritePipelineIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -890,7 +895,7 @@ func TestStorageWritePipelineIfNoneMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -924,7 +929,7 @@ func TestStorageWritePipelineIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -948,7 +953,7 @@ func TestStorageWritePipelineIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -977,7 +982,7 @@ func TestStorageWritePipelinePermissionFail(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1000,7 +1005,7 @@ func TestStorageWritePipelinePermissionFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -1027,7 +1032,7 @@ func TestStorageFetchRuntimeGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1080,7 +1085,7 @@ func TestStorageFetchRuntimeMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1140,7 +1145,7 @@ func TestStorageFetchRuntimeUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1194,7 +1199,7 @@ func TestStorageFetchPipelineGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1242,7 +1247,7 @@ func TestStorageFetchPipelineUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1291,7 +1296,7 @@ func TestStorageFetchPipelineUserRead(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1347,7 +1352,7 @@ func TestStorageFetchPipelineUserPublic(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1403,7 +1408,7 @@ func TestStorageFetchPipelineUserOtherRead(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1452,7 +1457,7 @@ func TestStorageFetchPipelineUserOtherPublic(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1518,7 +1523,7 @@ func TestStorageFetchPipelineUserOtherPublicMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1583,7 +1588,7 @@ func TestStorageRemoveRuntimeGlobalPublic(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1602,7 +1607,7 @@ func TestStorageRemoveRuntimeGlobalPublic(t *testing.T) {
 			Record:     record,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1632,7 +1637,7 @@ func TestStorageRemoveRuntimeGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1651,7 +1656,7 @@ func TestStorageRemoveRuntimeGlobalPrivate(t *testing.T) {
 			Record:     record,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1683,7 +1688,7 @@ func TestStorageRemoveRuntimeUserPublic(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1703,7 +1708,7 @@ func TestStorageRemoveRuntimeUserPublic(t *testing.T) {
 			UserId:     uid,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1735,7 +1740,7 @@ func TestStorageRemoveRuntimeUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1755,7 +1760,7 @@ func TestStorageRemoveRuntimeUserPrivate(t *testing.T) {
 			UserId:     uid,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1785,7 +1790,7 @@ func TestStorageRemovePipelineGlobalRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1804,7 +1809,7 @@ func TestStorageRemovePipelineGlobalRejected(t *testing.T) {
 			Record:     record,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.NewV4().String(), keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.NewV4().String(), keys)
 
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -1831,7 +1836,7 @@ func TestStorageRemovePipelineUserOtherRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1851,7 +1856,7 @@ func TestStorageRemovePipelineUserOtherRejected(t *testing.T) {
 			UserId:     data[0].UserId,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uuid.NewV4().String(), keys)
+	code, err = server.StorageRemove(logger, db, nil, uuid.NewV4().String(), keys)
 
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -1879,7 +1884,7 @@ func TestStorageRemovePipelineUserWrite(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1899,7 +1904,7 @@ func TestStorageRemovePipelineUserWrite(t *testing.T) {
 			UserId:     uid,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uid, keys)
+	code, err = server.StorageRemove(logger, db, nil, uid, keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -1926,7 +1931,7 @@ func TestStorageRemovePipelineUserDenied(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1946,7 +1951,7 @@ func TestStorageRemovePipelineUserDenied(t *testing.T) {
 			UserId:     uid,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uid, keys)
+	code, err = server.StorageRemove(logger, db, nil, uid, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -1968,7 +1973,7 @@ func TestStorageRemoveRuntimeGlobalIfMatchNotExists(t *testing.T) {
 			Version:    "fail",
 		},
 	}
-	code, err := server.StorageRemove(logger, db, "", keys)
+	code, err := server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -1993,7 +1998,7 @@ func TestStorageRemoveRuntimeGlobalIfMatchRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2013,7 +2018,7 @@ func TestStorageRemoveRuntimeGlobalIfMatchRejected(t *testing.T) {
 			Version:    "fail",
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2039,7 +2044,7 @@ func TestStorageRemoveRuntimeGlobalIfMatch(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2059,7 +2064,7 @@ func TestStorageRemoveRuntimeGlobalIfMatch(t *testing.T) {
 			Version:    keys[0].Version,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2093,7 +2098,7 @@ func TestStorageRemoveRuntimeGlobalMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2122,7 +2127,7 @@ func TestStorageRemoveRuntimeGlobalMultiple(t *testing.T) {
 			Record:     record2,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2148,7 +2153,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2172,7 +2177,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixed(t *testing.T) {
 			Record:     record2,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2206,7 +2211,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixedIfMatch(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2236,7 +2241,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixedIfMatch(t *testing.T) {
 			Version:    "fail",
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2274,7 +2279,7 @@ func TestStorageRemovePipelineUserMultipleMixedDenied(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2305,7 +2310,7 @@ func TestStorageRemovePipelineUserMultipleMixedDenied(t *testing.T) {
 			UserId:     uid,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, uid, keys)
+	code, err = server.StorageRemove(logger, db, nil, uid, keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2343,7 +2348,7 @@ func TestStorageRemoveRuntimeUserMultipleMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2374,7 +2379,7 @@ func TestStorageRemoveRuntimeUserMultipleMixed(t *testing.T) {
 			UserId:     uid,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2411,7 +2416,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatchFail(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2443,7 +2448,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatchFail(t *testing.T) {
 			Version:    "fail",
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.NotNil(t, err, "err was nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
@@ -2512,7 +2517,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatch(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2544,7 +2549,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatch(t *testing.T) {
 			Version:    keys[1].Version,
 		},
 	}
-	code, err = server.StorageRemove(logger, db, "", keys)
+	code, err = server.StorageRemove(logger, db, nil, "", keys)
 
 	assert.Nil(t, err, "err was nil")
 	assert.Equal(t, 0, int(code), "code did not match")
@@ -2609,14 +2614,14 @@ func TestStorageListRuntimeUser(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "keys was nil")
 	assert.Len(t, keys, 3, "keys length was not 3")
 
-	values, cursor, code, err := server.StorageList(logger, db, "", uid, "testbucket", "testcollection", 10, "")
+	values, cursor, _, code, err := server.StorageList(logger, db, "", uid, "testbucket", "testcollection", 10, "", nil)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2667,14 +2672,14 @@ func TestStorageListPipelineUserSelf(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "keys was nil")
 	assert.Len(t, keys, 3, "keys length was not 3")
 
-	values, cursor, code, err := server.StorageList(logger, db, uid, uid, "testbucket", collection, 10, "")
+	values, cursor, _, code, err := server.StorageList(logger, db, uid, uid, "testbucket", collection, 10, "", nil)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2724,14 +2729,14 @@ func TestStorageListPipelineUserOther(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "keys was nil")
 	assert.Len(t, keys, 3, "keys length was not 3")
 
-	values, cursor, code, err := server.StorageList(logger, db, uuid.NewV4().String(), uid, "testbucket", collection, 10, "")
+	values, cursor, _, code, err := server.StorageList(logger, db, uuid.NewV4().String(), uid, "testbucket", collection, 10, "", nil)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2766,7 +2771,7 @@ func TestStorageUpdateRuntimeNewRecord(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, "", updates)
+	keys, code, err := server.StorageUpdate(logger, db, nil, "", updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2804,7 +2809,7 @@ func TestStorageUpdateRuntimeExistingRecord(t *testing.T) {
 			Value:      []byte(`{"foo":{"bar":1}}`),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2827,7 +2832,7 @@ func TestStorageUpdateRuntimeExistingRecord(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, "", updates)
+	keys, code, err = server.StorageUpdate(logger, db, nil, "", updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2876,7 +2881,7 @@ func TestStorageUpdatePipelineNewRecord(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, uid, updates)
+	keys, code, err := server.StorageUpdate(logger, db, nil, uid, updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2919,7 +2924,7 @@ func TestStorageUpdatePipelineExistingRecord(t *testing.T) {
 			PermissionWrite: int64(1),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2943,7 +2948,7 @@ func TestStorageUpdatePipelineExistingRecord(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, uid, updates)
+	keys, code, err = server.StorageUpdate(logger, db, nil, uid, updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2986,7 +2991,7 @@ func TestStorageUpdatePipelineExistingRecordPermissionDenied(t *testing.T) {
 			PermissionWrite: int64(0),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, nil, uid, data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3010,7 +3015,7 @@ func TestStorageUpdatePipelineExistingRecordPermissionDenied(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, uid, updates)
+	keys, code, err = server.StorageUpdate(logger, db, nil, uid, updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
@@ -3041,7 +3046,7 @@ func TestStorageUpdateRuntimeBadPatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, "", updates)
+	keys, code, err := server.StorageUpdate(logger, db, nil, "", updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: jsonpatch incr operation does not apply: doc is missing path: /foo/bar", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
@@ -3073,7 +3078,7 @@ func TestStorageUpdateRuntimeNewRecordIfNoneMatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, "", updates)
+	keys, code, err := server.StorageUpdate(logger, db, nil, "", updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3111,7 +3116,7 @@ func TestStorageUpdateRuntimeExistingRecordIfNoneMatch(t *testing.T) {
 			Value:      []byte(`{"foo":{"bar":1}}`),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3133,7 +3138,7 @@ func TestStorageUpdateRuntimeExistingRecordIfNoneMatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, "", updates)
+	keys, code, err = server.StorageUpdate(logger, db, nil, "", updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
@@ -3165,7 +3170,7 @@ func TestStorageUpdateRuntimeNewRecordIfMatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, "", updates)
+	keys, code, err := server.StorageUpdate(logger, db, nil, "", updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
@@ -3189,7 +3194,7 @@ func TestStorageUpdateRuntimeExistingRecordIfMatch(t *testing.T) {
 			Value:      []byte(`{"foo":{"bar":1}}`),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3211,7 +3216,7 @@ func TestStorageUpdateRuntimeExistingRecordIfMatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, "", updates)
+	keys, code, err = server.StorageUpdate(logger, db, nil, "", updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3249,7 +3254,7 @@ func TestStorageUpdateRuntimeExistingRecordIfMatchBadVersion(t *testing.T) {
 			Value:      []byte(`{"foo":{"bar":1}}`),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, "", data)
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3271,9 +3276,1523 @@ func TestStorageUpdateRuntimeExistingRecordIfMatchBadVersion(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, "", updates)
+	keys, code, err = server.StorageUpdate(logger, db, nil, "", updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
 	assert.Nil(t, keys, "values was nil")
 }
+
+func setupStorageIndex(t *testing.T, collection string) *server.StorageService {
+	config := server.NewStorageConfig()
+	config.Indexes = []*server.StorageIndexConfig{
+		{Name: "rarity", Bucket: "testbucket", Collection: collection, Field: "item.rarity", Type: "string"},
+		{Name: "level", Bucket: "testbucket", Collection: collection, Field: "item.level", Type: "number"},
+	}
+	storageService, err := server.NewStorageService(logger, nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storageService
+}
+
+func TestStorageIndexInvalidConfig(t *testing.T) {
+	config := server.NewStorageConfig()
+	config.Indexes = []*server.StorageIndexConfig{
+		{Name: "rarity", Bucket: "testbucket", Collection: "testcollection", Field: "rarity", Type: "bool"},
+	}
+	_, err := server.NewStorageIndex(config)
+	assert.NotNil(t, err, "err was nil")
+
+	config.Indexes = []*server.StorageIndexConfig{
+		{Name: "rarity", Bucket: "testbucket", Collection: "testcollection", Field: "rarity", Type: "string"},
+		{Name: "rarity", Bucket: "testbucket", Collection: "testcollection", Field: "item.rarity", Type: "string"},
+	}
+	_, err = server.NewStorageIndex(config)
+	assert.NotNil(t, err, "err was nil")
+}
+
+func TestStorageQueryFilterAndSort(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	storageService := setupStorageIndex(t, collection)
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:         "testbucket",
+			Collection:     collection,
+			Record:         "a",
+			Value:          []byte(`{"item":{"rarity":"legendary","level":3}}`),
+			PermissionRead: 2,
+		},
+		&server.StorageData{
+			Bucket:         "testbucket",
+			Collection:     collection,
+			Record:         "b",
+			Value:          []byte(`{"item":{"rarity":"common","level":5}}`),
+			PermissionRead: 2,
+		},
+		&server.StorageData{
+			Bucket:         "testbucket",
+			Collection:     collection,
+			Record:         "c",
+			Value:          []byte(`{"item":{"rarity":"legendary","level":7}}`),
+			PermissionRead: 2,
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, storageService, "", data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	filters := []*server.StorageQueryFilter{
+		&server.StorageQueryFilter{Index: "rarity", Op: int64(server.EQUAL), Type: server.STORAGE_INDEX_STRING, StringValue: "legendary"},
+	}
+	values, _, code, err := server.StorageQuery(logger, db, storageService, uuid.NewV4().String(), "", "testbucket", collection, filters, "level", true, 10, "")
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, values, 2, "values length was not 2")
+	assert.Equal(t, "c", values[0].Record, "record did not match")
+	assert.Equal(t, "a", values[1].Record, "record did not match")
+
+	filters = append(filters, &server.StorageQueryFilter{Index: "level", Op: int64(server.LESS_THAN_OR_EQUAL), Type: server.STORAGE_INDEX_NUMBER, NumberValue: 5})
+	values, _, _, err = server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, filters, "", false, 10, "")
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 1, "values length was not 1")
+	assert.Equal(t, "a", values[0].Record, "record did not match")
+
+	// Removed records are no longer returned.
+	keys := []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: collection, Record: "a"},
+	}
+	code, err = server.StorageRemove(logger, db, storageService, "", keys)
+	assert.Nil(t, err, "err was not nil")
+	values, _, _, err = server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, filters, "", false, 10, "")
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 0, "values length was not 0")
+}
+
+func TestStorageQueryUnknownIndex(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	storageService := setupStorageIndex(t, collection)
+
+	filters := []*server.StorageQueryFilter{
+		&server.StorageQueryFilter{Index: "colour", Op: int64(server.EQUAL), Type: server.STORAGE_INDEX_STRING, StringValue: "red"},
+	}
+	values, _, code, err := server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, filters, "", false, 10, "")
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code was not BAD_INPUT")
+	assert.Nil(t, values, "values was not nil")
+}
+
+func TestStorageQueryFilterTypeMismatch(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	storageService := setupStorageIndex(t, collection)
+
+	invalid := [][]*server.StorageQueryFilter{
+		{&server.StorageQueryFilter{Index: "rarity", Op: int64(server.EQUAL), Type: server.STORAGE_INDEX_NUMBER, NumberValue: 1}},
+		{&server.StorageQueryFilter{Index: "level", Op: int64(server.EQUAL), Type: server.STORAGE_INDEX_STRING, StringValue: "1"}},
+		{&server.StorageQueryFilter{Index: "level", Op: int64(server.EQUAL)}},
+	}
+	for _, filters := range invalid {
+		values, _, code, err := server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, filters, "", false, 10, "")
+		assert.NotNil(t, err, "err was nil")
+		assert.Equal(t, server.BAD_INPUT, code, "code was not BAD_INPUT")
+		assert.Nil(t, values, "values was not nil")
+	}
+}
+
+func TestStorageQueryCursorSortMismatch(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	storageService := setupStorageIndex(t, collection)
+
+	data := make([]*server.StorageData, 0)
+	for i, record := range []string{"a", "b", "c"} {
+		data = append(data, &server.StorageData{
+			Bucket:         "testbucket",
+			Collection:     collection,
+			Record:         record,
+			Value:          []byte(fmt.Sprintf(`{"item":{"rarity":"common","level":%v}}`, i)),
+			PermissionRead: 2,
+		})
+	}
+	if _, _, err = server.StorageWrite(logger, db, storageService, "", data); err != nil {
+		t.Fatal(err)
+	}
+
+	values, cursor, _, err := server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, nil, "level", true, 1, "")
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 1, "values length was not 1")
+	assert.Equal(t, "c", values[0].Record, "record did not match")
+	assert.NotEqual(t, "", cursor, "cursor was empty")
+
+	// The cursor only continues a query with the same sort index and direction.
+	sorts := []struct {
+		index      string
+		descending bool
+	}{{"level", false}, {"rarity", true}, {"", true}}
+	for _, order := range sorts {
+		values, _, code, err := server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, nil, order.index, order.descending, 1, cursor)
+		assert.NotNil(t, err, "err was nil")
+		assert.Equal(t, server.BAD_INPUT, code, "code was not BAD_INPUT")
+		assert.Nil(t, values, "values was not nil")
+	}
+
+	values, _, _, err = server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, nil, "level", true, 1, cursor)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 1, "values length was not 1")
+	assert.Equal(t, "b", values[0].Record, "record did not match")
+}
+
+func TestStorageReindex(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+
+	// Records written before the collection has indexes have no index entries.
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:         "testbucket",
+			Collection:     collection,
+			Record:         "a",
+			Value:          []byte(`{"item":{"rarity":"legendary","level":3}}`),
+			PermissionRead: 2,
+		},
+		&server.StorageData{
+			Bucket:         "testbucket",
+			Collection:     collection,
+			Record:         "b",
+			Value:          []byte(`{"item":{"rarity":"common","level":5}}`),
+			PermissionRead: 2,
+		},
+	}
+	_, _, err = server.StorageWrite(logger, db, nil, "", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storageService := setupStorageIndex(t, collection)
+	filters := []*server.StorageQueryFilter{
+		&server.StorageQueryFilter{Index: "rarity", Op: int64(server.EQUAL), Type: server.STORAGE_INDEX_STRING, StringValue: "legendary"},
+	}
+	values, _, _, err := server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, filters, "", false, 10, "")
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 0, "values length was not 0")
+
+	count, err := storageService.Indexes().Reindex(logger, db, "testbucket", collection)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 2, count, "count was not 2")
+
+	values, _, _, err = server.StorageQuery(logger, db, storageService, "", "", "testbucket", collection, filters, "", false, 10, "")
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 1, "values length was not 1")
+	assert.Equal(t, "a", values[0].Record, "record did not match")
+
+	_, err = storageService.Indexes().Reindex(logger, db, "testbucket", generateString())
+	assert.NotNil(t, err, "err was nil")
+}
+
+type storageChangesRouter struct {
+	sent map[string]int
+}
+
+func (r *storageChangesRouter) Send(logger *zap.Logger, ps []server.Presence, msg proto.Message, reliable bool) {
+	for _, p := range ps {
+		r.sent[p.ID.SessionID]++
+	}
+}
+
+func TestStorageSubscriptionReadPermission(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	ownerID := uuid.NewV4().String()
+	otherID := uuid.NewV4().String()
+	ownerSessionID := uuid.NewV4().String()
+	otherSessionID := uuid.NewV4().String()
+
+	tracker := server.NewTrackerService("test-tracker")
+	router := &storageChangesRouter{sent: make(map[string]int)}
+	storageService, err := server.NewStorageService(logger, db, tracker, router, server.NewStorageConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner subscribes to the whole collection.
+	subscriptions := []*server.TStorageSubscribe_Subscription{
+		&server.TStorageSubscribe_Subscription{Bucket: "testbucket", Collection: collection},
+	}
+	_, err = server.StorageSubscribe(logger, db, tracker, 10, ownerSessionID, ownerID, server.PresenceMeta{}, subscriptions)
+	assert.Nil(t, err, "err was not nil")
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:         "testbucket",
+			Collection:     collection,
+			Record:         "record",
+			UserId:         ownerID,
+			Value:          []byte(`{"foo":"bar"}`),
+			PermissionRead: 2,
+		},
+	}
+	_, _, err = server.StorageWrite(logger, db, storageService, "", data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 1, router.sent[ownerSessionID], "owner change count did not match")
+	assert.Equal(t, 0, router.sent[otherSessionID], "other change count did not match")
+
+	// Another user subscribes to the record itself while they can read it.
+	subscriptions = []*server.TStorageSubscribe_Subscription{
+		&server.TStorageSubscribe_Subscription{Bucket: "testbucket", Collection: collection, UserId: ownerID, Record: "record"},
+	}
+	_, err = server.StorageSubscribe(logger, db, tracker, 10, otherSessionID, otherID, server.PresenceMeta{}, subscriptions)
+	assert.Nil(t, err, "err was not nil")
+
+	data[0].PermissionRead = 1
+	_, _, err = server.StorageWrite(logger, db, storageService, "", data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 2, router.sent[ownerSessionID], "owner change count did not match")
+	assert.Equal(t, 0, router.sent[otherSessionID], "other change count did not match")
+
+	data[0].PermissionRead = 2
+	_, _, err = server.StorageWrite(logger, db, storageService, "", data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 3, router.sent[ownerSessionID], "owner change count did not match")
+	assert.Equal(t, 1, router.sent[otherSessionID], "other change count did not match")
+}
+
+func TestStorageSubscribeValidation(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ownerID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := uuid.NewV4().String()
+	collection := generateString()
+
+	tracker := server.NewTrackerService("test-tracker")
+	router := &storageChangesRouter{sent: make(map[string]int)}
+	storageService, err := server.NewStorageService(logger, db, tracker, router, server.NewStorageConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:         "testbucket",
+			Collection:     collection,
+			Record:         "record",
+			UserId:         ownerID,
+			Value:          []byte(`{"foo":"bar"}`),
+			PermissionRead: 1,
+		},
+	}
+	if _, _, err = server.StorageWrite(logger, db, storageService, "", data); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := [][]*server.TStorageSubscribe_Subscription{
+		// Records of a user that does not exist.
+		{&server.TStorageSubscribe_Subscription{Bucket: "testbucket", Collection: collection, UserId: uuid.NewV4().String()}},
+		// A record the caller cannot read.
+		{&server.TStorageSubscribe_Subscription{Bucket: "testbucket", Collection: collection, UserId: ownerID, Record: "record"}},
+	}
+	for _, subscriptions := range invalid {
+		code, err := server.StorageSubscribe(logger, db, tracker, 2, sessionID, otherID, server.PresenceMeta{}, subscriptions)
+		assert.NotNil(t, err, "err was nil")
+		assert.Equal(t, server.BAD_INPUT, code, "code was not BAD_INPUT")
+	}
+
+	// A collection whose name contains a user ID does not match that user's records in another collection.
+	subscriptions := []*server.TStorageSubscribe_Subscription{
+		&server.TStorageSubscribe_Subscription{Bucket: "testbucket", Collection: collection + "/" + ownerID},
+	}
+	_, err = server.StorageSubscribe(logger, db, tracker, 2, sessionID, otherID, server.PresenceMeta{}, subscriptions)
+	assert.Nil(t, err, "err was not nil")
+
+	data[0].PermissionRead = 2
+	if _, _, err = server.StorageWrite(logger, db, storageService, "", data); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, router.sent[sessionID], "change count did not match")
+
+	subscriptions = []*server.TStorageSubscribe_Subscription{
+		&server.TStorageSubscribe_Subscription{Bucket: "testbucket", Collection: collection, UserId: ownerID},
+	}
+	_, err = server.StorageSubscribe(logger, db, tracker, 2, sessionID, otherID, server.PresenceMeta{}, subscriptions)
+	assert.Nil(t, err, "err was not nil")
+	if _, _, err = server.StorageWrite(logger, db, storageService, "", data); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, router.sent[sessionID], "change count did not match")
+
+	// Subscribing again to the same keys does not count against the limit, but new keys do.
+	_, err = server.StorageSubscribe(logger, db, tracker, 2, sessionID, otherID, server.PresenceMeta{}, subscriptions)
+	assert.Nil(t, err, "err was not nil")
+	subscriptions = []*server.TStorageSubscribe_Subscription{
+		&server.TStorageSubscribe_Subscription{Bucket: "testbucket", Collection: collection},
+	}
+	code, err := server.StorageSubscribe(logger, db, tracker, 2, sessionID, otherID, server.PresenceMeta{}, subscriptions)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code was not BAD_INPUT")
+}
+
+func TestStorageSubscriptionGroupRead(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ownerID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memberIDs := make([]string, 3)
+	for i := range memberIDs {
+		if memberIDs[i], err = createUser(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	otherID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:    generateString(),
+		Creator: ownerID,
+		Private: true,
+		Lang:    "en",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID := groups[0].Id
+
+	tracker := server.NewTrackerService("test-tracker")
+	router := &storageChangesRouter{sent: make(map[string]int)}
+	ns := server.NewNotificationService(logger, db, tracker, router, server.NewSocialConfig().Notification)
+	for _, memberID := range memberIDs {
+		if _, err = server.GroupUserAdd(logger, db, tracker, router, nil, ns, "", "", groupID, memberID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storageService, err := server.NewStorageService(logger, db, tracker, router, server.NewStorageConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everyone subscribes to the whole collection, and only the owner and group members receive changes.
+	collection := generateString()
+	sessionIDs := make(map[string]string)
+	for _, userID := range append([]string{ownerID, otherID}, memberIDs...) {
+		sessionIDs[userID] = uuid.NewV4().String()
+		subscriptions := []*server.TStorageSubscribe_Subscription{
+			&server.TStorageSubscribe_Subscription{Bucket: "testbucket", Collection: collection},
+		}
+		if _, err = server.StorageSubscribe(logger, db, tracker, 10, sessionIDs[userID], userID, server.PresenceMeta{}, subscriptions); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      collection,
+			Record:          "bank",
+			UserId:          ownerID,
+			Value:           []byte(`{"gold":10}`),
+			PermissionRead:  4,
+			PermissionWrite: 1,
+			GroupId:         groupID,
+		},
+	}
+	_, _, err = server.StorageWrite(logger, db, storageService, "", data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 1, router.sent[sessionIDs[ownerID]], "owner change count did not match")
+	for _, memberID := range memberIDs {
+		assert.Equal(t, 1, router.sent[sessionIDs[memberID]], "member change count did not match")
+	}
+	assert.Equal(t, 0, router.sent[sessionIDs[otherID]], "other change count did not match")
+}
+
+func TestStorageTransactionRuntimeMultipleUsers(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	userID1 := uuid.NewV4().String()
+	userID2 := uuid.NewV4().String()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:     "testbucket",
+			Collection: collection,
+			Record:     "item",
+			UserId:     userID1,
+			Value:      []byte(`{"count":2}`),
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	patch, err := jsonpatch.DecodeExtendedPatch([]byte(`[{"op":"incr","path":"/count","value":-1}]`))
+	assert.Nil(t, err, "err was not nil")
+
+	// Trade an item from one user to the other.
+	ops := []*server.StorageTransactionOp{
+		&server.StorageTransactionOp{
+			Update: &server.StorageKeyUpdate{
+				Key: &server.StorageKey{
+					Bucket:     "testbucket",
+					Collection: collection,
+					Record:     "item",
+					UserId:     userID1,
+					Version:    keys[0].Version,
+				},
+				PermissionRead:  int64(1),
+				PermissionWrite: int64(1),
+				Patch:           patch,
+			},
+		},
+		&server.StorageTransactionOp{
+			Write: &server.StorageData{
+				Bucket:          "testbucket",
+				Collection:      collection,
+				Record:          "item",
+				UserId:          userID2,
+				Value:           []byte(`{"count":1}`),
+				Version:         "*",
+				PermissionRead:  int64(1),
+				PermissionWrite: int64(1),
+			},
+		},
+	}
+	results, code, err := server.StorageTransaction(logger, db, nil, "", ops)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, results, 2, "results length was not 2")
+	assert.NotNil(t, results[0].Key, "first result key was nil")
+	assert.NotNil(t, results[1].Key, "second result key was nil")
+
+	fetched, code, err := server.StorageFetch(logger, db, "", []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: collection, Record: "item", UserId: userID1},
+		&server.StorageKey{Bucket: "testbucket", Collection: collection, Record: "item", UserId: userID2},
+	})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, fetched, 2, "data length was not 2")
+	for _, d := range fetched {
+		assert.EqualValues(t, []byte(`{"count":1}`), d.Value, "data value did not match")
+	}
+}
+
+func TestStorageTransactionRuntimeRollback(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	userID1 := uuid.NewV4().String()
+	userID2 := uuid.NewV4().String()
+
+	ops := []*server.StorageTransactionOp{
+		&server.StorageTransactionOp{
+			Write: &server.StorageData{
+				Bucket:          "testbucket",
+				Collection:      collection,
+				Record:          "item",
+				UserId:          userID1,
+				Value:           []byte(`{"count":1}`),
+				PermissionRead:  int64(1),
+				PermissionWrite: int64(1),
+			},
+		},
+		&server.StorageTransactionOp{
+			Write: &server.StorageData{
+				Bucket:          "testbucket",
+				Collection:      collection,
+				Record:          "item",
+				UserId:          userID2,
+				Value:           []byte(`{"count":1}`),
+				Version:         "fail",
+				PermissionRead:  int64(1),
+				PermissionWrite: int64(1),
+			},
+		},
+	}
+	results, code, err := server.StorageTransaction(logger, db, nil, "", ops)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+	assert.Nil(t, results, "results was not nil")
+
+	// The first write must not have taken effect.
+	fetched, code, err := server.StorageFetch(logger, db, "", []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: collection, Record: "item", UserId: userID1},
+	})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, fetched, 0, "data length was not 0")
+}
+
+func TestStorageHistoryInvalidConfig(t *testing.T) {
+	config := server.NewStorageConfig()
+	config.History = []*server.StorageHistoryConfig{
+		{Bucket: "testbucket", Collection: "testcollection"},
+	}
+	_, err := server.NewStorageHistory(config)
+	assert.NotNil(t, err, "err was nil")
+
+	config.History = []*server.StorageHistoryConfig{
+		{Bucket: "testbucket", Collection: "testcollection", MaxVersions: 5},
+		{Bucket: "testbucket", Collection: "testcollection", MaxDays: 7},
+	}
+	_, err = server.NewStorageHistory(config)
+	assert.NotNil(t, err, "err was nil")
+}
+
+func TestStorageHistoryListAndRestore(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	userID := uuid.NewV4().String()
+
+	config := server.NewStorageConfig()
+	config.History = []*server.StorageHistoryConfig{
+		{Bucket: "testbucket", Collection: collection, MaxVersions: 2},
+	}
+	storageService, err := server.NewStorageService(logger, nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := make([]string, 0)
+	for _, value := range []string{`{"level":1}`, `{"level":2}`, `{"level":3}`} {
+		data := []*server.StorageData{
+			&server.StorageData{
+				Bucket:          "testbucket",
+				Collection:      collection,
+				Record:          "save",
+				UserId:          userID,
+				Value:           []byte(value),
+				PermissionRead:  1,
+				PermissionWrite: 1,
+			},
+		}
+		keys, code, err := server.StorageWrite(logger, db, storageService, "", data)
+		assert.Nil(t, err, "err was not nil")
+		assert.Equal(t, 0, int(code), "code was not 0")
+		versions = append(versions, keys[0].Version)
+	}
+
+	key := &server.StorageKey{
+		Bucket:     "testbucket",
+		Collection: collection,
+		Record:     "save",
+		UserId:     userID,
+	}
+
+	// Only the last two versions are kept.
+	history, cursor, code, err := server.StorageHistoryList(logger, db, storageService, userID, key, 10, "")
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Equal(t, "", cursor, "cursor was not empty")
+	assert.Len(t, history, 2, "history length was not 2")
+	assert.Equal(t, versions[2], history[0].Version, "newest version did not match")
+	assert.Equal(t, versions[1], history[1].Version, "oldest version did not match")
+
+	// The oldest version is no longer available.
+	_, code, err = server.StorageHistoryRestore(logger, db, storageService, key, versions[0])
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	restoredKey, code, err := server.StorageHistoryRestore(logger, db, storageService, key, versions[1])
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Equal(t, versions[1], restoredKey.Version, "restored version did not match")
+
+	data, code, err := server.StorageFetch(logger, db, userID, []*server.StorageKey{key})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, data, 1, "data length was not 1")
+	assert.EqualValues(t, []byte(`{"level":2}`), data[0].Value, "data value did not match")
+}
+
+func TestStorageHistoryListPrunesExpiredVersions(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	userID := uuid.NewV4().String()
+
+	config := server.NewStorageConfig()
+	config.History = []*server.StorageHistoryConfig{
+		{Bucket: "testbucket", Collection: collection, MaxDays: 1},
+	}
+	storageService, err := server.NewStorageService(logger, nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := make([]string, 0)
+	for _, value := range []string{`{"level":1}`, `{"level":2}`} {
+		data := []*server.StorageData{
+			&server.StorageData{
+				Bucket:          "testbucket",
+				Collection:      collection,
+				Record:          "save",
+				UserId:          userID,
+				Value:           []byte(value),
+				PermissionRead:  1,
+				PermissionWrite: 1,
+			},
+		}
+		keys, code, err := server.StorageWrite(logger, db, storageService, "", data)
+		assert.Nil(t, err, "err was not nil")
+		assert.Equal(t, 0, int(code), "code was not 0")
+		versions = append(versions, keys[0].Version)
+	}
+
+	// Age both versions past the limit, the record is not written again afterwards.
+	now := time.Now().UTC().Unix() * 1000
+	_, err = db.Exec("UPDATE storage_history SET created_at = $1 WHERE collection = $2 AND version = $3", now-3*24*60*60*1000, collection, versions[0])
+	assert.Nil(t, err, "err was not nil")
+	_, err = db.Exec("UPDATE storage_history SET created_at = $1 WHERE collection = $2 AND version = $3", now-2*24*60*60*1000, collection, versions[1])
+	assert.Nil(t, err, "err was not nil")
+
+	key := &server.StorageKey{
+		Bucket:     "testbucket",
+		Collection: collection,
+		Record:     "save",
+		UserId:     userID,
+	}
+
+	// Only the newest version is kept.
+	history, _, code, err := server.StorageHistoryList(logger, db, storageService, userID, key, 10, "")
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, history, 1, "history length was not 1")
+	assert.Equal(t, versions[1], history[0].Version, "newest version did not match")
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM storage_history WHERE collection = $1", collection).Scan(&count)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 1, count, "stored history count was not 1")
+
+	_, code, err = server.StorageHistoryRestore(logger, db, storageService, key, versions[0])
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+}
+
+func TestStorageWriteRuntimeLargeValueCompressed(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	config := server.NewStorageConfig()
+	config.MaxValueSizeBytes = 100000
+	storageService, err := server.NewStorageService(logger, nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collection := generateString()
+	value := []byte(`{"level":"` + strings.Repeat("a", 50000) + `"}`)
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:     "testbucket",
+			Collection: collection,
+			Record:     "record",
+			Value:      value,
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, storageService, "", data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, keys, 1, "keys length was not 1")
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(value)), keys[0].Version, "version did not match")
+
+	fetched, code, err := server.StorageFetch(logger, db, "", []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: collection, Record: "record"},
+	})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, fetched, 1, "data length was not 1")
+	assert.EqualValues(t, value, fetched[0].Value, "data value did not match")
+}
+
+func TestStorageWriteRuntimeValueTooLarge(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:     "testbucket",
+			Collection: generateString(),
+			Record:     "record",
+			Value:      []byte(`{"level":"` + strings.Repeat("a", 16000) + `"}`),
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, nil, "", data)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+	assert.Nil(t, keys, "keys was not nil")
+}
+
+func TestStorageBlobWriteFetchRemove(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	config := server.NewStorageConfig()
+	config.BlobChunkSizeBytes = 1000
+	storageService, err := server.NewStorageService(logger, nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collection := generateString()
+	ownerID := uuid.NewV4().String()
+	otherID := uuid.NewV4().String()
+	content := bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6}, 1000)
+
+	blob := &server.StorageBlob{
+		Bucket:          "testbucket",
+		Collection:      collection,
+		Record:          "replay",
+		UserId:          ownerID,
+		ContentType:     "application/octet-stream",
+		PermissionRead:  1,
+		PermissionWrite: 1,
+	}
+	key, code, err := server.StorageBlobWrite(logger, db, storageService, ownerID, blob, bytes.NewReader(content))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), key.Version, "version did not match")
+
+	// Another user cannot read an owner read blob.
+	fetched, code, err := server.StorageBlobFetch(logger, db, otherID, key)
+	assert.Nil(t, err, "err was not nil")
+	assert.Nil(t, fetched, "blob was not nil")
+
+	fetched, code, err = server.StorageBlobFetch(logger, db, ownerID, key)
+	assert.Nil(t, err, "err was not nil")
+	assert.NotNil(t, fetched, "blob was nil")
+	assert.Equal(t, int64(len(content)), fetched.Size, "size did not match")
+
+	buf := new(bytes.Buffer)
+	err = server.StorageBlobRead(logger, db, fetched, buf)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, content, buf.Bytes(), "content did not match")
+
+	// Another user cannot remove the blob.
+	code, err = server.StorageBlobRemove(logger, db, otherID, key)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	code, err = server.StorageBlobRemove(logger, db, ownerID, key)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	fetched, code, err = server.StorageBlobFetch(logger, db, ownerID, key)
+	assert.Nil(t, err, "err was not nil")
+	assert.Nil(t, fetched, "blob was not nil")
+}
+
+func TestStorageBlobWriteReplace(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	config := server.NewStorageConfig()
+	config.BlobChunkSizeBytes = 1000
+	storageService, err := server.NewStorageService(logger, nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collection := generateString()
+	ownerID := uuid.NewV4().String()
+
+	blob := &server.StorageBlob{
+		Bucket:          "testbucket",
+		Collection:      collection,
+		Record:          "replay",
+		UserId:          ownerID,
+		PermissionRead:  1,
+		PermissionWrite: 1,
+	}
+	key, code, err := server.StorageBlobWrite(logger, db, storageService, ownerID, blob, bytes.NewReader(bytes.Repeat([]byte{1}, 2500)))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	// A version mismatch is rejected without keeping the new content.
+	blob.Version = "invalid"
+	_, code, err = server.StorageBlobWrite(logger, db, storageService, ownerID, blob, bytes.NewReader(bytes.Repeat([]byte{2}, 2500)))
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+
+	blob.Version = key.Version
+	_, code, err = server.StorageBlobWrite(logger, db, storageService, ownerID, blob, bytes.NewReader(bytes.Repeat([]byte{3}, 1500)))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	// The blob now references only the chunks of the replacement content.
+	var chunks int
+	err = db.QueryRow(`
+SELECT COUNT(*) FROM storage_blob_chunk
+WHERE blob_id IN (SELECT id FROM storage_blob WHERE collection = $1)`, collection).Scan(&chunks)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 2, chunks, "chunk count was not 2")
+
+	fetched, _, err := server.StorageBlobFetch(logger, db, ownerID, key)
+	assert.Nil(t, err, "err was not nil")
+	buf := new(bytes.Buffer)
+	err = server.StorageBlobRead(logger, db, fetched, buf)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, bytes.Repeat([]byte{3}, 1500), buf.Bytes(), "content did not match")
+}
+
+func TestStorageBlobFetchFriendAndGroupRead(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ownerID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	friendID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memberID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = createFriendEdge(db, friendID, ownerID, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:    generateString(),
+		Creator: ownerID,
+		Private: true,
+		Lang:    "en",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID := groups[0].Id
+
+	tracker := server.NewTrackerService("test-tracker")
+	msgRouter := &fakeMessageRouter{}
+	ns := server.NewNotificationService(logger, db, tracker, msgRouter, server.NewSocialConfig().Notification)
+	if _, err = server.GroupUserAdd(logger, db, tracker, msgRouter, nil, ns, "", "", groupID, memberID); err != nil {
+		t.Fatal(err)
+	}
+
+	storageService, err := server.NewStorageService(logger, nil, nil, nil, server.NewStorageConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := generateString()
+
+	// Group read blobs require a group the owner belongs to.
+	blob := &server.StorageBlob{
+		Bucket:          "testbucket",
+		Collection:      collection,
+		Record:          "group",
+		UserId:          ownerID,
+		PermissionRead:  4,
+		PermissionWrite: 1,
+	}
+	_, code, err := server.StorageBlobWrite(logger, db, storageService, ownerID, blob, bytes.NewReader([]byte{1}))
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	blob.GroupId = groupID
+	groupKey, code, err := server.StorageBlobWrite(logger, db, storageService, ownerID, blob, bytes.NewReader([]byte{1}))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	blob = &server.StorageBlob{
+		Bucket:          "testbucket",
+		Collection:      collection,
+		Record:          "friends",
+		UserId:          ownerID,
+		PermissionRead:  3,
+		PermissionWrite: 1,
+	}
+	friendKey, code, err := server.StorageBlobWrite(logger, db, storageService, ownerID, blob, bytes.NewReader([]byte{2}))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	for _, c := range []struct {
+		caller   string
+		key      *server.StorageKey
+		readable bool
+	}{
+		{ownerID, friendKey, true},
+		{friendID, friendKey, true},
+		{memberID, friendKey, false},
+		{otherID, friendKey, false},
+		{ownerID, groupKey, true},
+		{memberID, groupKey, true},
+		{friendID, groupKey, false},
+		{otherID, groupKey, false},
+	} {
+		fetched, code, err := server.StorageBlobFetch(logger, db, c.caller, c.key)
+		assert.Nil(t, err, "err was not nil")
+		assert.Equal(t, 0, int(code), "code was not 0")
+		assert.Equal(t, c.readable, fetched != nil, "readable did not match for record "+c.key.Record)
+	}
+}
+
+func TestStorageFetchListFriendRead(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ownerID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	friendID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = createFriendEdge(db, friendID, ownerID, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	collection := generateString()
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      collection,
+			Record:          "profile",
+			UserId:          ownerID,
+			Value:           []byte(`{"title":"friends only"}`),
+			PermissionRead:  int64(3),
+			PermissionWrite: int64(1),
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, nil, ownerID, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	keys := []*server.StorageKey{
+		&server.StorageKey{
+			Bucket:     "testbucket",
+			Collection: collection,
+			Record:     "profile",
+			UserId:     ownerID,
+		},
+	}
+	values, code, err := server.StorageFetch(logger, db, friendID, keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 1, "values length was not 1")
+	assert.Equal(t, int64(3), values[0].PermissionRead, "read permission did not match")
+
+	values, code, err = server.StorageFetch(logger, db, otherID, keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 0, "values length was not 0")
+
+	listed, _, _, code, err := server.StorageList(logger, db, friendID, ownerID, "testbucket", collection, 0, "", nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, listed, 1, "values length was not 1")
+
+	listed, _, _, code, err = server.StorageList(logger, db, otherID, ownerID, "testbucket", collection, 0, "", nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, listed, 0, "values length was not 0")
+}
+
+func TestStorageUpdateGroupWrite(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ownerID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memberID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:    generateString(),
+		Creator: ownerID,
+		Private: true,
+		Lang:    "en",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID := groups[0].Id
+
+	tracker := server.NewTrackerService("test-tracker")
+	msgRouter := &fakeMessageRouter{}
+	ns := server.NewNotificationService(logger, db, tracker, msgRouter, server.NewSocialConfig().Notification)
+	if _, err = server.GroupUserAdd(logger, db, tracker, msgRouter, nil, ns, "", "", groupID, memberID); err != nil {
+		t.Fatal(err)
+	}
+
+	collection := generateString()
+
+	// Group permissions require a group.
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      collection,
+			Record:          "bank",
+			UserId:          ownerID,
+			Value:           []byte(`{"gold":10}`),
+			PermissionRead:  int64(4),
+			PermissionWrite: int64(2),
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, nil, ownerID, data)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code was not BAD_INPUT")
+
+	data[0].GroupId = groupID
+	_, code, err = server.StorageWrite(logger, db, nil, ownerID, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	patch, err := jsonpatch.DecodeExtendedPatch([]byte(`[{"op":"incr","path":"/gold","value":5}]`))
+	assert.Nil(t, err, "err was not nil")
+	updates := []*server.StorageKeyUpdate{
+		&server.StorageKeyUpdate{
+			Key: &server.StorageKey{
+				Bucket:     "testbucket",
+				Collection: collection,
+				Record:     "bank",
+				UserId:     ownerID,
+			},
+			PermissionRead:  int64(1),
+			PermissionWrite: int64(1),
+			Patch:           patch,
+		},
+	}
+
+	// Users outside the group can neither read nor update the record.
+	_, code, err = server.StorageUpdate(logger, db, nil, otherID, updates)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
+
+	keys := []*server.StorageKey{updates[0].Key}
+	values, code, err := server.StorageFetch(logger, db, otherID, keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 0, "values length was not 0")
+
+	// Group members can update the value, but the record keeps its permissions.
+	_, code, err = server.StorageUpdate(logger, db, nil, memberID, updates)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	values, code, err = server.StorageFetch(logger, db, memberID, keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 1, "values length was not 1")
+	assert.Equal(t, []byte(`{"gold":15}`), values[0].Value, "value did not match")
+	assert.Equal(t, int64(4), values[0].PermissionRead, "read permission did not match")
+	assert.Equal(t, int64(2), values[0].PermissionWrite, "write permission did not match")
+	assert.Equal(t, groupID, values[0].GroupId, "group ID did not match")
+
+	// Group members cannot create records in other users' collections.
+	updates[0].Key.Record = "other"
+	_, code, err = server.StorageUpdate(logger, db, nil, memberID, updates)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
+}
+
+func TestStorageSchemaInvalidConfig(t *testing.T) {
+	config := server.NewStorageConfig()
+	config.Schemas = []*server.StorageSchemaConfig{
+		{Bucket: "testbucket", Collection: "testcollection", Schema: `{"type":"object","required":"name"}`},
+	}
+	_, err := server.NewStorageService(logger, nil, nil, nil, config)
+	assert.NotNil(t, err, "err was nil")
+
+	config.Schemas = []*server.StorageSchemaConfig{
+		{Bucket: "testbucket", Collection: "testcollection", Schema: `{"type":"object"}`},
+		{Bucket: "testbucket", Collection: "testcollection", Schema: `{"type":"object"}`},
+	}
+	_, err = server.NewStorageService(logger, nil, nil, nil, config)
+	assert.NotNil(t, err, "err was nil")
+}
+
+func TestStorageWriteUpdateSchema(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	uid := uuid.NewV4().String()
+	collection := generateString()
+
+	config := server.NewStorageConfig()
+	config.Schemas = []*server.StorageSchemaConfig{
+		{Bucket: "testbucket", Collection: collection, Schema: `{"type":"object","required":["gold"],"properties":{"gold":{"type":"integer","minimum":0}}}`},
+	}
+	storageService, err := server.NewStorageService(logger, nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      collection,
+			Record:          "wallet",
+			UserId:          uid,
+			Value:           []byte(`{"silver":10}`),
+			PermissionRead:  int64(1),
+			PermissionWrite: int64(1),
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, storageService, uid, data)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_SCHEMA_VIOLATION, code, "code was not STORAGE_SCHEMA_VIOLATION")
+	assert.Equal(t, "Value does not match the collection schema: must have property gold", err.Error(), "error message did not match")
+
+	data[0].Value = []byte(`{"gold":10}`)
+	_, code, err = server.StorageWrite(logger, db, storageService, uid, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	// Patches are checked on their result.
+	patch, err := jsonpatch.DecodeExtendedPatch([]byte(`[{"op":"incr","path":"/gold","value":-20}]`))
+	assert.Nil(t, err, "err was not nil")
+	updates := []*server.StorageKeyUpdate{
+		&server.StorageKeyUpdate{
+			Key: &server.StorageKey{
+				Bucket:     "testbucket",
+				Collection: collection,
+				Record:     "wallet",
+				UserId:     uid,
+			},
+			PermissionRead:  int64(1),
+			PermissionWrite: int64(1),
+			Patch:           patch,
+		},
+	}
+	_, code, err = server.StorageUpdate(logger, db, storageService, uid, updates)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_SCHEMA_VIOLATION, code, "code was not STORAGE_SCHEMA_VIOLATION")
+	assert.Equal(t, "Storage update index 0 rejected: Value does not match the collection schema: /gold must be at least 0", err.Error(), "error message did not match")
+
+	// Schemas registered later replace configured ones.
+	err = storageService.Schemas().Register("testbucket", collection, []byte(`{"type":"object"}`))
+	assert.Nil(t, err, "err was not nil")
+	_, code, err = server.StorageUpdate(logger, db, storageService, uid, updates)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+}
+
+func TestStorageExportImport(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	uid1 := uuid.NewV4().String()
+	uid2 := uuid.NewV4().String()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      collection,
+			Record:          "record",
+			UserId:          uid1,
+			Value:           []byte(`{"foo":"bar"}`),
+			PermissionRead:  int64(2),
+			PermissionWrite: int64(0),
+		},
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      collection,
+			Record:          "record",
+			UserId:          uid2,
+			Value:           []byte(`{"foo":"baz"}`),
+			PermissionRead:  int64(1),
+			PermissionWrite: int64(1),
+		},
+	}
+	keys, _, err := server.StorageWrite(logger, db, nil, "", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	count, err := server.StorageExport(logger, db, "testbucket", collection, "", buf)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 2, count, "count was not 2")
+	assert.Len(t, strings.Split(strings.TrimSpace(buf.String()), "\n"), 2, "lines length was not 2")
+	export := buf.String()
+
+	removeKeys := []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: collection, Record: "record", UserId: uid1},
+	}
+	if _, err = server.StorageRemove(logger, db, nil, "", removeKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run counts the records without changing any.
+	result, err := server.StorageImport(logger, db, nil, strings.NewReader(export), server.STORAGE_IMPORT_CONFLICT_SKIP, true)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 1, result.Imported, "imported was not 1")
+	assert.Equal(t, 1, result.Skipped, "skipped was not 1")
+	values, _, err := server.StorageFetch(logger, db, "", removeKeys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 0, "values length was not 0")
+
+	result, err = server.StorageImport(logger, db, nil, strings.NewReader(export), server.STORAGE_IMPORT_CONFLICT_SKIP, false)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 1, result.Imported, "imported was not 1")
+	assert.Equal(t, 1, result.Skipped, "skipped was not 1")
+
+	values, _, err = server.StorageFetch(logger, db, "", removeKeys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 1, "values length was not 1")
+	assert.Equal(t, []byte(`{"foo":"bar"}`), values[0].Value, "value did not match")
+	assert.Equal(t, keys[0].Version, values[0].Version, "version did not match")
+	assert.Equal(t, int64(2), values[0].PermissionRead, "read permission did not match")
+	assert.Equal(t, int64(0), values[0].PermissionWrite, "write permission did not match")
+
+	// Records are only replaced if their versions match the export.
+	changed := []*server.StorageData{data[1]}
+	changed[0].Value = []byte(`{"foo":"changed"}`)
+	if _, _, err = server.StorageWrite(logger, db, nil, "", changed); err != nil {
+		t.Fatal(err)
+	}
+	result, err = server.StorageImport(logger, db, nil, strings.NewReader(export), server.STORAGE_IMPORT_CONFLICT_IF_VERSION_MATCHES, false)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 1, result.Imported, "imported was not 1")
+	assert.Equal(t, 1, result.Skipped, "skipped was not 1")
+
+	result, err = server.StorageImport(logger, db, nil, strings.NewReader(export), server.STORAGE_IMPORT_CONFLICT_OVERWRITE, false)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 2, result.Imported, "imported was not 2")
+	assert.Equal(t, 0, result.Skipped, "skipped was not 0")
+
+	values, _, err = server.StorageFetch(logger, db, "", []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: collection, Record: "record", UserId: uid2},
+	})
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 1, "values length was not 1")
+	assert.Equal(t, []byte(`{"foo":"baz"}`), values[0].Value, "value did not match")
+}
+
+func TestStorageImportInvalid(t *testing.T) {
+	_, err := server.StorageImport(logger, nil, nil, strings.NewReader(""), "replace", false)
+	assert.NotNil(t, err, "err was nil")
+
+	_, err = server.StorageImport(logger, nil, nil, strings.NewReader(`{"bucket":"testbucket","collection":"c","record":"r","value":[]}`), server.STORAGE_IMPORT_CONFLICT_SKIP, false)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, "Invalid record on line 1: Value must be a valid JSON object", err.Error(), "error message did not match")
+}
+
+func TestStorageListSorted(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	uid := uuid.NewV4().String()
+
+	// Import records with known timestamps, updated in the opposite order they were created.
+	buf := new(bytes.Buffer)
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(buf, `{"bucket":"testbucket","collection":"%v","record":"r%02d","user_id":"%v","value":{},"permission_read":2,"permission_write":1,"created_at":%v,"updated_at":%v,"expires_at":0}`+"\n",
+			collection, i, uid, 2000-i*10, 1000+i*10)
+	}
+	result, err := server.StorageImport(logger, db, nil, buf, server.STORAGE_IMPORT_CONFLICT_SKIP, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 12, result.Imported, "imported was not 12")
+
+	options := &server.StorageListOptions{Sort: server.STORAGE_LIST_SORT_UPDATED_AT, SortDescending: true}
+	values, cursor, previousCursor, code, err := server.StorageList(logger, db, uuid.NewV4().String(), "", "testbucket", collection, 10, "", options)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, values, 10, "values length was not 10")
+	assert.Equal(t, "r11", values[0].Record, "values[0].Record was not r11")
+	assert.Equal(t, "r02", values[9].Record, "values[9].Record was not r02")
+	assert.NotEqual(t, "", cursor, "cursor was empty")
+	assert.Equal(t, "", previousCursor, "previous cursor was not empty")
+
+	values, cursor, previousCursor, code, err = server.StorageList(logger, db, uuid.NewV4().String(), "", "testbucket", collection, 10, cursor, options)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 2, "values length was not 2")
+	assert.Equal(t, "r01", values[0].Record, "values[0].Record was not r01")
+	assert.Equal(t, "r00", values[1].Record, "values[1].Record was not r00")
+	assert.Equal(t, "", cursor, "cursor was not empty")
+	assert.NotEqual(t, "", previousCursor, "previous cursor was empty")
+
+	values, cursor, previousCursor, code, err = server.StorageList(logger, db, uuid.NewV4().String(), "", "testbucket", collection, 10, previousCursor, options)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 10, "values length was not 10")
+	assert.Equal(t, "r11", values[0].Record, "values[0].Record was not r11")
+	assert.Equal(t, "r02", values[9].Record, "values[9].Record was not r02")
+	assert.NotEqual(t, "", cursor, "cursor was empty")
+	assert.Equal(t, "", previousCursor, "previous cursor was not empty")
+
+	// A cursor only continues the list it came from.
+	_, _, _, code, err = server.StorageList(logger, db, "", "", "testbucket", collection, 10, cursor, &server.StorageListOptions{Sort: server.STORAGE_LIST_SORT_CREATED_AT})
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code was not BAD_INPUT")
+
+	values, _, _, code, err = server.StorageList(logger, db, "", "", "testbucket", collection, 10, "", &server.StorageListOptions{Sort: server.STORAGE_LIST_SORT_CREATED_AT})
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 10, "values length was not 10")
+	assert.Equal(t, "r11", values[0].Record, "values[0].Record was not r11")
+}
+
+func TestStorageListSortedTimeRange(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	uid := uuid.NewV4().String()
+
+	buf := new(bytes.Buffer)
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(buf, `{"bucket":"testbucket","collection":"%v","record":"r%02d","user_id":"%v","value":{},"permission_read":1,"permission_write":1,"created_at":%v,"updated_at":%v,"expires_at":0}`+"\n",
+			collection, i, uid, 1000+i*10, 1000+i*10)
+	}
+	if _, err := server.StorageImport(logger, db, nil, buf, server.STORAGE_IMPORT_CONFLICT_SKIP, false); err != nil {
+		t.Fatal(err)
+	}
+
+	options := &server.StorageListOptions{Sort: server.STORAGE_LIST_SORT_UPDATED_AT, StartTime: 1050, EndTime: 1100}
+	values, cursor, previousCursor, code, err := server.StorageList(logger, db, "", "", "testbucket", collection, 10, "", options)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, values, 5, "values length was not 5")
+	assert.Equal(t, "r05", values[0].Record, "values[0].Record was not r05")
+	assert.Equal(t, "r09", values[4].Record, "values[4].Record was not r09")
+	assert.Equal(t, "", cursor, "cursor was not empty")
+	assert.Equal(t, "", previousCursor, "previous cursor was not empty")
+
+	// Records only the owner can read are not listed for other users.
+	values, _, _, code, err = server.StorageList(logger, db, uuid.NewV4().String(), "", "testbucket", collection, 10, "", options)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 0, "values length was not 0")
+
+	values, _, _, code, err = server.StorageList(logger, db, uid, uid, "testbucket", collection, 10, "", options)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, values, 5, "values length was not 5")
+}
+
+func TestStorageListSortedInvalid(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	invalid := []*server.StorageListOptions{
+		&server.StorageListOptions{Sort: "value"},
+		&server.StorageListOptions{SortDescending: true},
+		&server.StorageListOptions{StartTime: 1000},
+		&server.StorageListOptions{Sort: server.STORAGE_LIST_SORT_CREATED_AT, StartTime: 2000, EndTime: 1000},
+	}
+	for _, options := range invalid {
+		_, _, _, code, err := server.StorageList(logger, db, "", "", "testbucket", "testcollection", 10, "", options)
+		assert.NotNil(t, err, "err was nil")
+		assert.Equal(t, server.BAD_INPUT, code, "code was not BAD_INPUT")
+	}
+}
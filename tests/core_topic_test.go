@@ -0,0 +1,586 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"database/sql"
+	"nakama/server"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// topicSignalRouter records the signals routed through it, and who they were routed to.
+type topicSignalRouter struct {
+	sync.Mutex
+	presences [][]server.Presence
+	signals   []*server.TopicSignal
+}
+
+func (r *topicSignalRouter) Send(logger *zap.Logger, ps []server.Presence, msg proto.Message, reliable bool) {
+	r.Lock()
+	r.presences = append(r.presences, ps)
+	r.signals = append(r.signals, msg.(*server.Envelope).GetTopicSignal())
+	r.Unlock()
+}
+
+func createMessage(db *sql.DB, topic string, topicType int64, userID string, createdAt int64) (string, error) {
+	messageID := uuid.NewV4().String()
+	_, err := db.Exec(`
+INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
+VALUES ($1, $2, $3, $4, $5, 0, 'handle', 0, '{}')`, topic, topicType, messageID, userID, createdAt)
+	return messageID, err
+}
+
+func TestTopicMessageUpdateRemoveAuthor(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	authorID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUserID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := generateString()
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+	messageID, err := createMessage(db, room, 1, authorID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other users cannot update or remove the message.
+	if _, code, err := server.TopicMessageUpdate(logger, db, otherUserID, topic, messageID, []byte(`{"text":"other"}`)); err == nil {
+		t.Fatal("Expected update by another user to fail")
+	} else if code != server.BAD_INPUT {
+		t.Fatalf("Expected BAD_INPUT but was %v", code)
+	}
+	if _, code, err := server.TopicMessageRemove(logger, db, otherUserID, topic, messageID); err == nil {
+		t.Fatal("Expected remove by another user to fail")
+	} else if code != server.BAD_INPUT {
+		t.Fatalf("Expected BAD_INPUT but was %v", code)
+	}
+
+	message, _, err := server.TopicMessageUpdate(logger, db, authorID, topic, messageID, []byte(`{"text":"edited"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.UserId != authorID || message.CreatedAt != 1 || message.UpdatedAt == 0 {
+		t.Fatalf("Unexpected updated message %v", message)
+	}
+
+	var data []byte
+	var updatedAt int64
+	if err = db.QueryRow("SELECT data, updated_at FROM message WHERE topic = $1 AND topic_type = 1 AND message_id = $2", room, messageID).Scan(&data, &updatedAt); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"text":"edited"}` {
+		t.Fatalf("Expected updated data but was %v", string(data))
+	}
+	if updatedAt != message.UpdatedAt {
+		t.Fatalf("Expected updated_at %v but was %v", message.UpdatedAt, updatedAt)
+	}
+
+	message, _, err = server.TopicMessageRemove(logger, db, authorID, topic, messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !message.Removed {
+		t.Fatal("Expected message to be marked removed")
+	}
+
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM message WHERE topic = $1 AND topic_type = 1 AND message_id = $2", room, messageID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("Expected message to be deleted")
+	}
+}
+
+func TestTopicMessageUpdateRemoveGroupAdmin(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	adminID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memberID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMemberID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:    generateString(),
+		Creator: adminID,
+		Lang:    "en",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID := groups[0].Id
+	for _, userID := range []string{memberID, otherMemberID} {
+		_, err = db.Exec(`
+INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
+VALUES ($1, 1, 1, $2, 1), ($2, 1, 1, $1, 1)`, groupID, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	topic := &server.TopicId{Id: &server.TopicId_GroupId{GroupId: groupID}}
+	messageID, err := createMessage(db, groupID, 2, memberID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Members cannot change each other's messages, but admins can.
+	if _, _, err = server.TopicMessageUpdate(logger, db, otherMemberID, topic, messageID, []byte(`{"text":"other"}`)); err == nil {
+		t.Fatal("Expected update by another member to fail")
+	}
+	if _, _, err = server.TopicMessageUpdate(logger, db, adminID, topic, messageID, []byte(`{"text":"moderated"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.TopicMessageRemove(logger, db, otherMemberID, topic, messageID); err == nil {
+		t.Fatal("Expected remove by another member to fail")
+	}
+	if _, _, err = server.TopicMessageRemove(logger, db, adminID, topic, messageID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopicMessageUpdateRemoveNotChat(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := generateString()
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+
+	// Group join notices and other system messages are not chat messages, even if the user is their author.
+	messageID := uuid.NewV4().String()
+	_, err = db.Exec(`
+INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
+VALUES ($1, 1, $2, $3, 1, 0, 'handle', 1, '{}')`, room, messageID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = server.TopicMessageUpdate(logger, db, userID, topic, messageID, []byte(`{"text":"edited"}`)); err == nil {
+		t.Fatal("Expected update of a non-chat message to fail")
+	}
+	if _, _, err = server.TopicMessageRemove(logger, db, userID, topic, messageID); err == nil {
+		t.Fatal("Expected remove of a non-chat message to fail")
+	}
+}
+
+func TestTopicMessagesReadUnreadCount(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUserID := uuid.NewV4().String()
+	room := generateString()
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+
+	// Three messages from another user, then one from the user themselves.
+	messageIDs := make([]string, 0)
+	for i := int64(1); i <= 3; i++ {
+		messageID, err := createMessage(db, room, 1, otherUserID, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	if _, err = createMessage(db, room, 1, userID, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	readAt, _, err := server.TopicMessagesRead(logger, db, userID, topic, messageIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readAt != 1 {
+		t.Fatalf("Expected read at 1 but was %v", readAt)
+	}
+
+	topics, _, err := server.TopicsUnreadList(logger, db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 1 {
+		t.Fatalf("Expected 1 topic but was %v", len(topics))
+	}
+	if topics[0].Topic.GetRoom() != room || topics[0].Count != 2 || topics[0].MessageId != messageIDs[0] {
+		t.Fatalf("Unexpected unread topic %v", topics[0])
+	}
+
+	// Marking an older message read does not move the cursor back.
+	if _, _, err = server.TopicMessagesRead(logger, db, userID, topic, messageIDs[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.TopicMessagesRead(logger, db, userID, topic, messageIDs[1]); err != nil {
+		t.Fatal(err)
+	}
+	topics, _, err = server.TopicsUnreadList(logger, db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics[0].Count != 0 || topics[0].MessageId != messageIDs[2] {
+		t.Fatalf("Unexpected unread topic %v", topics[0])
+	}
+}
+
+func TestTopicMessagesReadNotFound(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: generateString()}}
+	_, code, err := server.TopicMessagesRead(logger, db, uuid.NewV4().String(), topic, uuid.NewV4().String())
+	if err == nil {
+		t.Fatal("Expected error but was nil")
+	}
+	if code != server.BAD_INPUT {
+		t.Fatalf("Expected BAD_INPUT but was %v", code)
+	}
+}
+
+func TestTopicMessagesReadDmParticipant(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := uuid.NewV4().String()
+	otherUserID := uuid.NewV4().String()
+	dm := userID + otherUserID
+	topic := &server.TopicId{Id: &server.TopicId_Dm{Dm: dm}}
+	messageID, err := createMessage(db, dm, 0, otherUserID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = server.TopicMessagesRead(logger, db, userID, topic, messageID); err != nil {
+		t.Fatal(err)
+	}
+
+	// An ID made of the end of one participant's ID and the start of the other's is not a participant.
+	_, code, err := server.TopicMessagesRead(logger, db, dm[4:4+len(userID)], topic, messageID)
+	if err == nil {
+		t.Fatal("Expected error but was nil")
+	}
+	if code != server.BAD_INPUT {
+		t.Fatalf("Expected BAD_INPUT but was %v", code)
+	}
+}
+
+func TestTopicBanKicksAndUnban(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := uuid.NewV4().String()
+	sessionID := uuid.NewV4().String()
+	room := generateString()
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+
+	tracker := server.NewTrackerService("test-tracker")
+	tracker.Track(sessionID, "room:"+room, userID, server.PresenceMeta{})
+
+	if _, err = server.TopicBan(logger, db, tracker, &fakeMessageRouter{}, topic, userID); err != nil {
+		t.Fatal(err)
+	}
+	if tracker.CheckLocalByIDTopicUser(sessionID, "room:"+room, userID) {
+		t.Fatal("Expected banned user to be removed from topic")
+	}
+
+	var bannedAt int64
+	if err = db.QueryRow("SELECT banned_at FROM topic_moderation WHERE topic = $1 AND topic_type = 1 AND user_id = $2", room, userID).Scan(&bannedAt); err != nil {
+		t.Fatal(err)
+	}
+	if bannedAt == 0 {
+		t.Fatal("Expected user to be banned")
+	}
+
+	if _, err = server.TopicUnban(logger, db, topic, userID); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("SELECT banned_at FROM topic_moderation WHERE topic = $1 AND topic_type = 1 AND user_id = $2", room, userID).Scan(&bannedAt); err != nil {
+		t.Fatal(err)
+	}
+	if bannedAt != 0 {
+		t.Fatal("Expected user to be unbanned")
+	}
+}
+
+func TestTopicMessagesSearch(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := uuid.NewV4().String()
+	otherUserID := uuid.NewV4().String()
+	room := generateString()
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+
+	for i, m := range []struct {
+		userID string
+		data   string
+	}{
+		{userID, `{"msg":"Hello there"}`},
+		{otherUserID, `{"msg":"hello back"}`},
+		{userID, `{"msg":"goodbye"}`},
+		{userID, `{"msg":"100% HELLO"}`},
+	} {
+		_, err = db.Exec(`
+INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
+VALUES ($1, 1, $2, $3, $4, 0, 'handle', 0, $5)`, room, uuid.NewV4().String(), m.userID, int64(i+1), []byte(m.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, _, _, err := server.TopicMessagesSearch(logger, db, userID, topic, "hello", "", 0, 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages but was %v", len(messages))
+	}
+	if messages[0].CreatedAt != 4 {
+		t.Fatalf("Expected newest message first but was %v", messages[0].CreatedAt)
+	}
+
+	messages, _, _, err = server.TopicMessagesSearch(logger, db, userID, topic, "hello", userID, 2, 3, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("Expected 0 messages but was %v", len(messages))
+	}
+
+	// Wildcards in the search text match literally.
+	messages, _, _, err = server.TopicMessagesSearch(logger, db, userID, topic, "0%", "", 0, 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].CreatedAt != 4 {
+		t.Fatalf("Unexpected messages %v", messages)
+	}
+}
+
+func TestTopicMessagesSearchDmNotParticipant(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := &server.TopicId{Id: &server.TopicId_Dm{Dm: uuid.NewV4().String() + uuid.NewV4().String()}}
+	_, _, code, err := server.TopicMessagesSearch(logger, db, uuid.NewV4().String(), topic, "", "", 0, 0, 0, "")
+	if err == nil {
+		t.Fatal("Expected error but was nil")
+	}
+	if code != server.BAD_INPUT {
+		t.Fatalf("Expected BAD_INPUT but was %v", code)
+	}
+}
+
+func TestTopicMessagesSearchDmSpanningID(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	userID := uuid.NewV4().String()
+	dm := userID + uuid.NewV4().String()
+	topic := &server.TopicId{Id: &server.TopicId_Dm{Dm: dm}}
+
+	if _, _, _, err = server.TopicMessagesSearch(logger, db, userID, topic, "", "", 0, 0, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// An ID made of the end of one participant's ID and the start of the other's is not a participant.
+	_, _, code, err := server.TopicMessagesSearch(logger, db, dm[4:4+len(userID)], topic, "", "", 0, 0, 0, "")
+	if err == nil {
+		t.Fatal("Expected error but was nil")
+	}
+	if code != server.BAD_INPUT {
+		t.Fatalf("Expected BAD_INPUT but was %v", code)
+	}
+}
+
+func TestTopicSignalSend(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tracker := server.NewTrackerService("test-tracker")
+	router := &topicSignalRouter{}
+	senderID := uuid.NewV4().String()
+	senderSessionID := uuid.NewV4().String()
+	otherID := uuid.NewV4().String()
+	otherSessionID := uuid.NewV4().String()
+	room := generateString()
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+
+	// Senders must join the topic first.
+	if _, err = server.TopicSignalSend(logger, db, tracker, router, senderSessionID, senderID, "sender", topic, `{"typing":true}`, false); err == nil {
+		t.Fatal("Expected signal before joining to fail")
+	}
+
+	tracker.Track(senderSessionID, "room:"+room, senderID, server.PresenceMeta{Handle: "sender"})
+	tracker.Track(otherSessionID, "room:"+room, otherID, server.PresenceMeta{Handle: "other"})
+
+	for _, data := range []string{"", `"typing"`, `[true]`, "not json", `{"typing":"` + strings.Repeat("a", 250) + `"}`} {
+		if code, err := server.TopicSignalSend(logger, db, tracker, router, senderSessionID, senderID, "sender", topic, data, false); err == nil {
+			t.Fatalf("Expected signal data %v to be rejected", data)
+		} else if code != server.BAD_INPUT {
+			t.Fatalf("Expected BAD_INPUT but was %v", code)
+		}
+	}
+	if len(router.signals) != 0 {
+		t.Fatal("Expected rejected signals not to be routed")
+	}
+
+	data := `{"typing":"` + strings.Repeat("a", 243) + `"}`
+	if len(data) != 256 {
+		t.Fatalf("Expected 256 byte signal but was %v", len(data))
+	}
+	if _, err = server.TopicSignalSend(logger, db, tracker, router, senderSessionID, senderID, "sender", topic, data, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The signal goes to the other user only, without being echoed to the sender.
+	if len(router.signals) != 1 {
+		t.Fatalf("Expected 1 routed signal but was %v", len(router.signals))
+	}
+	if len(router.presences[0]) != 1 || router.presences[0][0].ID.SessionID != otherSessionID {
+		t.Fatalf("Expected signal routed to other session only but was %v", router.presences[0])
+	}
+	if signal := router.signals[0]; signal.UserId != senderID || signal.Handle != "sender" || signal.Data != data {
+		t.Fatalf("Unexpected signal %v", signal)
+	}
+
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM message WHERE topic = $1 AND topic_type = 1", room).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("Expected signals not to be stored")
+	}
+}
+
+func TestTopicSignalSendMuted(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tracker := server.NewTrackerService("test-tracker")
+	router := &topicSignalRouter{}
+	userID := uuid.NewV4().String()
+	sessionID := uuid.NewV4().String()
+	room := generateString()
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+	tracker.Track(sessionID, "room:"+room, userID, server.PresenceMeta{})
+	tracker.Track(uuid.NewV4().String(), "room:"+room, uuid.NewV4().String(), server.PresenceMeta{})
+
+	if _, err = server.TopicMute(logger, db, topic, userID, time.Now().UTC().Add(time.Minute).UnixNano()/int64(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, err := server.TopicSignalSend(logger, db, tracker, router, sessionID, userID, "handle", topic, `{"typing":true}`, false); err == nil {
+		t.Fatal("Expected signal from muted user to fail")
+	} else if code != server.TOPIC_RESTRICTED {
+		t.Fatalf("Expected TOPIC_RESTRICTED but was %v", code)
+	}
+	if len(router.signals) != 0 {
+		t.Fatal("Expected signal from muted user not to be routed")
+	}
+}
+
+func TestTopicSignalSendBanned(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tracker := server.NewTrackerService("test-tracker")
+	router := &topicSignalRouter{}
+	userID := uuid.NewV4().String()
+	sessionID := uuid.NewV4().String()
+	room := generateString()
+	topic := &server.TopicId{Id: &server.TopicId_Room{Room: room}}
+	tracker.Track(uuid.NewV4().String(), "room:"+room, uuid.NewV4().String(), server.PresenceMeta{})
+
+	if _, err = server.TopicBan(logger, db, tracker, &fakeMessageRouter{}, topic, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A presence tracked after the ban, such as one that raced the kick, is still refused.
+	tracker.Track(sessionID, "room:"+room, userID, server.PresenceMeta{})
+	if code, err := server.TopicSignalSend(logger, db, tracker, router, sessionID, userID, "handle", topic, `{"typing":true}`, false); err == nil {
+		t.Fatal("Expected signal from banned user to fail")
+	} else if code != server.TOPIC_RESTRICTED || err.Error() != "Banned from topic" {
+		t.Fatalf("Expected TOPIC_RESTRICTED 'Banned from topic' but was %v '%v'", code, err)
+	}
+	if len(router.signals) != 0 {
+		t.Fatal("Expected signal from banned user not to be routed")
+	}
+}
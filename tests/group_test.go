@@ -148,3 +148,155 @@ func TestGroupCreateMultiple(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestGroupUserAddPromoteKickRuntime(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	creatorID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:    generateString(),
+		Creator: creatorID,
+		Private: true,
+		Lang:    "en",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID := groups[0].Id
+
+	tracker := server.NewTrackerService("test-tracker")
+	msgRouter := &fakeMessageRouter{}
+	ns := server.NewNotificationService(logger, db, tracker, msgRouter, server.NewSocialConfig().Notification)
+
+	// Runtime callers bypass the group admin check.
+	if _, err = server.GroupUserAdd(logger, db, tracker, msgRouter, nil, ns, "", "", groupID, userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.GroupUserPromote(logger, db, tracker, msgRouter, nil, "", "", groupID, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	users, _, err := server.GroupUsersList(logger, db, tracker, "", groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 group users but was %v", len(users))
+	}
+	for _, u := range users {
+		if u.State != 0 {
+			t.Fatal("Expected all group users to be admins")
+		}
+	}
+
+	if _, err = server.GroupUserKick(logger, db, tracker, msgRouter, nil, "", "", groupID, userID); err != nil {
+		t.Fatal(err)
+	}
+	users, _, err = server.GroupUsersList(logger, db, tracker, "", groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("Expected 1 group user but was %v", len(users))
+	}
+}
+
+func TestGroupUserAddNotAdmin(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	creatorID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:    generateString(),
+		Creator: creatorID,
+		Lang:    "en",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := server.NewTrackerService("test-tracker")
+	msgRouter := &fakeMessageRouter{}
+	ns := server.NewNotificationService(logger, db, tracker, msgRouter, server.NewSocialConfig().Notification)
+
+	_, err = server.GroupUserAdd(logger, db, tracker, msgRouter, nil, ns, userID, "handle", groups[0].Id, userID)
+	if err == nil {
+		t.Fatal("Expected error but was nil")
+	}
+}
+
+func TestGroupJoinLeaveRemove(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	creatorID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := createUser(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:    generateString(),
+		Creator: creatorID,
+		Lang:    "en",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID := groups[0].Id
+
+	tracker := server.NewTrackerService("test-tracker")
+	msgRouter := &fakeMessageRouter{}
+	ns := server.NewNotificationService(logger, db, tracker, msgRouter, server.NewSocialConfig().Notification)
+
+	if _, err = server.GroupJoin(logger, db, tracker, msgRouter, nil, ns, userID, "handle", groupID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.GroupLeave(logger, db, tracker, msgRouter, nil, userID, "handle", groupID); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := server.GroupLeave(logger, db, tracker, msgRouter, nil, creatorID, "handle", groupID)
+	if err == nil {
+		t.Fatal("Expected error but was nil")
+	}
+	if code != server.GROUP_LAST_ADMIN {
+		t.Fatalf("Expected GROUP_LAST_ADMIN but was %v", code)
+	}
+
+	if _, err = server.GroupRemove(logger, db, userID, groupID); err == nil {
+		t.Fatal("Expected error but was nil")
+	}
+	if _, err = server.GroupRemove(logger, db, creatorID, groupID); err != nil {
+		t.Fatal(err)
+	}
+}
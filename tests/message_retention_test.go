@@ -0,0 +1,80 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"nakama/server"
+	"testing"
+
+	"github.com/satori/go.uuid"
+)
+
+func TestMessageRetentionExpiresAt(t *testing.T) {
+	config := &server.TopicConfig{
+		DmExpiryMs:            1000,
+		RoomExpiryMs:          2000,
+		RoomExpiryOverridesMs: map[string]int64{"lobby": 500, "archive": 0},
+	}
+	m := server.NewMessageRetentionService(logger, nil, config)
+	defer m.Stop()
+
+	cases := []struct {
+		topic    *server.TopicId
+		expected int64
+	}{
+		{&server.TopicId{Id: &server.TopicId_Dm{Dm: "dm"}}, 11000},
+		{&server.TopicId{Id: &server.TopicId_Room{Room: "room"}}, 12000},
+		{&server.TopicId{Id: &server.TopicId_Room{Room: "lobby"}}, 10500},
+		{&server.TopicId{Id: &server.TopicId_Room{Room: "archive"}}, 0},
+		{&server.TopicId{Id: &server.TopicId_GroupId{GroupId: "group"}}, 0},
+	}
+	for _, c := range cases {
+		if expiresAt := m.ExpiresAt(c.topic, 10000); expiresAt != c.expected {
+			t.Fatalf("Expected %v to expire at %v but was %v", c.topic, c.expected, expiresAt)
+		}
+	}
+}
+
+func TestMessageRetentionSweep(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	room := generateString()
+	userID := uuid.NewV4().String()
+	expiries := []int64{0, 1, 2, 3, 9999999999999}
+	for i, expiresAt := range expiries {
+		_, err = db.Exec(`
+INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
+VALUES ($1, 1, $2, $3, $4, $5, 'handle', 0, '{}')`, room, uuid.NewV4().String(), userID, i+1, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := server.NewMessageRetentionService(logger, db, &server.TopicConfig{SweepBatchSize: 2})
+	defer m.Stop()
+	m.Sweep()
+
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM message WHERE topic = $1 AND topic_type = 1", room).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 messages to remain but was %v", count)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"nakama/server"
+	"testing"
+)
+
+func newModerationService(t *testing.T) *server.ModerationService {
+	config := server.NewSocialConfig().Moderation
+	config.Words = []string{"darn", "heck"}
+	config.Patterns = []string{`\d{3}-\d{4}`}
+	config.LangWords = map[string][]string{"fr": {"zut"}}
+
+	m, err := server.NewModerationService(logger, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestModerationFilterWords(t *testing.T) {
+	m := newModerationService(t)
+
+	text, matched := m.Filter("en", "Darn it, what the heck")
+	if !matched {
+		t.Fatal("Expected match")
+	}
+	if text != "**** it, what the ****" {
+		t.Fatalf("Unexpected masked text %q", text)
+	}
+
+	// Words only match whole words.
+	if _, matched = m.Filter("en", "darning socks"); matched {
+		t.Fatal("Expected no match")
+	}
+}
+
+func TestModerationFilterPatterns(t *testing.T) {
+	m := newModerationService(t)
+
+	text, matched := m.Filter("en", "call 555-1234")
+	if !matched {
+		t.Fatal("Expected match")
+	}
+	if text != "call ********" {
+		t.Fatalf("Unexpected masked text %q", text)
+	}
+}
+
+func TestModerationFilterLang(t *testing.T) {
+	m := newModerationService(t)
+
+	if _, matched := m.Filter("en", "zut alors"); matched {
+		t.Fatal("Expected no match for en")
+	}
+	if _, matched := m.Filter("fr", "zut alors"); !matched {
+		t.Fatal("Expected match for fr")
+	}
+	if _, matched := m.Filter("fr-CA", "zut alors"); !matched {
+		t.Fatal("Expected match for fr-CA")
+	}
+}
+
+func TestModerationInvalidConfig(t *testing.T) {
+	config := server.NewSocialConfig().Moderation
+	config.Mode = "ignore"
+	if _, err := server.NewModerationService(logger, config, nil); err == nil {
+		t.Fatal("Expected error for invalid mode")
+	}
+
+	config = server.NewSocialConfig().Moderation
+	config.Patterns = []string{"("}
+	if _, err := server.NewModerationService(logger, config, nil); err == nil {
+		t.Fatal("Expected error for invalid pattern")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"nakama/server"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	config := server.NewSocketConfig()
+	config.RateLimitChat = &server.RateLimitConfig{Rate: 0.001, Burst: 2}
+	r := server.NewRateLimiter(config)
+
+	for i := 0; i < 2; i++ {
+		if !r.Allow("*server.Envelope_TopicMessageSend") {
+			t.Fatalf("Expected message %v to be allowed", i)
+		}
+	}
+	if r.Allow("*server.Envelope_TopicMessageSend") {
+		t.Fatal("Expected message to be rate limited")
+	}
+	if r.Violations() != 1 {
+		t.Fatalf("Expected 1 violation but was %v", r.Violations())
+	}
+
+	// Each message type has its own bucket.
+	if !r.Allow("*server.Envelope_TopicMessageUpdate") {
+		t.Fatal("Expected other message type to be allowed")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	config := server.NewSocketConfig()
+	r := server.NewRateLimiter(config)
+
+	// No default limit applies to other message types.
+	for i := 0; i < 1000; i++ {
+		if !r.Allow("*server.Envelope_MatchDataSend") {
+			t.Fatal("Expected message to be allowed")
+		}
+	}
+}
+
+func TestRateLimiterChatTypes(t *testing.T) {
+	config := server.NewSocketConfig()
+	config.RateLimitChat = &server.RateLimitConfig{Rate: 0.001, Burst: 1}
+	r := server.NewRateLimiter(config)
+
+	// Joining, leaving and listing topics are not chat messages.
+	for i := 0; i < 10; i++ {
+		if !r.Allow("*server.Envelope_TopicsJoin") {
+			t.Fatal("Expected topic join to be allowed")
+		}
+		if !r.Allow("*server.Envelope_TopicMessagesList") {
+			t.Fatal("Expected message list to be allowed")
+		}
+	}
+
+	r.Allow("*server.Envelope_TopicSignalSend")
+	if r.Allow("*server.Envelope_TopicSignalSend") {
+		t.Fatal("Expected signal to be rate limited")
+	}
+}
+
+func TestRateLimiterViolationWindow(t *testing.T) {
+	config := server.NewSocketConfig()
+	config.RateLimitChat = &server.RateLimitConfig{Rate: 0.001, Burst: 1}
+	config.RateLimitViolationWindowMs = 50
+	r := server.NewRateLimiter(config)
+
+	for i := 0; i < 3; i++ {
+		r.Allow("*server.Envelope_TopicMessageSend")
+	}
+	if r.Violations() != 2 {
+		t.Fatalf("Expected 2 violations but was %v", r.Violations())
+	}
+
+	// Violations older than the window no longer count.
+	time.Sleep(100 * time.Millisecond)
+	if r.Violations() != 0 {
+		t.Fatalf("Expected 0 violations but was %v", r.Violations())
+	}
+	r.Allow("*server.Envelope_TopicMessageSend")
+	if r.Violations() != 1 {
+		t.Fatalf("Expected 1 violation but was %v", r.Violations())
+	}
+}
@@ -38,7 +38,7 @@ func newRuntimePool() (*server.RuntimePool, error) {
 	}
 	c := server.NewRuntimeConfig()
 	c.Path = filepath.Join(DATA_PATH, "modules")
-	return server.NewRuntimePool(logger, logger, db, c, nil, nil)
+	return server.NewRuntimePool(logger, logger, db, c, nil, nil, nil, nil, nil)
 }
 
 func writeStatsModule() {
@@ -592,3 +592,27 @@ end
 		t.Error(err)
 	}
 }
+
+func TestRuntimeFriends(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("friends.lua", `
+local nk = require("nakama")
+
+local user_id = nk.uuid_v4()
+local friends, cursor = nk.friends_list(user_id, 0, 10)
+assert(#friends == 0, "'friends' must be empty")
+assert(cursor == nil, "'cursor' must be nil")
+
+local status, res = pcall(nk.friends_add, user_id, user_id)
+assert(status == false, "adding self as friend must fail")
+
+status, res = pcall(nk.friends_remove, user_id, nk.uuid_v4())
+assert(status == true, "removing an unknown friend must succeed")
+`)
+
+	setupDB()
+	_, err := newRuntimePool()
+	if err != nil {
+		t.Error(err)
+	}
+}
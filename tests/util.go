@@ -21,6 +21,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
@@ -45,3 +46,16 @@ func setupDB() (*sql.DB, error) {
 func generateString() string {
 	return strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
 }
+
+func createUser(db *sql.DB) (string, error) {
+	userID := uuid.NewV4().String()
+	ts := time.Now().UTC().UnixNano() / int64(time.Millisecond)
+	_, err := db.Exec(`
+INSERT INTO users (id, handle, created_at, updated_at)
+VALUES ($1, $2, $3, $3)`, userID, generateString(), ts)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec("INSERT INTO user_edge_metadata (source_id, count, state, updated_at) VALUES ($1, 0, 0, $2)", userID, ts)
+	return userID, err
+}